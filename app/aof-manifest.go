@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	aofTypeBase    = 'b'
+	aofTypeHistory = 'h' // replaced by a rewrite, deleted once the new manifest is persisted
+	aofTypeIncr    = 'i'
+
+	aofBaseRDBSuffix = ".base.rdb"
+	aofBaseSuffix    = ".base.aof"
+	aofIncrSuffix    = ".incr.aof"
+)
+
+type aofFileInfo struct {
+	name string
+	seq  int
+	kind byte
+}
+
+// aofManifest lists files of the AOF directory, one per line in the format of
+// Redis 7: "file <name> seq <seq> type <b|h|i>"
+type aofManifest struct {
+	base    *aofFileInfo
+	incrs   []aofFileInfo // in load order
+	history []aofFileInfo
+	baseSeq int // last sequence numbers used
+	incrSeq int
+}
+
+func (m *aofManifest) clone() *aofManifest {
+	c := *m
+	if m.base != nil {
+		base := *m.base
+		c.base = &base
+	}
+	c.incrs = append([]aofFileInfo(nil), m.incrs...)
+	c.history = append([]aofFileInfo(nil), m.history...)
+	return &c
+}
+
+func (m *aofManifest) encode() []byte {
+	var b bytes.Buffer
+	write := func(f aofFileInfo) {
+		fmt.Fprintf(&b, "file %s seq %d type %c\n", f.name, f.seq, f.kind)
+	}
+	if m.base != nil {
+		write(*m.base)
+	}
+	for _, f := range m.history {
+		write(f)
+	}
+	for _, f := range m.incrs {
+		write(f)
+	}
+	return b.Bytes()
+}
+
+func parseAOFManifest(data []byte) (*aofManifest, error) {
+	m := &aofManifest{}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields)%2 != 0 {
+			return nil, fmt.Errorf("invalid AOF manifest line %d: %q", i+1, line)
+		}
+		var f aofFileInfo
+		for j := 0; j < len(fields); j += 2 {
+			switch fields[j] {
+			case "file":
+				f.name = fields[j+1]
+			case "seq":
+				seq, err := strconv.Atoi(fields[j+1])
+				if err != nil || seq < 0 {
+					return nil, fmt.Errorf("invalid AOF manifest line %d: %q", i+1, line)
+				}
+				f.seq = seq
+			case "type":
+				if len(fields[j+1]) != 1 {
+					return nil, fmt.Errorf("invalid AOF manifest line %d: %q", i+1, line)
+				}
+				f.kind = fields[j+1][0]
+			}
+		}
+		if f.name == "" || strings.ContainsAny(f.name, "/\\") {
+			return nil, fmt.Errorf("invalid AOF manifest line %d: %q", i+1, line)
+		}
+		switch f.kind {
+		case aofTypeBase:
+			if m.base != nil {
+				return nil, fmt.Errorf("AOF manifest lists more than one base file")
+			}
+			m.base = &f
+			m.baseSeq = f.seq
+		case aofTypeHistory:
+			m.history = append(m.history, f)
+		case aofTypeIncr:
+			if len(m.incrs) > 0 && f.seq <= m.incrSeq {
+				return nil, fmt.Errorf("AOF manifest lists incremental files out of order")
+			}
+			m.incrs = append(m.incrs, f)
+			m.incrSeq = f.seq
+		default:
+			return nil, fmt.Errorf("invalid AOF manifest line %d: %q", i+1, line)
+		}
+	}
+	return m, nil
+}
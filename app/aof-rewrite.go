@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// aofRewriteItemsPerCmd limits elements of a collection written by a single
+// command of the rewritten AOF
+const aofRewriteItemsPerCmd = 64
+
+var errAOFRewriteInProgress = errors.New("ERR Background append only file rewriting already in progress")
+
+// keyCommands returns commands that recreate key with value v, followed by
+// PEXPIREAT when it has a TTL. Consumer groups of streams are not recreated.
+func keyCommands(key string, v StoredValue) []Value {
+	var cmds []Value
+	// emit appends commands of name with items split into chunks of up to
+	// aofRewriteItemsPerCmd elements of width items each
+	emit := func(name string, items []string, width int) {
+		step := aofRewriteItemsPerCmd * width
+		for i := 0; i < len(items); i += step {
+			args := append([]string{name, key}, items[i:min(i+step, len(items))]...)
+			cmds = append(cmds, bulkArray(args))
+		}
+	}
+
+	switch v.vType {
+	case "string":
+		cmds = append(cmds, bulkArray([]string{"SET", key, v.val}))
+	case "list":
+		emit("RPUSH", v.list.items, 1)
+	case "set":
+		var members []string
+		v.set.Range(func(member string, _ struct{}) bool {
+			members = append(members, member)
+			return true
+		})
+		emit("SADD", members, 1)
+	case "hash":
+		var pairs []string
+		v.hash.Range(func(field, value string) bool {
+			pairs = append(pairs, field, value)
+			return true
+		})
+		emit("HSET", pairs, 2)
+	case "zset":
+		var pairs []string
+		for _, e := range v.zset.sorted {
+			pairs = append(pairs, formatScore(e.score), e.member)
+		}
+		emit("ZADD", pairs, 2)
+	case "stream":
+		for _, e := range v.stream.entries {
+			args := append([]string{"XADD", key, e.id.String()}, e.fields...)
+			cmds = append(cmds, bulkArray(args))
+		}
+	}
+	if !v.expires.IsZero() && len(cmds) > 0 {
+		cmds = append(cmds, bulkArray([]string{"PEXPIREAT", key, strconv.FormatInt(v.expires.UnixMilli(), 10)}))
+	}
+	return cmds
+}
+
+func bulkArray(args []string) Value {
+	v := Value{vType: "array", array: make([]Value, len(args))}
+	for i, arg := range args {
+		v.array[i] = Value{vType: "bulk", bulk: arg}
+	}
+	return v
+}
+
+// writeAOFCommands writes commands recreating keys of all databases in RESP
+func writeAOFCommands(w io.Writer, dbs []*dict[StoredValue]) error {
+	bw := bufio.NewWriter(w)
+	var err error
+	for db, keys := range dbs {
+		selected := false
+		keys.Range(func(key string, v StoredValue) bool {
+			if v.isExpired() {
+				return true
+			}
+			if !selected {
+				sel := bulkArray([]string{"SELECT", strconv.Itoa(db)})
+				_, err = bw.Write(sel.Unmarshal())
+				selected = true
+			}
+			for _, cmd := range keyCommands(key, v) {
+				if err == nil {
+					_, err = bw.Write(cmd.Unmarshal())
+				}
+			}
+			return err == nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// startAOFRewrite switches writes to a new incremental file and writes the
+// dataset as of the switch to a new base file in background. Files listed
+// before the switch are replaced by the base file once it is complete.
+func (ch *CommandHandler) startAOFRewrite() error {
+	a := ch.aof
+	// no write may be applied between the switch and the snapshot
+	ch.writeMu.Lock()
+	a.mu.Lock()
+	if a.rewriting {
+		a.mu.Unlock()
+		ch.writeMu.Unlock()
+		return errAOFRewriteInProgress
+	}
+	a.lastRewriteTry = time.Now()
+	if err := a.addIncrFile(); err != nil {
+		a.lastRewriteErr = err
+		a.mu.Unlock()
+		ch.writeMu.Unlock()
+		return err
+	}
+	a.rewriting = true
+	a.rewriteIncrSeq = a.manifest.incrSeq - 1
+	a.mu.Unlock()
+	dbs, _ := ch.takeSnapshot()
+	ch.writeMu.Unlock()
+
+	go func() {
+		tmpPath := a.path(fmt.Sprintf("temp-rewriteaof-bg-%d.aof", os.Getpid()))
+		err := writeAOFBase(tmpPath, dbs, ch.aofConf.useRDBPreamble)
+		ch.releaseSnapshot()
+		if err == nil {
+			err = a.finishRewrite(tmpPath, ch.aofConf.useRDBPreamble)
+		}
+		a.mu.Lock()
+		a.rewriting = false
+		a.lastRewriteErr = err
+		a.mu.Unlock()
+		if err != nil {
+			os.Remove(tmpPath)
+			fmt.Println("aof-rewrite.go/startAOFRewrite(): error rewriting the append only file", err)
+			return
+		}
+		fmt.Println("Background AOF rewrite finished successfully")
+	}()
+	return nil
+}
+
+// writeAOFBase writes dbs to path in RDB format or as commands
+func writeAOFBase(path string, dbs []*dict[StoredValue], rdbPreamble bool) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if rdbPreamble {
+		err = writeRDBFile(f, dbs, true)
+	} else {
+		err = writeAOFCommands(f, dbs)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// finishRewrite installs the base file written to tmpPath. The new manifest
+// moves the old base and the replaced incremental files to history, so a
+// crash leaves either the old or the new set of files listed. History files
+// are deleted afterwards.
+func (a *AOF) finishRewrite(tmpPath string, rdbPreamble bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	m := a.manifest.clone()
+	m.baseSeq++
+	suffix := aofBaseSuffix
+	if rdbPreamble {
+		suffix = aofBaseRDBSuffix
+	}
+	base := aofFileInfo{name: fmt.Sprintf("%s.%d%s", a.filename, m.baseSeq, suffix), seq: m.baseSeq, kind: aofTypeBase}
+	if err := os.Rename(tmpPath, a.path(base.name)); err != nil {
+		return err
+	}
+	if m.base != nil {
+		m.history = append(m.history, aofFileInfo{name: m.base.name, seq: m.base.seq, kind: aofTypeHistory})
+	}
+	m.base = &base
+	var incrs []aofFileInfo
+	for _, incr := range m.incrs {
+		if incr.seq <= a.rewriteIncrSeq {
+			m.history = append(m.history, aofFileInfo{name: incr.name, seq: incr.seq, kind: aofTypeHistory})
+		} else {
+			incrs = append(incrs, incr)
+		}
+	}
+	m.incrs = incrs
+	if err := a.persistManifest(m); err != nil {
+		os.Remove(a.path(base.name))
+		return err
+	}
+	a.manifest = m
+
+	for _, f := range m.history {
+		if err := os.Remove(a.path(f.name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			fmt.Println("aof-rewrite.go/finishRewrite(): error deleting history file", err)
+		}
+	}
+	clean := m.clone()
+	clean.history = nil
+	if err := a.persistManifest(clean); err != nil {
+		fmt.Println("aof-rewrite.go/finishRewrite(): error persisting the manifest", err)
+	} else {
+		a.manifest = clean
+	}
+	a.updateSizes()
+	a.rewriteBaseSize = a.baseSize + a.incrSize
+	if a.baseUnsynced {
+		a.baseUnsynced = false
+		if !a.fsyncPending && a.writeErr == nil {
+			a.fsyncedReploff = a.reploff
+		}
+	}
+	return nil
+}
+
+func (ch *CommandHandler) bgrewriteaof(v Value) []byte {
+	var repl Value
+	if len(v.array) != 1 {
+		return wrongArgsError("bgrewriteaof")
+	}
+	if ch.aof == nil {
+		return repl.Error("ERR Append only file is disabled, enable appendonly to rewrite it")
+	}
+	if err := ch.startAOFRewrite(); err != nil {
+		if errors.Is(err, errAOFRewriteInProgress) {
+			return repl.Error(err.Error())
+		}
+		return repl.Error("ERR " + err.Error())
+	}
+	repl.vType = "str"
+	repl.str = "Background append only file rewriting started"
+	return repl.Unmarshal()
+}
+
+// checkAOFRewrite starts a rewrite once the AOF reaches auto-aof-rewrite-min-size
+// and grew by auto-aof-rewrite-percentage since the last rewrite
+func (ch *CommandHandler) checkAOFRewrite() {
+	a := ch.aof
+	if ch.aofConf.rewritePercentage <= 0 {
+		return
+	}
+	a.mu.Lock()
+	size := a.baseSize + a.incrSize
+	base := max(a.rewriteBaseSize, 1)
+	start := !a.rewriting && size >= ch.aofConf.rewriteMinSize &&
+		(size-base)*100/base >= int64(ch.aofConf.rewritePercentage) &&
+		(a.lastRewriteErr == nil || time.Since(a.lastRewriteTry) > bgsaveRetryDelay)
+	a.mu.Unlock()
+
+	if start {
+		fmt.Printf("Starting automatic rewriting of AOF on %d%% growth\n", (size-base)*100/base)
+		ch.startAOFRewrite()
+	}
+}
+
+// parseMemorySize parses size in bytes with optional k, kb, m, mb, g or gb unit
+func parseMemorySize(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		mul    int64
+	}{{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30}, {"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000}}
+	num := strings.ToLower(s)
+	mul := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(num, u.suffix) {
+			num = strings.TrimSuffix(num, u.suffix)
+			mul = u.mul
+			break
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid memory size %q", s)
+	}
+	return n * mul, nil
+}
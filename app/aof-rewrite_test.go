@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAOFRewriteSwitchOver(t *testing.T) {
+	for _, rdbPreamble := range []bool{false, true} {
+		name := "commands"
+		if rdbPreamble {
+			name = "rdb preamble"
+		}
+		t.Run(name, func(t *testing.T) {
+			rdb := &RDBconfig{dir: t.TempDir()}
+			aof := &AOFconfig{enabled: true, filename: "appendonly.aof", dirname: "appendonlydir", fsync: "always", useRDBPreamble: rdbPreamble}
+			open := func() *CommandHandler {
+				t.Helper()
+				repl := &ReplicationConfig{}
+				repl.replication.role = "master"
+				ch, err := NewCommandHandler(&ServerConfig{databases: 16}, rdb, aof, repl, &ClusterConfig{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(ch.stopCron)
+				return ch
+			}
+			ch := open()
+			c := NewClient(bufio.NewReader(strings.NewReader("")), bufio.NewWriter(io.Discard))
+			run := func(args ...string) {
+				t.Helper()
+				if reply := ch.call(c, bulkArray(args)); reply[0] == '-' {
+					t.Fatalf("%q: %s", args, reply)
+				}
+			}
+
+			run("SET", "before", "1")
+			run("RPUSH", "list", "a", "b")
+			a := ch.aof
+			a.mu.Lock()
+			old := a.manifest.clone()
+			a.mu.Unlock()
+			if old.base != nil || len(old.incrs) != 1 {
+				t.Fatalf("manifest before the rewrite: %q", old.encode())
+			}
+
+			if err := ch.startAOFRewrite(); err != nil {
+				t.Fatal(err)
+			}
+			// written to the new incremental file while the base is written
+			run("SET", "after", "2")
+			run("RPUSH", "list", "c")
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				a.mu.Lock()
+				rewriting, err := a.rewriting, a.lastRewriteErr
+				a.mu.Unlock()
+				if !rewriting {
+					if err != nil {
+						t.Fatal(err)
+					}
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatal("rewrite did not finish")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			a.mu.Lock()
+			m := a.manifest.clone()
+			a.mu.Unlock()
+			wantBase := "appendonly.aof.1.base.aof"
+			if rdbPreamble {
+				wantBase = "appendonly.aof.1.base.rdb"
+			}
+			if m.base == nil || m.base.name != wantBase {
+				t.Errorf("manifest after the rewrite: %q, want base %s", m.encode(), wantBase)
+			}
+			if len(m.incrs) != 1 || m.incrs[0].seq != old.incrs[0].seq+1 || len(m.history) != 0 {
+				t.Errorf("manifest after the rewrite: %q, want only the incremental file after %s", m.encode(), old.incrs[0].name)
+			}
+			entries, err := os.ReadDir(a.dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var files []string
+			for _, e := range entries {
+				files = append(files, e.Name())
+			}
+			if slices.Contains(files, old.incrs[0].name) {
+				t.Errorf("replaced file %s still in %q", old.incrs[0].name, files)
+			}
+
+			ch.closeAOF()
+			loaded := open()
+			defer loaded.closeAOF()
+			for key, want := range map[string]string{"before": "1", "after": "2"} {
+				if v, ok := loaded.getValue(0, key); !ok || v.val != want {
+					t.Errorf("key %s after loading = %q, %v, want %q", key, v.val, ok, want)
+				}
+			}
+			if v, ok := loaded.getValue(0, "list"); !ok || !slices.Equal(v.list.Range(0, -1), []string{"a", "b", "c"}) {
+				t.Errorf("list missing or wrong after loading, want [a b c]")
+			}
+		})
+	}
+}
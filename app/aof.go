@@ -0,0 +1,554 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	aofFsyncAlways   = "always"
+	aofFsyncEverySec = "everysec"
+	aofFsyncNo       = "no"
+)
+
+// AOF appends executed write commands in RESP, the same format they are
+// propagated to replicas in. Like in Redis 7 the log is split into a base
+// file holding the dataset of the last rewrite and incremental files with
+// commands executed since, all listed in load order by the manifest.
+type AOF struct {
+	mu       sync.Mutex
+	dir      string
+	filename string // prefix of the file names
+	manifest *aofManifest
+	file     *os.File // last incremental file, new commands are appended to it
+	fsync    string
+
+	buf          []byte // commands not written to the file yet because of an error
+	db           int    // database selected in the file, -1 forces SELECT
+	writeErr     error
+	fsyncPending bool
+	lastFsync    time.Time
+
+	reploff        int  // replication offset after the last command appended
+	fsyncedReploff int  // replication offset covered by the last fsync, -1 when unknown
+	baseUnsynced   bool // the dataset loaded from the master is only on disk once rewritten
+
+	baseSize        int64
+	incrSize        int64 // size of all incremental files
+	rewriteBaseSize int64 // size after the last rewrite or at startup, auto rewrite compares growth to it
+
+	rewriting      bool
+	rewriteIncrSeq int // incremental files up to this one are replaced by the rewrite in progress
+	lastRewriteErr error
+	lastRewriteTry time.Time
+}
+
+// openAOF reads the manifest of the AOF directory. An append only file
+// written by older versions next to the dump is moved into the directory and
+// becomes the base file.
+func openAOF(dir string, conf *AOFconfig) (*AOF, error) {
+	a := &AOF{
+		dir:       filepath.Join(dir, conf.dirname),
+		filename:  conf.filename,
+		fsync:     conf.fsync,
+		db:        -1,
+		lastFsync: time.Now(),
+	}
+	if err := os.MkdirAll(a.dir, 0755); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(a.path(a.manifestName()))
+	if err == nil {
+		a.manifest, err = parseAOFManifest(data)
+		if err != nil {
+			return nil, err
+		}
+		return a, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	a.manifest = &aofManifest{}
+	old := filepath.Join(dir, conf.filename)
+	if _, err := os.Stat(old); err != nil {
+		return a, nil
+	}
+	fmt.Printf("Moving the append only file %s into %s\n", old, a.dir)
+	if err := os.Rename(old, a.path(conf.filename)); err != nil {
+		return nil, err
+	}
+	m := &aofManifest{base: &aofFileInfo{name: conf.filename, seq: 1, kind: aofTypeBase}, baseSeq: 1}
+	if err := a.persistManifest(m); err != nil {
+		return nil, err
+	}
+	a.manifest = m
+	return a, nil
+}
+
+func (a *AOF) path(name string) string {
+	return filepath.Join(a.dir, name)
+}
+
+func (a *AOF) manifestName() string {
+	return a.filename + ".manifest"
+}
+
+// persistManifest replaces the manifest file, a crash leaves either the old
+// or the new one in place
+func (a *AOF) persistManifest(m *aofManifest) error {
+	tmpPath := a.path("temp-" + a.manifestName())
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(m.encode()); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, a.path(a.manifestName()))
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(a.dir)
+}
+
+// syncDir makes renames and new files of the directory durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// openIncrFile opens the last incremental file for appending, creating one
+// when the manifest has none
+func (a *AOF) openIncrFile() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.manifest.incrs) == 0 {
+		if err := a.addIncrFile(); err != nil {
+			return err
+		}
+	} else {
+		last := a.manifest.incrs[len(a.manifest.incrs)-1]
+		f, err := os.OpenFile(a.path(last.name), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		a.file = f
+	}
+	a.updateSizes()
+	a.rewriteBaseSize = a.baseSize + a.incrSize
+	return nil
+}
+
+// updateSizes stats the files of the manifest. Caller must hold a.mu.
+func (a *AOF) updateSizes() {
+	a.baseSize, a.incrSize = 0, 0
+	if a.manifest.base != nil {
+		if info, err := os.Stat(a.path(a.manifest.base.name)); err == nil {
+			a.baseSize = info.Size()
+		}
+	}
+	for _, incr := range a.manifest.incrs {
+		if info, err := os.Stat(a.path(incr.name)); err == nil {
+			a.incrSize += info.Size()
+		}
+	}
+}
+
+// addIncrFile creates the next incremental file, persists the manifest
+// listing it and switches writes to it. Caller must hold a.mu.
+func (a *AOF) addIncrFile() error {
+	if a.file != nil {
+		a.flush()
+		if a.writeErr != nil {
+			return a.writeErr
+		}
+	}
+	m := a.manifest.clone()
+	m.incrSeq++
+	incr := aofFileInfo{name: fmt.Sprintf("%s.%d%s", a.filename, m.incrSeq, aofIncrSuffix), seq: m.incrSeq, kind: aofTypeIncr}
+	f, err := os.OpenFile(a.path(incr.name), os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	m.incrs = append(m.incrs, incr)
+	if err := a.persistManifest(m); err != nil {
+		f.Close()
+		os.Remove(a.path(incr.name))
+		return err
+	}
+	if a.file != nil {
+		if err := a.file.Sync(); err != nil {
+			fmt.Println("aof.go/addIncrFile(): error syncing the AOF file", err)
+		}
+		a.file.Close()
+	}
+	a.file = f
+	a.manifest = m
+	a.db = -1
+	return nil
+}
+
+// Append logs command executed in db, prefixed by SELECT when the database changes
+func (a *AOF) Append(db int, cmd Value) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if db != a.db {
+		sel := Value{vType: "array", array: []Value{{vType: "bulk", bulk: "SELECT"}, {vType: "bulk", bulk: strconv.Itoa(db)}}}
+		a.buf = append(a.buf, sel.Unmarshal()...)
+		a.db = db
+	}
+	a.buf = append(a.buf, cmd.Unmarshal()...)
+	a.flush()
+}
+
+// flush writes the buffer to the file, fsyncing it right away with the always
+// policy. Caller must hold a.mu.
+func (a *AOF) flush() {
+	if len(a.buf) == 0 {
+		return
+	}
+	n, err := a.file.Write(a.buf)
+	a.incrSize += int64(n)
+	a.buf = a.buf[n:]
+	a.writeErr = err
+	if err != nil {
+		fmt.Println("aof.go/flush(): error writing to the AOF file", err)
+		return
+	}
+	a.buf = nil
+	// with the no policy the OS syncs the file, written data counts as synced
+	if a.fsync == aofFsyncNo {
+		return
+	}
+	if a.fsync == aofFsyncEverySec {
+		a.fsyncPending = true
+		return
+	}
+	if err := a.file.Sync(); err != nil {
+		fmt.Println("aof.go/flush(): error syncing the AOF file", err)
+		a.writeErr = err
+	}
+	a.lastFsync = time.Now()
+}
+
+// cron retries failed writes and fsyncs the file once a second with the
+// everysec policy. It returns true when the synced replication offset advanced.
+func (a *AOF) cron() bool {
+	a.mu.Lock()
+	if a.writeErr != nil {
+		a.flush()
+	}
+	fsync := a.fsync == aofFsyncEverySec && a.fsyncPending && time.Since(a.lastFsync) >= time.Second
+	file := a.file
+	reploff := a.reploff
+	if fsync {
+		a.fsyncPending = false
+		a.lastFsync = time.Now()
+	}
+	a.mu.Unlock()
+
+	// writes may go on while the file is synced, the file may also be
+	// switched to a new incremental one and closed meanwhile
+	if !fsync {
+		return false
+	}
+	if err := file.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+		fmt.Println("aof.go/cron(): error syncing the AOF file", err)
+		return false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.baseUnsynced {
+		return false
+	}
+	a.fsyncedReploff = reploff
+	return true
+}
+
+// setReplOffset records the replication offset reached by the commands
+// appended so far
+func (a *AOF) setReplOffset(offset int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.reploff = offset
+	if !a.fsyncPending && a.writeErr == nil && !a.baseUnsynced {
+		a.fsyncedReploff = offset
+	}
+}
+
+// resetReplOffset starts over from offset of a dataset loaded from the master,
+// it is not synced until the rewrite started for it completes
+func (a *AOF) resetReplOffset(offset int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.reploff = offset
+	a.baseUnsynced = a.rewriting
+	a.fsyncedReploff = -1
+	if !a.baseUnsynced && !a.fsyncPending {
+		a.fsyncedReploff = offset
+	}
+}
+
+// FsyncedOffset is the replication offset up to which the commands are
+// synced to disk, -1 when unknown
+func (a *AOF) FsyncedOffset() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.fsyncedReploff
+}
+
+// WriteError returns the error of the last write, commands are refused until it succeeds
+func (a *AOF) WriteError() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.writeErr
+}
+
+// Close writes what is left in the buffer and syncs the file
+func (a *AOF) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.flush()
+	if a.writeErr != nil {
+		a.file.Close()
+		return a.writeErr
+	}
+	if err := a.file.Sync(); err != nil {
+		a.file.Close()
+		return err
+	}
+	return a.file.Close()
+}
+
+// call executes the command and records it for INFO. Write commands are
+// serialized so they are logged and propagated to replicas in the order they
+// were applied.
+func (ch *CommandHandler) call(c *Client, v Value) []byte {
+	name := commandName(v)
+	// ASKING only applies to the command that follows it
+	if name != "asking" {
+		defer func() { c.asking = false }()
+	}
+	if reply := ch.rejectCommand(c, v); reply != nil {
+		ch.stats.rejected(name, reply)
+		return reply
+	}
+	start := time.Now()
+	var reply []byte
+	if isWriteCommand(v) {
+		ch.writeMu.Lock()
+		reply = ch.execute(c, v)
+		ch.writeMu.Unlock()
+	} else {
+		reply = ch.HandleCommand(c, v)
+	}
+	ch.stats.called(name, time.Since(start), reply)
+	return reply
+}
+
+// rejectCommand returns the error refusing v before it runs, nil when it can
+// run. In cluster mode commands on keys served by another node are
+// redirected. Write commands are refused while the AOF can't be written or
+// too few replicas are connected. Only the master writes to a read only
+// replica.
+func (ch *CommandHandler) rejectCommand(c *Client, v Value) []byte {
+	var repl Value
+	if reply := checkCommand(v); reply != nil {
+		return reply
+	}
+	spec := commandTable[commandName(v)]
+	if reply := ch.clusterRedirect(c, v); reply != nil {
+		return reply
+	}
+	if spec.flags&cmdWrite == 0 {
+		return nil
+	}
+	if !c.master && ch.replConf.readOnly && !ch.isMaster() {
+		return repl.Error("READONLY You can't write against a read only replica.")
+	}
+	if ch.replConf.minReplicas > 0 && ch.isMaster() && ch.goodReplicas() < ch.replConf.minReplicas {
+		return repl.Error("NOREPLICAS Not enough good replicas to write.")
+	}
+	if ch.aof != nil {
+		if err := ch.aof.WriteError(); err != nil {
+			return repl.Error("MISCONF Errors writing to the AOF file: " + err.Error())
+		}
+	}
+	return nil
+}
+
+// execute runs write command v and propagates it, or the commands it was
+// rewritten to. Caller must hold ch.writeMu.
+func (ch *CommandHandler) execute(c *Client, v Value) []byte {
+	c.propagateAs, c.rewritten = nil, false
+	reply := ch.HandleCommand(c, v)
+	if len(reply) > 0 && reply[0] != '-' {
+		cmds := []Value{v}
+		if c.rewritten {
+			cmds = c.propagateAs
+		}
+		for _, cmd := range cmds {
+			c.woff = ch.propagateWrite(c.db, cmd)
+		}
+	}
+	return reply
+}
+
+// applyFromMaster executes a command of the replication stream on a replica.
+// The stream is recorded under writeMu like the writes of a master, so a
+// snapshot taken for a replica of this replica matches its offset.
+func (ch *CommandHandler) applyFromMaster(c *Client, v Value) []byte {
+	ch.writeMu.Lock()
+	defer ch.writeMu.Unlock()
+	if reply := checkCommand(v); reply != nil {
+		return reply
+	}
+	start := time.Now()
+	var reply []byte
+	if isWriteCommand(v) {
+		reply = ch.execute(c, v)
+	} else {
+		reply = ch.HandleCommand(c, v)
+	}
+	ch.stats.called(commandName(v), time.Since(start), reply)
+	ch.feedFromMaster(c.db, v.Unmarshal())
+	return reply
+}
+
+// propagateWrite logs write command executed in db to the AOF and sends it
+// to the replicas. It returns the replication offset after the command.
+// Caller must hold ch.writeMu.
+func (ch *CommandHandler) propagateWrite(db int, cmd Value) int {
+	if ch.aof != nil {
+		ch.aof.Append(db, cmd)
+	}
+	// a replica records the stream of its master instead, see feedFromMaster
+	if ch.replConf.replication.role != "master" {
+		return 0
+	}
+	offset := ch.propagate(db, cmd)
+	if ch.aof != nil {
+		ch.aof.setReplOffset(offset)
+	}
+	return offset
+}
+
+// loadAOFFiles loads the base file and replays the incremental files in the
+// order of the manifest. Only the last file may be cut short by a crash.
+func (ch *CommandHandler) loadAOFFiles(a *AOF, loadTruncated bool) error {
+	m := a.manifest
+	if m.base != nil {
+		if err := ch.loadAOFBase(a.path(m.base.name), loadTruncated && len(m.incrs) == 0); err != nil {
+			return fmt.Errorf("%s: %w", m.base.name, err)
+		}
+	}
+	for i, incr := range m.incrs {
+		err := ch.loadAOF(a.path(incr.name), loadTruncated && i == len(m.incrs)-1)
+		// the last incremental file is listed before it is created
+		if err != nil && !(errors.Is(err, os.ErrNotExist) && i == len(m.incrs)-1) {
+			return fmt.Errorf("%s: %w", incr.name, err)
+		}
+	}
+	ch.dirty.Store(0)
+	return nil
+}
+
+// loadAOFBase loads base file in RDB format, recognized by its magic, or in RESP
+func (ch *CommandHandler) loadAOFBase(path string, loadTruncated bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	magic := make([]byte, 5)
+	n, _ := io.ReadFull(f, magic)
+	f.Close()
+	if string(magic[:n]) != "REDIS" {
+		return ch.loadAOF(path, loadTruncated)
+	}
+	dbs, _, err := loadRDBFile(path)
+	if err != nil {
+		return err
+	}
+	ch.setKeys(dbs)
+	fmt.Printf("DB loaded from base file %s\n", path)
+	return nil
+}
+
+// loadAOF replays commands of the file. A command cut short at the end of the
+// file, left by a crash during write, is dropped and the file truncated to
+// the last complete command if loadTruncated is set.
+func (ch *CommandHandler) loadAOF(path string, loadTruncated bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	// replies of the replayed commands are discarded
+	c := NewClient(bufio.NewReader(strings.NewReader("")), bufio.NewWriter(io.Discard))
+	parser := NewParser(bufio.NewReader(f))
+	var valid int64
+	commands := 0
+	for {
+		v, err := parser.Parse()
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			if valid == info.Size() {
+				break
+			}
+			if !loadTruncated {
+				return fmt.Errorf("unexpected end of the AOF file at offset %d, enable aof-load-truncated to load it anyway", valid)
+			}
+			fmt.Printf("!!! Warning: short read while loading the AOF file %s !!!\n", path)
+			fmt.Printf("AOF loaded anyway because aof-load-truncated is enabled, truncating it to %d bytes\n", valid)
+			if err := os.Truncate(path, valid); err != nil {
+				return err
+			}
+			break
+		}
+		if err != nil || v.vType != "array" || len(v.array) == 0 {
+			return fmt.Errorf("bad file format reading the AOF file at offset %d", valid)
+		}
+		if reply := checkCommand(v); reply != nil {
+			return fmt.Errorf("%s reading the AOF file at offset %d", strings.TrimSpace(string(reply[1:])), valid)
+		}
+		ch.HandleCommand(c, v)
+		valid += int64(len(v.Unmarshal()))
+		commands++
+	}
+	fmt.Printf("DB loaded from append only file %s: %d commands\n", path, commands)
+	return nil
+}
+
+func (ch *CommandHandler) closeAOF() {
+	if ch.aof == nil {
+		return
+	}
+	if err := ch.aof.Close(); err != nil {
+		fmt.Println("aof.go/closeAOF(): error closing the AOF file", err)
+	}
+}
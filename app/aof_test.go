@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestCommandHandler(t *testing.T) *CommandHandler {
+	t.Helper()
+	repl := &ReplicationConfig{}
+	repl.replication.role = "master"
+	ch, err := NewCommandHandler(&ServerConfig{databases: 16}, &RDBconfig{}, &AOFconfig{}, repl, &ClusterConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ch.stopCron)
+	return ch
+}
+
+func TestLoadAOFTruncatedTail(t *testing.T) {
+	complete := "*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n" +
+		"*2\r\n$6\r\nSELECT\r\n$1\r\n2\r\n" +
+		"*3\r\n$3\r\nSET\r\n$1\r\nb\r\n$1\r\n2\r\n"
+	tests := []struct {
+		name          string
+		tail          string // appended to the complete commands
+		loadTruncated bool
+		wantErr       string
+	}{
+		{"complete", "", false, ""},
+		{"cut in a bulk", "*3\r\n$3\r\nSET\r\n$1\r\nc\r\n$5\r\nhel", true, ""},
+		{"cut in a header", "*3\r\n$3\r\nSE", true, ""},
+		{"cut without aof-load-truncated", "*3\r\n$3\r\nSET\r\n$1\r\nc", false, "unexpected end of the AOF file"},
+		{"not a command", "+OK\r\n", true, "bad file format"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "appendonly.aof.1.incr.aof")
+			if err := os.WriteFile(path, []byte(complete+tt.tail), 0644); err != nil {
+				t.Fatal(err)
+			}
+			ch := newTestCommandHandler(t)
+			err := ch.loadAOF(path, tt.loadTruncated)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("loadAOF error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadAOF: %v", err)
+			}
+			if _, ok := ch.getValue(0, "a"); !ok {
+				t.Errorf("key a missing in db 0")
+			}
+			if _, ok := ch.getValue(2, "b"); !ok {
+				t.Errorf("key b missing in db 2")
+			}
+			if _, ok := ch.getValue(2, "c"); ok {
+				t.Errorf("key of the truncated command was set")
+			}
+			// the incomplete command is cut off so new writes follow the valid ones
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != complete {
+				t.Errorf("file after loading is %q, want %q", data, complete)
+			}
+		})
+	}
+}
+
+func TestPropagatedRewrites(t *testing.T) {
+	aof := &AOFconfig{enabled: true, filename: "appendonly.aof", dirname: "appendonlydir", fsync: "no"}
+	repl := &ReplicationConfig{}
+	repl.replication.role = "master"
+	ch, err := NewCommandHandler(&ServerConfig{databases: 16}, &RDBconfig{dir: t.TempDir()}, aof, repl, &ClusterConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ch.stopCron)
+	t.Cleanup(ch.closeAOF)
+	a := ch.aof
+	path := a.path(a.manifest.incrs[len(a.manifest.incrs)-1].name)
+	c := NewClient(bufio.NewReader(strings.NewReader("")), bufio.NewWriter(io.Discard))
+
+	// run returns the reply of the command and the commands it appended to
+	// the AOF, SELECT left out
+	var offset int
+	run := func(args ...string) (string, [][]string) {
+		t.Helper()
+		reply := string(ch.call(c, bulkArray(args)))
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parser := NewParser(bufio.NewReader(bytes.NewReader(data[offset:])))
+		offset = len(data)
+		var cmds [][]string
+		for {
+			v, err := parser.Parse()
+			if err != nil {
+				break
+			}
+			var cmd []string
+			for _, arg := range v.array {
+				cmd = append(cmd, arg.bulk)
+			}
+			if !strings.EqualFold(cmd[0], "select") {
+				cmds = append(cmds, cmd)
+			}
+		}
+		return reply, cmds
+	}
+	expectAbsolute := func(cmds [][]string, name string, start time.Time, ttl time.Duration) {
+		t.Helper()
+		if len(cmds) != 1 || len(cmds[0]) < 2 || cmds[0][0] != name {
+			t.Fatalf("propagated %q, want %s", cmds, name)
+		}
+		ms, err := strconv.ParseInt(cmds[0][len(cmds[0])-1], 10, 64)
+		if err != nil {
+			t.Fatalf("propagated %q: %v", cmds, err)
+		}
+		if ms < start.Add(ttl).UnixMilli() || ms > time.Now().Add(ttl).UnixMilli() {
+			t.Errorf("propagated %q, want a Unix time %v from now", cmds, ttl)
+		}
+	}
+
+	start := time.Now()
+	_, cmds := run("SET", "k", "v", "EX", "100")
+	expectAbsolute(cmds, "SET", start, 100*time.Second)
+	if got := cmds[0][:4]; !slices.Equal(got, []string{"SET", "k", "v", "PXAT"}) {
+		t.Errorf("propagated %q, want SET k v PXAT", cmds)
+	}
+	if _, cmds := run("SET", "plain", "v"); !slices.EqualFunc(cmds, [][]string{{"SET", "plain", "v"}}, slices.Equal[[]string]) {
+		t.Errorf("SET without TTL propagated %q", cmds)
+	}
+	if _, cmds := run("SET", "k", "v", "NX"); len(cmds) != 0 {
+		t.Errorf("SET NX of an existing key propagated %q", cmds)
+	}
+
+	start = time.Now()
+	_, cmds = run("EXPIRE", "k", "200")
+	expectAbsolute(cmds, "PEXPIREAT", start, 200*time.Second)
+	if _, cmds := run("EXPIRE", "missing", "200"); len(cmds) != 0 {
+		t.Errorf("EXPIRE of a missing key propagated %q", cmds)
+	}
+	if _, cmds := run("EXPIRE", "k", "-1"); !slices.EqualFunc(cmds, [][]string{{"DEL", "k"}}, slices.Equal[[]string]) {
+		t.Errorf("EXPIRE in the past propagated %q, want DEL k", cmds)
+	}
+
+	run("SADD", "s", "a", "b", "c", "d")
+	_, cmds = run("SPOP", "s", "2")
+	if len(cmds) != 1 || len(cmds[0]) != 4 || cmds[0][0] != "SREM" || cmds[0][1] != "s" {
+		t.Fatalf("SPOP s 2 propagated %q, want SREM s with 2 members", cmds)
+	}
+	for _, member := range cmds[0][2:] {
+		if reply, _ := run("SISMEMBER", "s", member); reply != ":0\r\n" {
+			t.Errorf("%s removed by the propagated SREM is still in the set", member)
+		}
+	}
+	if _, cmds := run("SPOP", "missing"); len(cmds) != 0 {
+		t.Errorf("SPOP of a missing key propagated %q", cmds)
+	}
+}
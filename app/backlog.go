@@ -0,0 +1,53 @@
+package main
+
+// replBacklog keeps the latest bytes of the replication stream in a circular
+// buffer, so a replica reconnecting after a short break only gets the part of
+// the stream it missed instead of a full snapshot.
+// Offsets count the bytes of the stream starting from 1.
+type replBacklog struct {
+	buf     []byte
+	idx     int // position in buf of the next byte written
+	histlen int // bytes of buf holding stream data
+	end     int // offset of the last byte written
+}
+
+// newReplBacklog creates a backlog of size bytes for the stream continuing
+// after offset
+func newReplBacklog(size int, offset int) *replBacklog {
+	return &replBacklog{buf: make([]byte, size), end: offset}
+}
+
+// start is the offset of the first byte in the backlog
+func (b *replBacklog) start() int {
+	return b.end - b.histlen + 1
+}
+
+func (b *replBacklog) write(p []byte) {
+	b.end += len(p)
+	// only the tail fits when p is larger than the backlog
+	if len(p) > len(b.buf) {
+		p = p[len(p)-len(b.buf):]
+	}
+	for len(p) > 0 {
+		n := copy(b.buf[b.idx:], p)
+		b.idx = (b.idx + n) % len(b.buf)
+		b.histlen = min(b.histlen+n, len(b.buf))
+		p = p[n:]
+	}
+}
+
+// readFrom returns the stream from offset to the end, false when the bytes
+// at offset are no longer or not yet in the backlog
+func (b *replBacklog) readFrom(offset int) ([]byte, bool) {
+	if offset < b.start() || offset > b.end+1 {
+		return nil, false
+	}
+	skip := offset - b.start()
+	data := make([]byte, 0, b.histlen-skip)
+	pos := (b.idx - b.histlen + skip + len(b.buf)) % len(b.buf)
+	if pos+cap(data) <= len(b.buf) {
+		return append(data, b.buf[pos:pos+cap(data)]...), true
+	}
+	data = append(data, b.buf[pos:]...)
+	return append(data, b.buf[:cap(data)-len(data)]...), true
+}
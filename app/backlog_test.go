@@ -0,0 +1,64 @@
+package main
+
+import "testing"
+
+func TestReplBacklog(t *testing.T) {
+	type read struct {
+		offset int
+		want   string
+		ok     bool
+	}
+	tests := []struct {
+		name   string
+		size   int
+		offset int // offset of the stream before the backlog was created
+		writes []string
+		reads  []read
+	}{
+		{
+			name:   "not full",
+			size:   8,
+			writes: []string{"abc", "de"},
+			reads:  []read{{1, "abcde", true}, {4, "de", true}, {6, "", true}, {7, "", false}, {0, "", false}},
+		},
+		{
+			name:   "wraps around",
+			size:   8,
+			writes: []string{"abcdef", "ghij"},
+			reads:  []read{{2, "", false}, {3, "cdefghij", true}, {6, "fghij", true}, {9, "ij", true}, {11, "", true}},
+		},
+		{
+			name:   "wraps several times",
+			size:   4,
+			writes: []string{"abc", "def", "ghi", "jk"},
+			reads:  []read{{8, "hijk", true}, {10, "jk", true}, {7, "", false}},
+		},
+		{
+			name:   "write larger than the backlog",
+			size:   4,
+			writes: []string{"ab", "cdefghij"},
+			reads:  []read{{7, "ghij", true}, {6, "", false}},
+		},
+		{
+			name:   "created after a full resync",
+			size:   4,
+			offset: 100,
+			writes: []string{"abc", "def"},
+			reads:  []read{{100, "", false}, {103, "cdef", true}, {106, "f", true}, {107, "", true}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newReplBacklog(tt.size, tt.offset)
+			for _, w := range tt.writes {
+				b.write([]byte(w))
+			}
+			for _, r := range tt.reads {
+				got, ok := b.readFrom(r.offset)
+				if ok != r.ok || string(got) != r.want {
+					t.Errorf("readFrom(%d) = %q, %v, want %q, %v", r.offset, got, ok, r.want, r.ok)
+				}
+			}
+		})
+	}
+}
@@ -2,14 +2,160 @@ package main
 
 import (
 	"bufio"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
 )
 
+var lastClientID atomic.Int64
+
+// pushOutputLimit is the most pub/sub and tracking messages buffered for a
+// client, a client falling further behind is disconnected
+const pushOutputLimit = 32 * 1024 * 1024
+
 type Client struct {
-	rw *bufio.ReadWriter
+	id   int64
+	rw   *bufio.ReadWriter
+	mu   sync.Mutex   // guards writes
+	resp atomic.Int32 // protocol version switched by HELLO, read by clients pushing messages to this one
+	db   int          // database selected with SELECT
+
+	replCapaEOF    bool // replica accepts the snapshot in the EOF format, set by REPLCONF capa eof
+	replCapaPSync2 bool // replica follows replication ID changes in +CONTINUE, set by REPLCONF capa psync2
+	master         bool // connection of a replica to its master, allowed to write on a read only replica
+
+	replListeningPort int // port the replica accepts clients on, set by REPLCONF listening-port
+
+	// commands logged and propagated in place of the one being executed, set
+	// by commands whose effect depends on the time or randomness
+	propagateAs []Value
+	rewritten   bool
+
+	woff int // replication offset after the last write of the client, WAIT waits for it
+
+	asking bool // the next command may run in a slot being imported, set by ASKING
+
+	conn io.Closer // connection of the client, nil for internal clients
+	addr string    // remote address of the connection
+
+	// messages pushed by other clients are written by a writer goroutine of
+	// their own, pushMu is never held while writing to the connection
+	pushMu      sync.Mutex
+	pushBuf     []byte        // messages not written to the client yet
+	pushWake    chan struct{} // signals new messages to the writer, created with the first message
+	pushStopped bool          // client disconnected or dropped, messages are discarded
 }
 
 func NewClient(br *bufio.Reader, bw *bufio.Writer) *Client {
-	return &Client{
+	c := &Client{
+		id: lastClientID.Add(1),
 		rw: bufio.NewReadWriter(bufio.NewReader(br), bufio.NewWriter(bw)),
 	}
+	c.resp.Store(2)
+	return c
+}
+
+// Write sends reply to the client right away
+func (c *Client) Write(reply []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.rw.Write(reply); err != nil {
+		return err
+	}
+	return c.rw.Flush()
+}
+
+// Push queues msg for the writer of the client, started with the first
+// message. Unlike Write it never waits for the client to read, so it can be
+// called holding ch.writeMu.
+func (c *Client) Push(msg []byte) {
+	c.pushMu.Lock()
+	defer c.pushMu.Unlock()
+	if c.pushStopped {
+		return
+	}
+	if len(c.pushBuf)+len(msg) > pushOutputLimit {
+		fmt.Printf("Client id=%d scheduled to be closed ASAP for overcoming of output buffer limits.\n", c.id)
+		c.pushStopped = true
+		c.pushBuf = nil
+		c.Close()
+		return
+	}
+	c.pushBuf = append(c.pushBuf, msg...)
+	if c.pushWake == nil {
+		c.pushWake = make(chan struct{}, 1)
+		go c.writePushed(c.pushWake)
+	}
+	select {
+	case c.pushWake <- struct{}{}:
+	default:
+	}
+}
+
+// writePushed sends the queued messages until stopPush is called
+func (c *Client) writePushed(wake chan struct{}) {
+	for range wake {
+		c.pushMu.Lock()
+		buf := c.pushBuf
+		c.pushBuf = nil
+		c.pushMu.Unlock()
+		if len(buf) == 0 {
+			continue
+		}
+		if err := c.Write(buf); err != nil {
+			c.Close()
+			return
+		}
+	}
+}
+
+// stopPush discards the queued messages and ends the writer, called once the
+// client disconnected
+func (c *Client) stopPush() {
+	c.pushMu.Lock()
+	defer c.pushMu.Unlock()
+	c.pushStopped = true
+	c.pushBuf = nil
+	if c.pushWake != nil {
+		close(c.pushWake)
+		c.pushWake = nil
+	}
+}
+
+// Close disconnects the client, its connection handler cleans up
+func (c *Client) Close() error {
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+// WriteFrom sends header followed by everything read from r, nothing else is
+// written to the client meanwhile
+func (c *Client) WriteFrom(header []byte, r io.Reader) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.rw.Write(header); err != nil {
+		return err
+	}
+	if _, err := io.Copy(c.rw, r); err != nil {
+		return err
+	}
+	return c.rw.Flush()
+}
+
+// rewriteCommand replaces the command being executed by cmds in the AOF and
+// the replication stream, no command at all is propagated when cmds is empty
+func (c *Client) rewriteCommand(cmds ...Value) {
+	c.propagateAs = cmds
+	c.rewritten = true
+}
+
+func (c *Client) Protocol() int {
+	return int(c.resp.Load())
+}
+
+func (c *Client) SetProtocol(resp int) {
+	c.resp.Store(int32(resp))
 }
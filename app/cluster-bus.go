@@ -0,0 +1,462 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// types of the messages of the cluster bus. Every message is an array of bulk
+// strings starting with the header of the sender: type, name, port, bus port,
+// current epoch, config epoch, replication offset and slots. PING, PONG and
+// MEET go on with gossip sections about other nodes, FAIL with the name of
+// the failing node.
+const (
+	busPing = "ping"
+	busPong = "pong"
+	busMeet = "meet"
+	busFail = "fail"
+)
+
+const (
+	busHeaderFields     = 8
+	busGossipFields     = 7 // name, ip, port, bus port, flags, ping sent and pong received
+	clusterCronPeriod   = 100 * time.Millisecond
+	clusterGossipEvery  = time.Second // a random node is pinged this often
+	clusterWriteTimeout = time.Second
+)
+
+// busMessage is a decoded message of the cluster bus
+type busMessage struct {
+	typ          string
+	sender       string
+	port, cport  string
+	currentEpoch int
+	configEpoch  int
+	offset       int
+	slots        string
+	args         []string // gossip sections or the failing node
+}
+
+func parseBusMessage(v Value) (busMessage, bool) {
+	var m busMessage
+	if v.vType != "array" || len(v.array) < busHeaderFields {
+		return m, false
+	}
+	f := make([]string, len(v.array))
+	for i, arg := range v.array {
+		f[i] = arg.bulk
+	}
+	var err1, err2, err3 error
+	m.typ, m.sender, m.port, m.cport, m.slots = f[0], f[1], f[2], f[3], f[7]
+	m.currentEpoch, err1 = strconv.Atoi(f[4])
+	m.configEpoch, err2 = strconv.Atoi(f[5])
+	m.offset, err3 = strconv.Atoi(f[6])
+	m.args = f[busHeaderFields:]
+	return m, err1 == nil && err2 == nil && err3 == nil
+}
+
+// clusterLink is a connection of the bus. Nodes ping others on outbound
+// links and reply on the inbound ones.
+type clusterLink struct {
+	conn      net.Conn
+	w         *bufio.Writer
+	createdAt time.Time
+}
+
+func newClusterLink(conn net.Conn) *clusterLink {
+	return &clusterLink{conn: conn, w: bufio.NewWriter(conn), createdAt: time.Now()}
+}
+
+// send writes msg, a failed write closes the connection and its reader
+// drops the link. Caller must hold Cluster.mu.
+func (l *clusterLink) send(msg []string) {
+	v := bulkArray(msg)
+	l.conn.SetWriteDeadline(time.Now().Add(clusterWriteTimeout))
+	_, err := l.w.Write(v.Unmarshal())
+	if err == nil {
+		err = l.w.Flush()
+	}
+	if err != nil {
+		l.conn.Close()
+	}
+}
+
+// serve accepts the links of the other nodes and runs the cluster cron
+func (cl *Cluster) serve(l net.Listener) {
+	defer l.Close()
+	go cl.cron()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			fmt.Println("cluster-bus.go/Accept(): error accepting connection: ", err.Error())
+			return
+		}
+		go cl.readLink(newClusterLink(conn), nil)
+	}
+}
+
+// connect opens the outbound link to n and pings it, or sends MEET to a
+// node met with CLUSTER MEET
+func (cl *Cluster) connect(n *clusterNode) {
+	conn, err := dialInstance(n.ip, n.cport, cl.conf.nodeTimeout)
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	n.connecting = false
+	if err != nil {
+		// an unreachable node is failing like one not replying
+		if n.pingSent.IsZero() {
+			n.pingSent = time.Now()
+		}
+		return
+	}
+	if cl.nodes[n.name] != n {
+		conn.Close()
+		return
+	}
+	l := newClusterLink(conn)
+	n.link = l
+	if n.flags&nodeMeet != 0 {
+		cl.sendPing(n, busMeet)
+	} else {
+		cl.sendPing(n, busPing)
+	}
+	go cl.readLink(l, n)
+}
+
+// readLink processes the messages of a link until its connection breaks.
+// node is the node of an outbound link, nil for inbound ones.
+func (cl *Cluster) readLink(l *clusterLink, node *clusterNode) {
+	rd := bufio.NewReader(l.conn)
+	for {
+		v, err := NewParser(rd).Parse()
+		m, ok := parseBusMessage(v)
+
+		cl.mu.Lock()
+		if err != nil || !ok {
+			l.conn.Close()
+			if node != nil && node.link == l {
+				node.link = nil
+			}
+			cl.mu.Unlock()
+			return
+		}
+		cl.process(l, node, m)
+		cl.mu.Unlock()
+	}
+}
+
+// header returns the header of a message of type typ. Caller must hold cl.mu.
+func (cl *Cluster) header(typ string) []string {
+	me := cl.myself
+	return []string{
+		typ, me.name, me.port, me.cport,
+		strconv.Itoa(cl.currentEpoch), strconv.Itoa(me.configEpoch), strconv.Itoa(cl.replOffset()),
+		cl.formatSlotRanges(me),
+	}
+}
+
+// gossipMessage returns a message of type typ with gossip about every node
+// this one knows, the clusters of local nodes are small. Caller must hold
+// cl.mu.
+func (cl *Cluster) gossipMessage(typ string) []string {
+	msg := cl.header(typ)
+	for _, n := range cl.nodes {
+		if n == cl.myself || n.flags&nodeHandshake != 0 {
+			continue
+		}
+		msg = append(msg, n.name, n.ip, n.port, n.cport, strconv.Itoa(n.flags),
+			strconv.FormatInt(unixMilli(n.pingSent), 10), strconv.FormatInt(unixMilli(n.pongReceived), 10))
+	}
+	cl.sent[typ]++
+	return msg
+}
+
+// sendPing sends PING or MEET to n on its outbound link. Caller must hold
+// cl.mu.
+func (cl *Cluster) sendPing(n *clusterNode, typ string) {
+	if n.pingSent.IsZero() {
+		n.pingSent = time.Now()
+	}
+	n.link.send(cl.gossipMessage(typ))
+}
+
+// process handles message m read from link l of node, nil for an inbound
+// link. Caller must hold cl.mu.
+func (cl *Cluster) process(l *clusterLink, node *clusterNode, m busMessage) {
+	cl.received[m.typ]++
+	now := time.Now()
+	sender := cl.nodes[m.sender]
+	if sender != nil && sender.flags&nodeHandshake != 0 {
+		sender = nil
+	}
+	if sender != nil {
+		if m.currentEpoch > cl.currentEpoch {
+			cl.currentEpoch = m.currentEpoch
+			cl.todoSave = true
+		}
+		if m.configEpoch > sender.configEpoch {
+			sender.configEpoch = m.configEpoch
+			cl.todoSave = true
+		}
+		sender.replOffset = m.offset
+	}
+
+	switch m.typ {
+	case busPing, busMeet:
+		// nodes learn their address from the others
+		if m.typ == busMeet || cl.myself.ip == "" {
+			if ip, _, err := net.SplitHostPort(l.conn.LocalAddr().String()); err == nil && ip != cl.myself.ip {
+				cl.myself.ip = ip
+				fmt.Println("IP address for this node updated to", ip)
+				cl.todoSave = true
+			}
+		}
+		if sender == nil && m.typ == busMeet {
+			ip, _, _ := net.SplitHostPort(l.conn.RemoteAddr().String())
+			sender = newClusterNode(m.sender, nodeMaster)
+			sender.ip, sender.port, sender.cport = ip, m.port, m.cport
+			sender.configEpoch = m.configEpoch
+			cl.nodes[sender.name] = sender
+			cl.todoSave = true
+		}
+		l.send(cl.gossipMessage(busPong))
+	case busPong:
+		if node == nil {
+			return
+		}
+		if node.flags&nodeHandshake != 0 {
+			if sender != nil {
+				// the node was known already, the handshake was redundant
+				cl.deleteNode(node)
+				return
+			}
+			delete(cl.nodes, node.name)
+			node.name = m.sender
+			node.flags &^= nodeHandshake
+			node.configEpoch = m.configEpoch
+			cl.nodes[node.name] = node
+			sender = node
+			fmt.Printf("Handshake with node %s completed.\n", node.name)
+			cl.todoSave = true
+		} else if node.name != m.sender {
+			fmt.Printf("PONG contains mismatching sender ID. About node %s, got %s instead\n", node.name, m.sender)
+			l.conn.Close()
+			node.link = nil
+			return
+		}
+		node.flags &^= nodeMeet
+		node.pongReceived, node.pingSent = now, time.Time{}
+		if node.flags&nodePFail != 0 {
+			node.flags &^= nodePFail
+			cl.updateState()
+		}
+		// a failing master serving slots comes back after twice the node
+		// timeout, it could have been replaced meanwhile
+		if node.flags&nodeFail != 0 && (!cl.ownsSlots(node) || now.Sub(node.failTime) > 2*cl.conf.nodeTimeout) {
+			fmt.Printf("Clear FAIL state for node %s: is reachable again.\n", node.name)
+			node.flags &^= nodeFail
+			cl.updateState()
+			cl.todoSave = true
+		}
+	case busFail:
+		if sender == nil || len(m.args) != 1 {
+			return
+		}
+		failing := cl.nodes[m.args[0]]
+		if failing != nil && failing != cl.myself && failing.flags&nodeFail == 0 {
+			fmt.Printf("FAIL message received from %s about %s\n", sender.name, failing.name)
+			failing.flags = failing.flags&^nodePFail | nodeFail
+			failing.failTime = now
+			cl.updateState()
+			cl.todoSave = true
+		}
+		return
+	default:
+		return
+	}
+
+	if sender != nil {
+		cl.processGossip(sender, m.args)
+		cl.updateSlots(sender, m.slots)
+		cl.handleEpochCollision(sender)
+	}
+}
+
+// processGossip records the failure reports of sender and meets the nodes it
+// knows that this one doesn't. Caller must hold cl.mu.
+func (cl *Cluster) processGossip(sender *clusterNode, args []string) {
+	for i := 0; i+busGossipFields <= len(args); i += busGossipFields {
+		name, ip, port, cport := args[i], args[i+1], args[i+2], args[i+3]
+		flags, err := strconv.Atoi(args[i+4])
+		if err != nil {
+			return
+		}
+		n := cl.nodes[name]
+		if n == nil {
+			if ip != "" {
+				cl.startHandshake(ip, port, cport, false)
+			}
+			continue
+		}
+		if n == cl.myself {
+			continue
+		}
+		if flags&(nodePFail|nodeFail) != 0 {
+			if _, ok := n.failReports[sender.name]; !ok {
+				fmt.Printf("Node %s reported node %s as not reachable.\n", sender.name, n.name)
+			}
+			n.failReports[sender.name] = time.Now()
+			cl.markFailingIfNeeded(n)
+		} else {
+			delete(n.failReports, sender.name)
+		}
+	}
+}
+
+// markFailingIfNeeded marks n as failing when it doesn't reply to this node
+// and a majority of the masters reported it recently, and tells the other
+// nodes. Caller must hold cl.mu.
+func (cl *Cluster) markFailingIfNeeded(n *clusterNode) {
+	if n.flags&nodePFail == 0 || n.flags&nodeFail != 0 {
+		return
+	}
+	failures := 1 // this node
+	for name, at := range n.failReports {
+		if time.Since(at) > 2*cl.conf.nodeTimeout {
+			delete(n.failReports, name)
+		} else {
+			failures++
+		}
+	}
+	if failures < cl.size()/2+1 {
+		return
+	}
+	fmt.Printf("Marking node %s as failing (quorum reached).\n", n.name)
+	n.flags = n.flags&^nodePFail | nodeFail
+	n.failTime = time.Now()
+	for _, other := range cl.nodes {
+		if other.link != nil && other.flags&nodeHandshake == 0 {
+			cl.sent[busFail]++
+			other.link.send(append(cl.header(busFail), n.name))
+		}
+	}
+	cl.updateState()
+	cl.todoSave = true
+}
+
+// updateSlots gives sender the slots it claims unless their owner has a
+// newer config epoch or the slot is being imported here. Caller must hold
+// cl.mu.
+func (cl *Cluster) updateSlots(sender *clusterNode, claimed string) {
+	slots, err := parseSlotRanges(claimed)
+	if err != nil {
+		return
+	}
+	changed := false
+	for _, s := range slots {
+		owner := cl.slots[s]
+		if owner == sender || cl.importing[s] != nil {
+			continue
+		}
+		if owner == nil || owner.configEpoch < sender.configEpoch {
+			cl.slots[s] = sender
+			if owner == cl.myself {
+				cl.migrating[s] = nil
+			}
+			changed = true
+		}
+	}
+	if changed {
+		cl.updateState()
+		cl.todoSave = true
+	}
+}
+
+// handleEpochCollision gives myself a new config epoch when sender has the
+// same, the node with the smaller name moves. Slot ownership compares config
+// epochs so every master needs its own. Caller must hold cl.mu.
+func (cl *Cluster) handleEpochCollision(sender *clusterNode) {
+	if sender.configEpoch != cl.myself.configEpoch || sender.name <= cl.myself.name {
+		return
+	}
+	cl.currentEpoch++
+	cl.myself.configEpoch = cl.currentEpoch
+	cl.todoSave = true
+	fmt.Printf("WARNING: configEpoch collision with node %s. configEpoch set to %d\n", sender.name, cl.myself.configEpoch)
+}
+
+// cron keeps links to the other nodes, pings them and detects the nodes not
+// replying within node timeout
+func (cl *Cluster) cron() {
+	ticker := time.NewTicker(clusterCronPeriod)
+	defer ticker.Stop()
+	for range ticker.C {
+		cl.mu.Lock()
+		now := time.Now()
+		timeout := cl.conf.nodeTimeout
+		for _, n := range cl.nodes {
+			if n == cl.myself {
+				continue
+			}
+			if n.flags&nodeHandshake != 0 && now.Sub(n.createdAt) > max(timeout, time.Second) {
+				cl.deleteNode(n)
+				continue
+			}
+			if n.link == nil && !n.connecting {
+				n.connecting = true
+				go cl.connect(n)
+			}
+			// a link waiting for a pong for half the timeout may be stuck, a
+			// new one is tried while the ping stays pending
+			if n.link != nil && !n.pingSent.IsZero() && now.Sub(n.pingSent) > timeout/2 && now.Sub(n.link.createdAt) > timeout/2 {
+				n.link.conn.Close()
+				n.link = nil
+			}
+			if n.link != nil && n.pingSent.IsZero() && now.Sub(n.pongReceived) > timeout/2 {
+				cl.sendPing(n, busPing)
+			}
+			if !n.pingSent.IsZero() && now.Sub(n.pingSent) > timeout && n.flags&(nodePFail|nodeFail|nodeHandshake) == 0 {
+				fmt.Printf("*** NODE %s possibly failing\n", n.name)
+				n.flags |= nodePFail
+				cl.markFailingIfNeeded(n)
+			}
+		}
+		if now.Sub(cl.lastGossip) >= clusterGossipEvery {
+			cl.lastGossip = now
+			cl.pingRandomNode()
+		}
+		cl.updateState()
+		if cl.todoSave {
+			cl.save()
+		}
+		cl.mu.Unlock()
+	}
+}
+
+// pingRandomNode pings the node with the oldest pong among a few random ones,
+// so gossip spreads even when every node replies in time. Caller must hold
+// cl.mu.
+func (cl *Cluster) pingRandomNode() {
+	var oldest *clusterNode
+	tried := 0
+	// map iteration order is random
+	for _, n := range cl.nodes {
+		if tried == 5 {
+			break
+		}
+		if n == cl.myself || n.link == nil || !n.pingSent.IsZero() || n.flags&nodeHandshake != 0 {
+			continue
+		}
+		tried++
+		if oldest == nil || n.pongReceived.Before(oldest.pongReceived) {
+			oldest = n
+		}
+	}
+	if oldest != nil {
+		cl.sendPing(oldest, busPing)
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const clusterDisabledError = "ERR This instance has cluster support disabled"
+
+// clusterCommand implements the CLUSTER subcommands
+func (ch *CommandHandler) clusterCommand(c *Client, v Value) []byte {
+	var repl Value
+	cl := ch.cluster
+	if cl == nil {
+		return repl.Error(clusterDisabledError)
+	}
+	sub := strings.ToLower(v.array[1].bulk)
+	args := v.array[2:]
+	// arity including CLUSTER and the subcommand, -N means at least N
+	arity := map[string]int{
+		"myid": 2, "info": 2, "nodes": 2, "slots": 2, "shards": 2,
+		"keyslot": 3, "countkeysinslot": 3, "getkeysinslot": 4,
+		"addslots": -3, "delslots": -3, "setslot": -4, "meet": -4,
+	}
+	n, ok := arity[sub]
+	if !ok {
+		return repl.Error(fmt.Sprintf("ERR unknown subcommand '%s'. Try CLUSTER HELP.", v.array[1].bulk))
+	}
+	if !(commandSpec{arity: n}).arityOK(len(v.array)) {
+		return repl.Error(fmt.Sprintf("ERR wrong number of arguments for 'cluster|%s' command", sub))
+	}
+
+	switch sub {
+	case "keyslot":
+		repl = Value{vType: "num", num: keyHashSlot(args[0].bulk)}
+		return repl.Unmarshal()
+	case "countkeysinslot":
+		slot, err := strconv.Atoi(args[0].bulk)
+		if err != nil || slot < 0 || slot >= clusterSlots {
+			return repl.Error("ERR Invalid slot")
+		}
+		repl = Value{vType: "num", num: len(ch.keysInSlot(slot, -1))}
+		return repl.Unmarshal()
+	case "getkeysinslot":
+		slot, err1 := strconv.Atoi(args[0].bulk)
+		count, err2 := strconv.Atoi(args[1].bulk)
+		if err1 != nil || err2 != nil || slot < 0 || slot >= clusterSlots || count < 0 {
+			return repl.Error("ERR Invalid slot or number of keys")
+		}
+		repl = bulkArray(ch.keysInSlot(slot, count))
+		return repl.Unmarshal()
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	switch sub {
+	case "myid":
+		repl = Value{vType: "bulk", bulk: cl.myself.name}
+	case "info":
+		repl = Value{vType: "bulk", bulk: strings.Join(cl.infoLines(), "\r\n") + "\r\n"}
+	case "nodes":
+		var b strings.Builder
+		for _, name := range sortedKeys(cl.nodes) {
+			b.WriteString(cl.nodeLine(cl.nodes[name]))
+			b.WriteByte('\n')
+		}
+		repl = Value{vType: "bulk", bulk: b.String()}
+	case "slots":
+		repl = cl.slotsReply()
+	case "shards":
+		repl = cl.shardsReply(c.Protocol() == 3)
+	case "addslots", "delslots":
+		return ch.clusterAddSlots(args, sub == "addslots")
+	case "setslot":
+		return ch.clusterSetSlot(args)
+	case "meet":
+		return cl.meet(args)
+	}
+	return repl.Unmarshal()
+}
+
+// asking lets the next command of c run in a slot being imported here
+func (ch *CommandHandler) asking(c *Client) []byte {
+	var repl Value
+	if ch.cluster == nil {
+		return repl.Error(clusterDisabledError)
+	}
+	c.asking = true
+	return repl.OK()
+}
+
+// keysInSlot returns up to count keys of slot, all of them when count is
+// negative. The keyspace is scanned, keys are not indexed by slot.
+func (ch *CommandHandler) keysInSlot(slot, count int) []string {
+	keys := []string{}
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	ch.data[0].Range(func(key string, val StoredValue) bool {
+		if count >= 0 && len(keys) >= count {
+			return false
+		}
+		if !val.isExpired() && keyHashSlot(key) == slot {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	return keys
+}
+
+// parseSlot parses a slot given to ADDSLOTS, DELSLOTS or SETSLOT
+func parseSlot(arg string) (int, error) {
+	slot, err := strconv.Atoi(arg)
+	if err != nil || slot < 0 || slot >= clusterSlots {
+		return 0, fmt.Errorf("ERR Invalid or out of range slot")
+	}
+	return slot, nil
+}
+
+// clusterAddSlots assigns the slots to myself, or unassigns them. Caller must
+// hold ch.cluster.mu.
+func (ch *CommandHandler) clusterAddSlots(args []Value, add bool) []byte {
+	var repl Value
+	cl := ch.cluster
+	seen := make(map[int]bool)
+	for _, arg := range args {
+		slot, err := parseSlot(arg.bulk)
+		if err != nil {
+			return repl.Error(err.Error())
+		}
+		if seen[slot] {
+			return repl.Error(fmt.Sprintf("ERR Slot %d specified multiple times", slot))
+		}
+		seen[slot] = true
+		if add && cl.slots[slot] != nil {
+			return repl.Error(fmt.Sprintf("ERR Slot %d is already busy", slot))
+		}
+		if !add && cl.slots[slot] == nil {
+			return repl.Error(fmt.Sprintf("ERR Slot %d is already unassigned", slot))
+		}
+	}
+	for slot := range seen {
+		if add {
+			cl.slots[slot] = cl.myself
+			cl.importing[slot] = nil
+		} else {
+			cl.slots[slot], cl.migrating[slot], cl.importing[slot] = nil, nil, nil
+		}
+	}
+	cl.updateState()
+	cl.save()
+	return repl.OK()
+}
+
+// clusterSetSlot changes the state of a slot: IMPORTING from and MIGRATING
+// to another node during a migration, STABLE to cancel it, or NODE to
+// assign the slot when it ends. Caller must hold ch.cluster.mu.
+func (ch *CommandHandler) clusterSetSlot(args []Value) []byte {
+	var repl Value
+	cl := ch.cluster
+	slot, err := parseSlot(args[0].bulk)
+	if err != nil {
+		return repl.Error(err.Error())
+	}
+	action := strings.ToLower(args[1].bulk)
+	if (action == "stable") != (len(args) == 2) || len(args) > 3 {
+		return repl.Error("ERR Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP")
+	}
+	var n *clusterNode
+	if len(args) == 3 {
+		if n = cl.nodes[args[2].bulk]; n == nil || n.flags&nodeHandshake != 0 {
+			return repl.Error("ERR I don't know about node " + args[2].bulk)
+		}
+	}
+
+	switch action {
+	case "migrating":
+		if cl.slots[slot] != cl.myself {
+			return repl.Error(fmt.Sprintf("ERR I'm not the owner of hash slot %d", slot))
+		}
+		if n == cl.myself {
+			return repl.Error("ERR Target node is myself")
+		}
+		cl.migrating[slot] = n
+	case "importing":
+		if cl.slots[slot] == cl.myself {
+			return repl.Error(fmt.Sprintf("ERR I'm already the owner of hash slot %d", slot))
+		}
+		if n == cl.myself {
+			return repl.Error("ERR Source node is myself")
+		}
+		cl.importing[slot] = n
+	case "stable":
+		cl.migrating[slot], cl.importing[slot] = nil, nil
+	case "node":
+		if cl.slots[slot] == cl.myself && n != cl.myself && len(ch.keysInSlot(slot, 1)) > 0 {
+			return repl.Error(fmt.Sprintf("ERR Can't assign hashslot %d to a different node while I still hold keys for this hash slot.", slot))
+		}
+		// the migration ends, the new owner announces the slot with a new
+		// config epoch so the other nodes prefer it to the former owner
+		if n != cl.myself {
+			cl.migrating[slot] = nil
+		}
+		if n == cl.myself && cl.importing[slot] != nil {
+			cl.importing[slot] = nil
+			cl.bumpEpoch()
+		}
+		cl.slots[slot] = n
+	default:
+		return repl.Error("ERR Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP")
+	}
+	cl.updateState()
+	cl.save()
+	return repl.OK()
+}
+
+// meet starts the handshake with the node at ip port [bus port], the bus
+// port defaults to port + 10000. Caller must hold cl.mu.
+func (cl *Cluster) meet(args []Value) []byte {
+	var repl Value
+	if len(args) > 3 {
+		return repl.Error("ERR wrong number of arguments for 'cluster|meet' command")
+	}
+	port, err := strconv.Atoi(args[1].bulk)
+	if err != nil || port <= 0 || port > 65535 {
+		return repl.Error("ERR Invalid base port specified: " + args[1].bulk)
+	}
+	cport := port + 10000
+	if len(args) == 3 {
+		if cport, err = strconv.Atoi(args[2].bulk); err != nil || cport <= 0 || cport > 65535 {
+			return repl.Error("ERR Invalid bus port specified: " + args[2].bulk)
+		}
+	}
+	ip := net.ParseIP(args[0].bulk)
+	if ip == nil {
+		return repl.Error(fmt.Sprintf("ERR Invalid node address specified: %s:%s", args[0].bulk, args[1].bulk))
+	}
+	cl.startHandshake(ip.String(), strconv.Itoa(port), strconv.Itoa(cport), true)
+	return repl.OK()
+}
+
+// infoLines are the fields of CLUSTER INFO. Caller must hold cl.mu.
+func (cl *Cluster) infoLines() []string {
+	assigned, pfail, fail := 0, 0, 0
+	for _, n := range cl.slots {
+		switch {
+		case n == nil:
+			continue
+		case n.flags&nodeFail != 0:
+			fail++
+		case n.flags&nodePFail != 0:
+			pfail++
+		}
+		assigned++
+	}
+	lines := []string{
+		"cluster_state:" + cl.state,
+		fmt.Sprintf("cluster_slots_assigned:%d", assigned),
+		fmt.Sprintf("cluster_slots_ok:%d", assigned-pfail-fail),
+		fmt.Sprintf("cluster_slots_pfail:%d", pfail),
+		fmt.Sprintf("cluster_slots_fail:%d", fail),
+		fmt.Sprintf("cluster_known_nodes:%d", len(cl.nodes)),
+		fmt.Sprintf("cluster_size:%d", cl.size()),
+		fmt.Sprintf("cluster_current_epoch:%d", cl.currentEpoch),
+		fmt.Sprintf("cluster_my_epoch:%d", cl.myself.configEpoch),
+	}
+	types := []string{busPing, busPong, busMeet, busFail}
+	for _, stats := range []struct {
+		dir    string
+		counts map[string]int
+	}{{"sent", cl.sent}, {"received", cl.received}} {
+		total := 0
+		for _, typ := range types {
+			if n := stats.counts[typ]; n > 0 {
+				lines = append(lines, fmt.Sprintf("cluster_stats_messages_%s_%s:%d", typ, stats.dir, n))
+				total += n
+			}
+		}
+		lines = append(lines, fmt.Sprintf("cluster_stats_messages_%s:%d", stats.dir, total))
+	}
+	return lines
+}
+
+// slotsReply lists the ranges of slots with the node serving them. Caller
+// must hold cl.mu.
+func (cl *Cluster) slotsReply() Value {
+	repl := Value{vType: "array", array: []Value{}}
+	for s := 0; s < clusterSlots; s++ {
+		n := cl.slots[s]
+		if n == nil {
+			continue
+		}
+		start := s
+		for s+1 < clusterSlots && cl.slots[s+1] == n {
+			s++
+		}
+		port, _ := strconv.Atoi(n.port)
+		repl.array = append(repl.array, Value{vType: "array", array: []Value{
+			{vType: "num", num: start},
+			{vType: "num", num: s},
+			{vType: "array", array: []Value{
+				{vType: "bulk", bulk: n.ip},
+				{vType: "num", num: port},
+				{vType: "bulk", bulk: n.name},
+			}},
+		}})
+	}
+	return repl
+}
+
+// shardsReply describes every master with its slots, as maps for RESP3
+// clients. Caller must hold cl.mu.
+func (cl *Cluster) shardsReply(resp3 bool) Value {
+	mapType := "array"
+	if resp3 {
+		mapType = "map"
+	}
+	repl := Value{vType: "array", array: []Value{}}
+	for _, name := range sortedKeys(cl.nodes) {
+		n := cl.nodes[name]
+		if n.flags&nodeHandshake != 0 {
+			continue
+		}
+		slots := Value{vType: "array", array: []Value{}}
+		for _, r := range cl.slotRanges(n) {
+			slots.array = append(slots.array, Value{vType: "num", num: r[0]}, Value{vType: "num", num: r[1]})
+		}
+		port, _ := strconv.Atoi(n.port)
+		offset := n.replOffset
+		if n == cl.myself {
+			offset = cl.replOffset()
+		}
+		health := "online"
+		if n.flags&(nodePFail|nodeFail) != 0 {
+			health = "failed"
+		}
+		node := Value{vType: mapType, array: []Value{
+			{vType: "bulk", bulk: "id"}, {vType: "bulk", bulk: n.name},
+			{vType: "bulk", bulk: "port"}, {vType: "num", num: port},
+			{vType: "bulk", bulk: "ip"}, {vType: "bulk", bulk: n.ip},
+			{vType: "bulk", bulk: "endpoint"}, {vType: "bulk", bulk: n.ip},
+			{vType: "bulk", bulk: "role"}, {vType: "bulk", bulk: "master"},
+			{vType: "bulk", bulk: "replication-offset"}, {vType: "num", num: offset},
+			{vType: "bulk", bulk: "health"}, {vType: "bulk", bulk: health},
+		}}
+		repl.array = append(repl.array, Value{vType: mapType, array: []Value{
+			{vType: "bulk", bulk: "slots"}, slots,
+			{vType: "bulk", bulk: "nodes"}, {vType: "array", array: []Value{node}},
+		}})
+	}
+	return repl
+}
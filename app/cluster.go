@@ -0,0 +1,527 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ClusterConfig holds the options of cluster mode
+type ClusterConfig struct {
+	enabled     bool
+	configFile  string        // nodes.conf written by the node, in dir
+	nodeTimeout time.Duration // a node not replying for this long is failing
+	port        string        // port of the cluster bus
+}
+
+// node flags, named as in CLUSTER NODES
+const (
+	nodeMyself = 1 << iota
+	nodeMaster
+	nodePFail     // not replying for node timeout according to this node
+	nodeFail      // failing according to a majority of masters
+	nodeHandshake // address given by MEET or gossip, its ID is not known yet
+	nodeMeet      // sent MEET instead of PING until it replies
+)
+
+var nodeFlagNames = []struct {
+	flag int
+	name string
+}{
+	{nodeMyself, "myself"},
+	{nodeMaster, "master"},
+	{nodePFail, "fail?"},
+	{nodeFail, "fail"},
+	{nodeHandshake, "handshake"},
+}
+
+// clusterNode is a node of the cluster as known by this node
+type clusterNode struct {
+	name        string // 40 hex characters, random for nodes in handshake
+	flags       int
+	ip          string // empty for myself until another node tells it
+	port, cport string // ports of the clients and of the cluster bus
+	configEpoch int    // epoch of the last change of its slots
+
+	pingSent     time.Time // when the oldest unanswered ping was sent, zero if none
+	pongReceived time.Time
+	failTime     time.Time
+	// masters reporting the node failing in gossip, by name, with the time of
+	// the last report
+	failReports map[string]time.Time
+	createdAt   time.Time
+
+	link       *clusterLink // outbound link of the bus, nil while disconnected
+	connecting bool
+	replOffset int // replication offset announced by the node
+}
+
+// Cluster is the state of the cluster as known by this node: its nodes and
+// the owner of every hash slot. It is kept in nodes.conf.
+type Cluster struct {
+	conf *ClusterConfig
+	path string // of nodes.conf
+
+	mu           sync.Mutex // guards the state below and the nodes
+	myself       *clusterNode
+	nodes        map[string]*clusterNode // by name
+	currentEpoch int
+	slots        [clusterSlots]*clusterNode
+	migrating    [clusterSlots]*clusterNode // slots of myself being moved to another node
+	importing    [clusterSlots]*clusterNode // slots moved to myself from another node
+	state        string                     // ok or fail
+	sent         map[string]int             // bus messages by type
+	received     map[string]int
+	lastGossip   time.Time
+	todoSave     bool // nodes.conf is saved on the next cron
+
+	// replication offset of the node, set by the command handler
+	replOffset func() int
+}
+
+func newClusterNode(name string, flags int) *clusterNode {
+	return &clusterNode{name: name, flags: flags, failReports: make(map[string]time.Time), createdAt: time.Now()}
+}
+
+// newCluster loads nodes.conf from dir, a node without one starts as the
+// only master of a new cluster without slots
+func newCluster(conf *ClusterConfig, dir, host, port string) (*Cluster, error) {
+	cl := &Cluster{
+		conf:     conf,
+		path:     filepath.Join(dir, conf.configFile),
+		nodes:    make(map[string]*clusterNode),
+		state:    "fail",
+		sent:     make(map[string]int),
+		received: make(map[string]int),
+	}
+	err := cl.loadConfig()
+	if errors.Is(err, os.ErrNotExist) {
+		cl.myself = newClusterNode(randomHex(20), nodeMyself|nodeMaster)
+		if host != "0.0.0.0" {
+			cl.myself.ip = host
+		}
+		cl.nodes[cl.myself.name] = cl.myself
+		fmt.Println("No cluster configuration found, I'm", cl.myself.name)
+		err = nil
+	} else if err == nil {
+		fmt.Println("Node configuration loaded, I'm", cl.myself.name)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cl.myself.port, cl.myself.cport = port, conf.port
+	cl.updateState()
+	return cl, cl.saveConfig()
+}
+
+// loadConfig reads nodes.conf, in the format of CLUSTER NODES followed by a
+// line with the epoch
+func (cl *Cluster) loadConfig() error {
+	data, err := os.ReadFile(cl.path)
+	if err != nil {
+		return err
+	}
+	type slotState struct {
+		slot      int
+		node      string
+		importing bool
+	}
+	owners := make(map[*clusterNode][]string)
+	var open []slotState
+	for _, line := range strings.Split(string(data), "\n") {
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		if f[0] == "vars" {
+			for i := 1; i+1 < len(f); i += 2 {
+				if f[i] == "currentEpoch" {
+					cl.currentEpoch, _ = strconv.Atoi(f[i+1])
+				}
+			}
+			continue
+		}
+		if len(f) < 8 {
+			return fmt.Errorf("unrecoverable error: corrupted cluster config file %q", line)
+		}
+		n := newClusterNode(f[0], 0)
+		addr, _, _ := strings.Cut(f[1], ",")
+		hostPort, cport, _ := strings.Cut(addr, "@")
+		i := strings.LastIndexByte(hostPort, ':')
+		if i < 0 {
+			return fmt.Errorf("unrecoverable error: corrupted cluster config file %q", line)
+		}
+		n.ip, n.port, n.cport = hostPort[:i], hostPort[i+1:], cport
+		for _, name := range strings.Split(f[2], ",") {
+			for _, fl := range nodeFlagNames {
+				if fl.name == name {
+					n.flags |= fl.flag
+				}
+			}
+		}
+		if n.flags&nodeFail != 0 {
+			n.failTime = time.Now()
+		}
+		n.configEpoch, _ = strconv.Atoi(f[6])
+		if n.flags&nodeMyself != 0 {
+			cl.myself = n
+		}
+		cl.nodes[n.name] = n
+
+		for _, arg := range f[8:] {
+			// [slot->-node] and [slot-<-node] record an open migration of myself
+			if strings.HasPrefix(arg, "[") {
+				slot, rest, _ := strings.Cut(strings.Trim(arg, "[]"), "-")
+				s, err := strconv.Atoi(slot)
+				if err != nil || len(rest) < 2 {
+					return fmt.Errorf("unrecoverable error: corrupted cluster config file %q", line)
+				}
+				open = append(open, slotState{s, rest[2:], rest[0] == '<'})
+				continue
+			}
+			owners[n] = append(owners[n], arg)
+		}
+	}
+	if cl.myself == nil {
+		return errors.New("unrecoverable error: myself not found in the cluster config file")
+	}
+	for n, ranges := range owners {
+		slots, err := parseSlotRanges(strings.Join(ranges, ","))
+		if err != nil {
+			return fmt.Errorf("unrecoverable error: corrupted cluster config file: %w", err)
+		}
+		for _, s := range slots {
+			cl.slots[s] = n
+		}
+	}
+	for _, o := range open {
+		n, ok := cl.nodes[o.node]
+		if !ok || o.slot < 0 || o.slot >= clusterSlots {
+			return fmt.Errorf("unrecoverable error: corrupted cluster config file, open slot %d", o.slot)
+		}
+		if o.importing {
+			cl.importing[o.slot] = n
+		} else {
+			cl.migrating[o.slot] = n
+		}
+	}
+	return nil
+}
+
+// saveConfig replaces nodes.conf, a crash leaves either the old or the new
+// one in place. Caller must hold cl.mu or own cl alone.
+func (cl *Cluster) saveConfig() error {
+	var b strings.Builder
+	for _, name := range sortedKeys(cl.nodes) {
+		if n := cl.nodes[name]; n.flags&nodeHandshake == 0 {
+			b.WriteString(cl.nodeLine(n))
+			b.WriteByte('\n')
+		}
+	}
+	fmt.Fprintf(&b, "vars currentEpoch %d lastVoteEpoch 0\n", cl.currentEpoch)
+
+	tmpPath := cl.path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if _, err = f.WriteString(b.String()); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, cl.path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return syncDir(filepath.Dir(cl.path))
+}
+
+// save writes nodes.conf right away, the node can't go on with a cluster
+// configuration it failed to record. Caller must hold cl.mu.
+func (cl *Cluster) save() {
+	if err := cl.saveConfig(); err != nil {
+		fmt.Println("Fatal: can't update cluster config file:", err)
+		os.Exit(1)
+	}
+	cl.todoSave = false
+}
+
+// nodeLine describes n as a line of CLUSTER NODES. Caller must hold cl.mu.
+func (cl *Cluster) nodeLine(n *clusterNode) string {
+	var flags []string
+	for _, fl := range nodeFlagNames {
+		if n.flags&fl.flag != 0 {
+			flags = append(flags, fl.name)
+		}
+	}
+	linkState := "disconnected"
+	if n == cl.myself || n.link != nil {
+		linkState = "connected"
+	}
+	fields := []string{
+		n.name,
+		fmt.Sprintf("%s:%s@%s", n.ip, n.port, n.cport),
+		strings.Join(flags, ","),
+		"-",
+		strconv.FormatInt(unixMilli(n.pingSent), 10),
+		strconv.FormatInt(unixMilli(n.pongReceived), 10),
+		strconv.Itoa(n.configEpoch),
+		linkState,
+	}
+	for _, r := range cl.slotRanges(n) {
+		if r[0] == r[1] {
+			fields = append(fields, strconv.Itoa(r[0]))
+		} else {
+			fields = append(fields, fmt.Sprintf("%d-%d", r[0], r[1]))
+		}
+	}
+	if n == cl.myself {
+		for s := range clusterSlots {
+			if m := cl.migrating[s]; m != nil {
+				fields = append(fields, fmt.Sprintf("[%d->-%s]", s, m.name))
+			}
+			if i := cl.importing[s]; i != nil {
+				fields = append(fields, fmt.Sprintf("[%d-<-%s]", s, i.name))
+			}
+		}
+	}
+	return strings.Join(fields, " ")
+}
+
+// unixMilli is t in milliseconds, 0 for the zero time
+func unixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+// slotRanges returns the ranges of consecutive slots served by n. Caller
+// must hold cl.mu.
+func (cl *Cluster) slotRanges(n *clusterNode) [][2]int {
+	var ranges [][2]int
+	for s := 0; s < clusterSlots; s++ {
+		if cl.slots[s] != n {
+			continue
+		}
+		start := s
+		for s+1 < clusterSlots && cl.slots[s+1] == n {
+			s++
+		}
+		ranges = append(ranges, [2]int{start, s})
+	}
+	return ranges
+}
+
+// formatSlotRanges encodes the slots of n as comma separated ranges, the
+// format of parseSlotRanges. Caller must hold cl.mu.
+func (cl *Cluster) formatSlotRanges(n *clusterNode) string {
+	var parts []string
+	for _, r := range cl.slotRanges(n) {
+		parts = append(parts, fmt.Sprintf("%d-%d", r[0], r[1]))
+	}
+	return strings.Join(parts, ",")
+}
+
+// parseSlotRanges decodes slots given as comma separated numbers and ranges
+func parseSlotRanges(s string) ([]int, error) {
+	var slots []int
+	for _, part := range strings.Split(s, ",") {
+		if part == "" {
+			continue
+		}
+		first, last, isRange := strings.Cut(part, "-")
+		start, err := strconv.Atoi(first)
+		end := start
+		if err == nil && isRange {
+			end, err = strconv.Atoi(last)
+		}
+		if err != nil || start < 0 || end >= clusterSlots || start > end {
+			return nil, fmt.Errorf("invalid slot range %q", part)
+		}
+		for slot := start; slot <= end; slot++ {
+			slots = append(slots, slot)
+		}
+	}
+	return slots, nil
+}
+
+// ownsSlots reports whether n serves at least one slot. Caller must hold cl.mu.
+func (cl *Cluster) ownsSlots(n *clusterNode) bool {
+	for _, owner := range cl.slots {
+		if owner == n {
+			return true
+		}
+	}
+	return false
+}
+
+// size is the number of masters serving slots, a majority of them is needed
+// to mark a node as failing. Caller must hold cl.mu.
+func (cl *Cluster) size() int {
+	masters := make(map[*clusterNode]bool)
+	for _, n := range cl.slots {
+		if n != nil {
+			masters[n] = true
+		}
+	}
+	return len(masters)
+}
+
+// deleteNode forgets n and the slots it serves. Caller must hold cl.mu.
+func (cl *Cluster) deleteNode(n *clusterNode) {
+	for s := range clusterSlots {
+		if cl.slots[s] == n {
+			cl.slots[s] = nil
+		}
+		if cl.migrating[s] == n {
+			cl.migrating[s] = nil
+		}
+		if cl.importing[s] == n {
+			cl.importing[s] = nil
+		}
+	}
+	for _, other := range cl.nodes {
+		delete(other.failReports, n.name)
+	}
+	if n.link != nil {
+		n.link.conn.Close()
+		n.link = nil
+	}
+	delete(cl.nodes, n.name)
+}
+
+// startHandshake adds the node at ip:port to the cluster unless it is known
+// or met already. Caller must hold cl.mu.
+func (cl *Cluster) startHandshake(ip, port, cport string, meet bool) {
+	for _, n := range cl.nodes {
+		if n.ip == ip && n.port == port && n.cport == cport && (n.flags&nodeHandshake != 0 || !meet) {
+			return
+		}
+	}
+	flags := nodeHandshake | nodeMaster
+	if meet {
+		flags |= nodeMeet
+	}
+	n := newClusterNode(randomHex(20), flags)
+	n.ip, n.port, n.cport = ip, port, cport
+	cl.nodes[n.name] = n
+}
+
+// bumpEpoch gives myself a new config epoch without agreement of the other
+// nodes, when it takes over a slot whose migration ended. Caller must hold
+// cl.mu.
+func (cl *Cluster) bumpEpoch() {
+	maxEpoch := 0
+	for _, n := range cl.nodes {
+		maxEpoch = max(maxEpoch, n.configEpoch)
+	}
+	if cl.myself.configEpoch == 0 || cl.myself.configEpoch != maxEpoch {
+		cl.currentEpoch++
+		cl.myself.configEpoch = cl.currentEpoch
+		fmt.Println("configEpoch updated after importing slot to", cl.myself.configEpoch)
+	}
+}
+
+// updateState computes whether the cluster is ok: every slot is served by a
+// node that is not failing and this node reaches a majority of the masters.
+// Caller must hold cl.mu.
+func (cl *Cluster) updateState() {
+	state := "ok"
+	masters := make(map[*clusterNode]bool)
+	for _, n := range cl.slots {
+		if n == nil || n.flags&nodeFail != 0 {
+			state = "fail"
+			break
+		}
+		masters[n] = true
+	}
+	unreachable := 0
+	for n := range masters {
+		if n.flags&(nodePFail|nodeFail) != 0 {
+			unreachable++
+		}
+	}
+	if len(masters)-unreachable < len(masters)/2+1 {
+		state = "fail"
+	}
+	if state != cl.state {
+		fmt.Println("Cluster state changed:", state)
+		cl.state = state
+	}
+}
+
+// clusterRedirect returns the error sending command v to the node serving
+// its keys, nil when it runs here. All the keys must be in the same slot.
+// A slot being migrated is served here for the keys still here, the others
+// are asked to the target where only clients that sent ASKING are served.
+func (ch *CommandHandler) clusterRedirect(c *Client, v Value) []byte {
+	var repl Value
+	cl := ch.cluster
+	keys := commandKeys(v)
+	if cl == nil || c.master || len(keys) == 0 {
+		return nil
+	}
+	slot := keyHashSlot(keys[0])
+	for _, key := range keys[1:] {
+		if keyHashSlot(key) != slot {
+			return repl.Error("CROSSSLOT Keys in request don't hash to the same slot")
+		}
+	}
+
+	cl.mu.Lock()
+	n, migrating, importing := cl.slots[slot], cl.migrating[slot], cl.importing[slot]
+	myself, state := n == cl.myself, cl.state
+	// clients are moved to the owner, or asked to the target of a migration
+	target, addr := n, ""
+	if myself {
+		target = migrating
+	}
+	if target != nil {
+		addr = fmt.Sprintf("%d %s:%s", slot, target.ip, target.port)
+	}
+	cl.mu.Unlock()
+
+	if state != "ok" {
+		return repl.Error("CLUSTERDOWN The cluster is down")
+	}
+	if n == nil {
+		return repl.Error("CLUSTERDOWN Hash slot not served")
+	}
+	if myself && migrating == nil {
+		return nil
+	}
+	asking := c.asking || commandTable[commandName(v)].flags&cmdAsking != 0
+	if !myself && (importing == nil || !asking) {
+		return repl.Error("MOVED " + addr)
+	}
+
+	missing := 0
+	ch.mu.RLock()
+	for _, key := range keys {
+		if _, ok := ch.lookupKey(c.db, key); !ok {
+			missing++
+		}
+	}
+	ch.mu.RUnlock()
+	if myself {
+		if missing > 0 {
+			return repl.Error("ASK " + addr)
+		}
+		return nil
+	}
+	if len(keys) > 1 && missing > 0 {
+		return repl.Error("TRYAGAIN Multiple keys request during rehashing of slot")
+	}
+	return nil
+}
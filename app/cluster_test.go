@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestClusterRedirect(t *testing.T) {
+	repl := &ReplicationConfig{}
+	repl.replication.role = "master"
+	rdb := &RDBconfig{dir: t.TempDir()}
+	conf := &ClusterConfig{enabled: true, configFile: "nodes.conf", port: "17000"}
+	ch, err := NewCommandHandler(&ServerConfig{databases: 1}, rdb, &AOFconfig{}, repl, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(ch.stopCron)
+	cl := ch.cluster
+	other := newClusterNode("0123456789012345678901234567890123456789", nodeMaster)
+	other.ip, other.port = "127.0.0.1", "7001"
+	cl.nodes[other.name] = other
+	for slot := range cl.slots {
+		cl.slots[slot] = cl.myself
+	}
+	// "moved" is served by the other node, "migrating" is being moved to it
+	// and "importing" from it
+	cl.slots[keyHashSlot("moved")] = other
+	cl.migrating[keyHashSlot("migrating")] = other
+	cl.slots[keyHashSlot("importing")] = other
+	cl.importing[keyHashSlot("importing")] = other
+	cl.updateState()
+	ch.data[0].Set("{migrating}here", StoredValue{vType: "string", val: "v"})
+	ch.data[0].Set("{importing}here", StoredValue{vType: "string", val: "v"})
+
+	tests := []struct {
+		name   string
+		args   []string
+		asking bool
+		master bool
+		want   string // prefix of the error, empty when the command runs here
+	}{
+		{"no keys", []string{"PING"}, false, false, ""},
+		{"served here", []string{"GET", "foo"}, false, false, ""},
+		{"same slot", []string{"DEL", "{user}a", "{user}b"}, false, false, ""},
+		{"cross slot", []string{"DEL", "foo", "bar"}, false, false, "-CROSSSLOT"},
+		{"cross slot migrate", []string{"MIGRATE", "127.0.0.1", "7001", "", "0", "1000", "KEYS", "foo", "bar"}, false, false, "-CROSSSLOT"},
+		{"moved", []string{"GET", "moved"}, false, false, "-MOVED 1999 127.0.0.1:7001"},
+		{"from the master", []string{"GET", "moved"}, false, true, ""},
+		{"migrating key still here", []string{"GET", "{migrating}here"}, false, false, ""},
+		{"migrating key gone", []string{"GET", "{migrating}gone"}, false, false, "-ASK 7346 127.0.0.1:7001"},
+		{"migrating keys partly gone", []string{"DEL", "{migrating}here", "{migrating}gone"}, false, false, "-ASK"},
+		{"importing without asking", []string{"GET", "{importing}here"}, false, false, "-MOVED"},
+		{"importing after asking", []string{"GET", "{importing}here"}, true, false, ""},
+		{"importing restore", []string{"RESTORE-ASKING", "importing", "0", "payload"}, false, false, ""},
+		{"importing keys partly missing", []string{"DEL", "{importing}here", "{importing}gone"}, true, false, "-TRYAGAIN"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewClient(bufio.NewReader(strings.NewReader("")), bufio.NewWriter(io.Discard))
+			c.asking, c.master = tt.asking, tt.master
+			got := string(ch.clusterRedirect(c, bulkArray(tt.args)))
+			if tt.want == "" && got != "" || !strings.HasPrefix(got, tt.want) {
+				t.Errorf("clusterRedirect(%q) = %q, want %q", tt.args, got, tt.want)
+			}
+		})
+	}
+
+	cl.slots[keyHashSlot("moved")] = nil
+	cl.updateState()
+	c := NewClient(bufio.NewReader(strings.NewReader("")), bufio.NewWriter(io.Discard))
+	if got := string(ch.clusterRedirect(c, bulkArray([]string{"GET", "foo"}))); !strings.HasPrefix(got, "-CLUSTERDOWN") {
+		t.Errorf("with a slot not served clusterRedirect = %q, want CLUSTERDOWN", got)
+	}
+}
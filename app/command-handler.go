@@ -1,77 +1,360 @@
 package main
 
 import (
-	"encoding/hex"
+	"errors"
 	"fmt"
+	"math"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const (
-	emptyRDBhash = "524544495330303131fa0972656469732d76657205372e322e30fa0a72656469732d62697473c040fa056374696d65c26d08bc65fa08757365642d6d656dc2b0c41000fa08616f662d62617365c000fff06e3bfec0ff5aa2"
-)
+var errWrongType = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
 
 type CommandHandler struct {
-	data     map[string]StoredValue
-	rdbconn  *RDBconn
-	replConf *ReplicationConfig
-	mu       sync.RWMutex
+	data      []*dict[StoredValue] // keyspace of every database
+	rdbconn   *RDBconn
+	replConf  *ReplicationConfig
+	mu        sync.RWMutex
+	clients   map[int64]*Client
+	clientsMu sync.RWMutex
+	pubsub    *PubSub
+	tracking  *Tracking
+
+	dirty       atomic.Int64 // changes since the last successful save
+	snapshotGen uint64       // incremented by every snapshot, guarded by mu
+	snapshots   int          // snapshots in progress, guarded by mu
+	bgsave      bgsaveState
+	// where activeExpireCycle stopped in every database, guarded by writeMu
+	expireCursors []uint64
+
+	aofConf *AOFconfig
+	aof     *AOF       // nil when AOF is disabled
+	writeMu sync.Mutex // serializes write commands logged to the AOF and propagated to replicas
+
+	replMu   sync.Mutex         // guards replicas, replDB and the replication offset
+	replicas map[int64]*replica // by client id
+	replDB   int                // database selected in the replication stream, -1 forces SELECT
+	// replicas waiting for the next diskless transfer, guarded by replMu
+	disklessBatch []*replica
+	backlog       *replBacklog  // nil until the first replica connects, guarded by replMu
+	acked         chan struct{} // closed and replaced on every REPLCONF ACK, guarded by replMu
+	noReplicasAt  time.Time     // when the last replica disconnected, guarded by replMu
+	pingedAt      time.Time     // when the replicas were last pinged, guarded by replMu
+	// connects to the master given to REPLICAOF, an empty host promotes the
+	// server to a master. Set by Redis.
+	setMaster func(host, port string)
+
+	stats    *serverStats
+	cronDone chan struct{} // closed by stopCron
+
+	cluster *Cluster // nil unless cluster mode is enabled
 }
 
-func NewCommandHandler(rdb *RDBconfig, repl *ReplicationConfig) *CommandHandler {
-	rdbConn := NewRDBconn(rdb.dir, rdb.dbfilename)
+// NewCommandHandler loads the dataset into memory, from the AOF when it is
+// enabled and from the dump file otherwise. A missing file starts with empty
+// databases while a corrupted one is an error.
+func NewCommandHandler(conf *ServerConfig, rdb *RDBconfig, aof *AOFconfig, repl *ReplicationConfig, cluster *ClusterConfig) (*CommandHandler, error) {
+	rdbConn := NewRDBconn(rdb)
+
+	data := make([]*dict[StoredValue], conf.databases)
+	for i := range data {
+		data[i] = newDict[StoredValue]()
+	}
+	ch := &CommandHandler{
+		data:          data,
+		expireCursors: make([]uint64, conf.databases),
+		rdbconn:       rdbConn,
+		aofConf:       aof,
+		replConf:      repl,
+		clients:       make(map[int64]*Client),
+		pubsub:        NewPubSub(),
+		tracking:      NewTracking(),
+		replicas:      make(map[int64]*replica),
+		replDB:        -1,
+		acked:         make(chan struct{}),
+		stats:         newServerStats(),
+		cronDone:      make(chan struct{}),
+	}
 
-	data := make(map[string]StoredValue)
-	if rdbConn != nil {
-		data, _ = rdbConn.LoadFromRDStoMemory()
+	if aof.enabled {
+		var err error
+		if ch.aof, err = openAOF(rdb.dir, aof); err != nil {
+			return nil, fmt.Errorf("error opening append only file: %w", err)
+		}
+		if err := ch.loadAOFFiles(ch.aof, aof.loadTruncated); err != nil {
+			return nil, fmt.Errorf("error loading append only file: %w", err)
+		}
+		if err := ch.aof.openIncrFile(); err != nil {
+			return nil, fmt.Errorf("error opening append only file: %w", err)
+		}
+	} else if rdb.load {
+		dbs, aux, err := rdbConn.LoadFromRDStoMemory()
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("error loading rdb file: %w", err)
+		}
+		ch.setKeys(dbs)
+		ch.restoreReplInfo(aux)
 	}
-	return &CommandHandler{
-		data:     data,
-		rdbconn:  rdbConn,
-		replConf: repl,
+	if cluster.enabled {
+		var err error
+		if ch.cluster, err = newCluster(cluster, rdb.dir, repl.host, repl.port); err != nil {
+			return nil, fmt.Errorf("error loading cluster config file: %w", err)
+		}
+		ch.cluster.replOffset = ch.replOffset
 	}
+	ch.bgsave.lastSave = time.Now()
+	go ch.cron()
+	return ch, nil
 }
 
-func (ch *CommandHandler) HandleCommand(v Value) []byte {
+// setKeys stores keys loaded from a dump into the databases
+func (ch *CommandHandler) setKeys(dbs map[int]map[string]StoredValue) {
+	for db, keys := range dbs {
+		if db >= len(ch.data) {
+			fmt.Printf("rdb file contains database %d, only %d databases configured\n", db, len(ch.data))
+			continue
+		}
+		for key, val := range keys {
+			ch.data[db].Set(key, val)
+		}
+	}
+}
+
+// cron runs periodic background tasks
+func (ch *CommandHandler) cron() {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ch.cronDone:
+			return
+		}
+		ch.checkSavePoints()
+		if ch.aof != nil {
+			if ch.aof.cron() {
+				ch.replMu.Lock()
+				ch.notifyAcked()
+				ch.replMu.Unlock()
+			}
+			ch.checkAOFRewrite()
+		}
+		ch.activeExpireCycle()
+		ch.replicationCron()
+		ch.stats.cron()
+	}
+}
+
+// stopCron ends the background tasks of a handler that is not used anymore
+func (ch *CommandHandler) stopCron() {
+	close(ch.cronDone)
+}
+
+func (ch *CommandHandler) addClient(c *Client) {
+	ch.clientsMu.Lock()
+	defer ch.clientsMu.Unlock()
+	ch.clients[c.id] = c
+}
+
+func (ch *CommandHandler) removeClient(c *Client) {
+	ch.clientsMu.Lock()
+	delete(ch.clients, c.id)
+	ch.clientsMu.Unlock()
+
+	ch.pubsub.RemoveClient(c)
+	ch.tracking.Disable(c.id)
+	ch.removeReplica(c)
+	c.stopPush()
+}
+
+func (ch *CommandHandler) getClient(id int64) *Client {
+	ch.clientsMu.RLock()
+	defer ch.clientsMu.RUnlock()
+	return ch.clients[id]
+}
+
+func (ch *CommandHandler) HandleCommand(c *Client, v Value) []byte {
 	var repl Value
 	if v.vType == "array" {
 		command := strings.ToLower(v.array[0].bulk)
-		fmt.Printf("HANDLE COMMAND %s by %s\n", command, ch.replConf.replication.role)
+		if ch.pubsub.inSubscribedContext(c, command) {
+			return repl.Error(fmt.Sprintf("ERR Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context", command))
+		}
+		if command != "client" || len(v.array) < 2 || strings.ToLower(v.array[1].bulk) != "caching" {
+			defer ch.tracking.ResetCaching(c.id)
+		}
 		switch command {
 		case "ping":
-			return ch.ping(v)
+			return ch.ping(c, v)
 		case "echo":
 			return ch.echo(v)
 		case "set":
-			return ch.set(v)
+			return ch.set(c, v)
 		case "get":
-			return ch.get(v)
+			return ch.get(c, v)
+		case "incr":
+			return ch.incrBy(c, v.array[1].bulk, 1)
+		case "decr":
+			return ch.incrBy(c, v.array[1].bulk, -1)
+		case "incrby":
+			return ch.incrByCmd(c, v, false)
+		case "decrby":
+			return ch.incrByCmd(c, v, true)
 		case "config":
 			return ch.config(v)
 		case "keys":
-			return ch.keys(v)
+			return ch.keys(c, v)
 		case "info":
 			return ch.info(v)
+		case "role":
+			return ch.role()
 		case "replconf":
-			return ch.replconf(v)
+			return ch.replconf(c, v)
 		case "psync":
-			return ch.psync(v)
+			return ch.psync(c, v)
+		case "replicaof", "slaveof":
+			return ch.replicaof(v)
 		case "wait":
-			return ch.wait(v)
+			return ch.wait(c, v)
+		case "waitaof":
+			return ch.waitaof(c, v)
+		case "hello":
+			return ch.hello(c, v)
+		case "client":
+			return ch.client(c, v)
+		case "subscribe":
+			return ch.pubsub.subscribe(c, v)
+		case "unsubscribe":
+			return ch.pubsub.unsubscribe(c, v)
+		case "psubscribe":
+			return ch.pubsub.psubscribe(c, v)
+		case "punsubscribe":
+			return ch.pubsub.punsubscribe(c, v)
+		case "publish":
+			return ch.publish(v)
+		case "select":
+			return ch.selectDB(c, v)
+		case "move":
+			return ch.move(c, v)
+		case "swapdb":
+			return ch.swapdb(v)
+		case "flushdb":
+			return ch.flushdb(c, v)
+		case "flushall":
+			return ch.flushall(c, v)
+		case "dbsize":
+			return ch.dbsize(c)
+		case "save":
+			return ch.save(v)
+		case "bgsave":
+			return ch.bgsaveCmd(v)
+		case "lastsave":
+			return ch.lastsave()
+		case "del":
+			return ch.del(c, v)
+		case "type":
+			return ch.typeCmd(c, v)
+		case "expire":
+			return ch.expire(c, v, time.Second, true)
+		case "pexpire":
+			return ch.expire(c, v, time.Millisecond, true)
+		case "expireat":
+			return ch.expire(c, v, time.Second, false)
+		case "pexpireat":
+			return ch.expire(c, v, time.Millisecond, false)
+		case "dump":
+			return ch.dump(c, v)
+		case "restore", "restore-asking":
+			return ch.restore(c, v)
+		case "migrate":
+			return ch.migrate(c, v)
+		case "bgrewriteaof":
+			return ch.bgrewriteaof(v)
+		case "scan":
+			return ch.scan(c, v)
+		case "lpush":
+			return ch.push(c, v, true)
+		case "rpush":
+			return ch.push(c, v, false)
+		case "lpop":
+			return ch.pop(c, v, true)
+		case "rpop":
+			return ch.pop(c, v, false)
+		case "llen":
+			return ch.llen(c, v)
+		case "lrange":
+			return ch.lrange(c, v)
+		case "hset":
+			return ch.hset(c, v)
+		case "hget":
+			return ch.hget(c, v)
+		case "hdel":
+			return ch.hdel(c, v)
+		case "hlen":
+			return ch.hlen(c, v)
+		case "hgetall":
+			return ch.hgetall(c, v)
+		case "hscan":
+			return ch.hscan(c, v)
+		case "sadd":
+			return ch.sadd(c, v)
+		case "srem":
+			return ch.srem(c, v)
+		case "spop":
+			return ch.spop(c, v)
+		case "sismember":
+			return ch.sismember(c, v)
+		case "scard":
+			return ch.scard(c, v)
+		case "smembers":
+			return ch.smembers(c, v)
+		case "sscan":
+			return ch.sscan(c, v)
+		case "zadd":
+			return ch.zadd(c, v)
+		case "zrem":
+			return ch.zrem(c, v)
+		case "zscore":
+			return ch.zscore(c, v)
+		case "zcard":
+			return ch.zcard(c, v)
+		case "zrange":
+			return ch.zrange(c, v)
+		case "zscan":
+			return ch.zscan(c, v)
+		case "xadd":
+			return ch.xadd(c, v)
+		case "xlen":
+			return ch.xlen(c, v)
+		case "xrange":
+			return ch.xrange(c, v)
+		case "cluster":
+			return ch.clusterCommand(c, v)
+		case "asking":
+			return ch.asking(c)
 		}
 	} else {
 		return []byte("$5\r\nERROR\r\n")
 	}
-	return repl.OK()
+	return unknownCommandError(v)
 }
 
 type setOptions struct {
-	PX int
+	expires time.Time // zero when the key has no TTL
+	nx      bool      // only set a missing key
+	xx      bool      // only set an existing key
+	keepTTL bool      // keep the TTL of the existing key
+	get     bool      // reply with the old value
 }
 
-func (ch *CommandHandler) ping(_ Value) []byte {
+func (ch *CommandHandler) ping(c *Client, _ Value) []byte {
+	if ch.pubsub.SubscriptionsCount(c) > 0 && c.Protocol() == 2 {
+		return pubsubMessage(c, "pong", Value{vType: "bulk", bulk: ""})
+	}
 	repl := Value{
 		vType: "str",
 		str:   "PONG",
@@ -87,28 +370,134 @@ func (ch *CommandHandler) echo(v Value) []byte {
 	return repl.Unmarshal()
 }
 
-func (ch *CommandHandler) set(v Value) []byte {
+func (ch *CommandHandler) set(c *Client, v Value) []byte {
 	var repl Value
 	key := v.array[1].bulk
 	value := v.array[2].bulk
-	var opts setOptions
-	if len(v.array) > 3 {
-		opts = ch.parseSetOpts(v.array[2:])
+	opts, err := ch.parseSetOpts(v.array[3:])
+	if err != nil {
+		return repl.Error(err.Error())
+	}
+	old, existed, written, err := ch.setValue(c.db, key, value, opts)
+	if err != nil {
+		return repl.Error(err.Error())
+	}
+	if written {
+		ch.signalModifiedKey(c, key)
+		// a relative TTL would expire later on replicas and AOF reloads
+		if !opts.expires.IsZero() {
+			c.rewriteCommand(bulkArray([]string{"SET", key, value, "PXAT", strconv.FormatInt(opts.expires.UnixMilli(), 10)}))
+		}
+	} else {
+		c.rewriteCommand()
+	}
+
+	switch {
+	case opts.get && existed:
+		repl.vType = "bulk"
+		repl.bulk = old.val
+		return repl.Unmarshal()
+	case opts.get || !written:
+		repl.vType = "null"
+		return repl.Unmarshal()
 	}
-	ch.setValue(key, value, opts)
 	return repl.OK()
 }
 
-func (ch *CommandHandler) get(v Value) []byte {
+func (ch *CommandHandler) get(c *Client, v Value) []byte {
 	key := v.array[1].bulk
-	val := ch.getValue(key)
+	val, ok := ch.getValue(c.db, key)
+	ch.tracking.Read(c.id, key)
 	var repl Value
-	repl.vType = "bulk"
-	if val == "" {
-		repl.bulk = ""
+	if ok && val.vType != "string" {
+		return repl.Error(errWrongType.Error())
+	}
+	if !ok {
+		repl.vType = "null"
 		return repl.Unmarshal()
 	}
-	repl.bulk = val
+	repl.vType = "bulk"
+	repl.bulk = val.val
+	return repl.Unmarshal()
+}
+
+func (ch *CommandHandler) incrBy(c *Client, key string, delta int64) []byte {
+	var repl Value
+	ch.mu.Lock()
+	val, ok, err := ch.lookupTyped(c.db, key, "string")
+	if err != nil {
+		ch.mu.Unlock()
+		return repl.Error(err.Error())
+	}
+	n := int64(0)
+	if ok {
+		if n, err = strconv.ParseInt(val.val, 10, 64); err != nil {
+			ch.mu.Unlock()
+			return repl.Error("ERR value is not an integer or out of range")
+		}
+	}
+	if delta > 0 && n > math.MaxInt64-delta || delta < 0 && n < math.MinInt64-delta {
+		ch.mu.Unlock()
+		return repl.Error("ERR increment or decrement would overflow")
+	}
+	n += delta
+	// the TTL of an existing key is kept
+	val.vType = "string"
+	val.val = strconv.FormatInt(n, 10)
+	ch.data[c.db].Set(key, val)
+	ch.mu.Unlock()
+
+	ch.signalModifiedKey(c, key)
+	repl.vType = "num"
+	repl.num = int(n)
+	return repl.Unmarshal()
+}
+
+func (ch *CommandHandler) incrByCmd(c *Client, v Value, decr bool) []byte {
+	var repl Value
+	delta, err := strconv.ParseInt(v.array[2].bulk, 10, 64)
+	if err != nil {
+		return repl.Error("ERR value is not an integer or out of range")
+	}
+	if decr {
+		if delta == math.MinInt64 {
+			return repl.Error("ERR decrement would overflow")
+		}
+		delta = -delta
+	}
+	return ch.incrBy(c, v.array[1].bulk, delta)
+}
+
+func (ch *CommandHandler) del(c *Client, v Value) []byte {
+	if len(v.array) < 2 {
+		return wrongArgsError("del")
+	}
+	var deleted []string
+	ch.mu.Lock()
+	for _, arg := range v.array[1:] {
+		if _, ok := ch.lookupKey(c.db, arg.bulk); ok {
+			deleted = append(deleted, arg.bulk)
+		}
+		ch.data[c.db].Delete(arg.bulk)
+	}
+	ch.mu.Unlock()
+
+	for _, key := range deleted {
+		ch.signalModifiedKey(c, key)
+	}
+	repl := Value{vType: "num", num: len(deleted)}
+	return repl.Unmarshal()
+}
+
+func (ch *CommandHandler) typeCmd(c *Client, v Value) []byte {
+	if len(v.array) != 2 {
+		return wrongArgsError("type")
+	}
+	repl := Value{vType: "str", str: "none"}
+	if val, ok := ch.getValue(c.db, v.array[1].bulk); ok {
+		repl.str = val.vType
+	}
+	ch.tracking.Read(c.id, v.array[1].bulk)
 	return repl.Unmarshal()
 }
 
@@ -125,127 +514,506 @@ func (ch *CommandHandler) config(v Value) []byte {
 		if key == "dbfilename" {
 			repl.array = append(repl.array, Value{vType: "bulk", bulk: ch.rdbconn.dbfilename})
 		}
+		if key == "databases" {
+			repl.array = append(repl.array, Value{vType: "bulk", bulk: strconv.Itoa(len(ch.data))})
+		}
+		if key == "save" {
+			repl.array = append(repl.array, Value{vType: "bulk", bulk: formatSaveParams(ch.rdbconn.save)})
+		}
+		if key == "appendonly" {
+			appendonly := "no"
+			if ch.aofConf.enabled {
+				appendonly = "yes"
+			}
+			repl.array = append(repl.array, Value{vType: "bulk", bulk: appendonly})
+		}
+		if key == "appendfilename" {
+			repl.array = append(repl.array, Value{vType: "bulk", bulk: ch.aofConf.filename})
+		}
+		if key == "appenddirname" {
+			repl.array = append(repl.array, Value{vType: "bulk", bulk: ch.aofConf.dirname})
+		}
+		if key == "appendfsync" {
+			repl.array = append(repl.array, Value{vType: "bulk", bulk: ch.aofConf.fsync})
+		}
+		if key == "repl-diskless-sync" {
+			disklessSync := "no"
+			if ch.replConf.disklessSync {
+				disklessSync = "yes"
+			}
+			repl.array = append(repl.array, Value{vType: "bulk", bulk: disklessSync})
+		}
+		if key == "repl-diskless-sync-delay" {
+			delay := strconv.Itoa(int(ch.replConf.disklessSyncDelay / time.Second))
+			repl.array = append(repl.array, Value{vType: "bulk", bulk: delay})
+		}
+		if key == "repl-diskless-load" {
+			repl.array = append(repl.array, Value{vType: "bulk", bulk: ch.replConf.disklessLoad})
+		}
+		if key == "repl-backlog-size" {
+			repl.array = append(repl.array, Value{vType: "bulk", bulk: strconv.Itoa(ch.replConf.backlogSize)})
+		}
+		if key == "repl-backlog-ttl" {
+			ttl := strconv.Itoa(int(ch.replConf.backlogTTL / time.Second))
+			repl.array = append(repl.array, Value{vType: "bulk", bulk: ttl})
+		}
+		if key == "repl-ping-replica-period" {
+			period := strconv.Itoa(int(ch.replConf.pingPeriod / time.Second))
+			repl.array = append(repl.array, Value{vType: "bulk", bulk: period})
+		}
+		if key == "repl-timeout" {
+			timeout := strconv.Itoa(int(ch.replConf.timeout / time.Second))
+			repl.array = append(repl.array, Value{vType: "bulk", bulk: timeout})
+		}
+		if key == "min-replicas-to-write" {
+			repl.array = append(repl.array, Value{vType: "bulk", bulk: strconv.Itoa(ch.replConf.minReplicas)})
+		}
+		if key == "min-replicas-max-lag" {
+			lag := strconv.Itoa(int(ch.replConf.minReplicasMaxLag / time.Second))
+			repl.array = append(repl.array, Value{vType: "bulk", bulk: lag})
+		}
+		if key == "replica-read-only" {
+			readOnly := "no"
+			if ch.replConf.readOnly {
+				readOnly = "yes"
+			}
+			repl.array = append(repl.array, Value{vType: "bulk", bulk: readOnly})
+		}
 		return repl.Unmarshal()
 	}
 	return nil
 }
 
-func (ch *CommandHandler) keys(v Value) []byte {
+func (ch *CommandHandler) keys(c *Client, v Value) []byte {
 	var repl Value
+	if len(v.array) != 2 {
+		return wrongArgsError("keys")
+	}
 	repl.vType = "array"
 
 	pattern := v.array[1].bulk
-	keys, err := ch.rdbconn.GetKeysWithPattern(pattern)
-	if err != nil {
-		fmt.Println("error getting keys", err)
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	ch.data[c.db].Range(func(key string, val StoredValue) bool {
+		if !val.isExpired() && (pattern == "*" || stringMatch(pattern, key, false)) {
+			repl.array = append(repl.array, Value{vType: "bulk", bulk: key})
+		}
+		return true
+	})
+	return repl.Unmarshal()
+}
+
+func (ch *CommandHandler) replconf(c *Client, v Value) []byte {
+	var repl Value
+	if len(v.array)%2 == 0 {
+		return repl.Error("ERR syntax error")
+	}
+
+	ack, fack := -1, -1
+	for i := 1; i < len(v.array); i += 2 {
+		arg := strings.ToUpper(v.array[i].bulk)
+		argVal := strings.ToLower(v.array[i+1].bulk)
+		if arg == "ACK" {
+			offset, err := strconv.Atoi(argVal)
+			if err != nil {
+				return repl.Error("ERR value is not an integer or out of range")
+			}
+			ack = offset
+		}
+		if arg == "FACK" {
+			offset, err := strconv.Atoi(argVal)
+			if err != nil {
+				return repl.Error("ERR value is not an integer or out of range")
+			}
+			fack = offset
+		}
+		if arg == "GETACK" && argVal == "*" {
+			return ch.ackCommand()
+		}
+		if arg == "LISTENING-PORT" {
+			port, err := strconv.Atoi(argVal)
+			if err != nil {
+				return repl.Error("ERR value is not an integer or out of range")
+			}
+			c.replListeningPort = port
+		}
+		if arg == "CAPA" && argVal == "eof" {
+			c.replCapaEOF = true
+		}
+		if arg == "CAPA" && argVal == "psync2" {
+			c.replCapaPSync2 = true
+		}
+	}
+	// acknowledgements of replicas get no reply, it would end up in their
+	// replication stream
+	if ack >= 0 {
+		ch.replicaAck(c, ack, fack)
 		return nil
 	}
-	if len(keys) == 0 {
-		return repl.Unmarshal()
+	return repl.OK()
+}
+
+func (ch *CommandHandler) hello(c *Client, v Value) []byte {
+	var repl Value
+	if len(v.array) > 1 {
+		proto, err := strconv.Atoi(v.array[1].bulk)
+		if err != nil {
+			return repl.Error("ERR Protocol version is not an integer or out of range")
+		}
+		if proto != 2 && proto != 3 {
+			return repl.Error("NOPROTO unsupported protocol version")
+		}
+		c.SetProtocol(proto)
 	}
-	for _, k := range keys {
-		var val Value
-		val.vType = "bulk"
-		val.bulk = string(k)
-		repl.array = append(repl.array, val)
+
+	role := "master"
+	if !ch.isMaster() {
+		role = "replica"
+	}
+	repl.vType = "array"
+	if c.Protocol() == 3 {
+		repl.vType = "map"
 	}
+	repl.array = append(repl.array,
+		Value{vType: "bulk", bulk: "server"}, Value{vType: "bulk", bulk: "redis"},
+		Value{vType: "bulk", bulk: "version"}, Value{vType: "bulk", bulk: "7.2.0"},
+		Value{vType: "bulk", bulk: "proto"}, Value{vType: "num", num: c.Protocol()},
+		Value{vType: "bulk", bulk: "id"}, Value{vType: "num", num: int(c.id)},
+		Value{vType: "bulk", bulk: "mode"}, Value{vType: "bulk", bulk: ch.mode()},
+		Value{vType: "bulk", bulk: "role"}, Value{vType: "bulk", bulk: role},
+		Value{vType: "bulk", bulk: "modules"}, Value{vType: "array"},
+	)
 	return repl.Unmarshal()
 }
 
-func (ch *CommandHandler) info(v Value) []byte {
-	arg := strings.ToLower(v.array[1].bulk)
-	if arg == "replication" && ch.replConf.replication.role == "master" {
-		return ch.replConf.MasterInfo()
+func (ch *CommandHandler) client(c *Client, v Value) []byte {
+	var repl Value
+	if len(v.array) < 2 {
+		return repl.Error("ERR wrong number of arguments for 'client' command")
+	}
+	switch strings.ToLower(v.array[1].bulk) {
+	case "id":
+		repl.vType = "num"
+		repl.num = int(c.id)
+		return repl.Unmarshal()
+	case "tracking":
+		return ch.clientTracking(c, v)
+	case "caching":
+		return ch.clientCaching(c, v)
+	case "getredir":
+		return ch.clientGetredir(c)
+	case "trackinginfo":
+		return ch.clientTrackingInfo(c)
 	}
+	return repl.Error(fmt.Sprintf("ERR unknown subcommand '%s'. Try CLIENT HELP.", v.array[1].bulk))
+}
 
-	return ch.replConf.SlaveInfo()
+func (ch *CommandHandler) selectDB(c *Client, v Value) []byte {
+	var repl Value
+	if len(v.array) != 2 {
+		return repl.Error("ERR wrong number of arguments for 'select' command")
+	}
+	db, err := ch.parseDBIndex(v.array[1].bulk)
+	if err != nil {
+		return repl.Error(err.Error())
+	}
+	// a cluster only has database 0
+	if ch.cluster != nil && db != 0 {
+		return repl.Error("ERR SELECT is not allowed in cluster mode")
+	}
+	c.db = db
+	return repl.OK()
 }
 
-func (ch *CommandHandler) replconf(v Value) []byte {
+func (ch *CommandHandler) move(c *Client, v Value) []byte {
 	var repl Value
+	if len(v.array) != 3 {
+		return repl.Error("ERR wrong number of arguments for 'move' command")
+	}
+	if ch.cluster != nil {
+		return repl.Error("ERR MOVE is not allowed in cluster mode")
+	}
+	key := v.array[1].bulk
+	db, err := ch.parseDBIndex(v.array[2].bulk)
+	if err != nil {
+		return repl.Error(err.Error())
+	}
+	if db == c.db {
+		return repl.Error("ERR source and destination objects are the same")
+	}
 
-	arg := strings.ToUpper(v.array[1].bulk)
-	argVal := strings.ToLower(v.array[2].bulk)
-	fmt.Println(arg, "\n", argVal)
-	if arg == "GETACK" && argVal == "*" {
-		repl.vType = "array"
-		offset := strconv.Itoa(ch.replConf.replication.offset)
-		repl.array = append(repl.array, Value{vType: "bulk", bulk: "REPLCONF"}, Value{vType: "bulk", bulk: "ACK"}, Value{vType: "bulk", bulk: offset})
+	repl.vType = "num"
+	ch.mu.Lock()
+	val, ok := ch.data[c.db].Get(key)
+	if ok && val.isExpired() {
+		ch.data[c.db].Delete(key)
+		ok = false
+	}
+	if target, exists := ch.data[db].Get(key); !ok || (exists && !target.isExpired()) {
+		ch.mu.Unlock()
 		return repl.Unmarshal()
 	}
+	ch.data[db].Set(key, val)
+	ch.data[c.db].Delete(key)
+	ch.mu.Unlock()
+
+	ch.signalModifiedKey(c, key)
+	repl.num = 1
+	return repl.Unmarshal()
+}
+
+func (ch *CommandHandler) swapdb(v Value) []byte {
+	var repl Value
+	if len(v.array) != 3 {
+		return repl.Error("ERR wrong number of arguments for 'swapdb' command")
+	}
+	if ch.cluster != nil {
+		return repl.Error("ERR SWAPDB is not allowed in cluster mode")
+	}
+	first, err := strconv.Atoi(v.array[1].bulk)
+	if err != nil {
+		return repl.Error("ERR invalid first DB index")
+	}
+	second, err := strconv.Atoi(v.array[2].bulk)
+	if err != nil {
+		return repl.Error("ERR invalid second DB index")
+	}
+	if first < 0 || first >= len(ch.data) || second < 0 || second >= len(ch.data) {
+		return repl.Error("ERR DB index is out of range")
+	}
+
+	ch.mu.Lock()
+	ch.data[first], ch.data[second] = ch.data[second], ch.data[first]
+	ch.mu.Unlock()
+	ch.dirty.Add(1)
+	// keys cached by clients may now hold the values of the other database
+	ch.invalidateAll()
 	return repl.OK()
 }
 
-func (ch *CommandHandler) psync(_ Value) []byte {
-	//TODO add check for args ? and 0 for full resync
-	reply := fmt.Sprintf("+FULLRESYNC %s %d\r\n", ch.replConf.replication.master_replid, ch.replConf.replication.master_repl_offset)
+func (ch *CommandHandler) flushdb(c *Client, v Value) []byte {
+	var repl Value
+	if err := parseFlushMode(v); err != nil {
+		return repl.Error(err.Error())
+	}
+	ch.flush(c.db)
+	return repl.OK()
+}
 
-	decoded, _ := hex.DecodeString(emptyRDBhash)
+func (ch *CommandHandler) flushall(c *Client, v Value) []byte {
+	var repl Value
+	if err := parseFlushMode(v); err != nil {
+		return repl.Error(err.Error())
+	}
+	dbs := make([]int, len(ch.data))
+	for i := range dbs {
+		dbs[i] = i
+	}
+	ch.flush(dbs...)
+	return repl.OK()
+}
+
+// parseFlushMode checks optional ASYNC or SYNC argument of FLUSHDB and FLUSHALL
+func parseFlushMode(v Value) error {
+	if len(v.array) > 2 {
+		return fmt.Errorf("ERR syntax error")
+	}
+	if len(v.array) == 2 {
+		mode := strings.ToLower(v.array[1].bulk)
+		if mode != "async" && mode != "sync" {
+			return fmt.Errorf("ERR syntax error")
+		}
+	}
+	return nil
+}
 
-	var res []byte
-	res = append(res, []byte(reply)...)
-	res = append(res, []byte(fmt.Sprintf("$%d\r\n", len(decoded)))...)
-	res = append(res, decoded...) //decoded RDB hash is not a bulk string so without CRLF
-	return res
+func (ch *CommandHandler) flush(dbs ...int) {
+	ch.mu.Lock()
+	for _, db := range dbs {
+		ch.dirty.Add(int64(ch.data[db].Len()))
+		// the old keyspace is released by the garbage collector in background,
+		// so SYNC and ASYNC behave the same
+		ch.data[db] = newDict[StoredValue]()
+	}
+	ch.mu.Unlock()
+	ch.invalidateAll()
 }
 
-func (ch *CommandHandler) wait(v Value) []byte {
-	var reply Value
+func (ch *CommandHandler) dbsize(c *Client) []byte {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
 
-	replicasCount := v.array[1].bulk
-	// timeout := v.array[2].bulk
-	
-	reply.vType = "num"
-	if replicasCount == "0" {
-		reply.num = 0
-	} else {
-		reply.num = ch.replConf.replication.connected_slaves
+	repl := Value{vType: "num", num: ch.data[c.db].Len()}
+	return repl.Unmarshal()
+}
+
+func (ch *CommandHandler) parseDBIndex(arg string) (int, error) {
+	db, err := strconv.Atoi(arg)
+	if err != nil {
+		return 0, fmt.Errorf("ERR value is not an integer or out of range")
+	}
+	if db < 0 || db >= len(ch.data) {
+		return 0, fmt.Errorf("ERR DB index is out of range")
 	}
-	return reply.Unmarshal()
+	return db, nil
 }
 
-func (ch *CommandHandler) setValue(key, val string, opts setOptions) {
+// setValue stores val at key as SET with opts does. It returns the previous
+// value, whether there was one and whether the key was written, which NX and
+// XX can prevent. GET fails with errWrongType if the previous value is not a
+// string.
+func (ch *CommandHandler) setValue(db int, key, val string, opts setOptions) (StoredValue, bool, bool, error) {
 	ch.mu.Lock()
 	defer ch.mu.Unlock()
 
+	old, exists := ch.lookupKey(db, key)
+	if opts.get && exists && old.vType != "string" {
+		return old, exists, false, errWrongType
+	}
+	if opts.nx && exists || opts.xx && !exists {
+		return old, exists, false, nil
+	}
 	newVal := StoredValue{}
+	newVal.vType = "string"
 	newVal.val = val
-	var now time.Time
-	if opts.PX != 0 {
-		now = time.Now()
-		newVal.expires = now.Add(time.Millisecond * time.Duration(opts.PX))
+	newVal.expires = opts.expires
+	if opts.keepTTL && exists {
+		newVal.expires = old.expires
 	}
-	//TODO add support of other options
-	ch.data[key] = newVal
+	ch.data[db].Set(key, newVal)
+	return old, exists, true, nil
 }
 
-func (ch *CommandHandler) parseSetOpts(a []Value) setOptions {
+// parseSetOpts parses the options of SET: NX, XX, GET, KEEPTTL and the
+// expiration options EX, PX, EXAT and PXAT
+func (ch *CommandHandler) parseSetOpts(a []Value) (setOptions, error) {
 	opts := setOptions{}
-	for i, v := range a {
-		if strings.ToLower(v.bulk) == "px" {
-			pxVal, _ := strconv.Atoi(a[i+1].bulk) //TODO handle error
-			opts.PX = pxVal
-			break
+	for i := 0; i < len(a); i++ {
+		var unit time.Duration
+		relative := true
+		switch strings.ToLower(a[i].bulk) {
+		case "nx":
+			if opts.xx {
+				return opts, errors.New("ERR syntax error")
+			}
+			opts.nx = true
+			continue
+		case "xx":
+			if opts.nx {
+				return opts, errors.New("ERR syntax error")
+			}
+			opts.xx = true
+			continue
+		case "get":
+			opts.get = true
+			continue
+		case "keepttl":
+			if !opts.expires.IsZero() {
+				return opts, errors.New("ERR syntax error")
+			}
+			opts.keepTTL = true
+			continue
+		case "ex":
+			unit = time.Second
+		case "px":
+			unit = time.Millisecond
+		case "exat":
+			unit, relative = time.Second, false
+		case "pxat":
+			unit, relative = time.Millisecond, false
+		default:
+			return opts, errors.New("ERR syntax error")
+		}
+		if !opts.expires.IsZero() || opts.keepTTL || i+1 >= len(a) {
+			return opts, errors.New("ERR syntax error")
+		}
+		i++
+		n, err := strconv.ParseInt(a[i].bulk, 10, 64)
+		if err != nil {
+			return opts, errors.New("ERR value is not an integer or out of range")
+		}
+		if n <= 0 || n > math.MaxInt64/int64(unit) {
+			return opts, errors.New("ERR invalid expire time in 'set' command")
+		}
+		if relative {
+			opts.expires = time.Now().Add(time.Duration(n) * unit)
+		} else {
+			opts.expires = time.UnixMilli(n * int64(unit/time.Millisecond))
 		}
 	}
-	return opts
+	return opts, nil
 }
 
-func (ch *CommandHandler) getValue(key string) string {
+func (ch *CommandHandler) getValue(db int, key string) (StoredValue, bool) {
 	ch.mu.RLock()
 	defer ch.mu.RUnlock()
 
-	v, isKey := ch.data[key]
-	if !isKey {
-		fmt.Println("NO KEY")
-		return ""
+	return ch.lookupKey(db, key)
+}
+
+// lookupKey returns value stored at key, expired keys are reported as missing.
+// Caller must hold ch.mu.
+func (ch *CommandHandler) lookupKey(db int, key string) (StoredValue, bool) {
+	v, ok := ch.data[db].Get(key)
+	if !ok || v.isExpired() {
+		return StoredValue{}, false
 	}
+	return v, true
+}
 
-	if !v.expires.IsZero() {
-		isLost := v.expires.Before(time.Now())
-		if isLost {
-			return ""
-		}
+// lookupTyped is lookupKey failing with errWrongType if the value is not of vType.
+// Caller must hold ch.mu.
+func (ch *CommandHandler) lookupTyped(db int, key, vType string) (StoredValue, bool, error) {
+	v, ok := ch.lookupKey(db, key)
+	if ok && v.vType != vType {
+		return v, false, errWrongType
+	}
+	return v, ok, nil
+}
+
+// lookupWrite is lookupTyped for commands modifying the collection in place. If
+// the collection is shared with a snapshot being saved it is copied first.
+// Caller must hold ch.mu for writing.
+func (ch *CommandHandler) lookupWrite(db int, key, vType string) (StoredValue, bool, error) {
+	v, ok, err := ch.lookupTyped(db, key, vType)
+	if err != nil || !ok {
+		return v, ok, err
+	}
+	if ch.snapshots > 0 && v.gen < ch.snapshotGen {
+		v = v.clone()
+		v.gen = ch.snapshotGen
+		ch.data[db].Set(key, v)
 	}
-	return v.val
+	return v, true, nil
+}
+
+// lookupOrCreate returns value of vType stored at key, an empty one is stored
+// if the key is missing. Caller must hold ch.mu for writing.
+func (ch *CommandHandler) lookupOrCreate(db int, key, vType string) (StoredValue, error) {
+	v, ok, err := ch.lookupWrite(db, key, vType)
+	if err != nil || ok {
+		return v, err
+	}
+	v = newStoredValue(vType)
+	v.gen = ch.snapshotGen
+	ch.data[db].Set(key, v)
+	return v, nil
+}
+
+// signalModifiedKey must be called after every change of the key
+func (ch *CommandHandler) signalModifiedKey(c *Client, key string) {
+	ch.dirty.Add(1)
+	ch.invalidateKey(c, key)
+}
+
+// deleteIfEmpty removes collection left without elements. Caller must hold ch.mu for writing.
+func (ch *CommandHandler) deleteIfEmpty(db int, key string, v StoredValue) {
+	if v.length() == 0 {
+		ch.data[db].Delete(key)
+	}
+}
+
+func wrongArgsError(command string) []byte {
+	var repl Value
+	return repl.Error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", command))
 }
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestSelectMoveSwapdb(t *testing.T) {
+	ch := newTestCommandHandler(t)
+	c := NewClient(bufio.NewReader(strings.NewReader("")), bufio.NewWriter(io.Discard))
+	run := func(args ...string) string {
+		t.Helper()
+		return string(ch.call(c, bulkArray(args)))
+	}
+	expect := func(got, want string) {
+		t.Helper()
+		if got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+	inDB := func(db int, key, want string) {
+		t.Helper()
+		v, ok := ch.getValue(db, key)
+		if want == "" && ok {
+			t.Errorf("key %s in db %d, want none", key, db)
+		} else if want != "" && (!ok || v.val != want) {
+			t.Errorf("key %s in db %d = %v, %v, want %s", key, db, v.val, ok, want)
+		}
+	}
+
+	expect(run("SELECT", "16"), "-ERR DB index is out of range\r\n")
+	expect(run("SELECT", "x"), "-ERR value is not an integer or out of range\r\n")
+	expect(run("SELECT", "2"), "+OK\r\n")
+	run("SET", "k", "two")
+	inDB(2, "k", "two")
+	inDB(0, "k", "")
+
+	expect(run("MOVE", "k", "2"), "-ERR source and destination objects are the same\r\n")
+	expect(run("MOVE", "missing", "3"), ":0\r\n")
+	expect(run("MOVE", "k", "3"), ":1\r\n")
+	inDB(2, "k", "")
+	inDB(3, "k", "two")
+	// an existing key in the target database is not overwritten
+	run("SET", "k", "again")
+	expect(run("MOVE", "k", "3"), ":0\r\n")
+	inDB(2, "k", "again")
+	inDB(3, "k", "two")
+
+	dirty := ch.dirty.Load()
+	expect(run("SWAPDB", "2", "3"), "+OK\r\n")
+	inDB(2, "k", "two")
+	inDB(3, "k", "again")
+	if ch.dirty.Load() == dirty {
+		t.Error("SWAPDB didn't count as a change")
+	}
+	expect(run("SWAPDB", "0", "16"), "-ERR DB index is out of range\r\n")
+	// the selected database is an index, the client sees the swapped data
+	expect(run("GET", "k"), "$3\r\ntwo\r\n")
+}
+
+func TestSwapdbInvalidatesTracking(t *testing.T) {
+	ch := newTestCommandHandler(t)
+	tracker, conn := newPipeClient(t, ch)
+	tracker.SetProtocol(3)
+	ch.call(tracker, bulkArray([]string{"CLIENT", "TRACKING", "on"}))
+	ch.call(tracker, bulkArray([]string{"GET", "k"}))
+
+	c := NewClient(bufio.NewReader(strings.NewReader("")), bufio.NewWriter(io.Discard))
+	ch.call(c, bulkArray([]string{"SWAPDB", "0", "1"}))
+	expectPush(t, conn, invalidatePush(Value{vType: "null"}))
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// command flags
+const (
+	cmdWrite  = 1 << iota // modifies the dataset: logged to the AOF and propagated to replicas
+	cmdAsking             // runs in a slot being imported as if ASKING was sent first
+)
+
+type commandSpec struct {
+	arity int // number of arguments including the name, -N means at least N
+	flags int
+	// positions of the keys: from firstKey to lastKey every keyStep arguments,
+	// a negative lastKey counts from the end. firstKey is 0 without keys.
+	firstKey, lastKey, keyStep int
+}
+
+// commandTable lists the implemented commands
+var commandTable = map[string]commandSpec{
+	"ping":         {-1, 0, 0, 0, 0},
+	"echo":         {2, 0, 0, 0, 0},
+	"set":          {-3, cmdWrite, 1, 1, 1},
+	"get":          {2, 0, 1, 1, 1},
+	"incr":         {2, cmdWrite, 1, 1, 1},
+	"decr":         {2, cmdWrite, 1, 1, 1},
+	"incrby":       {3, cmdWrite, 1, 1, 1},
+	"decrby":       {3, cmdWrite, 1, 1, 1},
+	"config":       {-2, 0, 0, 0, 0},
+	"keys":         {2, 0, 0, 0, 0},
+	"info":         {-1, 0, 0, 0, 0},
+	"role":         {1, 0, 0, 0, 0},
+	"replconf":     {-1, 0, 0, 0, 0},
+	"psync":        {-3, 0, 0, 0, 0},
+	"replicaof":    {3, 0, 0, 0, 0},
+	"slaveof":      {3, 0, 0, 0, 0},
+	"wait":         {3, 0, 0, 0, 0},
+	"waitaof":      {4, 0, 0, 0, 0},
+	"hello":        {-1, 0, 0, 0, 0},
+	"client":       {-2, 0, 0, 0, 0},
+	"subscribe":    {-2, 0, 0, 0, 0},
+	"unsubscribe":  {-1, 0, 0, 0, 0},
+	"psubscribe":   {-2, 0, 0, 0, 0},
+	"punsubscribe": {-1, 0, 0, 0, 0},
+	"publish":      {3, 0, 0, 0, 0},
+	"select":       {2, 0, 0, 0, 0},
+	"move":         {3, cmdWrite, 1, 1, 1},
+	"swapdb":       {3, cmdWrite, 0, 0, 0},
+	"flushdb":      {-1, cmdWrite, 0, 0, 0},
+	"flushall":     {-1, cmdWrite, 0, 0, 0},
+	"dbsize":       {1, 0, 0, 0, 0},
+	"save":         {1, 0, 0, 0, 0},
+	"bgsave":       {-1, 0, 0, 0, 0},
+	"lastsave":     {1, 0, 0, 0, 0},
+	"del":          {-2, cmdWrite, 1, -1, 1},
+	"type":         {2, 0, 1, 1, 1},
+	"expire":       {3, cmdWrite, 1, 1, 1},
+	"pexpire":      {3, cmdWrite, 1, 1, 1},
+	"expireat":     {3, cmdWrite, 1, 1, 1},
+	"pexpireat":    {3, cmdWrite, 1, 1, 1},
+	"dump":         {2, 0, 1, 1, 1},
+	"restore":      {-4, cmdWrite, 1, 1, 1},
+	// RESTORE sent by MIGRATE in cluster mode
+	"restore-asking": {-4, cmdWrite | cmdAsking, 1, 1, 1},
+	// MIGRATE deletes the keys itself once the target accepted them
+	"migrate":      {-6, cmdWrite, 3, 3, 1},
+	"bgrewriteaof": {1, 0, 0, 0, 0},
+	"scan":         {-2, 0, 0, 0, 0},
+	"lpush":        {-3, cmdWrite, 1, 1, 1},
+	"rpush":        {-3, cmdWrite, 1, 1, 1},
+	"lpop":         {-2, cmdWrite, 1, 1, 1},
+	"rpop":         {-2, cmdWrite, 1, 1, 1},
+	"llen":         {2, 0, 1, 1, 1},
+	"lrange":       {4, 0, 1, 1, 1},
+	"hset":         {-4, cmdWrite, 1, 1, 1},
+	"hget":         {3, 0, 1, 1, 1},
+	"hdel":         {-3, cmdWrite, 1, 1, 1},
+	"hlen":         {2, 0, 1, 1, 1},
+	"hgetall":      {2, 0, 1, 1, 1},
+	"hscan":        {-3, 0, 1, 1, 1},
+	"sadd":         {-3, cmdWrite, 1, 1, 1},
+	"srem":         {-3, cmdWrite, 1, 1, 1},
+	"spop":         {-2, cmdWrite, 1, 1, 1},
+	"sismember":    {3, 0, 1, 1, 1},
+	"scard":        {2, 0, 1, 1, 1},
+	"smembers":     {2, 0, 1, 1, 1},
+	"sscan":        {-3, 0, 1, 1, 1},
+	"zadd":         {-4, cmdWrite, 1, 1, 1},
+	"zrem":         {-3, cmdWrite, 1, 1, 1},
+	"zscore":       {3, 0, 1, 1, 1},
+	"zcard":        {2, 0, 1, 1, 1},
+	"zrange":       {-4, 0, 1, 1, 1},
+	"zscan":        {-3, 0, 1, 1, 1},
+	"xadd":         {-5, cmdWrite, 1, 1, 1},
+	"xlen":         {2, 0, 1, 1, 1},
+	"xrange":       {-4, 0, 1, 1, 1},
+	"cluster":      {-2, 0, 0, 0, 0},
+	"asking":       {1, 0, 0, 0, 0},
+}
+
+// checkCommand returns the error for v naming a command that is not
+// implemented or having the wrong number of arguments, nil when its handler
+// can run it
+func checkCommand(v Value) []byte {
+	if v.vType != "array" {
+		return nil
+	}
+	name := commandName(v)
+	spec, ok := commandTable[name]
+	if !ok {
+		return unknownCommandError(v)
+	}
+	if !spec.arityOK(len(v.array)) {
+		return wrongArgsError(name)
+	}
+	return nil
+}
+
+// unknownCommandError quotes the command and the beginning of its arguments
+func unknownCommandError(v Value) []byte {
+	var repl Value
+	var name string
+	if len(v.array) > 0 {
+		name = v.array[0].bulk
+	}
+	var args strings.Builder
+	for _, arg := range v.array[min(1, len(v.array)):] {
+		if args.Len() >= 128 {
+			break
+		}
+		fmt.Fprintf(&args, "'%.*s' ", 128-args.Len(), arg.bulk)
+	}
+	return repl.Error(fmt.Sprintf("ERR unknown command '%.128s', with args beginning with: %s", name, args.String()))
+}
+
+// arityOK checks the number of arguments of the command, argc includes the name
+func (s commandSpec) arityOK(argc int) bool {
+	if s.arity < 0 {
+		return argc >= -s.arity
+	}
+	return argc == s.arity
+}
+
+// commandName returns the lowercase name of command v
+func commandName(v Value) string {
+	if v.vType != "array" || len(v.array) == 0 {
+		return ""
+	}
+	return strings.ToLower(v.array[0].bulk)
+}
+
+// isWriteCommand reports whether v is a command modifying the dataset
+func isWriteCommand(v Value) bool {
+	return commandTable[commandName(v)].flags&cmdWrite != 0
+}
+
+// commandKeys returns the keys command v works on
+func commandKeys(v Value) []string {
+	name := commandName(v)
+	spec := commandTable[name]
+	if spec.firstKey == 0 || !spec.arityOK(len(v.array)) {
+		return nil
+	}
+	// MIGRATE moves a single key, or the keys after KEYS when it is empty
+	if name == "migrate" {
+		opts, err := parseMigrateOptions(v)
+		if err != nil {
+			return nil
+		}
+		return opts.keys
+	}
+	last := spec.lastKey
+	if last < 0 {
+		last += len(v.array)
+	}
+	var keys []string
+	for i := spec.firstKey; i <= last && i < len(v.array); i += spec.keyStep {
+		keys = append(keys, v.array[i].bulk)
+	}
+	return keys
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestCommandKeys(t *testing.T) {
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"PING"}, nil},
+		{[]string{"GET", "k"}, []string{"k"}},
+		{[]string{"get", "k"}, []string{"k"}},
+		{[]string{"SET", "k", "v", "EX", "10"}, []string{"k"}},
+		{[]string{"DEL", "a", "b", "c"}, []string{"a", "b", "c"}},
+		{[]string{"HSET", "h", "f", "v"}, []string{"h"}},
+		{[]string{"FLUSHALL"}, nil},
+		{[]string{"MIGRATE", "127.0.0.1", "7001", "k", "0", "1000"}, []string{"k"}},
+		{[]string{"MIGRATE", "127.0.0.1", "7001", "", "0", "1000", "REPLACE", "KEYS", "a", "b"}, []string{"a", "b"}},
+		{[]string{"MIGRATE", "127.0.0.1", "7001", "k", "0", "1000", "BOGUS"}, nil},
+		// wrong number of arguments
+		{[]string{"GET"}, nil},
+		{[]string{"GET", "a", "b"}, nil},
+		{[]string{"NOSUCHCOMMAND", "k"}, nil},
+	}
+	for _, tt := range tests {
+		if got := commandKeys(bulkArray(tt.args)); !slices.Equal(got, tt.want) {
+			t.Errorf("commandKeys(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
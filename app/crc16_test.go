@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestKeyHashSlot(t *testing.T) {
+	if got := crc16("123456789"); got != 0x31C3 {
+		t.Errorf("crc16(\"123456789\") = %#04x, want 0x31c3", got)
+	}
+	tests := []struct {
+		key  string
+		want int
+	}{
+		{"foo", 12182},
+		{"bar", 5061},
+		{"hello", 866},
+		{"", 0},
+		// only the hash tag is hashed
+		{"{foo}", 12182},
+		{"{foo}.bar", 12182},
+		{"user:{foo}:1", 12182},
+		{"{foo}{bar}", 12182},
+		// the first { and the next } are used, an empty tag hashes the whole key
+		{"{{foo}}", int(crc16("{foo")) & (clusterSlots - 1)},
+		{"{}foo", int(crc16("{}foo")) & (clusterSlots - 1)},
+		{"foo{", int(crc16("foo{")) & (clusterSlots - 1)},
+		{"foo}{", int(crc16("foo}{")) & (clusterSlots - 1)},
+	}
+	for _, tt := range tests {
+		if got := keyHashSlot(tt.key); got != tt.want {
+			t.Errorf("keyHashSlot(%q) = %d, want %d", tt.key, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+package main
+
+import (
+	"hash/crc64"
+	"math/bits"
+)
+
+// Redis uses CRC-64/Jones: reflected, zero initial value and no final xor. Go
+// crc64 inverts the value on input and output, so it is inverted back here.
+var crc64Table = crc64.MakeTable(bits.Reverse64(0xad93d23594c935a9))
+
+func crc64Update(crc uint64, p []byte) uint64 {
+	return ^crc64.Update(^crc, crc64Table, p)
+}
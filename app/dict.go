@@ -0,0 +1,153 @@
+package main
+
+import (
+	"hash/maphash"
+	"math/bits"
+	"math/rand/v2"
+)
+
+const dictMinSize = 4
+
+var dictSeed = maphash.MakeSeed()
+
+type dictEntry[V any] struct {
+	key string
+	val V
+}
+
+// dict is a hash table with a power of two number of buckets. Unlike go map its
+// layout is known, so SCAN can walk it with a stateless cursor: every key present
+// for the whole iteration is returned even if the table grows or shrinks between calls.
+type dict[V any] struct {
+	buckets [][]dictEntry[V]
+	used    int
+}
+
+func newDict[V any]() *dict[V] {
+	return &dict[V]{
+		buckets: make([][]dictEntry[V], dictMinSize),
+	}
+}
+
+func (d *dict[V]) bucket(key string) int {
+	return int(maphash.String(dictSeed, key) & uint64(len(d.buckets)-1))
+}
+
+func (d *dict[V]) Len() int {
+	return d.used
+}
+
+func (d *dict[V]) Get(key string) (V, bool) {
+	for _, e := range d.buckets[d.bucket(key)] {
+		if e.key == key {
+			return e.val, true
+		}
+	}
+	var zero V
+	return zero, false
+}
+
+// Set returns true if the key was not in the dict before
+func (d *dict[V]) Set(key string, val V) bool {
+	b := d.bucket(key)
+	for i, e := range d.buckets[b] {
+		if e.key == key {
+			d.buckets[b][i].val = val
+			return false
+		}
+	}
+	d.buckets[b] = append(d.buckets[b], dictEntry[V]{key: key, val: val})
+	d.used++
+	if d.used > len(d.buckets) {
+		d.resize(len(d.buckets) * 2)
+	}
+	return true
+}
+
+// Delete returns true if the key was removed
+func (d *dict[V]) Delete(key string) bool {
+	b := d.bucket(key)
+	for i, e := range d.buckets[b] {
+		if e.key == key {
+			last := len(d.buckets[b]) - 1
+			d.buckets[b][i] = d.buckets[b][last]
+			d.buckets[b][last] = dictEntry[V]{}
+			d.buckets[b] = d.buckets[b][:last]
+			d.used--
+			if len(d.buckets) > dictMinSize && d.used < len(d.buckets)/8 {
+				d.resize(len(d.buckets) / 2)
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// RandomKey returns a key picked at random, false when the dict is empty.
+// Keys in less crowded buckets are a bit more likely to be picked.
+func (d *dict[V]) RandomKey() (string, bool) {
+	if d.used == 0 {
+		return "", false
+	}
+	for {
+		b := d.buckets[rand.IntN(len(d.buckets))]
+		if len(b) > 0 {
+			return b[rand.IntN(len(b))].key, true
+		}
+	}
+}
+
+// Range calls fn for every entry until fn returns false, dict must not be modified meanwhile
+func (d *dict[V]) Range(fn func(key string, val V) bool) {
+	for _, b := range d.buckets {
+		for _, e := range b {
+			if !fn(e.key, e.val) {
+				return
+			}
+		}
+	}
+}
+
+// clone returns a copy of the table, values are copied shallowly
+func (d *dict[V]) clone() *dict[V] {
+	c := &dict[V]{
+		buckets: make([][]dictEntry[V], len(d.buckets)),
+		used:    d.used,
+	}
+	for i, b := range d.buckets {
+		if len(b) > 0 {
+			c.buckets[i] = append([]dictEntry[V](nil), b...)
+		}
+	}
+	return c
+}
+
+func (d *dict[V]) resize(size int) {
+	if size < dictMinSize {
+		size = dictMinSize
+	}
+	old := d.buckets
+	d.buckets = make([][]dictEntry[V], size)
+	for _, b := range old {
+		for _, e := range b {
+			nb := d.bucket(e.key)
+			d.buckets[nb] = append(d.buckets[nb], e)
+		}
+	}
+}
+
+// Scan calls fn for every entry of the bucket pointed by cursor and returns the
+// next cursor, 0 when the iteration is complete. The cursor is incremented in
+// reverse bit order (the algorithm of Redis dictScan), so buckets already visited
+// before a resize map to buckets that are visited before the cursor after it.
+func (d *dict[V]) Scan(cursor uint64, fn func(key string, val V)) uint64 {
+	mask := uint64(len(d.buckets) - 1)
+	for _, e := range d.buckets[cursor&mask] {
+		fn(e.key, e.val)
+	}
+	// set unmasked bits so incrementing the reversed cursor carries into the masked ones
+	cursor |= ^mask
+	cursor = bits.Reverse64(cursor)
+	cursor++
+	return bits.Reverse64(cursor)
+}
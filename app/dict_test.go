@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestDictScanAcrossResize(t *testing.T) {
+	tests := []struct {
+		name    string
+		temp    int // temporary keys added before the iteration
+		perStep int // temporary keys added (> 0) or deleted (< 0) after every call
+	}{
+		{"stable", 0, 0},
+		{"grow", 0, 50},
+		{"shrink", 5000, -200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newDict[int]()
+			for i := range 100 {
+				d.Set("keep:"+strconv.Itoa(i), i)
+			}
+			for i := range tt.temp {
+				d.Set("temp:"+strconv.Itoa(i), i)
+			}
+			added, deleted := tt.temp, 0
+
+			seen := make(map[string]bool)
+			cursor := uint64(0)
+			for steps := 0; ; steps++ {
+				if steps > 100000 {
+					t.Fatal("scan did not terminate")
+				}
+				cursor = d.Scan(cursor, func(key string, _ int) {
+					seen[key] = true
+				})
+				if cursor == 0 {
+					break
+				}
+				// the table grows a few times, not faster than the cursor advances
+				for i := 0; i < tt.perStep && added < 5000; i++ {
+					d.Set("temp:"+strconv.Itoa(added), added)
+					added++
+				}
+				for i := 0; i > tt.perStep && deleted < added; i-- {
+					d.Delete("temp:" + strconv.Itoa(deleted))
+					deleted++
+				}
+			}
+			for i := range 100 {
+				if key := "keep:" + strconv.Itoa(i); !seen[key] {
+					t.Errorf("%s was not returned", key)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"time"
+)
+
+// expire implements EXPIRE, PEXPIRE, EXPIREAT and PEXPIREAT: unit is the unit
+// of the time argument, added to the current time when relative. The command
+// is propagated as PEXPIREAT, relative times would expire later on replicas.
+func (ch *CommandHandler) expire(c *Client, v Value, unit time.Duration, relative bool) []byte {
+	var repl Value
+	command := v.array[0].bulk
+	key := v.array[1].bulk
+	n, err := strconv.ParseInt(v.array[2].bulk, 10, 64)
+	if err != nil {
+		return repl.Error("ERR value is not an integer or out of range")
+	}
+	factor := int64(unit / time.Millisecond)
+	var now int64
+	if relative {
+		now = time.Now().UnixMilli()
+	}
+	if n > (math.MaxInt64-now)/factor || n < (math.MinInt64+now)/factor {
+		return repl.Error("ERR invalid expire time in '" + command + "' command")
+	}
+	ms := n*factor + now
+
+	ch.mu.Lock()
+	val, ok := ch.lookupKey(c.db, key)
+	if ok {
+		val.expires = time.UnixMilli(ms)
+		if val.isExpired() {
+			ch.data[c.db].Delete(key)
+		} else {
+			ch.data[c.db].Set(key, val)
+		}
+	}
+	ch.mu.Unlock()
+
+	repl.vType = "num"
+	if !ok {
+		c.rewriteCommand()
+		return repl.Unmarshal()
+	}
+	ch.signalModifiedKey(c, key)
+	if val.isExpired() {
+		c.rewriteCommand(bulkArray([]string{"DEL", key}))
+	} else {
+		c.rewriteCommand(bulkArray([]string{"PEXPIREAT", key, strconv.FormatInt(ms, 10)}))
+	}
+	repl.num = 1
+	return repl.Unmarshal()
+}
+
+const (
+	expireCycleBuckets = 64                    // buckets of a database checked at once
+	expireCycleTime    = 25 * time.Millisecond // time limit of a cycle
+)
+
+// activeExpireCycle deletes expired keys, walking every database a few buckets
+// at a time from where the previous cycle stopped. A database keeps being
+// walked while more than a tenth of its keys with a TTL turn out expired.
+// Deletions are propagated as DEL. Replicas don't expire keys themselves,
+// they wait for the DEL of the master.
+func (ch *CommandHandler) activeExpireCycle() {
+	ch.writeMu.Lock()
+	defer ch.writeMu.Unlock()
+	// checked under writeMu, the role can't change before the DELs are
+	// propagated
+	if ch.replConf.replication.role != "master" {
+		return
+	}
+
+	start := time.Now()
+	expired := make([][]string, len(ch.data))
+	ch.mu.Lock()
+	for db, keys := range ch.data {
+		for time.Since(start) < expireCycleTime {
+			withTTL, found := 0, 0
+			cursor := ch.expireCursors[db]
+			for i := 0; i < expireCycleBuckets; i++ {
+				cursor = keys.Scan(cursor, func(key string, v StoredValue) {
+					if v.expires.IsZero() {
+						return
+					}
+					withTTL++
+					if v.isExpired() {
+						found++
+						expired[db] = append(expired[db], key)
+					}
+				})
+				if cursor == 0 {
+					break
+				}
+			}
+			ch.expireCursors[db] = cursor
+			for _, key := range expired[db][len(expired[db])-found:] {
+				keys.Delete(key)
+			}
+			ch.stats.expiredKeys.Add(int64(found))
+			if found*10 <= withTTL {
+				break
+			}
+		}
+	}
+	ch.mu.Unlock()
+
+	for db, keys := range expired {
+		for _, key := range keys {
+			ch.signalModifiedKey(nil, key)
+			ch.propagateWrite(db, bulkArray([]string{"DEL", key}))
+		}
+	}
+}
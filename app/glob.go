@@ -0,0 +1,110 @@
+package main
+
+// stringMatch reports whether str matches glob style pattern the way Redis does.
+// '*' matches any sequence of bytes including the empty one, '?' any single byte,
+// [abc] one of the listed bytes, [^abc] any byte except them, [a-z] a byte in
+// range (ranges and listed bytes can be mixed), and \x matches x literally, also
+// inside brackets.
+func stringMatch(pattern, str string, nocase bool) bool {
+	// Only the last '*' needs a backtrack point: whatever an earlier star would
+	// consume differently can be consumed by the later one as well, so a failed
+	// match retries from the last star with one more byte and the cost stays
+	// O(len(pattern)*len(str)).
+	p, s := 0, 0
+	starP, starS := -1, 0
+	for {
+		if p < len(pattern) {
+			switch pattern[p] {
+			case '*':
+				starP, starS = p, s
+				p++
+				continue
+			case '?':
+				if s < len(str) {
+					p++
+					s++
+					continue
+				}
+			case '[':
+				if s < len(str) {
+					if matched, end := matchBracket(pattern, p+1, str[s], nocase); matched {
+						p = end + 1
+						s++
+						continue
+					}
+				}
+			default:
+				q := p
+				if pattern[q] == '\\' && q+1 < len(pattern) {
+					q++
+				}
+				if s < len(str) && equalByte(pattern[q], str[s], nocase) {
+					p = q + 1
+					s++
+					continue
+				}
+			}
+		} else if s == len(str) {
+			return true
+		}
+		if starP < 0 || starS >= len(str) {
+			return false
+		}
+		starS++
+		p, s = starP+1, starS
+	}
+}
+
+// matchBracket matches b against [...] class starting right after '[' and returns
+// the position of the closing ']' (or the last byte of unterminated pattern)
+func matchBracket(pattern string, p int, b byte, nocase bool) (bool, int) {
+	not := p < len(pattern) && pattern[p] == '^'
+	if not {
+		p++
+	}
+	matched := false
+	for ; p < len(pattern); p++ {
+		switch {
+		case pattern[p] == '\\' && p+1 < len(pattern):
+			p++
+			if equalByte(pattern[p], b, nocase) {
+				matched = true
+			}
+		case pattern[p] == ']':
+			return matched != not, p
+		case p+2 < len(pattern) && pattern[p+1] == '-':
+			start, end := pattern[p], pattern[p+2]
+			if start > end {
+				start, end = end, start
+			}
+			c := b
+			if nocase {
+				start, end, c = toLower(start), toLower(end), toLower(c)
+			}
+			if c >= start && c <= end {
+				matched = true
+			}
+			p += 2
+		default:
+			if equalByte(pattern[p], b, nocase) {
+				matched = true
+			}
+		}
+	}
+	// unterminated class, Redis treats the end of the pattern as the closing bracket
+	return matched != not, len(pattern) - 1
+}
+
+func equalByte(a, b byte, nocase bool) bool {
+	if nocase {
+		return toLower(a) == toLower(b)
+	}
+	return a == b
+}
+
+func toLower(b byte) byte {
+	if b >= 'A' && b <= 'Z' {
+		return b + ('a' - 'A')
+	}
+	return b
+}
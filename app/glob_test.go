@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestStringMatch(t *testing.T) {
+	tests := []struct {
+		pattern, str string
+		nocase       bool
+		want         bool
+	}{
+		{"", "", false, true},
+		{"", "a", false, false},
+		{"*", "", false, true},
+		{"*", "anything", false, true},
+		{"h?llo", "hello", false, true},
+		{"h?llo", "hllo", false, false},
+		{"h*llo", "hllo", false, true},
+		{"h*llo", "heeeello", false, true},
+		{"h*llo", "heeeellox", false, false},
+		{"*llo*", "hello world", false, true},
+		{"a*b*c", "axxbyyc", false, true},
+		{"a*b*c", "axxbyy", false, false},
+		{"a**b", "ab", false, true},
+		{"h[ae]llo", "hello", false, true},
+		{"h[ae]llo", "hillo", false, false},
+		{"h[^e]llo", "hallo", false, true},
+		{"h[^e]llo", "hello", false, false},
+		{"h[a-b]llo", "hbllo", false, true},
+		{"h[b-a]llo", "hallo", false, true},
+		{"h[a-b]llo", "hcllo", false, false},
+		{"[a-cx]", "x", false, true},
+		{`[\]]`, "]", false, true},
+		{`h\*llo`, "h*llo", false, true},
+		{`h\*llo`, "hello", false, false},
+		{`a\`, `a\`, false, true},
+		{"[abc", "b", false, true},
+		{"[abc", "bc", false, false},
+		{"HELLO", "hello", false, false},
+		{"HELLO", "hello", true, true},
+		{"h[A-Z]llo", "hello", true, true},
+		{"news.*", "news.tech", false, true},
+		{"news.*", "sports.tech", false, false},
+	}
+	for _, tt := range tests {
+		if got := stringMatch(tt.pattern, tt.str, tt.nocase); got != tt.want {
+			t.Errorf("stringMatch(%q, %q, %v) = %v, want %v", tt.pattern, tt.str, tt.nocase, got, tt.want)
+		}
+	}
+}
+
+func TestStringMatchManyStars(t *testing.T) {
+	pattern := strings.Repeat("a*", 20) + "b"
+	str := strings.Repeat("a", 40)
+	if stringMatch(pattern, str, false) {
+		t.Errorf("stringMatch(%q, %q) = true, want false", pattern, str)
+	}
+	if !stringMatch(pattern, str+"b", false) {
+		t.Errorf("stringMatch(%q, %q) = false, want true", pattern, str+"b")
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+func (ch *CommandHandler) hset(c *Client, v Value) []byte {
+	var repl Value
+	if len(v.array) < 4 || len(v.array)%2 != 0 {
+		return wrongArgsError("hset")
+	}
+	key := v.array[1].bulk
+
+	ch.mu.Lock()
+	hash, err := ch.lookupOrCreate(c.db, key, "hash")
+	if err != nil {
+		ch.mu.Unlock()
+		return repl.Error(err.Error())
+	}
+	added := 0
+	for i := 2; i < len(v.array); i += 2 {
+		if hash.hash.Set(v.array[i].bulk, v.array[i+1].bulk) {
+			added++
+		}
+	}
+	ch.mu.Unlock()
+
+	ch.signalModifiedKey(c, key)
+	repl.vType = "num"
+	repl.num = added
+	return repl.Unmarshal()
+}
+
+func (ch *CommandHandler) hget(c *Client, v Value) []byte {
+	var repl Value
+	if len(v.array) != 3 {
+		return wrongArgsError("hget")
+	}
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+
+	ch.tracking.Read(c.id, v.array[1].bulk)
+	hash, ok, err := ch.lookupTyped(c.db, v.array[1].bulk, "hash")
+	if err != nil {
+		return repl.Error(err.Error())
+	}
+	repl.vType = "null"
+	if ok {
+		if field, exists := hash.hash.Get(v.array[2].bulk); exists {
+			repl.vType = "bulk"
+			repl.bulk = field
+		}
+	}
+	return repl.Unmarshal()
+}
+
+func (ch *CommandHandler) hdel(c *Client, v Value) []byte {
+	var repl Value
+	if len(v.array) < 3 {
+		return wrongArgsError("hdel")
+	}
+	key := v.array[1].bulk
+
+	ch.mu.Lock()
+	hash, ok, err := ch.lookupWrite(c.db, key, "hash")
+	if err != nil {
+		ch.mu.Unlock()
+		return repl.Error(err.Error())
+	}
+	deleted := 0
+	if ok {
+		for _, field := range v.array[2:] {
+			if hash.hash.Delete(field.bulk) {
+				deleted++
+			}
+		}
+		ch.deleteIfEmpty(c.db, key, hash)
+	}
+	ch.mu.Unlock()
+
+	if deleted > 0 {
+		ch.signalModifiedKey(c, key)
+	}
+	repl.vType = "num"
+	repl.num = deleted
+	return repl.Unmarshal()
+}
+
+func (ch *CommandHandler) hlen(c *Client, v Value) []byte {
+	var repl Value
+	if len(v.array) != 2 {
+		return wrongArgsError("hlen")
+	}
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+
+	ch.tracking.Read(c.id, v.array[1].bulk)
+	hash, ok, err := ch.lookupTyped(c.db, v.array[1].bulk, "hash")
+	if err != nil {
+		return repl.Error(err.Error())
+	}
+	repl.vType = "num"
+	if ok {
+		repl.num = hash.hash.Len()
+	}
+	return repl.Unmarshal()
+}
+
+func (ch *CommandHandler) hgetall(c *Client, v Value) []byte {
+	var repl Value
+	if len(v.array) != 2 {
+		return wrongArgsError("hgetall")
+	}
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+
+	ch.tracking.Read(c.id, v.array[1].bulk)
+	hash, ok, err := ch.lookupTyped(c.db, v.array[1].bulk, "hash")
+	if err != nil {
+		return repl.Error(err.Error())
+	}
+	repl.vType = "array"
+	if c.Protocol() == 3 {
+		repl.vType = "map"
+	}
+	if ok {
+		hash.hash.Range(func(field, val string) bool {
+			repl.array = append(repl.array, Value{vType: "bulk", bulk: field}, Value{vType: "bulk", bulk: val})
+			return true
+		})
+	}
+	return repl.Unmarshal()
+}
+
+func (ch *CommandHandler) hscan(c *Client, v Value) []byte {
+	var repl Value
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+
+	hash, ok, cursor, opts, err := ch.scanCollection(c, v, "hash")
+	if err != nil {
+		return repl.Error(err.Error())
+	}
+	ch.tracking.Read(c.id, v.array[1].bulk)
+	if !ok {
+		return scanReply(0, nil)
+	}
+	var items []Value
+	cursor = scanDict(hash.hash, cursor, opts.count, func(field, val string) {
+		if !opts.matches(field) {
+			return
+		}
+		items = append(items, Value{vType: "bulk", bulk: field})
+		if !opts.novalues {
+			items = append(items, Value{vType: "bulk", bulk: val})
+		}
+	})
+	return scanReply(cursor, items)
+}
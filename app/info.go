@@ -0,0 +1,470 @@
+package main
+
+import (
+	"fmt"
+	"math/bits"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const redisVersion = "7.2.0"
+
+// instantaneous_ops_per_sec averages this many samples taken by cron
+const opsSamples = 16
+
+// latency histograms count calls by the bit length of their duration in
+// microseconds
+const latencyBuckets = 65
+
+// serverStats are the counters shown by INFO
+type serverStats struct {
+	startTime time.Time
+	runID     string
+
+	connections atomic.Int64 // total_connections_received
+	commands    atomic.Int64 // total_commands_processed
+	errors      atomic.Int64 // total_error_replies
+	expiredKeys atomic.Int64
+	blocked     atomic.Int64 // clients blocked in WAIT or WAITAOF
+	syncFull    atomic.Int64
+	syncPartOK  atomic.Int64
+	syncPartErr atomic.Int64
+
+	mu         sync.Mutex // guards the fields below
+	cmds       map[string]*commandStats
+	errorCodes map[string]int64 // error replies by their first word
+	peakMemory uint64
+	ops        [opsSamples]float64
+	opsIdx     int
+	sampledAt  time.Time
+	sampledOps int64
+}
+
+type commandStats struct {
+	calls, usec, rejected, failed int64
+	latency                       [latencyBuckets]int64
+}
+
+func newServerStats() *serverStats {
+	return &serverStats{
+		startTime:  time.Now(),
+		runID:      randomHex(20),
+		cmds:       make(map[string]*commandStats),
+		errorCodes: make(map[string]int64),
+	}
+}
+
+// called records an executed command, unknown commands only count errors
+func (s *serverStats) called(name string, d time.Duration, reply []byte) {
+	s.commands.Add(1)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := commandTable[name]; ok {
+		cs := s.command(name)
+		usec := d.Microseconds()
+		cs.calls++
+		cs.usec += usec
+		cs.latency[bits.Len64(uint64(usec))]++
+		if isErrorReply(reply) {
+			cs.failed++
+		}
+	}
+	s.countError(reply)
+}
+
+// rejected records a command refused before its execution
+func (s *serverStats) rejected(name string, reply []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := commandTable[name]; ok {
+		s.command(name).rejected++
+	}
+	s.countError(reply)
+}
+
+// command returns the stats of the command, caller must hold s.mu
+func (s *serverStats) command(name string) *commandStats {
+	cs, ok := s.cmds[name]
+	if !ok {
+		cs = &commandStats{}
+		s.cmds[name] = cs
+	}
+	return cs
+}
+
+// countError counts reply by its error code, caller must hold s.mu
+func (s *serverStats) countError(reply []byte) {
+	if !isErrorReply(reply) {
+		return
+	}
+	s.errors.Add(1)
+	code, _, _ := strings.Cut(strings.TrimRight(string(reply[1:]), "\r\n"), " ")
+	s.errorCodes[code]++
+}
+
+func isErrorReply(reply []byte) bool {
+	return len(reply) > 0 && reply[0] == '-'
+}
+
+// cron samples the command rate and the peak memory usage
+func (s *serverStats) cron() {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	now := time.Now()
+	n := s.commands.Load()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.peakMemory = max(s.peakMemory, m.HeapAlloc)
+	if !s.sampledAt.IsZero() {
+		s.ops[s.opsIdx] = float64(n-s.sampledOps) / now.Sub(s.sampledAt).Seconds()
+		s.opsIdx = (s.opsIdx + 1) % opsSamples
+	}
+	s.sampledAt, s.sampledOps = now, n
+}
+
+func (s *serverStats) opsPerSec() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var sum float64
+	for _, ops := range s.ops {
+		sum += ops
+	}
+	return int(sum / opsSamples)
+}
+
+// infoSections lists the sections of INFO in the order they are shown.
+// Sections marked default are shown by INFO without arguments.
+var infoSections = []struct {
+	name, title string
+	dflt        bool
+	lines       func(ch *CommandHandler) []string
+}{
+	{"server", "Server", true, (*CommandHandler).serverInfo},
+	{"clients", "Clients", true, (*CommandHandler).clientsInfo},
+	{"memory", "Memory", true, (*CommandHandler).memoryInfo},
+	{"persistence", "Persistence", true, (*CommandHandler).persistenceInfo},
+	{"stats", "Stats", true, (*CommandHandler).statsInfo},
+	{"replication", "Replication", true, (*CommandHandler).replicationInfo},
+	{"cpu", "CPU", true, (*CommandHandler).cpuInfo},
+	{"modules", "Modules", true, func(*CommandHandler) []string { return nil }},
+	{"commandstats", "Commandstats", false, (*CommandHandler).commandstatsInfo},
+	{"errorstats", "Errorstats", true, (*CommandHandler).errorstatsInfo},
+	{"latencystats", "Latencystats", false, (*CommandHandler).latencystatsInfo},
+	{"cluster", "Cluster", true, (*CommandHandler).clusterInfo},
+	{"keyspace", "Keyspace", true, (*CommandHandler).keyspaceInfo},
+}
+
+// info implements INFO [section ...]. Sections are case insensitive, "all"
+// and "everything" select every section and "default" the default ones.
+// Unknown sections are ignored.
+func (ch *CommandHandler) info(v Value) []byte {
+	selected := make(map[string]bool)
+	all, dflt := false, len(v.array) == 1
+	for _, arg := range v.array[1:] {
+		switch name := strings.ToLower(arg.bulk); name {
+		case "all", "everything":
+			all = true
+		case "default":
+			dflt = true
+		default:
+			selected[name] = true
+		}
+	}
+
+	var sections []string
+	for _, s := range infoSections {
+		if !all && !selected[s.name] && !(dflt && s.dflt) {
+			continue
+		}
+		var b strings.Builder
+		b.WriteString("# " + s.title + "\r\n")
+		for _, line := range s.lines(ch) {
+			b.WriteString(line + "\r\n")
+		}
+		sections = append(sections, b.String())
+	}
+	repl := Value{vType: "bulk", bulk: strings.Join(sections, "\r\n")}
+	return repl.Unmarshal()
+}
+
+func (ch *CommandHandler) serverInfo() []string {
+	uptime := time.Since(ch.stats.startTime)
+	executable, _ := os.Executable()
+	return []string{
+		"redis_version:" + redisVersion,
+		"redis_git_sha1:00000000",
+		"redis_git_dirty:0",
+		"redis_mode:" + ch.mode(),
+		fmt.Sprintf("os:%s %s", runtime.GOOS, runtime.GOARCH),
+		fmt.Sprintf("arch_bits:%d", strconv.IntSize),
+		"go_version:" + runtime.Version(),
+		fmt.Sprintf("process_id:%d", os.Getpid()),
+		"run_id:" + ch.stats.runID,
+		"tcp_port:" + ch.replConf.port,
+		fmt.Sprintf("server_time_usec:%d", time.Now().UnixMicro()),
+		fmt.Sprintf("uptime_in_seconds:%d", int(uptime/time.Second)),
+		fmt.Sprintf("uptime_in_days:%d", int(uptime/(24*time.Hour))),
+		"hz:10",
+		"executable:" + executable,
+		"config_file:",
+	}
+}
+
+func (ch *CommandHandler) clientsInfo() []string {
+	ch.clientsMu.RLock()
+	clients := len(ch.clients)
+	ch.clientsMu.RUnlock()
+	ch.replMu.Lock()
+	replicas := len(ch.replicas)
+	ch.replMu.Unlock()
+	return []string{
+		fmt.Sprintf("connected_clients:%d", clients-replicas),
+		fmt.Sprintf("blocked_clients:%d", ch.stats.blocked.Load()),
+		fmt.Sprintf("tracking_clients:%d", ch.tracking.Clients()),
+	}
+}
+
+func (ch *CommandHandler) memoryInfo() []string {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	ch.stats.mu.Lock()
+	ch.stats.peakMemory = max(ch.stats.peakMemory, m.HeapAlloc)
+	peak := ch.stats.peakMemory
+	ch.stats.mu.Unlock()
+	return []string{
+		fmt.Sprintf("used_memory:%d", m.HeapAlloc),
+		"used_memory_human:" + humanBytes(m.HeapAlloc),
+		fmt.Sprintf("used_memory_rss:%d", m.Sys),
+		"used_memory_rss_human:" + humanBytes(m.Sys),
+		fmt.Sprintf("used_memory_peak:%d", peak),
+		"used_memory_peak_human:" + humanBytes(peak),
+		"maxmemory:0",
+		"maxmemory_human:0B",
+		"maxmemory_policy:noeviction",
+		"mem_allocator:go",
+	}
+}
+
+// humanBytes formats n like used_memory_human
+func humanBytes(n uint64) string {
+	units := []string{"B", "K", "M", "G", "T", "P"}
+	f := float64(n)
+	i := 0
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%dB", n)
+	}
+	return fmt.Sprintf("%.2f%s", f, units[i])
+}
+
+func (ch *CommandHandler) statsInfo() []string {
+	channels, patterns := ch.pubsub.Counts()
+	return []string{
+		fmt.Sprintf("total_connections_received:%d", ch.stats.connections.Load()),
+		fmt.Sprintf("total_commands_processed:%d", ch.stats.commands.Load()),
+		fmt.Sprintf("instantaneous_ops_per_sec:%d", ch.stats.opsPerSec()),
+		fmt.Sprintf("expired_keys:%d", ch.stats.expiredKeys.Load()),
+		"evicted_keys:0",
+		fmt.Sprintf("pubsub_channels:%d", channels),
+		fmt.Sprintf("pubsub_patterns:%d", patterns),
+		fmt.Sprintf("sync_full:%d", ch.stats.syncFull.Load()),
+		fmt.Sprintf("sync_partial_ok:%d", ch.stats.syncPartOK.Load()),
+		fmt.Sprintf("sync_partial_err:%d", ch.stats.syncPartErr.Load()),
+		fmt.Sprintf("total_error_replies:%d", ch.stats.errors.Load()),
+	}
+}
+
+func (ch *CommandHandler) replicationInfo() []string {
+	ch.replMu.Lock()
+	defer ch.replMu.Unlock()
+	info := &ch.replConf.replication
+
+	lines := []string{"role:" + info.role}
+	if info.role == "slave" {
+		lastIO := -1
+		if !info.master_last_io.IsZero() {
+			lastIO = int(time.Since(info.master_last_io) / time.Second)
+		}
+		linkStatus := "down"
+		if info.master_link_state == replStateConnected {
+			linkStatus = "up"
+		}
+		lines = append(lines,
+			"master_host:"+info.master_host,
+			"master_port:"+info.master_port,
+			"master_link_status:"+linkStatus,
+			fmt.Sprintf("master_last_io_seconds_ago:%d", lastIO),
+			fmt.Sprintf("master_sync_in_progress:%d", boolToInt(info.master_link_state == replStateSync)),
+			fmt.Sprintf("slave_read_repl_offset:%d", info.offset),
+			fmt.Sprintf("slave_repl_offset:%d", info.offset),
+		)
+		if info.master_link_state != replStateConnected {
+			downSince := -1
+			if !info.master_link_down_since.IsZero() {
+				downSince = int(time.Since(info.master_link_down_since) / time.Second)
+			}
+			lines = append(lines, fmt.Sprintf("master_link_down_since_seconds:%d", downSince))
+		}
+		lines = append(lines,
+			"slave_priority:100",
+			fmt.Sprintf("slave_read_only:%d", boolToInt(ch.replConf.readOnly)),
+			"replica_announced:1",
+		)
+	}
+
+	lines = append(lines, fmt.Sprintf("connected_slaves:%d", len(ch.replicas)))
+	for i, line := range ch.replicaInfo() {
+		lines = append(lines, fmt.Sprintf("slave%d:%s", i, line))
+	}
+	backlogStart, backlogLen := 0, 0
+	if ch.backlog != nil {
+		backlogStart, backlogLen = ch.backlog.start(), ch.backlog.histlen
+	}
+	return append(lines,
+		"master_failover_state:no-failover",
+		"master_replid:"+info.master_replid,
+		"master_replid2:"+info.master_replid2,
+		fmt.Sprintf("master_repl_offset:%d", info.master_repl_offset),
+		fmt.Sprintf("second_repl_offset:%d", info.second_repl_offset),
+		fmt.Sprintf("repl_backlog_active:%d", boolToInt(ch.backlog != nil)),
+		fmt.Sprintf("repl_backlog_size:%d", ch.replConf.backlogSize),
+		fmt.Sprintf("repl_backlog_first_byte_offset:%d", backlogStart),
+		fmt.Sprintf("repl_backlog_histlen:%d", backlogLen),
+	)
+}
+
+func (ch *CommandHandler) cpuInfo() []string {
+	var self, children syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &self)
+	syscall.Getrusage(syscall.RUSAGE_CHILDREN, &children)
+	seconds := func(tv syscall.Timeval) string {
+		return fmt.Sprintf("%.6f", time.Duration(tv.Nano()).Seconds())
+	}
+	return []string{
+		"used_cpu_sys:" + seconds(self.Stime),
+		"used_cpu_user:" + seconds(self.Utime),
+		"used_cpu_sys_children:" + seconds(children.Stime),
+		"used_cpu_user_children:" + seconds(children.Utime),
+	}
+}
+
+func (ch *CommandHandler) commandstatsInfo() []string {
+	ch.stats.mu.Lock()
+	defer ch.stats.mu.Unlock()
+	var lines []string
+	for _, name := range sortedKeys(ch.stats.cmds) {
+		cs := ch.stats.cmds[name]
+		perCall := 0.0
+		if cs.calls > 0 {
+			perCall = float64(cs.usec) / float64(cs.calls)
+		}
+		lines = append(lines, fmt.Sprintf("cmdstat_%s:calls=%d,usec=%d,usec_per_call=%.2f,rejected_calls=%d,failed_calls=%d",
+			name, cs.calls, cs.usec, perCall, cs.rejected, cs.failed))
+	}
+	return lines
+}
+
+func (ch *CommandHandler) errorstatsInfo() []string {
+	ch.stats.mu.Lock()
+	defer ch.stats.mu.Unlock()
+	var lines []string
+	for _, code := range sortedKeys(ch.stats.errorCodes) {
+		lines = append(lines, fmt.Sprintf("errorstat_%s:count=%d", code, ch.stats.errorCodes[code]))
+	}
+	return lines
+}
+
+// latencystatsInfo shows the p50, p99 and p99.9 latency of every command, as
+// the upper bound of the histogram bucket holding the percentile
+func (ch *CommandHandler) latencystatsInfo() []string {
+	ch.stats.mu.Lock()
+	defer ch.stats.mu.Unlock()
+	var lines []string
+	for _, name := range sortedKeys(ch.stats.cmds) {
+		cs := ch.stats.cmds[name]
+		if cs.calls == 0 {
+			continue
+		}
+		var ps []string
+		for _, p := range []float64{50, 99, 99.9} {
+			ps = append(ps, fmt.Sprintf("p%s=%.3f", strconv.FormatFloat(p, 'f', -1, 64), cs.percentile(p)))
+		}
+		lines = append(lines, fmt.Sprintf("latency_percentiles_usec_%s:%s", name, strings.Join(ps, ",")))
+	}
+	return lines
+}
+
+// percentile returns the upper bound in microseconds of the latency bucket
+// holding the p-th percentile of the calls
+func (cs *commandStats) percentile(p float64) float64 {
+	rank := int64(p / 100 * float64(cs.calls))
+	var seen int64
+	for i, n := range cs.latency {
+		seen += n
+		if seen > rank || seen == cs.calls {
+			return float64(uint64(1) << i)
+		}
+	}
+	return 0
+}
+
+func (ch *CommandHandler) clusterInfo() []string {
+	return []string{fmt.Sprintf("cluster_enabled:%d", boolToInt(ch.cluster != nil))}
+}
+
+// mode is the mode of the server reported by INFO and HELLO
+func (ch *CommandHandler) mode() string {
+	if ch.cluster != nil {
+		return "cluster"
+	}
+	return "standalone"
+}
+
+// keyspaceInfo shows the keys, keys with a TTL and their average TTL in
+// milliseconds for every database holding keys
+func (ch *CommandHandler) keyspaceInfo() []string {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	var lines []string
+	now := time.Now()
+	for db, keys := range ch.data {
+		if keys.Len() == 0 {
+			continue
+		}
+		var expires int
+		var ttl time.Duration
+		keys.Range(func(_ string, v StoredValue) bool {
+			if !v.expires.IsZero() {
+				expires++
+				ttl += max(v.expires.Sub(now), 0)
+			}
+			return true
+		})
+		var avgTTL int64
+		if expires > 0 {
+			avgTTL = (ttl / time.Duration(expires)).Milliseconds()
+		}
+		lines = append(lines, fmt.Sprintf("db%d:keys=%d,expires=%d,avg_ttl=%d", db, keys.Len(), expires, avgTTL))
+	}
+	return lines
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	return keys
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+// list keeps elements in a slice, head first
+type list struct {
+	items []string
+}
+
+func newList() *list {
+	return &list{}
+}
+
+func (l *list) clone() *list {
+	return &list{items: append([]string(nil), l.items...)}
+}
+
+func (l *list) Len() int {
+	return len(l.items)
+}
+
+func (l *list) PushHead(items ...string) {
+	head := make([]string, 0, len(items)+len(l.items))
+	for i := len(items) - 1; i >= 0; i-- {
+		head = append(head, items[i])
+	}
+	l.items = append(head, l.items...)
+}
+
+func (l *list) PushTail(items ...string) {
+	l.items = append(l.items, items...)
+}
+
+// PopHead removes up to count elements from the head
+func (l *list) PopHead(count int) []string {
+	count = min(count, len(l.items))
+	popped := append([]string(nil), l.items[:count]...)
+	l.items = l.items[count:]
+	return popped
+}
+
+// PopTail removes up to count elements from the tail, the last element first
+func (l *list) PopTail(count int) []string {
+	count = min(count, len(l.items))
+	popped := make([]string, 0, count)
+	for i := len(l.items) - 1; i >= len(l.items)-count; i-- {
+		popped = append(popped, l.items[i])
+	}
+	l.items = l.items[:len(l.items)-count]
+	return popped
+}
+
+// Range returns elements between start and stop indexes inclusive, negative indexes count from the end
+func (l *list) Range(start, stop int) []string {
+	length := len(l.items)
+	if start < 0 {
+		start += length
+	}
+	if stop < 0 {
+		stop += length
+	}
+	start = max(start, 0)
+	stop = min(stop, length-1)
+	if start > stop || start >= length {
+		return nil
+	}
+	return l.items[start : stop+1]
+}
+
+func (ch *CommandHandler) push(c *Client, v Value, head bool) []byte {
+	var repl Value
+	if len(v.array) < 3 {
+		return wrongArgsError(strings.ToLower(v.array[0].bulk))
+	}
+	key := v.array[1].bulk
+	items := make([]string, 0, len(v.array)-2)
+	for _, item := range v.array[2:] {
+		items = append(items, item.bulk)
+	}
+
+	ch.mu.Lock()
+	l, err := ch.lookupOrCreate(c.db, key, "list")
+	if err != nil {
+		ch.mu.Unlock()
+		return repl.Error(err.Error())
+	}
+	if head {
+		l.list.PushHead(items...)
+	} else {
+		l.list.PushTail(items...)
+	}
+	length := l.list.Len()
+	ch.mu.Unlock()
+
+	ch.signalModifiedKey(c, key)
+	repl.vType = "num"
+	repl.num = length
+	return repl.Unmarshal()
+}
+
+func (ch *CommandHandler) pop(c *Client, v Value, head bool) []byte {
+	var repl Value
+	if len(v.array) != 2 && len(v.array) != 3 {
+		return wrongArgsError(strings.ToLower(v.array[0].bulk))
+	}
+	key := v.array[1].bulk
+	count := 1
+	if len(v.array) == 3 {
+		n, err := strconv.Atoi(v.array[2].bulk)
+		if err != nil || n < 0 {
+			return repl.Error("ERR value is out of range, must be positive")
+		}
+		count = n
+	}
+
+	ch.mu.Lock()
+	l, ok, err := ch.lookupWrite(c.db, key, "list")
+	if err != nil {
+		ch.mu.Unlock()
+		return repl.Error(err.Error())
+	}
+	var popped []string
+	if ok {
+		if head {
+			popped = l.list.PopHead(count)
+		} else {
+			popped = l.list.PopTail(count)
+		}
+		ch.deleteIfEmpty(c.db, key, l)
+	}
+	ch.mu.Unlock()
+
+	if len(popped) > 0 {
+		ch.signalModifiedKey(c, key)
+	}
+	switch {
+	case !ok:
+		repl.vType = "null"
+	case len(v.array) == 2:
+		repl.vType = "bulk"
+		repl.bulk = popped[0]
+	default:
+		repl.vType = "array"
+		for _, item := range popped {
+			repl.array = append(repl.array, Value{vType: "bulk", bulk: item})
+		}
+	}
+	return repl.Unmarshal()
+}
+
+func (ch *CommandHandler) llen(c *Client, v Value) []byte {
+	var repl Value
+	if len(v.array) != 2 {
+		return wrongArgsError("llen")
+	}
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+
+	ch.tracking.Read(c.id, v.array[1].bulk)
+	l, ok, err := ch.lookupTyped(c.db, v.array[1].bulk, "list")
+	if err != nil {
+		return repl.Error(err.Error())
+	}
+	repl.vType = "num"
+	if ok {
+		repl.num = l.list.Len()
+	}
+	return repl.Unmarshal()
+}
+
+func (ch *CommandHandler) lrange(c *Client, v Value) []byte {
+	var repl Value
+	if len(v.array) != 4 {
+		return wrongArgsError("lrange")
+	}
+	start, err1 := strconv.Atoi(v.array[2].bulk)
+	stop, err2 := strconv.Atoi(v.array[3].bulk)
+	if err1 != nil || err2 != nil {
+		return repl.Error("ERR value is not an integer or out of range")
+	}
+
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+
+	ch.tracking.Read(c.id, v.array[1].bulk)
+	l, ok, err := ch.lookupTyped(c.db, v.array[1].bulk, "list")
+	if err != nil {
+		return repl.Error(err.Error())
+	}
+	repl.vType = "array"
+	if ok {
+		for _, item := range l.list.Range(start, stop) {
+			repl.array = append(repl.array, Value{vType: "bulk", bulk: item})
+		}
+	}
+	return repl.Unmarshal()
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+const listpackHeaderSize = 6
+
+// listpackEntries decodes all elements of a listpack, integers are returned
+// in their decimal form
+func listpackEntries(lp []byte) ([]string, error) {
+	if len(lp) < listpackHeaderSize+1 {
+		return nil, fmt.Errorf("listpack is too short")
+	}
+	if total := binary.LittleEndian.Uint32(lp); int(total) != len(lp) {
+		return nil, fmt.Errorf("listpack size %d does not match header %d", len(lp), total)
+	}
+	var entries []string
+	p := listpackHeaderSize
+	for {
+		if p >= len(lp) {
+			return nil, fmt.Errorf("listpack is not terminated")
+		}
+		if lp[p] == 0xFF {
+			return entries, nil
+		}
+		entry, size, err := listpackEntry(lp[p:])
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+		p += size + listpackBacklenSize(size)
+	}
+}
+
+// listpackEntry decodes element at the beginning of p and returns it with the
+// size of its encoding and data, not counting the trailing backlen
+func listpackEntry(p []byte) (string, int, error) {
+	need := func(n int) error {
+		if len(p) < n {
+			return fmt.Errorf("listpack entry is truncated")
+		}
+		return nil
+	}
+	b := p[0]
+	switch {
+	case b&0x80 == 0: // 7 bit unsigned int
+		return strconv.Itoa(int(b & 0x7F)), 1, nil
+	case b&0xC0 == 0x80: // 6 bit string length
+		n := int(b & 0x3F)
+		if err := need(1 + n); err != nil {
+			return "", 0, err
+		}
+		return string(p[1 : 1+n]), 1 + n, nil
+	case b&0xE0 == 0xC0: // 13 bit signed int
+		if err := need(2); err != nil {
+			return "", 0, err
+		}
+		v := int64(b&0x1F)<<8 | int64(p[1])
+		if v >= 1<<12 {
+			v -= 1 << 13
+		}
+		return strconv.FormatInt(v, 10), 2, nil
+	case b&0xF0 == 0xE0: // 12 bit string length
+		if err := need(2); err != nil {
+			return "", 0, err
+		}
+		n := int(b&0x0F)<<8 | int(p[1])
+		if err := need(2 + n); err != nil {
+			return "", 0, err
+		}
+		return string(p[2 : 2+n]), 2 + n, nil
+	}
+	switch b {
+	case 0xF0: // 32 bit string length
+		if err := need(5); err != nil {
+			return "", 0, err
+		}
+		n := int(binary.LittleEndian.Uint32(p[1:]))
+		if err := need(5 + n); err != nil {
+			return "", 0, err
+		}
+		return string(p[5 : 5+n]), 5 + n, nil
+	case 0xF1:
+		if err := need(3); err != nil {
+			return "", 0, err
+		}
+		return strconv.FormatInt(int64(int16(binary.LittleEndian.Uint16(p[1:]))), 10), 3, nil
+	case 0xF2:
+		if err := need(4); err != nil {
+			return "", 0, err
+		}
+		v := int32(uint32(p[1])<<8|uint32(p[2])<<16|uint32(p[3])<<24) >> 8
+		return strconv.FormatInt(int64(v), 10), 4, nil
+	case 0xF3:
+		if err := need(5); err != nil {
+			return "", 0, err
+		}
+		return strconv.FormatInt(int64(int32(binary.LittleEndian.Uint32(p[1:]))), 10), 5, nil
+	case 0xF4:
+		if err := need(9); err != nil {
+			return "", 0, err
+		}
+		return strconv.FormatInt(int64(binary.LittleEndian.Uint64(p[1:])), 10), 9, nil
+	}
+	return "", 0, fmt.Errorf("invalid listpack entry encoding 0x%02x", b)
+}
+
+// listpackBacklenSize returns how many bytes backlen of entry of size takes
+func listpackBacklenSize(size int) int {
+	switch {
+	case size <= 127:
+		return 1
+	case size < 16383:
+		return 2
+	case size < 2097151:
+		return 3
+	case size < 268435455:
+		return 4
+	}
+	return 5
+}
+
+func listpackBacklen(size int) []byte {
+	n := listpackBacklenSize(size)
+	buf := make([]byte, n)
+	buf[0] = byte(size >> (7 * (n - 1)))
+	for i := 1; i < n; i++ {
+		buf[i] = byte(size>>(7*(n-1-i)))&127 | 128
+	}
+	return buf
+}
+
+// newListpack encodes entries into a listpack, integer looking strings are
+// stored as integers the way Redis does
+func newListpack(entries []string) []byte {
+	lp := make([]byte, listpackHeaderSize)
+	for _, e := range entries {
+		var enc []byte
+		if v, err := strconv.ParseInt(e, 10, 64); err == nil && strconv.FormatInt(v, 10) == e {
+			enc = listpackInt(v)
+		} else {
+			enc = listpackString(e)
+		}
+		lp = append(lp, enc...)
+		lp = append(lp, listpackBacklen(len(enc))...)
+	}
+	lp = append(lp, 0xFF)
+	binary.LittleEndian.PutUint32(lp, uint32(len(lp)))
+	count := len(entries)
+	if count > 65535 {
+		count = 65535 // unknown, must be counted by walking the listpack
+	}
+	binary.LittleEndian.PutUint16(lp[4:], uint16(count))
+	return lp
+}
+
+func listpackInt(v int64) []byte {
+	switch {
+	case v >= 0 && v <= 127:
+		return []byte{byte(v)}
+	case v >= -4096 && v <= 4095:
+		u := uint64(v) & 0x1FFF
+		return []byte{0xC0 | byte(u>>8), byte(u)}
+	case v >= -32768 && v <= 32767:
+		buf := []byte{0xF1, 0, 0}
+		binary.LittleEndian.PutUint16(buf[1:], uint16(v))
+		return buf
+	case v >= -8388608 && v <= 8388607:
+		u := uint32(v)
+		return []byte{0xF2, byte(u), byte(u >> 8), byte(u >> 16)}
+	case v >= -2147483648 && v <= 2147483647:
+		buf := []byte{0xF3, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(buf[1:], uint32(v))
+		return buf
+	}
+	buf := make([]byte, 9)
+	buf[0] = 0xF4
+	binary.LittleEndian.PutUint64(buf[1:], uint64(v))
+	return buf
+}
+
+func listpackString(s string) []byte {
+	n := len(s)
+	var buf []byte
+	switch {
+	case n < 64:
+		buf = []byte{0x80 | byte(n)}
+	case n < 4096:
+		buf = []byte{0xE0 | byte(n>>8), byte(n)}
+	default:
+		buf = []byte{0xF0, 0, 0, 0, 0}
+		binary.LittleEndian.PutUint32(buf[1:], uint32(n))
+	}
+	return append(buf, s...)
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// delays between attempts to reconnect to the master, doubled after every
+// failed attempt
+const (
+	replReconnectMin = 100 * time.Millisecond
+	replReconnectMax = 5 * time.Second
+)
+
+// replicas acknowledge the stream this often
+const replAckPeriod = time.Second
+
+var errLinkStopped = errors.New("replication link stopped")
+
+// timeoutConn fails reads waiting longer than timeout for data. The master
+// pings its replicas, a silent link is dead.
+type timeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c timeoutConn) Read(p []byte) (int, error) {
+	if err := c.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.Conn.Read(p)
+}
+
+// masterLink is the connection of a replica to its master. replicationLoop
+// keeps it up until REPLICAOF stops it.
+type masterLink struct {
+	host, port string
+
+	mu      sync.Mutex
+	conn    net.Conn // current connection, closed by stop
+	stopped bool
+	done    chan struct{} // closed by stop
+	exited  chan struct{} // closed when replicationLoop returns
+}
+
+func newMasterLink(host, port string) *masterLink {
+	return &masterLink{
+		host:   host,
+		port:   port,
+		done:   make(chan struct{}),
+		exited: make(chan struct{}),
+	}
+}
+
+// setConn makes conn the current connection, it is closed right away and
+// false is returned when the link was stopped meanwhile
+func (l *masterLink) setConn(conn net.Conn) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.stopped {
+		conn.Close()
+		return false
+	}
+	l.conn = conn
+	return true
+}
+
+func (l *masterLink) isStopped() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stopped
+}
+
+// stop closes the connection and waits for replicationLoop to return, so no
+// command of the former master is applied afterwards
+func (l *masterLink) stop() {
+	l.mu.Lock()
+	if !l.stopped {
+		l.stopped = true
+		close(l.done)
+		if l.conn != nil {
+			l.conn.Close()
+		}
+	}
+	l.mu.Unlock()
+	<-l.exited
+}
+
+// setMaster makes the server a replica of host:port, or promotes it to a
+// master when host is empty. The link to the former master is closed first.
+func (r *Redis) setMaster(host, port string) {
+	r.linkMu.Lock()
+	defer r.linkMu.Unlock()
+	if r.link != nil {
+		r.link.stop()
+		r.link = nil
+	}
+	if host == "" {
+		r.commandHandler.promote()
+		fmt.Println("MASTER MODE enabled")
+		return
+	}
+	r.commandHandler.demote(host, port)
+	r.link = newMasterLink(host, port)
+	go r.replicationLoop(r.link)
+}
+
+// replicationLoop connects to the master, synchronizes with it and applies
+// its stream. A failed attempt or a lost connection is retried with
+// exponential backoff until the link is stopped.
+func (r *Redis) replicationLoop(l *masterLink) {
+	defer close(l.exited)
+	delay := replReconnectMin
+	for !l.isStopped() {
+		fmt.Printf("Connecting to MASTER %s:%s\n", l.host, l.port)
+		r.commandHandler.setMasterLink(replStateConnecting)
+		conn, rd, err := r.Handshake(l)
+		if err == nil {
+			r.commandHandler.setMasterLink(replStateConnected)
+			delay = replReconnectMin
+			r.serveMaster(l, conn, rd)
+			fmt.Println("Connection with master lost.")
+		} else if !errors.Is(err, errLinkStopped) {
+			fmt.Println("Error condition on socket for SYNC:", err)
+		}
+		r.commandHandler.setMasterLink(replStateConnect)
+
+		select {
+		case <-l.done:
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, replReconnectMax)
+	}
+}
+
+// serveMaster applies the stream of the master until the connection breaks
+// or times out. Only REPLCONF GETACK gets a reply, the master doesn't read
+// the others.
+func (r *Redis) serveMaster(l *masterLink, conn net.Conn, rd *bufio.Reader) {
+	defer conn.Close()
+
+	client := NewClient(rd, bufio.NewWriter(conn))
+	client.master = true
+	// the stream continued after a snapshot or a reconnection doesn't
+	// repeat SELECT
+	client.db = r.commandHandler.streamDB()
+	r.commandHandler.addClient(client)
+	defer r.commandHandler.removeClient(client)
+
+	done := make(chan struct{})
+	defer close(done)
+	go r.sendAcks(client, done)
+
+	for {
+		parser := NewParser(client.rw.Reader)
+		v, err := parser.Parse()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			fmt.Println("MASTER timeout: no data nor PING received...")
+		}
+		if err != nil || l.isStopped() {
+			return
+		}
+		reply := r.commandHandler.applyFromMaster(client, v)
+		if isGetAck(v) {
+			client.Write(reply)
+		}
+	}
+}
+
+// sendAcks reports the processed offset to the master every replAckPeriod
+// until done is closed, the master uses it for WAIT and to detect timeouts
+func (r *Redis) sendAcks(client *Client, done chan struct{}) {
+	ticker := time.NewTicker(replAckPeriod)
+	defer ticker.Stop()
+	for {
+		if err := client.Write(r.commandHandler.ackCommand()); err != nil {
+			return
+		}
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func isGetAck(v Value) bool {
+	return v.vType == "array" && len(v.array) > 1 &&
+		strings.EqualFold(v.array[0].bulk, "replconf") && strings.EqualFold(v.array[1].bulk, "getack")
+}
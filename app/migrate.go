@@ -0,0 +1,359 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errBadDumpPayload = errors.New("ERR DUMP payload version or checksum are wrong")
+
+// dumpPayload serializes v the way DUMP does: the value in RDB format followed
+// by the RDB version and a CRC64 of everything before it, both little endian
+func dumpPayload(v StoredValue) []byte {
+	var b bytes.Buffer
+	rw := newRDBWriter(&b)
+	rw.writeByte(rdbValueType(v))
+	rw.writeValue(v)
+	rw.write([]byte{rdbVersion, 0})
+	rw.w.Flush()
+	return binary.LittleEndian.AppendUint64(b.Bytes(), rw.crc)
+}
+
+// parseDumpPayload verifies the footer of a DUMP payload and decodes the value
+func parseDumpPayload(payload []byte) (StoredValue, error) {
+	if len(payload) < 10 {
+		return StoredValue{}, errBadDumpPayload
+	}
+	footer := len(payload) - 10
+	version := binary.LittleEndian.Uint16(payload[footer:])
+	crc := binary.LittleEndian.Uint64(payload[footer+2:])
+	if version > rdbVersion || crc64Update(0, payload[:footer+2]) != crc {
+		return StoredValue{}, errBadDumpPayload
+	}
+
+	rr := &rdbReader{r: bufio.NewReader(bytes.NewReader(payload[:footer]))}
+	t, err := rr.readByte()
+	if err != nil || t == rdbTypeModule2 || t == rdbTypeModulePreGA {
+		return StoredValue{}, errors.New("ERR Bad data format")
+	}
+	v, err := rr.readObject(t)
+	if err != nil || rr.offset != int64(footer) {
+		return StoredValue{}, errors.New("ERR Bad data format")
+	}
+	return v, nil
+}
+
+func (ch *CommandHandler) dump(c *Client, v Value) []byte {
+	var repl Value
+	if len(v.array) != 2 {
+		return wrongArgsError("dump")
+	}
+	key := v.array[1].bulk
+	ch.mu.RLock()
+	val, ok := ch.lookupKey(c.db, key)
+	ch.tracking.Read(c.id, key)
+	if !ok {
+		ch.mu.RUnlock()
+		repl.vType = "null"
+		return repl.Unmarshal()
+	}
+	payload := dumpPayload(val)
+	ch.mu.RUnlock()
+
+	repl.vType = "bulk"
+	repl.bulk = string(payload)
+	return repl.Unmarshal()
+}
+
+// restore creates key from a DUMP payload. IDLETIME and FREQ are validated
+// but not used as keys have no access statistics.
+func (ch *CommandHandler) restore(c *Client, v Value) []byte {
+	var repl Value
+	if len(v.array) < 4 {
+		return wrongArgsError("restore")
+	}
+	key := v.array[1].bulk
+	ttl, err := strconv.ParseInt(v.array[2].bulk, 10, 64)
+	if err != nil {
+		return repl.Error("ERR value is not an integer or out of range")
+	}
+	if ttl < 0 {
+		return repl.Error("ERR Invalid TTL value, must be >= 0")
+	}
+	replace, absTTL := false, false
+	idle, freq := int64(-1), int64(-1)
+	args := v.array[4:]
+	for i := 0; i < len(args); i++ {
+		switch strings.ToLower(args[i].bulk) {
+		case "replace":
+			replace = true
+		case "absttl":
+			absTTL = true
+		case "idletime":
+			if i+1 >= len(args) || freq != -1 {
+				return repl.Error("ERR syntax error")
+			}
+			i++
+			idle, err = strconv.ParseInt(args[i].bulk, 10, 64)
+			if err != nil {
+				return repl.Error("ERR value is not an integer or out of range")
+			}
+			if idle < 0 {
+				return repl.Error("ERR Invalid IDLETIME value, must be >= 0")
+			}
+		case "freq":
+			if i+1 >= len(args) || idle != -1 {
+				return repl.Error("ERR syntax error")
+			}
+			i++
+			freq, err = strconv.ParseInt(args[i].bulk, 10, 64)
+			if err != nil {
+				return repl.Error("ERR value is not an integer or out of range")
+			}
+			if freq < 0 || freq > 255 {
+				return repl.Error("ERR Invalid FREQ value, must be >= 0 and <= 255")
+			}
+		default:
+			return repl.Error("ERR syntax error")
+		}
+	}
+
+	val, err := parseDumpPayload([]byte(v.array[3].bulk))
+	if err != nil {
+		return repl.Error(err.Error())
+	}
+	if ttl > 0 {
+		if absTTL {
+			val.expires = time.UnixMilli(ttl)
+		} else {
+			val.expires = time.Now().Add(time.Duration(ttl) * time.Millisecond)
+		}
+	}
+
+	ch.mu.Lock()
+	_, exists := ch.lookupKey(c.db, key)
+	if exists && !replace {
+		ch.mu.Unlock()
+		return repl.Error("BUSYKEY Target key name already exists.")
+	}
+	// a TTL in the past only deletes the key being replaced
+	if val.isExpired() {
+		ch.data[c.db].Delete(key)
+		ch.mu.Unlock()
+		if exists {
+			ch.signalModifiedKey(c, key)
+			c.rewriteCommand(bulkArray([]string{"DEL", key}))
+		} else {
+			c.rewriteCommand()
+		}
+		return repl.OK()
+	}
+	val.gen = ch.snapshotGen
+	ch.data[c.db].Set(key, val)
+	ch.mu.Unlock()
+
+	ch.signalModifiedKey(c, key)
+	// the TTL is propagated as a timestamp, replicas would expire the key later
+	if ttl > 0 && !absTTL {
+		argv := append([]Value(nil), v.array...)
+		argv[2] = Value{vType: "bulk", bulk: strconv.FormatInt(val.expires.UnixMilli(), 10)}
+		argv = append(argv, Value{vType: "bulk", bulk: "ABSTTL"})
+		c.rewriteCommand(Value{vType: "array", array: argv})
+	}
+	return repl.OK()
+}
+
+type migrateOptions struct {
+	host, port string
+	db         int
+	timeout    time.Duration
+	copy       bool
+	replace    bool
+	auth       []string // AUTH arguments sent to the target
+	keys       []string
+}
+
+func parseMigrateOptions(v Value) (migrateOptions, error) {
+	var opts migrateOptions
+	opts.host = v.array[1].bulk
+	opts.port = v.array[2].bulk
+	db, err := strconv.Atoi(v.array[4].bulk)
+	if err != nil {
+		return opts, errors.New("ERR value is not an integer or out of range")
+	}
+	timeout, err := strconv.ParseInt(v.array[5].bulk, 10, 64)
+	if err != nil {
+		return opts, errors.New("ERR value is not an integer or out of range")
+	}
+	if timeout <= 0 {
+		timeout = 1000
+	}
+	opts.db = db
+	opts.timeout = time.Duration(timeout) * time.Millisecond
+
+	args := v.array[6:]
+	for i := 0; i < len(args); i++ {
+		switch strings.ToLower(args[i].bulk) {
+		case "copy":
+			opts.copy = true
+		case "replace":
+			opts.replace = true
+		case "auth":
+			if i+1 >= len(args) {
+				return opts, errors.New("ERR syntax error")
+			}
+			opts.auth = []string{args[i+1].bulk}
+			i++
+		case "auth2":
+			if i+2 >= len(args) {
+				return opts, errors.New("ERR syntax error")
+			}
+			opts.auth = []string{args[i+1].bulk, args[i+2].bulk}
+			i += 2
+		case "keys":
+			if v.array[3].bulk != "" {
+				return opts, errors.New("ERR When using MIGRATE KEYS option, the key argument must be set to the empty string")
+			}
+			for _, arg := range args[i+1:] {
+				opts.keys = append(opts.keys, arg.bulk)
+			}
+			i = len(args)
+		default:
+			return opts, errors.New("ERR syntax error")
+		}
+	}
+	if v.array[3].bulk != "" {
+		opts.keys = []string{v.array[3].bulk}
+	}
+	return opts, nil
+}
+
+// migrate sends keys to another instance with RESTORE and, unless COPY is
+// given, deletes the keys the target accepted. It runs as a write command
+// under writeMu for the whole round trip, so the keys can't change between
+// being sent and being deleted.
+func (ch *CommandHandler) migrate(c *Client, v Value) []byte {
+	var repl Value
+	if len(v.array) < 6 {
+		return wrongArgsError("migrate")
+	}
+	opts, err := parseMigrateOptions(v)
+	if err != nil {
+		return repl.Error(err.Error())
+	}
+	// replaying MIGRATE would contact the target again, only the deletion
+	// of the moved keys is propagated
+	c.rewriteCommand()
+
+	// payloads are taken at once so the keys are sent as of the same moment
+	var keys []string
+	var cmds []Value
+	ch.mu.RLock()
+	for _, key := range opts.keys {
+		val, ok := ch.lookupKey(c.db, key)
+		if !ok {
+			continue
+		}
+		ttl := int64(0)
+		if !val.expires.IsZero() {
+			ttl = max(time.Until(val.expires).Milliseconds(), 1)
+		}
+		// the target of a slot migration accepts it before owning the slot
+		restore := "RESTORE"
+		if ch.cluster != nil {
+			restore = "RESTORE-ASKING"
+		}
+		args := []string{restore, key, strconv.FormatInt(ttl, 10), string(dumpPayload(val))}
+		if opts.replace {
+			args = append(args, "REPLACE")
+		}
+		keys = append(keys, key)
+		cmds = append(cmds, bulkArray(args))
+	}
+	ch.mu.RUnlock()
+	if len(keys) == 0 {
+		repl.vType = "str"
+		repl.str = "NOKEY"
+		return repl.Unmarshal()
+	}
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(opts.host, opts.port), opts.timeout)
+	if err != nil {
+		return repl.Error("IOERR error or timeout connecting to the client")
+	}
+	defer conn.Close()
+
+	var out []byte
+	if opts.auth != nil {
+		auth := bulkArray(append([]string{"AUTH"}, opts.auth...))
+		out = append(out, auth.Unmarshal()...)
+	}
+	sel := bulkArray([]string{"SELECT", strconv.Itoa(opts.db)})
+	out = append(out, sel.Unmarshal()...)
+	for _, cmd := range cmds {
+		out = append(out, cmd.Unmarshal()...)
+	}
+	conn.SetDeadline(time.Now().Add(opts.timeout))
+	if _, err := conn.Write(out); err != nil {
+		return repl.Error("IOERR error or timeout writing to target instance")
+	}
+
+	// replies to AUTH and SELECT come first, then one per RESTORE
+	parser := NewParser(bufio.NewReader(conn))
+	replies := len(cmds) + 1
+	if opts.auth != nil {
+		replies++
+	}
+	// keys restored after a failed AUTH or SELECT are not in the right place
+	// on the target, they are kept here
+	var moved []string
+	var targetErr string
+	prefixFailed := false
+	for i := 0; i < replies; i++ {
+		conn.SetDeadline(time.Now().Add(opts.timeout))
+		reply, err := parser.Parse()
+		if err != nil {
+			return repl.Error("IOERR error or timeout reading to target instance")
+		}
+		restored := i - (replies - len(cmds))
+		if reply.vType == "error" {
+			if targetErr == "" {
+				targetErr = reply.str
+			}
+			prefixFailed = prefixFailed || restored < 0
+			continue
+		}
+		if restored >= 0 && !prefixFailed {
+			moved = append(moved, keys[restored])
+		}
+	}
+
+	if !opts.copy && len(moved) > 0 {
+		ch.deleteMigrated(c, moved)
+	}
+	if targetErr != "" {
+		return repl.Error("ERR Target instance replied with error: " + targetErr)
+	}
+	return repl.OK()
+}
+
+// deleteMigrated deletes keys moved to the target and propagates it as DEL,
+// also when MIGRATE then fails for other keys. Caller must hold ch.writeMu.
+func (ch *CommandHandler) deleteMigrated(c *Client, keys []string) {
+	ch.mu.Lock()
+	for _, key := range keys {
+		ch.data[c.db].Delete(key)
+	}
+	ch.mu.Unlock()
+
+	for _, key := range keys {
+		ch.signalModifiedKey(c, key)
+	}
+	c.woff = ch.propagateWrite(c.db, bulkArray(append([]string{"DEL"}, keys...)))
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestDumpPayload(t *testing.T) {
+	hash, _ := hashFromItems([]string{"f", "v"})
+	for _, v := range []StoredValue{
+		{vType: "string", val: "hello"},
+		{vType: "string", val: ""},
+		listFromItems([]string{"a", "b", "c"}),
+		setFromItems([]string{"x", "y"}),
+		hash,
+		testStream(),
+	} {
+		payload := dumpPayload(v)
+		got, err := parseDumpPayload(payload)
+		if err != nil {
+			t.Fatalf("parseDumpPayload(dumpPayload(%s)): %v", v.vType, err)
+		}
+		if g, w := valueJSON(t, got), valueJSON(t, v); g != w {
+			t.Errorf("%s: got %s, want %s", v.vType, g, w)
+		}
+	}
+}
+
+func TestParseDumpPayloadErrors(t *testing.T) {
+	valid := dumpPayload(StoredValue{vType: "string", val: "hello"})
+	footer := len(valid) - 10
+
+	tests := []struct {
+		name    string
+		payload func(p []byte) []byte
+		wantErr string
+	}{
+		{"too short", func(p []byte) []byte { return p[:9] }, errBadDumpPayload.Error()},
+		{"value changed", func(p []byte) []byte { p[2] = 'H'; return p }, errBadDumpPayload.Error()},
+		{"checksum changed", func(p []byte) []byte { p[len(p)-1] ^= 1; return p }, errBadDumpPayload.Error()},
+		{"newer version", func(p []byte) []byte {
+			p[footer] = rdbVersion + 1
+			return withDumpChecksum(p)
+		}, errBadDumpPayload.Error()},
+		{"trailing bytes", func(p []byte) []byte {
+			p = append(p[:footer:footer], append([]byte("xx"), p[footer:]...)...)
+			return withDumpChecksum(p)
+		}, "ERR Bad data format"},
+		{"unknown type", func(p []byte) []byte {
+			p[0] = 99
+			return withDumpChecksum(p)
+		}, "ERR Bad data format"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseDumpPayload(tt.payload(append([]byte(nil), valid...)))
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("parseDumpPayload error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// withDumpChecksum recomputes the checksum ending payload p
+func withDumpChecksum(p []byte) []byte {
+	binary.LittleEndian.PutUint64(p[len(p)-8:], crc64Update(0, p[:len(p)-8]))
+	return p
+}
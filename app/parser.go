@@ -3,8 +3,8 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"strconv"
-	"strings"
 )
 
 type Value struct {
@@ -21,16 +21,30 @@ func (v *Value) OK() []byte {
 	return v.Unmarshal()
 }
 
+func (v *Value) Error(msg string) []byte {
+	v.vType = "error"
+	v.str = msg
+	return v.Unmarshal()
+}
+
 func (v *Value) Unmarshal() []byte {
 	switch v.vType {
 	case "str":
 		return v.toStr()
+	case "error":
+		return v.toError()
+	case "null":
+		return []byte("$-1\r\n")
 	case "num":
 		return v.toNum()
 	case "bulk":
 		return v.toBulk()
 	case "array":
 		return v.toArray()
+	case "map":
+		return v.toMap()
+	case "push":
+		return v.toPush()
 	}
 	return nil
 }
@@ -40,35 +54,44 @@ func (v *Value) toStr() []byte {
 	return []byte(reply)
 }
 
+func (v *Value) toError() []byte {
+	reply := fmt.Sprintf("-%s\r\n", v.str)
+	return []byte(reply)
+}
+
 func (v *Value) toNum() []byte {
 	reply := fmt.Sprintf(":%d\r\n", v.num)
 	return []byte(reply)
 }
 
 func (v *Value) toBulk() []byte {
-	var reply string
-	if v.bulk == "" {
-		reply = "$-1\r\n"
-	} else {
-		reply = fmt.Sprintf("$%d\r\n%s\r\n", len(v.bulk), v.bulk)
-	}
+	reply := fmt.Sprintf("$%d\r\n%s\r\n", len(v.bulk), v.bulk)
 	return []byte(reply)
 }
 
 func (v *Value) toArray() []byte {
 	if len(v.array) == 0 {
-		fmt.Println("ZERO arr")
 		return []byte("*0\r\n")
 	}
-	begin := fmt.Sprintf("*%d\r\n", len(v.array))
-	var vals []string
+	return v.toAggregate('*', len(v.array))
+}
+
+// toMap replies with a RESP3 map, array holds keys and values one after another
+func (v *Value) toMap() []byte {
+	return v.toAggregate('%', len(v.array)/2)
+}
+
+// toPush replies with a RESP3 out of band push message
+func (v *Value) toPush() []byte {
+	return v.toAggregate('>', len(v.array))
+}
+
+func (v *Value) toAggregate(prefix byte, length int) []byte {
+	reply := []byte(fmt.Sprintf("%c%d\r\n", prefix, length))
 	for _, v := range v.array {
-		length := fmt.Sprintf("$%d\r\n", len(v.bulk))
-		vals = append(vals, fmt.Sprintf("%s%s", length, v.bulk))
+		reply = append(reply, v.Unmarshal()...)
 	}
-	valsStr := strings.Join(vals, "\r\n")
-	reply := fmt.Sprintf("%s%s\r\n", begin, valsStr)
-	return []byte(reply)
+	return reply
 }
 
 const (
@@ -139,6 +162,16 @@ func (p *Parser) Parse() (Value, error) {
 		return p.readArray()
 	case BULK:
 		return p.readBulk()
+	case STRING, ERROR:
+		line, _, err := p.readLine()
+		v := Value{vType: "str", str: string(line)}
+		if vType == ERROR {
+			v.vType = "error"
+		}
+		return v, err
+	case INTEGER:
+		n, _, err := p.readInteger()
+		return Value{vType: "num", num: n}, err
 	default:
 		return Value{}, nil
 	}
@@ -152,6 +185,10 @@ func (p *Parser) readArray() (Value, error) {
 	if err != nil {
 		return v, err
 	}
+	if length < 0 {
+		v.vType = "null"
+		return v, nil
+	}
 	v.array = make([]Value, length)
 
 	for i := 0; i < length; i++ {
@@ -172,12 +209,20 @@ func (p *Parser) readBulk() (Value, error) {
 	if err != nil {
 		return v, err
 	}
+	if length < 0 {
+		v.vType = "null"
+		return v, nil
+	}
 	bulk := make([]byte, length)
-	p.reader.Read(bulk)
+	if _, err := io.ReadFull(p.reader, bulk); err != nil {
+		return v, err
+	}
 	v.bulk = string(bulk)
 
 	// read out trailing CRLF
-	p.readLine()
+	if _, _, err := p.readLine(); err != nil {
+		return v, err
+	}
 
 	return v, nil
 }
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"sync"
+)
+
+// PubSub keeps track of the channels and patterns clients subscribed to
+type PubSub struct {
+	mu             sync.RWMutex
+	channels       map[string]map[int64]*Client // subscribers of every channel
+	clients        map[int64]map[string]bool    // channels of every subscribed client
+	patterns       map[string]map[int64]*Client // subscribers of every pattern
+	clientPatterns map[int64]map[string]bool    // patterns of every subscribed client
+}
+
+func NewPubSub() *PubSub {
+	return &PubSub{
+		channels:       make(map[string]map[int64]*Client),
+		clients:        make(map[int64]map[string]bool),
+		patterns:       make(map[string]map[int64]*Client),
+		clientPatterns: make(map[int64]map[string]bool),
+	}
+}
+
+// Subscribe returns the number of channels and patterns client is subscribed to
+func (ps *PubSub) Subscribe(c *Client, channel string) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.channels[channel] == nil {
+		ps.channels[channel] = make(map[int64]*Client)
+	}
+	ps.channels[channel][c.id] = c
+	if ps.clients[c.id] == nil {
+		ps.clients[c.id] = make(map[string]bool)
+	}
+	ps.clients[c.id][channel] = true
+	return len(ps.clients[c.id]) + len(ps.clientPatterns[c.id])
+}
+
+// Unsubscribe returns the number of channels and patterns client is still subscribed to
+func (ps *PubSub) Unsubscribe(c *Client, channel string) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	delete(ps.channels[channel], c.id)
+	if len(ps.channels[channel]) == 0 {
+		delete(ps.channels, channel)
+	}
+	delete(ps.clients[c.id], channel)
+	if len(ps.clients[c.id]) == 0 {
+		delete(ps.clients, c.id)
+	}
+	return len(ps.clients[c.id]) + len(ps.clientPatterns[c.id])
+}
+
+// PSubscribe returns the number of channels and patterns client is subscribed to
+func (ps *PubSub) PSubscribe(c *Client, pattern string) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.patterns[pattern] == nil {
+		ps.patterns[pattern] = make(map[int64]*Client)
+	}
+	ps.patterns[pattern][c.id] = c
+	if ps.clientPatterns[c.id] == nil {
+		ps.clientPatterns[c.id] = make(map[string]bool)
+	}
+	ps.clientPatterns[c.id][pattern] = true
+	return len(ps.clients[c.id]) + len(ps.clientPatterns[c.id])
+}
+
+// PUnsubscribe returns the number of channels and patterns client is still subscribed to
+func (ps *PubSub) PUnsubscribe(c *Client, pattern string) int {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	delete(ps.patterns[pattern], c.id)
+	if len(ps.patterns[pattern]) == 0 {
+		delete(ps.patterns, pattern)
+	}
+	delete(ps.clientPatterns[c.id], pattern)
+	if len(ps.clientPatterns[c.id]) == 0 {
+		delete(ps.clientPatterns, c.id)
+	}
+	return len(ps.clients[c.id]) + len(ps.clientPatterns[c.id])
+}
+
+// RemoveClient drops all subscriptions of disconnected client
+func (ps *PubSub) RemoveClient(c *Client) {
+	for _, channel := range ps.Channels(c) {
+		ps.Unsubscribe(c, channel)
+	}
+	for _, pattern := range ps.Patterns(c) {
+		ps.PUnsubscribe(c, pattern)
+	}
+}
+
+func (ps *PubSub) Patterns(c *Client) []string {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	var patterns []string
+	for pattern := range ps.clientPatterns[c.id] {
+		patterns = append(patterns, pattern)
+	}
+	return patterns
+}
+
+func (ps *PubSub) Channels(c *Client) []string {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+
+	var channels []string
+	for channel := range ps.clients[c.id] {
+		channels = append(channels, channel)
+	}
+	return channels
+}
+
+func (ps *PubSub) IsSubscribed(c *Client, channel string) bool {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return ps.clients[c.id][channel]
+}
+
+func (ps *PubSub) SubscriptionsCount(c *Client) int {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return len(ps.clients[c.id]) + len(ps.clientPatterns[c.id])
+}
+
+// Counts returns the number of channels and patterns with subscribers
+func (ps *PubSub) Counts() (channels, patterns int) {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return len(ps.channels), len(ps.patterns)
+}
+
+// Publish queues msg for every subscriber of the channel and of the patterns
+// matching it, and returns the number of messages delivered
+func (ps *PubSub) Publish(channel string, msg Value) int {
+	type patternSubscriber struct {
+		pattern string
+		c       *Client
+	}
+	ps.mu.RLock()
+	var subscribers []*Client
+	for _, c := range ps.channels[channel] {
+		subscribers = append(subscribers, c)
+	}
+	var patternSubscribers []patternSubscriber
+	for pattern, clients := range ps.patterns {
+		if !stringMatch(pattern, channel, false) {
+			continue
+		}
+		for _, c := range clients {
+			patternSubscribers = append(patternSubscribers, patternSubscriber{pattern, c})
+		}
+	}
+	ps.mu.RUnlock()
+
+	for _, c := range subscribers {
+		c.Push(pubsubMessage(c, "message", Value{vType: "bulk", bulk: channel}, msg))
+	}
+	for _, s := range patternSubscribers {
+		s.c.Push(pubsubMessage(s.c, "pmessage", Value{vType: "bulk", bulk: s.pattern}, Value{vType: "bulk", bulk: channel}, msg))
+	}
+	return len(subscribers) + len(patternSubscribers)
+}
+
+// pubsubMessage builds a message of pub/sub kind, it is a push for RESP3 clients
+func pubsubMessage(c *Client, kind string, args ...Value) []byte {
+	var msg Value
+	msg.vType = "array"
+	if c.Protocol() == 3 {
+		msg.vType = "push"
+	}
+	msg.array = append(msg.array, Value{vType: "bulk", bulk: kind})
+	msg.array = append(msg.array, args...)
+	return msg.Unmarshal()
+}
+
+// commands allowed to RESP2 clients with active subscriptions
+var pubsubContextCommands = map[string]bool{
+	"subscribe":    true,
+	"unsubscribe":  true,
+	"psubscribe":   true,
+	"punsubscribe": true,
+	"ping":         true,
+	"quit":         true,
+	"reset":        true,
+}
+
+func (ps *PubSub) subscribe(c *Client, v Value) []byte {
+	var repl Value
+	if len(v.array) < 2 {
+		return repl.Error("ERR wrong number of arguments for 'subscribe' command")
+	}
+	var res []byte
+	for _, arg := range v.array[1:] {
+		count := ps.Subscribe(c, arg.bulk)
+		res = append(res, pubsubMessage(c, "subscribe", Value{vType: "bulk", bulk: arg.bulk}, Value{vType: "num", num: count})...)
+	}
+	return res
+}
+
+func (ps *PubSub) unsubscribe(c *Client, v Value) []byte {
+	var channels []string
+	for _, arg := range v.array[1:] {
+		channels = append(channels, arg.bulk)
+	}
+	if len(channels) == 0 {
+		channels = ps.Channels(c)
+	}
+	if len(channels) == 0 {
+		return pubsubMessage(c, "unsubscribe", Value{vType: "null"}, Value{vType: "num", num: ps.SubscriptionsCount(c)})
+	}
+	var res []byte
+	for _, channel := range channels {
+		count := ps.Unsubscribe(c, channel)
+		res = append(res, pubsubMessage(c, "unsubscribe", Value{vType: "bulk", bulk: channel}, Value{vType: "num", num: count})...)
+	}
+	return res
+}
+
+func (ps *PubSub) psubscribe(c *Client, v Value) []byte {
+	var repl Value
+	if len(v.array) < 2 {
+		return repl.Error("ERR wrong number of arguments for 'psubscribe' command")
+	}
+	var res []byte
+	for _, arg := range v.array[1:] {
+		count := ps.PSubscribe(c, arg.bulk)
+		res = append(res, pubsubMessage(c, "psubscribe", Value{vType: "bulk", bulk: arg.bulk}, Value{vType: "num", num: count})...)
+	}
+	return res
+}
+
+func (ps *PubSub) punsubscribe(c *Client, v Value) []byte {
+	var patterns []string
+	for _, arg := range v.array[1:] {
+		patterns = append(patterns, arg.bulk)
+	}
+	if len(patterns) == 0 {
+		patterns = ps.Patterns(c)
+	}
+	if len(patterns) == 0 {
+		return pubsubMessage(c, "punsubscribe", Value{vType: "null"}, Value{vType: "num", num: ps.SubscriptionsCount(c)})
+	}
+	var res []byte
+	for _, pattern := range patterns {
+		count := ps.PUnsubscribe(c, pattern)
+		res = append(res, pubsubMessage(c, "punsubscribe", Value{vType: "bulk", bulk: pattern}, Value{vType: "num", num: count})...)
+	}
+	return res
+}
+
+func (ch *CommandHandler) publish(v Value) []byte {
+	var repl Value
+	if len(v.array) != 3 {
+		return repl.Error("ERR wrong number of arguments for 'publish' command")
+	}
+	repl.vType = "num"
+	repl.num = ch.pubsub.Publish(v.array[1].bulk, Value{vType: "bulk", bulk: v.array[2].bulk})
+	return repl.Unmarshal()
+}
+
+// inSubscribedContext reports whether RESP2 client with subscriptions tries to run
+// a command that is not allowed in this state
+func (ps *PubSub) inSubscribedContext(c *Client, command string) bool {
+	if c.Protocol() == 3 || pubsubContextCommands[command] {
+		return false
+	}
+	return ps.SubscriptionsCount(c) > 0
+}
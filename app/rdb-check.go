@@ -0,0 +1,88 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+)
+
+type rdbDBStats struct {
+	keys    int
+	expires int
+	expired int
+	types   map[string]int
+}
+
+// checkRDB reads the whole file reporting statistics of every database and
+// the offset where the file is corrupted, if it is
+func checkRDB(path string, w io.Writer) error {
+	fmt.Fprintf(w, "Checking RDB file %s\n", path)
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return err
+	}
+	defer f.Close()
+
+	stats := make(map[int]*rdbDBStats)
+	keys := 0
+	aux, err := readRDB(f, func(db int, key string, v StoredValue) {
+		s := stats[db]
+		if s == nil {
+			s = &rdbDBStats{types: make(map[string]int)}
+			stats[db] = s
+		}
+		keys++
+		s.keys++
+		s.types[v.vType]++
+		if !v.expires.IsZero() {
+			s.expires++
+			if v.isExpired() {
+				s.expired++
+			}
+		}
+	})
+
+	auxKeys := make([]string, 0, len(aux))
+	for k := range aux {
+		auxKeys = append(auxKeys, k)
+	}
+	sort.Strings(auxKeys)
+	for _, k := range auxKeys {
+		fmt.Fprintf(w, "AUX FIELD %s = '%s'\n", k, aux[k])
+	}
+
+	dbs := make([]int, 0, len(stats))
+	for db := range stats {
+		dbs = append(dbs, db)
+	}
+	sort.Ints(dbs)
+	for _, db := range dbs {
+		s := stats[db]
+		fmt.Fprintf(w, "db %d: %d keys, %d with expire (%d already expired)\n", db, s.keys, s.expires, s.expired)
+		types := make([]string, 0, len(s.types))
+		for t := range s.types {
+			types = append(types, t)
+		}
+		sort.Strings(types)
+		for _, t := range types {
+			fmt.Fprintf(w, "    %-8s %d\n", t, s.types[t])
+		}
+	}
+
+	if err != nil {
+		fmt.Fprintln(w, "--- RDB ERROR DETECTED ---")
+		var rdbErr *RDBError
+		if errors.As(err, &rdbErr) {
+			fmt.Fprintf(w, "[offset %d] %v\n", rdbErr.Offset, rdbErr.Err)
+		} else {
+			fmt.Fprintln(w, err)
+		}
+		fmt.Fprintf(w, "%d keys read before the error\n", keys)
+		return err
+	}
+	fmt.Fprintf(w, "%d keys, RDB looks OK\n", keys)
+	return nil
+}
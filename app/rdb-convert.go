@@ -0,0 +1,439 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// rdbJSONRecord is one line of the JSON export. TTL is in milliseconds, -1
+// for keys without expire. Strings that are not valid UTF-8 can't be stored
+// in JSON as is, when a key has any all strings of the record are in base64
+// and encoding is "base64".
+type rdbJSONRecord struct {
+	DB       int             `json:"db"`
+	Key      string          `json:"key"`
+	Type     string          `json:"type"`
+	TTL      int64           `json:"ttl"`
+	Encoding string          `json:"encoding,omitempty"`
+	Value    json.RawMessage `json:"value"`
+}
+
+type jsonZsetEntry struct {
+	Member string `json:"member"`
+	Score  string `json:"score"` // formatted like ZSCORE replies, infinities are not valid JSON numbers
+}
+
+type jsonStream struct {
+	Entries      []jsonStreamEntry `json:"entries"`
+	LastID       string            `json:"last_id"`
+	MaxDeletedID string            `json:"max_deleted_id"`
+	EntriesAdded uint64            `json:"entries_added"`
+	Groups       []jsonStreamGroup `json:"groups,omitempty"`
+}
+
+type jsonStreamEntry struct {
+	ID     string   `json:"id"`
+	Fields []string `json:"fields"`
+}
+
+type jsonStreamGroup struct {
+	Name        string               `json:"name"`
+	LastID      string               `json:"last_id"`
+	EntriesRead int64                `json:"entries_read"`
+	Pending     []jsonStreamPending  `json:"pending"`
+	Consumers   []jsonStreamConsumer `json:"consumers"`
+}
+
+type jsonStreamPending struct {
+	ID            string `json:"id"`
+	Consumer      string `json:"consumer"`
+	DeliveryTime  int64  `json:"delivery_time"`
+	DeliveryCount uint64 `json:"delivery_count"`
+}
+
+type jsonStreamConsumer struct {
+	Name       string   `json:"name"`
+	SeenTime   int64    `json:"seen_time"`
+	ActiveTime int64    `json:"active_time"`
+	Pending    []string `json:"pending"`
+}
+
+// rdbToJSON writes keys of the RDB file at path to w, one JSON object per line.
+// Keys already expired are skipped.
+func rdbToJSON(path string, w io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	bw := bufio.NewWriter(w)
+	var writeErr error
+	_, err = readRDB(f, func(db int, key string, v StoredValue) {
+		if writeErr != nil || v.isExpired() {
+			return
+		}
+		var line []byte
+		line, writeErr = json.Marshal(storedValueToJSON(db, key, v))
+		if writeErr == nil {
+			line = append(line, '\n')
+			_, writeErr = bw.Write(line)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	return bw.Flush()
+}
+
+func storedValueToJSON(db int, key string, v StoredValue) rdbJSONRecord {
+	rec := rdbJSONRecord{DB: db, Type: v.vType, TTL: -1}
+	if !v.expires.IsZero() {
+		rec.TTL = max(time.Until(v.expires).Milliseconds(), 0)
+	}
+	str := func(s string) string { return s }
+	if !storedValueIsUTF8(key, v) {
+		rec.Encoding = "base64"
+		str = func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	}
+	strs := func(items []string) []string {
+		out := make([]string, len(items))
+		for i, s := range items {
+			out[i] = str(s)
+		}
+		return out
+	}
+	rec.Key = str(key)
+
+	var value any
+	switch v.vType {
+	case "string":
+		value = str(v.val)
+	case "list":
+		value = strs(v.list.items)
+	case "set":
+		members := []string{}
+		v.set.Range(func(member string, _ struct{}) bool {
+			members = append(members, str(member))
+			return true
+		})
+		sort.Strings(members)
+		value = members
+	case "hash":
+		fields := make(map[string]string)
+		v.hash.Range(func(field, val string) bool {
+			fields[str(field)] = str(val)
+			return true
+		})
+		value = fields
+	case "zset":
+		entries := []jsonZsetEntry{}
+		for _, e := range v.zset.sorted {
+			entries = append(entries, jsonZsetEntry{Member: str(e.member), Score: formatScore(e.score)})
+		}
+		value = entries
+	case "stream":
+		s := jsonStream{
+			Entries:      []jsonStreamEntry{},
+			LastID:       v.stream.lastID.String(),
+			MaxDeletedID: v.stream.maxDeletedID.String(),
+			EntriesAdded: v.stream.entriesAdded,
+		}
+		for _, e := range v.stream.entries {
+			s.Entries = append(s.Entries, jsonStreamEntry{ID: e.id.String(), Fields: strs(e.fields)})
+		}
+		for _, g := range v.stream.groups {
+			jg := jsonStreamGroup{
+				Name:        str(g.name),
+				LastID:      g.lastID.String(),
+				EntriesRead: g.entriesRead,
+				Pending:     []jsonStreamPending{},
+				Consumers:   []jsonStreamConsumer{},
+			}
+			for _, p := range g.pending {
+				jg.Pending = append(jg.Pending, jsonStreamPending{
+					ID:            p.id.String(),
+					Consumer:      str(p.consumer),
+					DeliveryTime:  p.deliveryTime,
+					DeliveryCount: p.deliveryCount,
+				})
+			}
+			for _, c := range g.consumers {
+				jc := jsonStreamConsumer{Name: str(c.name), SeenTime: c.seenTime, ActiveTime: c.activeTime, Pending: []string{}}
+				for _, id := range c.pending {
+					jc.Pending = append(jc.Pending, id.String())
+				}
+				jg.Consumers = append(jg.Consumers, jc)
+			}
+			s.Groups = append(s.Groups, jg)
+		}
+		value = s
+	}
+	rec.Value, _ = json.Marshal(value)
+	return rec
+}
+
+// storedValueIsUTF8 reports whether key and all strings of v are valid UTF-8
+func storedValueIsUTF8(key string, v StoredValue) bool {
+	valid := utf8.ValidString(key)
+	check := func(s string) bool {
+		valid = valid && utf8.ValidString(s)
+		return valid
+	}
+	switch v.vType {
+	case "string":
+		check(v.val)
+	case "list":
+		for _, s := range v.list.items {
+			check(s)
+		}
+	case "set":
+		v.set.Range(func(member string, _ struct{}) bool {
+			return check(member)
+		})
+	case "hash":
+		v.hash.Range(func(field, val string) bool {
+			return check(field) && check(val)
+		})
+	case "zset":
+		for _, e := range v.zset.sorted {
+			check(e.member)
+		}
+	case "stream":
+		for _, e := range v.stream.entries {
+			for _, s := range e.fields {
+				check(s)
+			}
+		}
+		for _, g := range v.stream.groups {
+			check(g.name)
+			for _, c := range g.consumers {
+				check(c.name)
+			}
+		}
+	}
+	return valid
+}
+
+// jsonToRDB reads JSON lines written by rdbToJSON from path and writes them
+// to w as an RDB file
+func jsonToRDB(path string, w io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var dbs []*dict[StoredValue]
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 512*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var rec rdbJSONRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		key, v, err := storedValueFromJSON(rec)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+		if rec.DB < 0 {
+			return fmt.Errorf("line %d: invalid db %d", line, rec.DB)
+		}
+		for len(dbs) <= rec.DB {
+			dbs = append(dbs, newDict[StoredValue]())
+		}
+		dbs[rec.DB].Set(key, v)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return writeRDB(w, dbs, nil)
+}
+
+func storedValueFromJSON(rec rdbJSONRecord) (string, StoredValue, error) {
+	var decodeErr error
+	str := func(s string) string { return s }
+	switch rec.Encoding {
+	case "":
+	case "base64":
+		str = func(s string) string {
+			b, err := base64.StdEncoding.DecodeString(s)
+			if err != nil && decodeErr == nil {
+				decodeErr = fmt.Errorf("invalid base64 string %q", s)
+			}
+			return string(b)
+		}
+	default:
+		return "", StoredValue{}, fmt.Errorf("unknown encoding %q", rec.Encoding)
+	}
+	strs := func(items []string) []string {
+		out := make([]string, len(items))
+		for i, s := range items {
+			out[i] = str(s)
+		}
+		return out
+	}
+	parseID := func(s string) streamID {
+		id, err := parseStreamID(s, 0)
+		if err != nil && decodeErr == nil {
+			decodeErr = fmt.Errorf("invalid stream ID %q", s)
+		}
+		return id
+	}
+
+	key := str(rec.Key)
+	switch rec.Type {
+	case "string", "list", "set", "hash", "zset", "stream":
+	default:
+		return "", StoredValue{}, fmt.Errorf("unknown type %q", rec.Type)
+	}
+	v := newStoredValue(rec.Type)
+	if rec.TTL >= 0 {
+		v.expires = time.Now().Add(time.Duration(rec.TTL) * time.Millisecond)
+	}
+
+	var err error
+	switch rec.Type {
+	case "string":
+		var s string
+		if err = json.Unmarshal(rec.Value, &s); err == nil {
+			v.val = str(s)
+		}
+	case "list":
+		var items []string
+		if err = json.Unmarshal(rec.Value, &items); err == nil {
+			v.list.PushTail(strs(items)...)
+		}
+	case "set":
+		var members []string
+		if err = json.Unmarshal(rec.Value, &members); err == nil {
+			for _, m := range members {
+				v.set.Set(str(m), struct{}{})
+			}
+		}
+	case "hash":
+		var fields map[string]string
+		if err = json.Unmarshal(rec.Value, &fields); err == nil {
+			for field, val := range fields {
+				v.hash.Set(str(field), str(val))
+			}
+		}
+	case "zset":
+		var entries []jsonZsetEntry
+		if err = json.Unmarshal(rec.Value, &entries); err == nil {
+			for _, e := range entries {
+				score, scoreErr := parseScore(e.Score)
+				if scoreErr != nil {
+					return "", StoredValue{}, fmt.Errorf("invalid score %q of member %q", e.Score, e.Member)
+				}
+				v.zset.Add(str(e.Member), score)
+			}
+		}
+	case "stream":
+		var js jsonStream
+		if err = json.Unmarshal(rec.Value, &js); err == nil {
+			s := v.stream
+			for _, e := range js.Entries {
+				s.entries = append(s.entries, streamEntry{id: parseID(e.ID), fields: strs(e.Fields)})
+			}
+			s.lastID = parseID(js.LastID)
+			s.maxDeletedID = parseID(js.MaxDeletedID)
+			s.entriesAdded = js.EntriesAdded
+			for _, jg := range js.Groups {
+				g := &streamGroup{name: str(jg.Name), lastID: parseID(jg.LastID), entriesRead: jg.EntriesRead}
+				for _, p := range jg.Pending {
+					g.pending = append(g.pending, streamPending{
+						id:            parseID(p.ID),
+						consumer:      str(p.Consumer),
+						deliveryTime:  p.DeliveryTime,
+						deliveryCount: p.DeliveryCount,
+					})
+				}
+				for _, jc := range jg.Consumers {
+					c := streamConsumer{name: str(jc.Name), seenTime: jc.SeenTime, activeTime: jc.ActiveTime}
+					for _, id := range jc.Pending {
+						c.pending = append(c.pending, parseID(id))
+					}
+					g.consumers = append(g.consumers, c)
+				}
+				s.groups = append(s.groups, g)
+			}
+		}
+	}
+	if err != nil {
+		return "", StoredValue{}, fmt.Errorf("invalid %s value: %w", rec.Type, err)
+	}
+	if decodeErr != nil {
+		return "", StoredValue{}, decodeErr
+	}
+	return key, v, nil
+}
+
+// rdbToRESP writes commands recreating keys of the RDB file at path to w, so
+// the dump can be replayed into a running server. Keys already expired are
+// skipped.
+func rdbToRESP(path string, w io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	bw := bufio.NewWriter(w)
+	var writeErr error
+	selected := -1
+	_, err = readRDB(f, func(db int, key string, v StoredValue) {
+		if writeErr != nil || v.isExpired() {
+			return
+		}
+		if db != selected {
+			sel := bulkArray([]string{"SELECT", strconv.Itoa(db)})
+			_, writeErr = bw.Write(sel.Unmarshal())
+			selected = db
+		}
+		for _, cmd := range keyCommands(key, v) {
+			if writeErr == nil {
+				_, writeErr = bw.Write(cmd.Unmarshal())
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	return bw.Flush()
+}
+
+// runRDBConversion runs conversion of a command line mode writing the result
+// to stdout, logs and errors go to stderr so they don't end up in the output
+func runRDBConversion(convert func(string, io.Writer) error, path string) int {
+	out := os.Stdout
+	os.Stdout = os.Stderr
+	if err := convert(path, out); err != nil {
+		var rdbErr *RDBError
+		if errors.As(err, &rdbErr) {
+			fmt.Fprintf(os.Stderr, "%s: [offset %d] %v\n", path, rdbErr.Offset, rdbErr.Err)
+		} else {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+		}
+		return 1
+	}
+	return 0
+}
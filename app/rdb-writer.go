@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	rdbVersion = 11
+
+	rdbOpcodeSlotInfo      = 0xF4
+	rdbOpcodeFunction2     = 0xF5
+	rdbOpcodeFunctionPreGA = 0xF6
+	rdbOpcodeModuleAux     = 0xF7
+	rdbOpcodeIdle          = 0xF8
+	rdbOpcodeFreq          = 0xF9
+	rdbOpcodeAux           = 0xFA
+	rdbOpcodeResizeDB      = 0xFB
+	rdbOpcodeExpireTimeMs  = 0xFC
+	rdbOpcodeExpireTime    = 0xFD
+	rdbOpcodeSelectDB      = 0xFE
+	rdbOpcodeEOF           = 0xFF
+
+	rdbTypeString           = 0
+	rdbTypeList             = 1
+	rdbTypeSet              = 2
+	rdbTypeZset             = 3
+	rdbTypeHash             = 4
+	rdbTypeZset2            = 5
+	rdbTypeModulePreGA      = 6
+	rdbTypeModule2          = 7
+	rdbTypeHashZipmap       = 9
+	rdbTypeListZiplist      = 10
+	rdbTypeSetIntset        = 11
+	rdbTypeZsetZiplist      = 12
+	rdbTypeHashZiplist      = 13
+	rdbTypeListQuicklist    = 14
+	rdbTypeStreamListpacks  = 15
+	rdbTypeHashListpack     = 16
+	rdbTypeZsetListpack     = 17
+	rdbTypeListQuicklist2   = 18
+	rdbTypeStreamListpacks2 = 19
+	rdbTypeSetListpack      = 20
+	rdbTypeStreamListpacks3 = 21
+
+	// special string encodings, length bits 11 followed by one of these
+	rdbEncInt8  = 0
+	rdbEncInt16 = 1
+	rdbEncInt32 = 2
+	rdbEncLZF   = 3
+
+	quicklistNodePlain  = 1
+	quicklistNodePacked = 2
+
+	rdbModuleOpcodeEOF    = 0
+	rdbModuleOpcodeSint   = 1
+	rdbModuleOpcodeUint   = 2
+	rdbModuleOpcodeFloat  = 3
+	rdbModuleOpcodeDouble = 4
+	rdbModuleOpcodeString = 5
+
+	streamItemFlagDeleted    = 1
+	streamItemFlagSameFields = 2
+
+	// entries per stream listpack node, the default of stream-node-max-entries
+	streamNodeMaxEntries = 100
+)
+
+// rdbWriter serializes values in RDB format keeping the checksum of everything written
+type rdbWriter struct {
+	w   *bufio.Writer
+	crc uint64
+	err error
+}
+
+func newRDBWriter(w io.Writer) *rdbWriter {
+	return &rdbWriter{w: bufio.NewWriter(w)}
+}
+
+func (rw *rdbWriter) write(p []byte) {
+	if rw.err != nil {
+		return
+	}
+	rw.crc = crc64Update(rw.crc, p)
+	_, rw.err = rw.w.Write(p)
+}
+
+func (rw *rdbWriter) writeByte(b byte) {
+	rw.write([]byte{b})
+}
+
+// writeLength uses the size encoding, the first two bits tell how many bytes follow
+func (rw *rdbWriter) writeLength(n uint64) {
+	switch {
+	case n < 1<<6:
+		rw.writeByte(byte(n))
+	case n < 1<<14:
+		rw.write([]byte{byte(n>>8) | 0x40, byte(n)})
+	case n <= math.MaxUint32:
+		buf := []byte{0x80, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(buf[1:], uint32(n))
+		rw.write(buf)
+	default:
+		buf := make([]byte, 9)
+		buf[0] = 0x81
+		binary.BigEndian.PutUint64(buf[1:], n)
+		rw.write(buf)
+	}
+}
+
+func (rw *rdbWriter) writeString(s string) {
+	rw.writeLength(uint64(len(s)))
+	rw.write([]byte(s))
+}
+
+func (rw *rdbWriter) writeAux(key, val string) {
+	rw.writeByte(rdbOpcodeAux)
+	rw.writeString(key)
+	rw.writeString(val)
+}
+
+// writeHeader writes the magic and auxiliary fields, aofBase marks a base
+// file of the AOF
+func (rw *rdbWriter) writeHeader(aofBase bool) {
+	rw.write([]byte(fmt.Sprintf("REDIS%04d", rdbVersion)))
+	rw.writeAux("redis-ver", "7.2.0")
+	rw.writeAux("redis-bits", "64")
+	rw.writeAux("ctime", strconv.FormatInt(time.Now().Unix(), 10))
+	rw.writeAux("aof-base", strconv.Itoa(boolToInt(aofBase)))
+}
+
+// writeDB writes database selector, size hints and all keys of the database
+func (rw *rdbWriter) writeDB(db int, keys *dict[StoredValue]) {
+	var size, expires uint64
+	keys.Range(func(_ string, v StoredValue) bool {
+		if !v.isExpired() {
+			size++
+			if !v.expires.IsZero() {
+				expires++
+			}
+		}
+		return true
+	})
+	if size == 0 {
+		return
+	}
+	rw.writeByte(rdbOpcodeSelectDB)
+	rw.writeLength(uint64(db))
+	rw.writeByte(rdbOpcodeResizeDB)
+	rw.writeLength(size)
+	rw.writeLength(expires)
+	keys.Range(func(key string, v StoredValue) bool {
+		if !v.isExpired() {
+			rw.writeKeyValue(key, v)
+		}
+		return rw.err == nil
+	})
+}
+
+func (rw *rdbWriter) writeKeyValue(key string, v StoredValue) {
+	if !v.expires.IsZero() {
+		rw.writeByte(rdbOpcodeExpireTimeMs)
+		buf := make([]byte, 8)
+		binary.LittleEndian.PutUint64(buf, uint64(v.expires.UnixMilli()))
+		rw.write(buf)
+	}
+	rw.writeByte(rdbValueType(v))
+	rw.writeString(key)
+	rw.writeValue(v)
+}
+
+func rdbValueType(v StoredValue) byte {
+	switch v.vType {
+	case "list":
+		return rdbTypeList
+	case "set":
+		return rdbTypeSet
+	case "hash":
+		return rdbTypeHash
+	case "zset":
+		return rdbTypeZset2
+	case "stream":
+		return rdbTypeStreamListpacks3
+	}
+	return rdbTypeString
+}
+
+// writeValue writes the value without its type byte
+func (rw *rdbWriter) writeValue(v StoredValue) {
+	switch v.vType {
+	case "string":
+		rw.writeString(v.val)
+	case "list":
+		rw.writeLength(uint64(v.list.Len()))
+		for _, item := range v.list.items {
+			rw.writeString(item)
+		}
+	case "set":
+		rw.writeLength(uint64(v.set.Len()))
+		v.set.Range(func(member string, _ struct{}) bool {
+			rw.writeString(member)
+			return true
+		})
+	case "hash":
+		rw.writeLength(uint64(v.hash.Len()))
+		v.hash.Range(func(field, val string) bool {
+			rw.writeString(field)
+			rw.writeString(val)
+			return true
+		})
+	case "zset":
+		rw.writeLength(uint64(v.zset.Len()))
+		buf := make([]byte, 8)
+		for _, e := range v.zset.sorted {
+			rw.writeString(e.member)
+			binary.LittleEndian.PutUint64(buf, math.Float64bits(e.score))
+			rw.write(buf)
+		}
+	case "stream":
+		rw.writeStream(v.stream)
+	}
+}
+
+func (rw *rdbWriter) writeUint(n uint64, size int) {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, n)
+	rw.write(buf[:size])
+}
+
+func (rw *rdbWriter) writeStreamID(id streamID) {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf, id.ms)
+	binary.BigEndian.PutUint64(buf[8:], id.seq)
+	rw.write(buf)
+}
+
+func (rw *rdbWriter) writeLengthStreamID(id streamID) {
+	rw.writeLength(id.ms)
+	rw.writeLength(id.seq)
+}
+
+// writeStream writes entries in listpack nodes followed by metadata and consumer groups
+func (rw *rdbWriter) writeStream(s *stream) {
+	nodes := (len(s.entries) + streamNodeMaxEntries - 1) / streamNodeMaxEntries
+	rw.writeLength(uint64(nodes))
+	for i := 0; i < len(s.entries); i += streamNodeMaxEntries {
+		entries := s.entries[i:min(i+streamNodeMaxEntries, len(s.entries))]
+		master := entries[0].id
+		key := make([]byte, 16)
+		binary.BigEndian.PutUint64(key, master.ms)
+		binary.BigEndian.PutUint64(key[8:], master.seq)
+		rw.writeString(string(key))
+		rw.writeString(string(newListpack(streamListpackItems(master, entries))))
+	}
+	rw.writeLength(uint64(len(s.entries)))
+	rw.writeLengthStreamID(s.lastID)
+	rw.writeLengthStreamID(s.firstID())
+	rw.writeLengthStreamID(s.maxDeletedID)
+	rw.writeLength(s.entriesAdded)
+
+	rw.writeLength(uint64(len(s.groups)))
+	for _, g := range s.groups {
+		rw.writeString(g.name)
+		rw.writeLengthStreamID(g.lastID)
+		rw.writeLength(uint64(g.entriesRead))
+		rw.writeLength(uint64(len(g.pending)))
+		for _, p := range g.pending {
+			rw.writeStreamID(p.id)
+			rw.writeUint(uint64(p.deliveryTime), 8)
+			rw.writeLength(p.deliveryCount)
+		}
+		rw.writeLength(uint64(len(g.consumers)))
+		for _, c := range g.consumers {
+			rw.writeString(c.name)
+			rw.writeUint(uint64(c.seenTime), 8)
+			rw.writeUint(uint64(c.activeTime), 8)
+			rw.writeLength(uint64(len(c.pending)))
+			for _, id := range c.pending {
+				rw.writeStreamID(id)
+			}
+		}
+	}
+}
+
+// streamListpackItems lays out entries of a stream node. The master entry has
+// no fields, so every entry stores its own fields.
+func streamListpackItems(master streamID, entries []streamEntry) []string {
+	items := []string{strconv.Itoa(len(entries)), "0", "0", "0"}
+	for _, e := range entries {
+		items = append(items,
+			"0",
+			strconv.FormatInt(int64(e.id.ms-master.ms), 10),
+			strconv.FormatInt(int64(e.id.seq-master.seq), 10),
+			strconv.Itoa(len(e.fields)/2))
+		items = append(items, e.fields...)
+		items = append(items, strconv.Itoa(len(e.fields)+4))
+	}
+	return items
+}
+
+// finish writes EOF opcode with the checksum and flushes the buffer
+func (rw *rdbWriter) finish() error {
+	rw.writeByte(rdbOpcodeEOF)
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, rw.crc)
+	rw.write(buf)
+	if rw.err != nil {
+		return rw.err
+	}
+	return rw.w.Flush()
+}
+
+// rdbReplInfo is the replication state saved with a dump, so a server
+// restarted from it can continue the replication stream
+type rdbReplInfo struct {
+	replid   string
+	offset   int
+	streamDB int // database selected in the stream after the dump, -1 if none
+}
+
+func (rw *rdbWriter) writeReplInfo(ri *rdbReplInfo) {
+	rw.writeAux("repl-stream-db", strconv.Itoa(ri.streamDB))
+	rw.writeAux("repl-id", ri.replid)
+	rw.writeAux("repl-offset", strconv.Itoa(ri.offset))
+}
+
+// writeRDB writes complete RDB file with keys of all databases, and the
+// replication state unless ri is nil
+func writeRDB(w io.Writer, dbs []*dict[StoredValue], ri *rdbReplInfo) error {
+	rw := newRDBWriter(w)
+	rw.writeHeader(false)
+	if ri != nil {
+		rw.writeReplInfo(ri)
+	}
+	for db, keys := range dbs {
+		rw.writeDB(db, keys)
+	}
+	return rw.finish()
+}
+
+// writeReplRDB writes the snapshot sent to a replica, streamDB is the database
+// selected in the replication stream following it
+func writeReplRDB(w io.Writer, dbs []*dict[StoredValue], streamDB int) error {
+	rw := newRDBWriter(w)
+	rw.writeHeader(false)
+	rw.writeAux("repl-stream-db", strconv.Itoa(streamDB))
+	for db, keys := range dbs {
+		rw.writeDB(db, keys)
+	}
+	return rw.finish()
+}
+
+func writeRDBFile(w io.Writer, dbs []*dict[StoredValue], aofBase bool) error {
+	rw := newRDBWriter(w)
+	rw.writeHeader(aofBase)
+	for db, keys := range dbs {
+		rw.writeDB(db, keys)
+	}
+	return rw.finish()
+}
+
+// Save writes dbs to a temporary file and renames it over the dump file,
+// so the dump is never left half written
+func (rdb *RDBconn) Save(dbs []*dict[StoredValue], ri *rdbReplInfo) error {
+	tmpPath := filepath.Join(rdb.dir, fmt.Sprintf("temp-%d.rdb", os.Getpid()))
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if err = writeRDB(f, dbs, ri); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, filepath.Join(rdb.dir, rdb.dbfilename))
+}
+
+// Receive replaces the dump file with the snapshot read from r, used by
+// replicas saving the snapshot sent by the master before loading it
+func (rdb *RDBconn) Receive(r io.Reader) error {
+	tmpPath := filepath.Join(rdb.dir, fmt.Sprintf("temp-%d.%d.rdb", time.Now().Unix(), os.Getpid()))
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(f, r); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, filepath.Join(rdb.dir, rdb.dbfilename))
+}
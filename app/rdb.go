@@ -2,203 +2,910 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"os"
+	"path/filepath"
+	"strconv"
 	"time"
 )
 
-type bit byte
-
-const (
-	b7 bit = 0b0000_0001
-	b6 bit = 0b0000_0010
-	b5 bit = 0b0000_0100
-	b4 bit = 0b0000_1000
-	b3 bit = 0b0001_0000
-	b2 bit = 0b0010_0000
-	b1 bit = 0b0100_0000
-	b0 bit = 0b1000_0000
+var (
+	ErrNotRDB             = errors.New("not a rdb file")
+	ErrUnsupportedVersion = errors.New("unsupported rdb version")
+	ErrChecksum           = errors.New("wrong rdb checksum")
+	ErrTruncated          = errors.New("unexpected end of rdb file")
 )
 
-// TODO rewrite to isZeroBit
-func isBitOne(b byte, n bit) bool {
-	return b&byte(n) > 0
+// RDBError reports where in the file loading failed
+type RDBError struct {
+	Offset int64
+	Err    error
 }
 
-func sizeDecode(r *bufio.Reader) int {
-	var buf []byte
-	firstByte, _ := r.ReadByte()
-	buf = append(buf, firstByte)
-	if !isBitOne(firstByte, b0) {
-		// case first 2 bits are 0x
-		if !isBitOne(firstByte, b1) {
-			// case first two bits are 00
-			var byteToInt int8
-			binary.Read(bytes.NewReader(buf), binary.BigEndian, &byteToInt)
-			return int(byteToInt)
-		}
-		// case first two bits are 01
-		secondByte, _ := r.ReadByte()
-		buf = append(buf, secondByte)
-		var byteToInt int16
-		binary.Read(bytes.NewReader(buf), binary.BigEndian, &byteToInt)
-		return int(byteToInt)
-	}
-	//TODO add case where first two bits are 11
-	// see 'string encoding' in "Read a key" part of the tutorial
-
-	// case first two bits are 10
-	// ignore the first byte, read to buffer the rest 3 bytes
-	for i := 0; i < 3; i++ {
-		byt, _ := r.ReadByte()
-		buf = append(buf, byt)
-	}
-	var byteToInt uint32
-	binary.Read(bytes.NewReader(buf[1:]), binary.BigEndian, &byteToInt)
-	return int(byteToInt)
+func (e *RDBError) Error() string {
+	return fmt.Sprintf("%v at offset %d", e.Err, e.Offset)
+}
+
+func (e *RDBError) Unwrap() error {
+	return e.Err
 }
 
 type RDBconn struct {
 	dir        string
 	dbfilename string
+	save       []saveParam
 }
 
-func NewRDBconn(dir, filename string) *RDBconn {
-	if dir == "" && filename == "" {
-		return nil
-	}
+func NewRDBconn(conf *RDBconfig) *RDBconn {
 	return &RDBconn{
-		dir:        dir,
-		dbfilename: filename,
+		dir:        conf.dir,
+		dbfilename: conf.dbfilename,
+		save:       conf.save,
 	}
 }
 
-func (rdb *RDBconn) openRDBfile() (*bufio.Reader, error) {
-	rdbFile, err := os.Open(rdb.dir + "/" + rdb.dbfilename)
+// LoadFromRDStoMemory returns keys of every database found in the file by
+// database index, and the auxiliary fields of the file. Keys read before an
+// error are returned with it.
+func (rdb *RDBconn) LoadFromRDStoMemory() (map[int]map[string]StoredValue, map[string]string, error) {
+	return loadRDBFile(filepath.Join(rdb.dir, rdb.dbfilename))
+}
+
+// loadRDBFile reads keys of the RDB file at path, like LoadFromRDStoMemory
+func loadRDBFile(path string) (map[int]map[string]StoredValue, map[string]string, error) {
+	rdbFile, err := os.Open(path)
 	if err != nil {
-		// treat db as empty
-		//TODO create 'no file error' type
-		return nil, err
+		return nil, nil, err
 	}
 	defer rdbFile.Close()
 
-	reader := bufio.NewReader(rdbFile)
-	err = healthCheck(reader)
+	dbs := make(map[int]map[string]StoredValue)
+	aux, err := readRDB(rdbFile, func(db int, key string, v StoredValue) {
+		if dbs[db] == nil {
+			dbs[db] = make(map[string]StoredValue)
+		}
+		dbs[db][key] = v
+	})
+	return dbs, aux, err
+}
+
+// readRDB parses RDB stream calling onKey for every key in it and returns the
+// auxiliary fields. Keys of module types are skipped as their modules are not
+// available here. Errors are *RDBError wrapping one of the Err* values or a
+// description of the corruption.
+func readRDB(r io.Reader, onKey func(db int, key string, v StoredValue)) (map[string]string, error) {
+	rr := &rdbReader{r: bufio.NewReader(r)}
+	aux, err := rr.readRDB(onKey)
 	if err != nil {
-		//TODO handle error
-		fmt.Println("Failed healthcheck", err)
-		// return nil, err
-		os.Exit(1)
+		return aux, &RDBError{Offset: rr.offset, Err: err}
 	}
-	return reader, nil
+	return aux, nil
 }
 
-func (rdb *RDBconn) GetKeysWithPattern(pattern string) (keys [][]byte, err error) {
-	reader, err := rdb.openRDBfile()
+func (rr *rdbReader) readRDB(onKey func(db int, key string, v StoredValue)) (map[string]string, error) {
+	header, err := rr.readFull(9)
 	if err != nil {
-		// treat db as empty
-		return nil, nil
+		if errors.Is(err, ErrTruncated) {
+			err = ErrNotRDB
+		}
+		return nil, err
+	}
+	if string(header[:5]) != "REDIS" {
+		rr.offset = 0
+		return nil, ErrNotRDB
 	}
-	// read till FB - indicates a resizedb field, which follows by 2 bytes with db size info
-	reader.ReadBytes('\xFB')
-	if pattern == "*" {
-		keys = getAllKeysFrom(reader)
+	version, err := strconv.Atoi(string(header[5:]))
+	if err != nil || version < 1 || version > rdbVersion {
+		rr.offset = 5
+		return nil, fmt.Errorf("%w %q", ErrUnsupportedVersion, header[5:])
+	}
+
+	aux := make(map[string]string)
+	db := 0
+	var expires time.Time
+	for {
+		opcode, err := rr.readByte()
+		if err != nil {
+			return aux, err
+		}
+		switch opcode {
+		case rdbOpcodeEOF:
+			if version >= 5 {
+				err = rr.verifyChecksum()
+			}
+			return aux, err
+		case rdbOpcodeSelectDB:
+			var n uint64
+			n, err = rr.readLength()
+			db = int(n)
+		case rdbOpcodeResizeDB:
+			// size hints of the main and the expires tables
+			if _, err = rr.readLength(); err == nil {
+				_, err = rr.readLength()
+			}
+		case rdbOpcodeExpireTime:
+			var sec uint64
+			sec, err = rr.readUint(4)
+			expires = time.Unix(int64(sec), 0)
+		case rdbOpcodeExpireTimeMs:
+			var ms uint64
+			ms, err = rr.readUint(8)
+			expires = time.UnixMilli(int64(ms))
+		case rdbOpcodeAux:
+			var key, val string
+			if key, err = rr.readString(); err == nil {
+				val, err = rr.readString()
+				aux[key] = val
+			}
+		case rdbOpcodeIdle:
+			_, err = rr.readLength()
+		case rdbOpcodeFreq:
+			_, err = rr.readByte()
+		case rdbOpcodeSlotInfo:
+			// slot id, keys and expires in the slot
+			for i := 0; i < 3 && err == nil; i++ {
+				_, err = rr.readLength()
+			}
+		case rdbOpcodeFunction2:
+			// functions are not supported, the library code is dropped
+			_, err = rr.readString()
+		case rdbOpcodeFunctionPreGA:
+			err = rr.skipFunctionPreGA()
+		case rdbOpcodeModuleAux:
+			err = rr.skipModuleAux()
+		default:
+			start := rr.offset - 1
+			var key string
+			var v StoredValue
+			key, err = rr.readString()
+			if err != nil {
+				break
+			}
+			v, err = rr.readObject(opcode)
+			if err != nil {
+				err = fmt.Errorf("key %q of type %d starting at offset %d: %w", key, opcode, start, err)
+				break
+			}
+			if v.vType == "module" {
+				fmt.Printf("rdb.go/readRDB(): skipping key %q of module %s\n", key, v.val)
+			} else {
+				v.expires = expires
+				onKey(db, key, v)
+			}
+			expires = time.Time{}
+		}
+		if err != nil {
+			return aux, err
+		}
 	}
-	//TODO add regex patterns
-	return keys, nil
 }
 
-func getAllKeysFrom(r *bufio.Reader) [][]byte {
-	hashTableSize := sizeDecode(r) // size of the corresponding hash table
-	r.Discard(1)                   // skip size of the corresponding expire hash table
-	keys := make([][]byte, hashTableSize)
-	for i := 0; i < hashTableSize; i++ {
-		r.ReadByte() // skip type of value encoding byte
-		keyLength := sizeDecode(r)
-		keys[i] = make([]byte, keyLength)
-		r.Read(keys[i])
-		skipValue(r)
+// rdbReader decodes the primitives of the RDB format keeping the offset and
+// the checksum of everything read
+type rdbReader struct {
+	r      *bufio.Reader
+	offset int64
+	crc    uint64
+}
+
+func (rr *rdbReader) readByte() (byte, error) {
+	b, err := rr.r.ReadByte()
+	if err != nil {
+		if err == io.EOF {
+			err = ErrTruncated
+		}
+		return 0, err
 	}
-	return keys
+	rr.offset++
+	rr.crc = crc64Update(rr.crc, []byte{b})
+	return b, nil
 }
 
-// advance reader skipping value bytes
-func skipValue(r *bufio.Reader) {
-	valLength := sizeDecode(r)
-	for i := 0; i < valLength; i++ {
-		r.ReadByte()
+// readFull reads exactly n bytes, memory grows with the data actually read so
+// a corrupted length does not allocate it all upfront
+func (rr *rdbReader) readFull(n uint64) ([]byte, error) {
+	var buf []byte
+	var err error
+	if n <= 4096 {
+		buf = make([]byte, n)
+		var read int
+		read, err = io.ReadFull(rr.r, buf)
+		buf = buf[:read]
+	} else {
+		buf, err = io.ReadAll(io.LimitReader(rr.r, int64(min(n, math.MaxInt64))))
+	}
+	rr.offset += int64(len(buf))
+	rr.crc = crc64Update(rr.crc, buf)
+	if err == nil && uint64(len(buf)) != n || err == io.ErrUnexpectedEOF || err == io.EOF {
+		return nil, ErrTruncated
 	}
+	return buf, err
 }
 
-func healthCheck(r *bufio.Reader) error {
-	magicString, err := r.Peek(5)
+// verifyChecksum reads the checksum trailer following EOF opcode, zero means
+// the file was saved with checksums disabled
+func (rr *rdbReader) verifyChecksum() error {
+	expected := rr.crc
+	sum, err := rr.readUint(8)
 	if err != nil {
 		return err
 	}
-	if string(magicString) != "REDIS" {
-		return fmt.Errorf("error not a rdb file")
+	if sum != 0 && sum != expected {
+		rr.offset -= 8
+		return fmt.Errorf("%w, computed %016x, file has %016x", ErrChecksum, expected, sum)
 	}
 	return nil
 }
 
-func (rdb *RDBconn) LoadFromRDStoMemory() (map[string]StoredValue, error) {
-	store := make(map[string]StoredValue)
-	reader, err := rdb.openRDBfile()
+// readUint reads little endian unsigned integer of size bytes
+func (rr *rdbReader) readUint(size int) (uint64, error) {
+	buf, err := rr.readFull(uint64(size))
+	if err != nil {
+		return 0, err
+	}
+	var n uint64
+	for i := size - 1; i >= 0; i-- {
+		n = n<<8 | uint64(buf[i])
+	}
+	return n, nil
+}
+
+// readLengthEncoding decodes the size encoding. The first two bits tell how
+// many bytes follow, 11 marks a special string encoding returned in n with
+// encoded set.
+func (rr *rdbReader) readLengthEncoding() (n uint64, encoded bool, err error) {
+	b, err := rr.readByte()
+	if err != nil {
+		return 0, false, err
+	}
+	switch b >> 6 {
+	case 0:
+		return uint64(b & 0x3F), false, nil
+	case 1:
+		next, err := rr.readByte()
+		return uint64(b&0x3F)<<8 | uint64(next), false, err
+	case 3:
+		return uint64(b & 0x3F), true, nil
+	}
+	var buf []byte
+	switch b {
+	case 0x80:
+		buf, err = rr.readFull(4)
+	case 0x81:
+		buf, err = rr.readFull(8)
+	default:
+		return 0, false, fmt.Errorf("unknown length encoding 0x%02x", b)
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	for _, digit := range buf {
+		n = n<<8 | uint64(digit)
+	}
+	return n, false, nil
+}
+
+func (rr *rdbReader) readLength() (uint64, error) {
+	n, encoded, err := rr.readLengthEncoding()
+	if err == nil && encoded {
+		err = fmt.Errorf("unexpected string encoding where length was expected")
+	}
+	return n, err
+}
+
+// readString reads length prefixed string, an integer or LZF compressed string
+func (rr *rdbReader) readString() (string, error) {
+	n, encoded, err := rr.readLengthEncoding()
+	if err != nil {
+		return "", err
+	}
+	if !encoded {
+		buf, err := rr.readFull(n)
+		return string(buf), err
+	}
+	switch n {
+	case rdbEncInt8:
+		b, err := rr.readByte()
+		return strconv.Itoa(int(int8(b))), err
+	case rdbEncInt16:
+		v, err := rr.readUint(2)
+		return strconv.Itoa(int(int16(v))), err
+	case rdbEncInt32:
+		v, err := rr.readUint(4)
+		return strconv.Itoa(int(int32(v))), err
+	case rdbEncLZF:
+		clen, err := rr.readLength()
+		if err != nil {
+			return "", err
+		}
+		size, err := rr.readLength()
+		if err != nil {
+			return "", err
+		}
+		compressed, err := rr.readFull(clen)
+		if err != nil {
+			return "", err
+		}
+		buf, err := lzfDecompress(compressed, int(size))
+		return string(buf), err
+	}
+	return "", fmt.Errorf("unknown string encoding %d", n)
+}
+
+// readBinaryDouble reads little endian IEEE 754 double
+func (rr *rdbReader) readBinaryDouble() (float64, error) {
+	bits, err := rr.readUint(8)
+	return math.Float64frombits(bits), err
+}
+
+// readDouble reads score of the old zset type, a double in text form
+// prefixed by its length with special lengths for NaN and infinities
+func (rr *rdbReader) readDouble() (float64, error) {
+	n, err := rr.readByte()
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	buf, err := rr.readFull(uint64(n))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(string(buf), 64)
+}
+
+// readStreamID reads 128 bit big endian stream ID used by consumer groups
+func (rr *rdbReader) readStreamID() (streamID, error) {
+	buf, err := rr.readFull(16)
+	if err != nil {
+		return streamID{}, err
+	}
+	return streamID{ms: binary.BigEndian.Uint64(buf), seq: binary.BigEndian.Uint64(buf[8:])}, nil
+}
+
+func (rr *rdbReader) readLengthStreamID() (streamID, error) {
+	ms, err := rr.readLength()
+	if err != nil {
+		return streamID{}, err
+	}
+	seq, err := rr.readLength()
+	return streamID{ms: ms, seq: seq}, err
+}
+
+// readStrings reads n length prefixed strings
+func (rr *rdbReader) readStrings(n uint64) ([]string, error) {
+	var items []string
+	for i := uint64(0); i < n; i++ {
+		s, err := rr.readString()
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, s)
+	}
+	return items, nil
+}
+
+// readEncoded reads a string holding elements in one of the compact encodings
+func (rr *rdbReader) readEncoded(decode func([]byte) ([]string, error)) ([]string, error) {
+	s, err := rr.readString()
 	if err != nil {
 		return nil, err
 	}
-	// read till FB - indicates a resizedb field, which follows by 2 bytes with db size info
-	reader.ReadBytes('\xFB')
-	reader.Discard(2) // skip size of the corresponding hash table and expire hash table
+	return decode([]byte(s))
+}
+
+// readObject reads value of the given type
+func (rr *rdbReader) readObject(t byte) (StoredValue, error) {
+	switch t {
+	case rdbTypeString:
+		s, err := rr.readString()
+		return StoredValue{vType: "string", val: s}, err
+	case rdbTypeList, rdbTypeSet, rdbTypeHash:
+		n, err := rr.readLength()
+		if err != nil {
+			return StoredValue{}, err
+		}
+		if t == rdbTypeHash {
+			n *= 2
+		}
+		items, err := rr.readStrings(n)
+		if err != nil {
+			return StoredValue{}, err
+		}
+		switch t {
+		case rdbTypeList:
+			return listFromItems(items), nil
+		case rdbTypeSet:
+			return setFromItems(items), nil
+		}
+		return hashFromItems(items)
+	case rdbTypeZset, rdbTypeZset2:
+		n, err := rr.readLength()
+		if err != nil {
+			return StoredValue{}, err
+		}
+		v := newStoredValue("zset")
+		for i := uint64(0); i < n; i++ {
+			member, err := rr.readString()
+			if err != nil {
+				return StoredValue{}, err
+			}
+			var score float64
+			if t == rdbTypeZset {
+				score, err = rr.readDouble()
+			} else {
+				score, err = rr.readBinaryDouble()
+			}
+			if err != nil {
+				return StoredValue{}, err
+			}
+			v.zset.Add(member, score)
+		}
+		return v, nil
+	case rdbTypeHashZipmap:
+		items, err := rr.readEncoded(zipmapEntries)
+		if err != nil {
+			return StoredValue{}, err
+		}
+		return hashFromItems(items)
+	case rdbTypeListZiplist:
+		items, err := rr.readEncoded(ziplistEntries)
+		return listFromItems(items), err
+	case rdbTypeSetIntset:
+		items, err := rr.readEncoded(intsetEntries)
+		return setFromItems(items), err
+	case rdbTypeSetListpack:
+		items, err := rr.readEncoded(listpackEntries)
+		return setFromItems(items), err
+	case rdbTypeZsetZiplist, rdbTypeZsetListpack:
+		decode := ziplistEntries
+		if t == rdbTypeZsetListpack {
+			decode = listpackEntries
+		}
+		items, err := rr.readEncoded(decode)
+		if err != nil {
+			return StoredValue{}, err
+		}
+		return zsetFromItems(items)
+	case rdbTypeHashZiplist, rdbTypeHashListpack:
+		decode := ziplistEntries
+		if t == rdbTypeHashListpack {
+			decode = listpackEntries
+		}
+		items, err := rr.readEncoded(decode)
+		if err != nil {
+			return StoredValue{}, err
+		}
+		return hashFromItems(items)
+	case rdbTypeListQuicklist, rdbTypeListQuicklist2:
+		return rr.readQuicklist(t)
+	case rdbTypeStreamListpacks, rdbTypeStreamListpacks2, rdbTypeStreamListpacks3:
+		return rr.readStream(t)
+	case rdbTypeModule2:
+		return rr.skipModuleValue()
+	case rdbTypeModulePreGA:
+		return StoredValue{}, fmt.Errorf("can't load module value saved by a pre release version of Redis modules")
+	}
+	return StoredValue{}, fmt.Errorf("unknown value type %d", t)
+}
+
+// readQuicklist reads list stored as a sequence of ziplists or, since
+// version 2, of listpacks and plain elements too large to be packed
+func (rr *rdbReader) readQuicklist(t byte) (StoredValue, error) {
+	nodes, err := rr.readLength()
+	if err != nil {
+		return StoredValue{}, err
+	}
+	v := newStoredValue("list")
+	for i := uint64(0); i < nodes; i++ {
+		container := uint64(quicklistNodePacked)
+		if t == rdbTypeListQuicklist2 {
+			if container, err = rr.readLength(); err != nil {
+				return StoredValue{}, err
+			}
+		}
+		var items []string
+		switch container {
+		case quicklistNodePlain:
+			var item string
+			item, err = rr.readString()
+			items = []string{item}
+		case quicklistNodePacked:
+			decode := ziplistEntries
+			if t == rdbTypeListQuicklist2 {
+				decode = listpackEntries
+			}
+			items, err = rr.readEncoded(decode)
+		default:
+			err = fmt.Errorf("unknown quicklist node container %d", container)
+		}
+		if err != nil {
+			return StoredValue{}, err
+		}
+		v.list.PushTail(items...)
+	}
+	return v, nil
+}
+
+// readStream reads stream entries stored in listpacks keyed by their master
+// ID, followed by the stream metadata and consumer groups. Later versions
+// added fields to the metadata, groups and consumers.
+func (rr *rdbReader) readStream(t byte) (StoredValue, error) {
+	nodes, err := rr.readLength()
+	if err != nil {
+		return StoredValue{}, err
+	}
+	v := newStoredValue("stream")
+	s := v.stream
+	for i := uint64(0); i < nodes; i++ {
+		nodeKey, err := rr.readString()
+		if err != nil {
+			return StoredValue{}, err
+		}
+		if len(nodeKey) != 16 {
+			return StoredValue{}, fmt.Errorf("stream node key is not a stream ID")
+		}
+		master := streamID{ms: binary.BigEndian.Uint64([]byte(nodeKey)), seq: binary.BigEndian.Uint64([]byte(nodeKey[8:]))}
+		items, err := rr.readEncoded(listpackEntries)
+		if err != nil {
+			return StoredValue{}, err
+		}
+		entries, err := streamEntriesFromListpack(master, items)
+		if err != nil {
+			return StoredValue{}, err
+		}
+		s.entries = append(s.entries, entries...)
+	}
+
+	length, err := rr.readLength()
+	if err != nil {
+		return StoredValue{}, err
+	}
+	if length != uint64(len(s.entries)) {
+		return StoredValue{}, fmt.Errorf("stream length %d does not match %d entries", length, len(s.entries))
+	}
+	if s.lastID, err = rr.readLengthStreamID(); err != nil {
+		return StoredValue{}, err
+	}
+	s.entriesAdded = length
+	if t >= rdbTypeStreamListpacks2 {
+		// the first ID is known from the entries
+		if _, err = rr.readLengthStreamID(); err != nil {
+			return StoredValue{}, err
+		}
+		if s.maxDeletedID, err = rr.readLengthStreamID(); err != nil {
+			return StoredValue{}, err
+		}
+		if s.entriesAdded, err = rr.readLength(); err != nil {
+			return StoredValue{}, err
+		}
+	}
+
+	groups, err := rr.readLength()
+	if err != nil {
+		return StoredValue{}, err
+	}
+	for i := uint64(0); i < groups; i++ {
+		g, err := rr.readStreamGroup(t)
+		if err != nil {
+			return StoredValue{}, err
+		}
+		s.groups = append(s.groups, g)
+	}
+	return v, nil
+}
+
+func (rr *rdbReader) readStreamGroup(t byte) (*streamGroup, error) {
+	var err error
+	g := &streamGroup{entriesRead: -1}
+	if g.name, err = rr.readString(); err != nil {
+		return nil, err
+	}
+	if g.lastID, err = rr.readLengthStreamID(); err != nil {
+		return nil, err
+	}
+	if t >= rdbTypeStreamListpacks2 {
+		var n uint64
+		if n, err = rr.readLength(); err != nil {
+			return nil, err
+		}
+		g.entriesRead = int64(n)
+	}
+
+	pending, err := rr.readLength()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < pending; i++ {
+		var p streamPending
+		if p.id, err = rr.readStreamID(); err != nil {
+			return nil, err
+		}
+		var deliveryTime uint64
+		if deliveryTime, err = rr.readUint(8); err != nil {
+			return nil, err
+		}
+		p.deliveryTime = int64(deliveryTime)
+		if p.deliveryCount, err = rr.readLength(); err != nil {
+			return nil, err
+		}
+		g.pending = append(g.pending, p)
+	}
+
+	consumers, err := rr.readLength()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint64(0); i < consumers; i++ {
+		c := streamConsumer{activeTime: -1}
+		if c.name, err = rr.readString(); err != nil {
+			return nil, err
+		}
+		var seen uint64
+		if seen, err = rr.readUint(8); err != nil {
+			return nil, err
+		}
+		c.seenTime = int64(seen)
+		if t >= rdbTypeStreamListpacks3 {
+			var active uint64
+			if active, err = rr.readUint(8); err != nil {
+				return nil, err
+			}
+			c.activeTime = int64(active)
+		}
+		n, err := rr.readLength()
+		if err != nil {
+			return nil, err
+		}
+		for j := uint64(0); j < n; j++ {
+			id, err := rr.readStreamID()
+			if err != nil {
+				return nil, err
+			}
+			found := false
+			for k := range g.pending {
+				if g.pending[k].id == id {
+					g.pending[k].consumer = c.name
+					found = true
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("consumer %q pending entry %s not found in the group", c.name, id)
+			}
+			c.pending = append(c.pending, id)
+		}
+		g.consumers = append(g.consumers, c)
+	}
+	return g, nil
+}
+
+// streamEntriesFromListpack decodes entries of a stream listpack node. The
+// node starts with a master entry holding the entry counts and the fields of
+// the first entry, later entries having the same fields store only the values.
+func streamEntriesFromListpack(master streamID, items []string) ([]streamEntry, error) {
+	p := 0
+	next := func() (string, error) {
+		if p >= len(items) {
+			return "", fmt.Errorf("stream listpack is truncated")
+		}
+		p++
+		return items[p-1], nil
+	}
+	nextInt := func() (int64, error) {
+		s, err := next()
+		if err != nil {
+			return 0, err
+		}
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("stream listpack has invalid integer %q", s)
+		}
+		return n, nil
+	}
+
+	// count and deleted count are known once all entries are read
+	for i := 0; i < 2; i++ {
+		if _, err := nextInt(); err != nil {
+			return nil, err
+		}
+	}
+	numMasterFields, err := nextInt()
+	if err != nil {
+		return nil, err
+	}
+	var masterFields []string
+	for i := int64(0); i < numMasterFields; i++ {
+		f, err := next()
+		if err != nil {
+			return nil, err
+		}
+		masterFields = append(masterFields, f)
+	}
+	if _, err := nextInt(); err != nil { // master entry terminator
+		return nil, err
+	}
+
+	var entries []streamEntry
+	for p < len(items) {
+		flags, err := nextInt()
+		if err != nil {
+			return nil, err
+		}
+		msDiff, err := nextInt()
+		if err != nil {
+			return nil, err
+		}
+		seqDiff, err := nextInt()
+		if err != nil {
+			return nil, err
+		}
+		e := streamEntry{id: streamID{ms: master.ms + uint64(msDiff), seq: master.seq + uint64(seqDiff)}}
+		if flags&streamItemFlagSameFields != 0 {
+			for _, f := range masterFields {
+				val, err := next()
+				if err != nil {
+					return nil, err
+				}
+				e.fields = append(e.fields, f, val)
+			}
+		} else {
+			n, err := nextInt()
+			if err != nil {
+				return nil, err
+			}
+			for i := int64(0); i < 2*n; i++ {
+				item, err := next()
+				if err != nil {
+					return nil, err
+				}
+				e.fields = append(e.fields, item)
+			}
+		}
+		if _, err := nextInt(); err != nil { // lp-count used to walk the listpack backwards
+			return nil, err
+		}
+		if flags&streamItemFlagDeleted == 0 {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+// skipModuleValue reads value of a module type saved with RDB_TYPE_MODULE_2,
+// it is a sequence of typed elements ending with EOF. The module name is
+// returned in val.
+func (rr *rdbReader) skipModuleValue() (StoredValue, error) {
+	id, err := rr.readLength()
+	if err != nil {
+		return StoredValue{}, err
+	}
+	return StoredValue{vType: "module", val: moduleName(id)}, rr.skipModuleElements()
+}
+
+func (rr *rdbReader) skipModuleElements() error {
 	for {
-		byt, err := reader.ReadByte()
-		if err != nil || byt == '\xFF' {
-			break
+		opcode, err := rr.readLength()
+		if err != nil {
+			return err
 		}
-		if byt == '\xFE' {
-			continue
+		switch opcode {
+		case rdbModuleOpcodeEOF:
+			return nil
+		case rdbModuleOpcodeSint, rdbModuleOpcodeUint:
+			_, err = rr.readLength()
+		case rdbModuleOpcodeFloat:
+			_, err = rr.readFull(4)
+		case rdbModuleOpcodeDouble:
+			_, err = rr.readFull(8)
+		case rdbModuleOpcodeString:
+			_, err = rr.readString()
+		default:
+			err = fmt.Errorf("unknown module opcode %d", opcode)
 		}
-		var expires time.Time
-		if byt == '\xFD' || byt == '\xFC' {
-			expires = getExpireDate(byt, reader)
+		if err != nil {
+			return err
 		}
-		keyLength := sizeDecode(reader)
-		keyBuf := make([]byte, keyLength)
-		reader.Read(keyBuf)
+	}
+}
+
+// skipModuleAux skips auxiliary data of a module, module id and when the data
+// is loaded are followed by elements like in module values
+func (rr *rdbReader) skipModuleAux() error {
+	if _, err := rr.readLength(); err != nil {
+		return err
+	}
+	whenOpcode, err := rr.readLength()
+	if err != nil {
+		return err
+	}
+	if whenOpcode != rdbModuleOpcodeUint {
+		return fmt.Errorf("invalid module aux when opcode %d", whenOpcode)
+	}
+	if _, err := rr.readLength(); err != nil {
+		return err
+	}
+	return rr.skipModuleElements()
+}
 
-		valLength := sizeDecode(reader)
-		valBuf := make([]byte, valLength)
-		reader.Read(valBuf)
-		val := StoredValue{
-			val:     string(valBuf),
-			expires: expires,
+// skipFunctionPreGA skips function saved by Redis 7.0 release candidates:
+// name, engine, optional description and code
+func (rr *rdbReader) skipFunctionPreGA() error {
+	for i := 0; i < 2; i++ {
+		if _, err := rr.readString(); err != nil {
+			return err
 		}
-		store[string(keyBuf)] = val
 	}
-	return store, nil
+	hasDesc, err := rr.readLength()
+	if err != nil {
+		return err
+	}
+	if hasDesc != 0 {
+		if _, err := rr.readString(); err != nil {
+			return err
+		}
+	}
+	_, err = rr.readString()
+	return err
 }
 
-func getExpireDate(b byte, r *bufio.Reader) time.Time {
-	var expires time.Time
-	// expiry time in seconds followed by 4 byte unsigned int
-	if b == '\xFD' {
-		var expiresInt32 uint32
-		expireBytes := make([]byte, 4)
-		r.Read(expireBytes)
-		binary.Read(bytes.NewReader(expireBytes), binary.LittleEndian, &expiresInt32)
-		expires = time.Unix(int64(expiresInt32), 0)
-	}
-	// expiry time in milliseconds followed by 8 byte unsigned long
-	if b == '\xFC' {
-		var expiresInt64 uint64
-		expireBytes := make([]byte, 8)
-		r.Read(expireBytes)
-		binary.Read(bytes.NewReader(expireBytes), binary.LittleEndian, &expiresInt64)
-		expires = time.UnixMilli(int64(expiresInt64))
-	}
-	//TODO add encoding type prcessing
-	r.ReadByte() // skip encoding byte
-	return expires
+// moduleName decodes 9 characters of the module name from the upper 54 bits of module id
+func moduleName(id uint64) string {
+	const charset = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789-_"
+	name := make([]byte, 9)
+	for i := range name {
+		name[i] = charset[(id>>(64-6*(i+1)))&63]
+	}
+	return string(name)
+}
+
+func listFromItems(items []string) StoredValue {
+	v := newStoredValue("list")
+	v.list.PushTail(items...)
+	return v
+}
+
+func setFromItems(items []string) StoredValue {
+	v := newStoredValue("set")
+	for _, member := range items {
+		v.set.Set(member, struct{}{})
+	}
+	return v
+}
+
+// hashFromItems builds hash from field value pairs
+func hashFromItems(items []string) (StoredValue, error) {
+	if len(items)%2 != 0 {
+		return StoredValue{}, fmt.Errorf("hash has a field without value")
+	}
+	v := newStoredValue("hash")
+	for i := 0; i < len(items); i += 2 {
+		v.hash.Set(items[i], items[i+1])
+	}
+	return v, nil
+}
+
+// zsetFromItems builds sorted set from member score pairs
+func zsetFromItems(items []string) (StoredValue, error) {
+	if len(items)%2 != 0 {
+		return StoredValue{}, fmt.Errorf("sorted set has a member without score")
+	}
+	v := newStoredValue("zset")
+	for i := 0; i < len(items); i += 2 {
+		score, err := strconv.ParseFloat(items[i+1], 64)
+		if err != nil {
+			return StoredValue{}, fmt.Errorf("sorted set has invalid score %q", items[i+1])
+		}
+		v.zset.Add(items[i], score)
+	}
+	return v, nil
 }
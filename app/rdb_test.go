@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// valueJSON is a comparable form of v, collections in a fixed order
+func valueJSON(t *testing.T, v StoredValue) string {
+	t.Helper()
+	b, err := json.Marshal(storedValueToJSON(0, "key", v))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func readObjectFrom(p []byte) (StoredValue, error) {
+	rr := &rdbReader{r: bufio.NewReader(bytes.NewReader(p))}
+	t, err := rr.readByte()
+	if err != nil {
+		return StoredValue{}, err
+	}
+	return rr.readObject(t)
+}
+
+func testStream() StoredValue {
+	v := newStoredValue("stream")
+	s := v.stream
+	// more entries than fit in one listpack node
+	for i := range streamNodeMaxEntries + 50 {
+		id := streamID{ms: 1700000000000 + uint64(i/3), seq: uint64(i % 3)}
+		s.entries = append(s.entries, streamEntry{id: id, fields: []string{"n", strconv.Itoa(i), "name", "item"}})
+		s.lastID = id
+	}
+	s.entriesAdded = uint64(len(s.entries)) + 2
+	s.maxDeletedID = streamID{ms: 1700000000000, seq: 5}
+	s.groups = []*streamGroup{{
+		name:        "group",
+		lastID:      s.entries[1].id,
+		entriesRead: 2,
+		pending: []streamPending{
+			{id: s.entries[0].id, consumer: "alice", deliveryTime: 1700000000100, deliveryCount: 1},
+			{id: s.entries[1].id, consumer: "alice", deliveryTime: 1700000000200, deliveryCount: 3},
+		},
+		consumers: []streamConsumer{
+			{name: "alice", seenTime: 1700000000200, activeTime: 1700000000100, pending: []streamID{s.entries[0].id, s.entries[1].id}},
+			{name: "bob", seenTime: 1700000000300, activeTime: -1, pending: []streamID{}},
+		},
+	}}
+	return v
+}
+
+func TestRDBValueRoundTrip(t *testing.T) {
+	list := listFromItems([]string{"a", "", "123", "-7", "a"})
+	bigList := newStoredValue("list")
+	for i := range 1000 {
+		bigList.list.PushTail(strconv.Itoa(i))
+	}
+	set := setFromItems([]string{"x", "y", "42", "\x00\xff"})
+	hash, _ := hashFromItems([]string{"f1", "v1", "f2", "", "n", "10"})
+	zset := newStoredValue("zset")
+	zset.zset.Add("a", 1.5)
+	zset.zset.Add("b", -3)
+	zset.zset.Add("inf", math.Inf(1))
+	zset.zset.Add("-inf", math.Inf(-1))
+
+	tests := []struct {
+		name string
+		v    StoredValue
+	}{
+		{"empty string", StoredValue{vType: "string", val: ""}},
+		{"string", StoredValue{vType: "string", val: "hello world"}},
+		{"integer string", StoredValue{vType: "string", val: "-12345"}},
+		{"binary string", StoredValue{vType: "string", val: "\x00\x01\xfe\xff"}},
+		{"long string", StoredValue{vType: "string", val: string(bytes.Repeat([]byte("abc"), 10000))}},
+		{"list", list},
+		{"long list", bigList},
+		{"set", set},
+		{"hash", hash},
+		{"zset", zset},
+		{"stream", testStream()},
+		{"empty stream", newStoredValue("stream")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b bytes.Buffer
+			rw := newRDBWriter(&b)
+			rw.writeByte(rdbValueType(tt.v))
+			rw.writeValue(tt.v)
+			if err := rw.w.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			got, err := readObjectFrom(b.Bytes())
+			if err != nil {
+				t.Fatalf("readObject: %v", err)
+			}
+			if g, w := valueJSON(t, got), valueJSON(t, tt.v); g != w {
+				t.Errorf("got %s\nwant %s", g, w)
+			}
+		})
+	}
+}
+
+// rdbBytes returns what fn writes with an rdbWriter
+func rdbBytes(fn func(rw *rdbWriter)) []byte {
+	var b bytes.Buffer
+	rw := newRDBWriter(&b)
+	fn(rw)
+	rw.w.Flush()
+	return b.Bytes()
+}
+
+// testZiplist builds a ziplist of already encoded entries, the lengths of
+// previous entries are not checked by the decoder
+func testZiplist(entries ...[]byte) []byte {
+	zl := make([]byte, ziplistHeaderSize)
+	for _, e := range entries {
+		zl = append(zl, 0)
+		zl = append(zl, e...)
+	}
+	zl = append(zl, 0xFF)
+	binary.LittleEndian.PutUint32(zl, uint32(len(zl)))
+	binary.LittleEndian.PutUint16(zl[8:], uint16(len(entries)))
+	return zl
+}
+
+func zlStr(s string) []byte {
+	return append([]byte{byte(len(s))}, s...)
+}
+
+func TestRDBReadEncodings(t *testing.T) {
+	str := func(s string) StoredValue { return StoredValue{vType: "string", val: s} }
+	zset := func(items ...string) StoredValue {
+		v, _ := zsetFromItems(items)
+		return v
+	}
+	hash := func(items ...string) StoredValue {
+		v, _ := hashFromItems(items)
+		return v
+	}
+	// ziplist entries: a string, int8, 4 bit immediate, int16 and int24
+	ziplist := testZiplist(zlStr("foo"), []byte{0xFE, 0xFB}, []byte{0xF3}, []byte{0xC0, 0xE8, 0x03}, []byte{0xF0, 0xA0, 0x86, 0x01})
+	intset := []byte{2, 0, 0, 0, 3, 0, 0, 0, 0xFF, 0xFF, 2, 0, 0x2C, 0x01}
+	zipmap := []byte{2, 1, 'a', 1, 0, '1', 1, 'b', 2, 1, '2', '2', 'x', 0xFF}
+
+	tests := []struct {
+		name    string
+		t       byte
+		payload []byte // value following the type byte
+		want    StoredValue
+	}{
+		{"int8 string", rdbTypeString, []byte{0xC0, 0x85}, str("-123")},
+		{"int16 string", rdbTypeString, []byte{0xC1, 0x39, 0x30}, str("12345")},
+		{"int32 string", rdbTypeString, []byte{0xC2, 0x15, 0xCD, 0x5B, 0x07}, str("123456789")},
+		{"lzf string", rdbTypeString, []byte{0xC3, 6, 9, 2, 'a', 'b', 'c', 0x80, 2}, str("abcabcabc")},
+		{"zset with text scores", rdbTypeZset, []byte{2, 1, 'a', 3, '1', '.', '5', 1, 'b', 254}, zset("a", "1.5", "b", "inf")},
+		{"hash zipmap", rdbTypeHashZipmap, rdbBytes(func(rw *rdbWriter) { rw.writeString(string(zipmap)) }), hash("a", "1", "b", "22")},
+		{"list ziplist", rdbTypeListZiplist, rdbBytes(func(rw *rdbWriter) { rw.writeString(string(ziplist)) }),
+			listFromItems([]string{"foo", "-5", "2", "1000", "100000"})},
+		{"set intset", rdbTypeSetIntset, rdbBytes(func(rw *rdbWriter) { rw.writeString(string(intset)) }),
+			setFromItems([]string{"-1", "2", "300"})},
+		{"set listpack", rdbTypeSetListpack, rdbBytes(func(rw *rdbWriter) {
+			rw.writeString(string(newListpack([]string{"a", "1", "-70000", "5000000000"})))
+		}), setFromItems([]string{"a", "1", "-70000", "5000000000"})},
+		{"zset ziplist", rdbTypeZsetZiplist, rdbBytes(func(rw *rdbWriter) {
+			rw.writeString(string(testZiplist(zlStr("m"), zlStr("1.5"), zlStr("n"), []byte{0xF4})))
+		}), zset("m", "1.5", "n", "3")},
+		{"zset listpack", rdbTypeZsetListpack, rdbBytes(func(rw *rdbWriter) {
+			rw.writeString(string(newListpack([]string{"m", "1.5", "n", "-2"})))
+		}), zset("m", "1.5", "n", "-2")},
+		{"hash ziplist", rdbTypeHashZiplist, rdbBytes(func(rw *rdbWriter) {
+			rw.writeString(string(testZiplist(zlStr("f"), zlStr("v"), zlStr("n"), []byte{0xFE, 7})))
+		}), hash("f", "v", "n", "7")},
+		{"hash listpack", rdbTypeHashListpack, rdbBytes(func(rw *rdbWriter) {
+			rw.writeString(string(newListpack([]string{"f", "v", "n", "7"})))
+		}), hash("f", "v", "n", "7")},
+		{"quicklist", rdbTypeListQuicklist, rdbBytes(func(rw *rdbWriter) {
+			rw.writeLength(2)
+			rw.writeString(string(testZiplist(zlStr("a"), zlStr("b"))))
+			rw.writeString(string(testZiplist([]byte{0xF2})))
+		}), listFromItems([]string{"a", "b", "1"})},
+		{"quicklist2", rdbTypeListQuicklist2, rdbBytes(func(rw *rdbWriter) {
+			rw.writeLength(2)
+			rw.writeLength(quicklistNodePacked)
+			rw.writeString(string(newListpack([]string{"a", "12"})))
+			rw.writeLength(quicklistNodePlain)
+			rw.writeString("plain element")
+		}), listFromItems([]string{"a", "12", "plain element"})},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readObjectFrom(append([]byte{tt.t}, tt.payload...))
+			if err != nil {
+				t.Fatalf("readObject: %v", err)
+			}
+			if g, w := valueJSON(t, got), valueJSON(t, tt.want); g != w {
+				t.Errorf("got %s\nwant %s", g, w)
+			}
+		})
+	}
+}
+
+func TestRDBFileRoundTrip(t *testing.T) {
+	dbs := []*dict[StoredValue]{newDict[StoredValue](), newDict[StoredValue](), newDict[StoredValue]()}
+	dbs[0].Set("s", StoredValue{vType: "string", val: "v"})
+	dbs[0].Set("ttl", StoredValue{vType: "string", val: "v", expires: time.UnixMilli(4102444800000)})
+	dbs[2].Set("l", listFromItems([]string{"a", "b"}))
+	dbs[2].Set("x", testStream())
+
+	var b bytes.Buffer
+	if err := writeRDB(&b, dbs, &rdbReplInfo{replid: "0123456789abcdef0123456789abcdef01234567", offset: 42, streamDB: 2}); err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[int]map[string]StoredValue)
+	aux, err := readRDB(&b, func(db int, key string, v StoredValue) {
+		if got[db] == nil {
+			got[db] = make(map[string]StoredValue)
+		}
+		got[db][key] = v
+	})
+	if err != nil {
+		t.Fatalf("readRDB: %v", err)
+	}
+	if aux["repl-id"] != "0123456789abcdef0123456789abcdef01234567" || aux["repl-offset"] != "42" || aux["repl-stream-db"] != "2" {
+		t.Errorf("replication info not loaded: %v", aux)
+	}
+	for db, keys := range dbs {
+		if len(got[db]) != keys.Len() {
+			t.Errorf("db %d has %d keys, want %d", db, len(got[db]), keys.Len())
+		}
+		keys.Range(func(key string, want StoredValue) bool {
+			v, ok := got[db][key]
+			if !ok {
+				t.Errorf("db %d key %q missing", db, key)
+				return true
+			}
+			if !v.expires.Equal(want.expires) {
+				t.Errorf("db %d key %q expires at %v, want %v", db, key, v.expires, want.expires)
+			}
+			if g, w := valueJSON(t, v), valueJSON(t, want); g != w {
+				t.Errorf("db %d key %q is %s, want %s", db, key, g, w)
+			}
+			return true
+		})
+	}
+}
+
+func TestRDBChecksum(t *testing.T) {
+	dbs := []*dict[StoredValue]{newDict[StoredValue]()}
+	dbs[0].Set("key", StoredValue{vType: "string", val: "value"})
+	var b bytes.Buffer
+	if err := writeRDB(&b, dbs, nil); err != nil {
+		t.Fatal(err)
+	}
+	valid := b.Bytes()
+	sumAt := len(valid) - 8
+
+	tests := []struct {
+		name    string
+		corrupt func(p []byte) []byte
+		wantErr error
+	}{
+		{"valid", func(p []byte) []byte { return p }, nil},
+		{"checksum disabled", func(p []byte) []byte { copy(p[sumAt:], make([]byte, 8)); return p }, nil},
+		{"value changed", func(p []byte) []byte { p[bytes.Index(p, []byte("value"))] = 'V'; return p }, ErrChecksum},
+		{"checksum changed", func(p []byte) []byte { p[sumAt] ^= 1; return p }, ErrChecksum},
+		{"truncated", func(p []byte) []byte { return p[:sumAt+4] }, ErrTruncated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := tt.corrupt(append([]byte(nil), valid...))
+			_, err := readRDB(bytes.NewReader(p), func(int, string, StoredValue) {})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("readRDB error = %v, want %v", err, tt.wantErr)
+			}
+			var rdbErr *RDBError
+			if tt.wantErr == ErrChecksum && (!errors.As(err, &rdbErr) || rdbErr.Offset != int64(sumAt)) {
+				t.Errorf("checksum error %v not reported at offset %d", err, sumAt)
+			}
+		})
+	}
+}
@@ -3,144 +3,200 @@ package main
 import (
 	"bufio"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 type RDBconfig struct {
 	dir        string
 	dbfilename string
+	load       bool // load dbfilename at startup
+	save       []saveParam
+}
+
+type AOFconfig struct {
+	enabled           bool
+	filename          string
+	dirname           string // directory of the base and incremental files, relative to dir
+	fsync             string // always, everysec or no
+	loadTruncated     bool
+	useRDBPreamble    bool  // rewrite writes the base file in RDB format
+	rewritePercentage int   // growth since the last rewrite that starts a new one, 0 disables it
+	rewriteMinSize    int64 // automatic rewrite starts only for larger files
+}
+
+type ServerConfig struct {
+	databases int
 }
 
 type ReplicationConfig struct {
-	host        string
-	port        string
-	replication struct {
+	host              string
+	port              string
+	disklessSync      bool          // send the snapshot to replicas without saving it to disk
+	disklessSyncDelay time.Duration // wait for more replicas before a diskless transfer
+	disklessLoad      string        // disabled, on-empty-db or swapdb
+	backlogSize       int           // bytes of the replication stream kept for partial resyncs
+	backlogTTL        time.Duration // backlog of a master without replicas is freed after it, 0 never
+	readOnly          bool          // a replica refuses writes from its clients
+	pingPeriod        time.Duration // master pings its replicas this often
+	timeout           time.Duration // a link without data for this long is dropped
+	minReplicas       int           // writes need this many good replicas, 0 disables the check
+	minReplicasMaxLag time.Duration // a good replica acknowledged the stream within it
+	replication       struct {
 		role               string
 		master_replid      string
+		master_replid2     string // ID of the former master, accepted up to second_repl_offset
 		master_repl_offset int
-		connected_slaves int
+		second_repl_offset int
 		master_host        string
 		master_port        string
 		offset             int
+
+		master_link_state      string    // replState* of the link to the master
+		master_link_down_since time.Time // when the link went down, zero if it was never up
+		master_last_io         time.Time // when the master last sent data
 	}
 }
 
 type StoredValue struct {
+	vType   string // string, list, hash, set, zset or stream
 	val     string
+	list    *list
+	hash    *dict[string]
+	set     *dict[struct{}]
+	zset    *sortedSet
+	stream  *stream
 	expires time.Time
+	gen     uint64 // snapshot generation the collection belongs to, see lookupWrite
 }
 
-// TODO add the rest of replication options
-func (rc *ReplicationConfig) MasterInfo() []byte {
-	role := fmt.Sprintf("%s:%s", "role", rc.replication.role)
-	masterReplID := fmt.Sprintf("%s:%s", "master_replid", rc.replication.master_replid)
-	masterReplOffset := fmt.Sprintf("%s:%d", "master_repl_offset", rc.replication.master_repl_offset)
-
-	var arr []string
-	arr = append(arr, role)
-	arr = append(arr, masterReplID)
-	arr = append(arr, masterReplOffset)
-	resStr := strings.Join(arr, "\r\n")
+// newStoredValue returns an empty value of vType
+func newStoredValue(vType string) StoredValue {
+	v := StoredValue{vType: vType}
+	switch vType {
+	case "list":
+		v.list = newList()
+	case "hash":
+		v.hash = newDict[string]()
+	case "set":
+		v.set = newDict[struct{}]()
+	case "zset":
+		v.zset = newSortedSet()
+	case "stream":
+		v.stream = newStream()
+	}
+	return v
+}
 
-	len := len(resStr)
-	reply := fmt.Sprintf("$%d\r\n%s\r\n", len, resStr)
-	return []byte(reply)
+// clone returns a copy of the value that does not share collections with v
+func (v StoredValue) clone() StoredValue {
+	switch v.vType {
+	case "list":
+		v.list = v.list.clone()
+	case "hash":
+		v.hash = v.hash.clone()
+	case "set":
+		v.set = v.set.clone()
+	case "zset":
+		v.zset = v.zset.clone()
+	case "stream":
+		v.stream = v.stream.clone()
+	}
+	return v
 }
 
-func (rc *ReplicationConfig) SlaveInfo() []byte {
-	role := fmt.Sprintf("%s:%s", "role", rc.replication.role)
-	length := len(role)
-	reply := fmt.Sprintf("$%d\r\n%s\r\n", length, role)
-	return []byte(reply)
+func (v StoredValue) isExpired() bool {
+	return !v.expires.IsZero() && v.expires.Before(time.Now())
+}
 
+// length returns the number of elements of a collection
+func (v StoredValue) length() int {
+	switch v.vType {
+	case "list":
+		return v.list.Len()
+	case "hash":
+		return v.hash.Len()
+	case "set":
+		return v.set.Len()
+	case "zset":
+		return v.zset.Len()
+	case "stream":
+		return v.stream.Len()
+	}
+	return len(v.val)
 }
 
 type Redis struct {
 	commandHandler *CommandHandler
 	rdbConf        *RDBconfig
 	replConf       *ReplicationConfig
-	replicas       []bufio.Writer
+
+	linkMu sync.Mutex  // serializes REPLICAOF
+	link   *masterLink // nil on a master
 }
 
-func NewRedis(rdb *RDBconfig, repl *ReplicationConfig) *Redis {
-	return &Redis{
-		commandHandler: NewCommandHandler(rdb, repl),
+func NewRedis(conf *ServerConfig, rdb *RDBconfig, aof *AOFconfig, repl *ReplicationConfig, cluster *ClusterConfig) (*Redis, error) {
+	ch, err := NewCommandHandler(conf, rdb, aof, repl, cluster)
+	if err != nil {
+		return nil, err
+	}
+	r := &Redis{
+		commandHandler: ch,
 		rdbConf:        rdb,
 		replConf:       repl,
 	}
+	ch.setMaster = r.setMaster
+	return r, nil
 }
 
-func (r *Redis) handleConn(conn net.Conn, rd *bufio.Reader) {
+func (r *Redis) handleConn(conn net.Conn) {
 	defer conn.Close()
 
-	addr := strings.Split(conn.RemoteAddr().String(), "]:")
-	if addr[1] == r.replConf.replication.master_port {
-		// fmt.Println("HANDLING request from MASTER PORT")
-		// fmt.Println("CONN: ", conn)
-	}
-	
-	var client *Client
-	if rd == nil {
-		client = NewClient(bufio.NewReader(conn), bufio.NewWriter(conn))
-	} else {
-		client = NewClient(rd, bufio.NewWriter(conn))
-	}
-	// fmt.Printf("Buffered reader: %d\n", client.rw.Available())
-	// client.rw.Reader.Reset(conn)
-	// client.rw.Writer.Reset(conn)
+	client := NewClient(bufio.NewReader(conn), bufio.NewWriter(conn))
+	client.conn = conn
+	client.addr = conn.RemoteAddr().String()
+	r.commandHandler.addClient(client)
+	defer r.commandHandler.removeClient(client)
+	r.commandHandler.stats.connections.Add(1)
 	for {
 		parser := NewParser(client.rw.Reader)
 		v, err := parser.Parse()
-		fmt.Printf("V = %+v\n", v)
 		if err != nil { //EOF so exit
-			fmt.Printf("Error is %+v\n", err)
 			return
 		}
-		reply := r.commandHandler.HandleCommand(v)
-		if r.replConf.replication.role == "master" {
-			if v.vType == "array" && strings.ToUpper(v.array[0].bulk) == "PSYNC" {
-				r.replicas = append(r.replicas, *client.rw.Writer)
-				r.replConf.replication.connected_slaves += 1
-			}
-			client.rw.Write(reply)
-			client.rw.Flush()
-		}
-		if v.vType == "array" && strings.ToUpper(v.array[0].bulk) == "SET" {
-			for _, c := range r.replicas {
-				c.Write(v.Unmarshal())
-				c.Flush()
-			}
-		}
-		if r.replConf.replication.role == "slave" {
-			addr := strings.Split(conn.RemoteAddr().String(), "]:")
-			r.replConf.replication.offset += len(v.Unmarshal())
-			if addr[1] != r.replConf.replication.master_port || (addr[1] == r.replConf.replication.master_port && v.array[0].bulk == "REPLCONF" && v.array[1].bulk == "GETACK") {
-				client.rw.Write(reply)
-				client.rw.Flush()
-			}
-		}
+		reply := r.commandHandler.call(client, v)
+		client.Write(reply)
 	}
 }
 
-// FIXME return slave connection here to main thread to propagate command from master
-func (r *Redis) Handshake() (net.Conn, *bufio.Reader, error) {
-	conn, err := r.PingMaster()
+// Handshake connects to the master of the link and synchronizes with it. The
+// returned connection carries the replication stream.
+func (r *Redis) Handshake(l *masterLink) (conn net.Conn, rdbuff *bufio.Reader, err error) {
+	conn, err = r.PingMaster(l)
 	if err != nil {
 		return nil, nil, err
 	}
-	rdbuff := bufio.NewReader(conn)
-	ok, err := rdbuff.ReadString('\r')
-	if ok != "+PONG\r" {
-		fmt.Println("ok is ", ok)
-		return nil, nil, fmt.Errorf("didn't receive PONG, received %s instead", ok)
+	defer func() {
+		if err != nil {
+			conn.Close()
+		}
+	}()
+	if !l.setConn(conn) {
+		return nil, nil, errLinkStopped
 	}
+	rdbuff = bufio.NewReader(conn)
+	ok, err := rdbuff.ReadString('\r')
 	if err != nil {
 		return nil, nil, err
 	}
+	if ok != "+PONG\r" {
+		return nil, nil, fmt.Errorf("didn't receive PONG, received %s instead", ok)
+	}
 
 	conn, err = r.ReplConf(conn, rdbuff)
 	if err != nil {
@@ -151,20 +207,18 @@ func (r *Redis) Handshake() (net.Conn, *bufio.Reader, error) {
 	if err != nil {
 		return nil, nil, err
 	}
-	// fmt.Printf("Buffered bytes: %d\n", rdbuff.Buffered())
 	return conn, rdbuff, nil
 }
 
-func (r *Redis) PingMaster() (net.Conn, error) {
-	addr := fmt.Sprintf("%s:%s", r.replConf.replication.master_host, r.replConf.replication.master_port)
-	conn, err := net.Dial("tcp", addr)
+func (r *Redis) PingMaster(l *masterLink) (net.Conn, error) {
+	c, err := dialInstance(l.host, l.port, r.replConf.timeout)
 	if err != nil {
-		fmt.Println(err)
 		return nil, err
 	}
+	conn := timeoutConn{Conn: c, timeout: r.replConf.timeout}
 
 	if _, err = conn.Write([]byte("*1\r\n$4\r\nPING\r\n")); err != nil {
-		fmt.Println(err)
+		conn.Close()
 		return nil, err
 	}
 	return conn, nil
@@ -185,7 +239,7 @@ func (r *Redis) ReplConf(conn net.Conn, buff *bufio.Reader) (net.Conn, error) {
 	}
 
 	buff.Reset(conn)
-	_, err = conn.Write([]byte("*3\r\n$8\r\nREPLCONF\r\n$4\r\ncapa\r\n$6\r\npsync2\r\n"))
+	_, err = conn.Write([]byte("*5\r\n$8\r\nREPLCONF\r\n$4\r\ncapa\r\n$3\r\neof\r\n$4\r\ncapa\r\n$6\r\npsync2\r\n"))
 	if err != nil {
 		return nil, err
 	}
@@ -202,34 +256,99 @@ func (r *Redis) ReplConf(conn net.Conn, buff *bufio.Reader) (net.Conn, error) {
 
 func (r *Redis) Psync(conn net.Conn, buff *bufio.Reader) (net.Conn, error) {
 	buff.Reset(conn)
-	_, err := conn.Write([]byte("*3\r\n$5\r\nPSYNC\r\n$1\r\n?\r\n$2\r\n-1\r\n"))
+	replid, psyncOffset := r.commandHandler.psyncArgs()
+	psync := bulkArray([]string{"PSYNC", replid, strconv.Itoa(psyncOffset)})
+	if _, err := conn.Write(psync.Unmarshal()); err != nil {
+		return nil, err
+	}
+
+	// +CONTINUE [<replid>] or +FULLRESYNC <replid> <offset>
+	line, err := buff.ReadString('\n')
 	if err != nil {
 		return nil, err
 	}
-	
-	buff.ReadBytes('\n') // read full recync message
-	lenPart, _ := buff.ReadBytes('\n')
-	leng, err := strconv.Atoi(string(lenPart[1 : len(lenPart)-2]))
+	fields := strings.Fields(line)
+	if len(fields) > 0 && fields[0] == "+CONTINUE" {
+		newReplid := ""
+		if len(fields) > 1 {
+			newReplid = fields[1]
+		}
+		r.commandHandler.masterContinue(newReplid)
+		fmt.Println("MASTER <-> REPLICA sync: Master accepted a Partial Resynchronization.")
+		return conn, nil
+	}
+	if len(fields) != 3 || fields[0] != "+FULLRESYNC" {
+		return nil, fmt.Errorf("unexpected reply to PSYNC %q", line)
+	}
+	offset, err := strconv.Atoi(fields[2])
 	if err != nil {
-		fmt.Println("Error conververting atoi", err)
+		return nil, fmt.Errorf("unexpected reply to PSYNC %q", line)
 	}
-	n, err := buff.Discard(leng)
+	r.commandHandler.setMasterLink(replStateSync)
+
+	// the snapshot is a bulk string without the trailing CRLF, or ends with
+	// the mark after $EOF: when the master doesn't know its size upfront
+	lenPart, err := buff.ReadString('\n')
 	if err != nil {
-		fmt.Printf("error discarding %d bytes - %v\n", n, err)
 		return nil, err
 	}
-	// fmt.Printf("Length = %d\nDiscarded bytes - %d\n", leng, n)
-	// fmt.Printf("Buffered bytes: %d\n", buff.Buffered())
+	if len(lenPart) < 3 || lenPart[0] != '$' {
+		return nil, fmt.Errorf("unexpected snapshot header %q", lenPart)
+	}
+	var snapshot io.Reader
+	if mark, ok := strings.CutPrefix(strings.TrimSpace(lenPart), "$EOF:"); ok {
+		if len(mark) != rdbEOFMarkSize {
+			return nil, fmt.Errorf("unexpected snapshot header %q", lenPart)
+		}
+		fmt.Println("MASTER <-> REPLICA sync: receiving streamed RDB from master with EOF to parser")
+		snapshot = &eofMarkReader{r: buff, mark: []byte(mark)}
+	} else {
+		size, err := strconv.ParseInt(strings.TrimSpace(lenPart[1:]), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("unexpected snapshot header %q", lenPart)
+		}
+		fmt.Printf("MASTER <-> REPLICA sync: receiving %d bytes from master\n", size)
+		snapshot = io.LimitReader(buff, size)
+	}
+	if err := r.commandHandler.syncFromMaster(snapshot); err != nil {
+		return nil, fmt.Errorf("error loading snapshot from master: %w", err)
+	}
+	// anything after the EOF opcode is not part of the dataset
+	if _, err := io.Copy(io.Discard, snapshot); err != nil {
+		return nil, err
+	}
+	r.commandHandler.masterFullResync(fields[1], offset)
 	return conn, nil
 }
 
+// Shutdown syncs the AOF and saves the dataset before exit if save points are configured
+func (r *Redis) Shutdown() {
+	r.commandHandler.closeAOF()
+	if len(r.rdbConf.save) == 0 {
+		return
+	}
+	fmt.Println("Saving the final RDB snapshot before exiting.")
+	if err := r.commandHandler.rdbSave(); err != nil {
+		fmt.Println("redis.go/Shutdown(): error saving the final RDB snapshot", err)
+	}
+}
+
 func (r *Redis) ListenPort() net.Listener {
-	address := r.replConf.host + ":" + r.replConf.port
-	l, err := net.Listen("tcp", address)
+	return listenPort(r.replConf.host, r.replConf.port)
+}
+
+// listenPort listens for clients on host:port, the server can't run without it
+func listenPort(host, port string) net.Listener {
+	l, err := net.Listen("tcp", net.JoinHostPort(host, port))
 	if err != nil {
-		fmt.Println("Failed to bind to port 6379")
+		fmt.Println("Failed to bind to port", port)
 		os.Exit(1)
 	}
-	fmt.Println("Server is listening on port", r.replConf.port)
+	fmt.Println("Server is listening on port", port)
 	return l
 }
+
+// dialInstance connects to the server at host:port
+func dialInstance(host, port string, timeout time.Duration) (net.Conn, error) {
+	return net.DialTimeout("tcp", net.JoinHostPort(host, port), timeout)
+}
@@ -0,0 +1,1025 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rdbEOFMarkSize is the length of the mark ending a diskless transfer
+const rdbEOFMarkSize = 40
+
+// noReplID is the replication ID that matches no PSYNC
+const noReplID = "0000000000000000000000000000000000000000"
+
+const minBacklogSize = 16 * 1024
+
+// repl-diskless-load values
+const (
+	replLoadDisabled  = "disabled"    // save the snapshot to the dump file, then load it
+	replLoadOnEmptyDB = "on-empty-db" // load from the socket when there is no data to lose
+	replLoadSwapDB    = "swapdb"      // load from the socket keeping the old data until it succeeds
+)
+
+const (
+	replicaWaitSnapshot = iota // waits for a diskless transfer to start, the stream is not kept
+	replicaSendSnapshot        // the stream is buffered while the snapshot is sent
+	replicaOnline              // the stream is written by the writer goroutine of the replica
+)
+
+// replicaStateNames are the states shown by INFO
+var replicaStateNames = []string{
+	replicaWaitSnapshot: "wait_bgsave",
+	replicaSendSnapshot: "send_bulk",
+	replicaOnline:       "online",
+}
+
+// states of the link of a replica to its master, as shown by ROLE
+const (
+	replStateConnect    = "connect"    // waiting to connect
+	replStateConnecting = "connecting" // connecting and handshaking
+	replStateSync       = "sync"       // receiving the snapshot
+	replStateConnected  = "connected"  // applying the stream
+)
+
+// replicaOutputLimit is the most stream buffered for a replica, a replica
+// falling further behind is disconnected
+const replicaOutputLimit = 256 * 1024 * 1024
+
+// replica is a connection that sent PSYNC. Its fields are guarded by
+// ch.replMu.
+type replica struct {
+	client     *Client
+	state      int
+	buf        []byte        // stream not written to the replica yet
+	wake       chan struct{} // signals new data in buf to the writer, closed when the replica is removed
+	dropped    bool          // disconnected for exceeding replicaOutputLimit
+	synced     chan error    // result of a diskless transfer
+	ackOffset  int           // offset the replica processed according to its last REPLCONF ACK
+	fackOffset int           // offset the replica synced to its AOF, -1 when it has none
+	ackTime    time.Time     // when the last REPLCONF ACK arrived, or the replica went online
+}
+
+func newReplica(c *Client, state int) *replica {
+	return &replica{client: c, state: state, wake: make(chan struct{}, 1), fackOffset: -1, ackTime: time.Now()}
+}
+
+// queue appends data to the output of the replica. Caller must hold
+// ch.replMu.
+func (r *replica) queue(data []byte) {
+	if r.dropped {
+		return
+	}
+	if len(r.buf)+len(data) > replicaOutputLimit {
+		fmt.Printf("Replica (client id %d) scheduled to be closed ASAP for overcoming of output buffer limits.\n", r.client.id)
+		r.dropped = true
+		r.buf = nil
+		r.client.Close()
+		return
+	}
+	r.buf = append(r.buf, data...)
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// writeToReplica sends the output of an online replica until it is removed.
+// Every replica has its own writer so a slow one doesn't hold up the others.
+func (ch *CommandHandler) writeToReplica(r *replica) {
+	for range r.wake {
+		ch.replMu.Lock()
+		buf := r.buf
+		r.buf = nil
+		ch.replMu.Unlock()
+		if len(buf) == 0 {
+			continue
+		}
+		if err := r.client.Write(buf); err != nil {
+			fmt.Println("replication.go/writeToReplica(): error writing to replica", err)
+			r.client.Close()
+			return
+		}
+	}
+}
+
+// propagate sends write command executed in db to the replicas, prefixed by
+// SELECT when the database changes, and returns the replication offset after it.
+// Caller must hold ch.writeMu so the stream has the order writes were applied in.
+func (ch *CommandHandler) propagate(db int, cmd Value) int {
+	ch.replMu.Lock()
+	defer ch.replMu.Unlock()
+
+	var stream []byte
+	if db != ch.replDB {
+		sel := Value{vType: "array", array: []Value{{vType: "bulk", bulk: "SELECT"}, {vType: "bulk", bulk: strconv.Itoa(db)}}}
+		stream = append(stream, sel.Unmarshal()...)
+		ch.replDB = db
+	}
+	stream = append(stream, cmd.Unmarshal()...)
+	ch.feedStream(stream)
+	return ch.replConf.replication.master_repl_offset
+}
+
+// feedStream appends stream to the backlog and sends it to the replicas
+// advancing the replication offset. Caller must hold ch.replMu.
+func (ch *CommandHandler) feedStream(stream []byte) {
+	ch.replConf.replication.master_repl_offset += len(stream)
+	if ch.backlog != nil {
+		ch.backlog.write(stream)
+	}
+	for _, r := range ch.replicas {
+		if r.state != replicaWaitSnapshot {
+			r.queue(stream)
+		}
+	}
+}
+
+// psync continues the replication stream from the offset requested by the
+// replica when it is still in the backlog. Otherwise it performs a full
+// resynchronization: the replica gets a point in time snapshot of the dataset
+// and then the writes applied after it. Replicas supporting the EOF format get
+// the snapshot straight from memory when repl-diskless-sync is enabled,
+// otherwise it is saved to disk first.
+func (ch *CommandHandler) psync(c *Client, v Value) []byte {
+	if len(v.array) != 3 {
+		return wrongArgsError("psync")
+	}
+	if ch.partialResync(c, v.array[1].bulk, v.array[2].bulk) {
+		ch.stats.syncPartOK.Add(1)
+		return nil
+	}
+	if v.array[1].bulk != "?" {
+		ch.stats.syncPartErr.Add(1)
+	}
+	ch.stats.syncFull.Add(1)
+	if ch.replConf.disklessSync && c.replCapaEOF {
+		ch.syncDiskless(c)
+		return nil
+	}
+
+	// no write may be applied between the snapshot and the registration of
+	// the replica, it would be lost or applied twice
+	ch.writeMu.Lock()
+	dbs, _ := ch.takeSnapshot()
+	ch.replMu.Lock()
+	offset := ch.replConf.replication.master_repl_offset
+	ch.createBacklog()
+	r := newReplica(c, replicaSendSnapshot)
+	ch.replicas[c.id] = r
+	streamDB := ch.syncStreamDB()
+	ch.replMu.Unlock()
+	ch.writeMu.Unlock()
+
+	err := c.Write(fullResyncReply(ch.replConf.replication.master_replid, offset))
+	if err == nil {
+		err = ch.sendSnapshot(c, dbs, streamDB)
+	}
+	ch.releaseSnapshot()
+	if err != nil {
+		fmt.Println("replication.go/psync(): error sending snapshot to replica", err)
+		ch.removeReplica(c)
+		return nil
+	}
+	ch.replMu.Lock()
+	ch.replicaOnline(r)
+	ch.replMu.Unlock()
+	return nil
+}
+
+// partialResync sends the replica the stream after offset when its history
+// is the one of this server: the current replication ID, or the former one up
+// to the offset where they diverged
+func (ch *CommandHandler) partialResync(c *Client, replid, offsetArg string) bool {
+	ch.replMu.Lock()
+	defer ch.replMu.Unlock()
+
+	offset, err := strconv.Atoi(offsetArg)
+	if err != nil || ch.backlog == nil {
+		return false
+	}
+	info := &ch.replConf.replication
+	if replid != info.master_replid && (replid != info.master_replid2 || offset > info.second_repl_offset) {
+		return false
+	}
+	data, ok := ch.backlog.readFrom(offset)
+	if !ok {
+		return false
+	}
+
+	reply := "+CONTINUE\r\n"
+	if c.replCapaPSync2 {
+		reply = fmt.Sprintf("+CONTINUE %s\r\n", info.master_replid)
+	}
+	r := newReplica(c, replicaSendSnapshot)
+	r.queue(append([]byte(reply), data...))
+	ch.replicas[c.id] = r
+	ch.replicaOnline(r)
+	fmt.Printf("Partial resynchronization accepted, sending %d bytes of backlog\n", len(data))
+	return true
+}
+
+// createBacklog starts keeping the stream propagated from now on, caller must
+// hold ch.replMu
+func (ch *CommandHandler) createBacklog() {
+	if ch.backlog == nil {
+		ch.backlog = newReplBacklog(ch.replConf.backlogSize, ch.replConf.replication.master_repl_offset)
+	}
+}
+
+// replicationCron pings the replicas every repl-ping-replica-period, so they
+// can tell a quiet master from a dead link, and disconnects replicas that
+// didn't acknowledge the stream for repl-timeout.
+func (ch *CommandHandler) replicationCron() {
+	ch.replMu.Lock()
+	defer ch.replMu.Unlock()
+	for _, r := range ch.replicas {
+		if r.state == replicaOnline && time.Since(r.ackTime) > ch.replConf.timeout {
+			fmt.Printf("Disconnecting timedout replica (client id %d)\n", r.client.id)
+			r.client.Close()
+		}
+	}
+	// a replica passes on the pings of its master
+	if ch.replConf.replication.role != "master" {
+		return
+	}
+	if len(ch.replicas) > 0 && time.Since(ch.pingedAt) >= ch.replConf.pingPeriod {
+		ping := bulkArray([]string{"PING"})
+		ch.feedStream(ping.Unmarshal())
+		ch.pingedAt = time.Now()
+	}
+	ch.freeBacklog()
+}
+
+// freeBacklog frees the backlog of a master without replicas for
+// repl-backlog-ttl. The replication ID changes too, replicas connecting later
+// can't continue from a stream that is no longer kept. Caller must hold
+// ch.replMu.
+func (ch *CommandHandler) freeBacklog() {
+	info := &ch.replConf.replication
+	if ch.backlog == nil || len(ch.replicas) > 0 || ch.replConf.backlogTTL == 0 {
+		return
+	}
+	if time.Since(ch.noReplicasAt) < ch.replConf.backlogTTL {
+		return
+	}
+	ch.backlog = nil
+	info.master_replid = randomHex(20)
+	info.master_replid2 = noReplID
+	info.second_repl_offset = -1
+	fmt.Printf("Replication backlog freed after %d seconds without connected replicas.\n", int(ch.replConf.backlogTTL/time.Second))
+}
+
+// disconnectReplicas closes the connections of all replicas, they reconnect
+// and learn the new replication ID or get a new snapshot. Caller must hold
+// ch.replMu.
+func (ch *CommandHandler) disconnectReplicas() {
+	for _, r := range ch.replicas {
+		r.client.Close()
+	}
+}
+
+// shiftReplicationID switches to a new replication ID keeping the current one
+// as the former ID, valid for partial resyncs up to the current offset
+func (ch *CommandHandler) shiftReplicationID(replid string) {
+	info := &ch.replConf.replication
+	info.master_replid2 = info.master_replid
+	info.second_repl_offset = info.master_repl_offset + 1
+	info.master_replid = replid
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// syncStreamDB is the database selected in the stream following a snapshot
+// sent to a replica. A master starts that stream with SELECT, while a replica
+// passes the stream of its master on unchanged and stores the database in the
+// snapshot instead. Caller must hold ch.replMu.
+func (ch *CommandHandler) syncStreamDB() int {
+	if ch.replConf.replication.role == "master" {
+		ch.replDB = -1
+		return 0
+	}
+	return max(ch.replDB, 0)
+}
+
+func fullResyncReply(replid string, offset int) []byte {
+	repl := Value{vType: "str", str: fmt.Sprintf("FULLRESYNC %s %d", replid, offset)}
+	return repl.Unmarshal()
+}
+
+// replicaOnline starts the writer of the replica, sending the stream
+// buffered during the snapshot transfer and then the live stream. Caller
+// must hold ch.replMu.
+func (ch *CommandHandler) replicaOnline(r *replica) {
+	r.state = replicaOnline
+	r.ackTime = time.Now()
+	go ch.writeToReplica(r)
+}
+
+// syncDiskless waits for repl-diskless-sync-delay so replicas connecting
+// meanwhile share the transfer, and blocks until the snapshot is sent
+func (ch *CommandHandler) syncDiskless(c *Client) {
+	r := newReplica(c, replicaWaitSnapshot)
+	r.synced = make(chan error, 1)
+	ch.replMu.Lock()
+	ch.replicas[c.id] = r
+	if ch.disklessBatch == nil {
+		time.AfterFunc(ch.replConf.disklessSyncDelay, ch.startDisklessSync)
+	}
+	ch.disklessBatch = append(ch.disklessBatch, r)
+	ch.replMu.Unlock()
+
+	if err := <-r.synced; err != nil {
+		fmt.Println("replication.go/syncDiskless(): error sending snapshot to replica", err)
+		ch.removeReplica(c)
+		return
+	}
+	ch.replMu.Lock()
+	ch.replicaOnline(r)
+	ch.replMu.Unlock()
+}
+
+// startDisklessSync writes one snapshot to all replicas of the batch at once,
+// framed by a random EOF mark instead of a length the master doesn't know
+// upfront: "$EOF:<mark>\r\n<rdb><mark>"
+func (ch *CommandHandler) startDisklessSync() {
+	ch.writeMu.Lock()
+	dbs, _ := ch.takeSnapshot()
+	ch.replMu.Lock()
+	batch := ch.disklessBatch
+	ch.disklessBatch = nil
+	offset := ch.replConf.replication.master_repl_offset
+	ch.createBacklog()
+	for _, r := range batch {
+		r.state = replicaSendSnapshot
+	}
+	streamDB := ch.syncStreamDB()
+	ch.replMu.Unlock()
+	ch.writeMu.Unlock()
+	defer ch.releaseSnapshot()
+
+	eofMark := []byte(randomHex(rdbEOFMarkSize / 2))
+	header := append(fullResyncReply(ch.replConf.replication.master_replid, offset), "$EOF:"...)
+	header = append(header, eofMark...)
+	header = append(header, "\r\n"...)
+
+	fmt.Printf("Starting diskless transfer of the snapshot to %d replicas\n", len(batch))
+	w := &replicaFanout{replicas: batch, errs: make([]error, len(batch))}
+	w.Write(header)
+	writeReplRDB(w, dbs, streamDB)
+	w.Write(eofMark)
+	for i, r := range batch {
+		r.synced <- w.errs[i]
+	}
+}
+
+// replicaFanout writes to all replicas, dropping those that fail
+type replicaFanout struct {
+	replicas []*replica
+	errs     []error
+}
+
+func (w *replicaFanout) Write(p []byte) (int, error) {
+	failed := 0
+	for i, r := range w.replicas {
+		if w.errs[i] == nil {
+			w.errs[i] = r.client.Write(p)
+		}
+		if w.errs[i] != nil {
+			failed++
+		}
+	}
+	if failed == len(w.replicas) {
+		return 0, errors.New("all replicas failed")
+	}
+	return len(p), nil
+}
+
+// sendSnapshot saves dbs to a temporary file and sends it to the replica as a
+// bulk string without the trailing CRLF
+func (ch *CommandHandler) sendSnapshot(c *Client, dbs []*dict[StoredValue], streamDB int) error {
+	path := filepath.Join(ch.rdbconn.dir, fmt.Sprintf("temp-repl-%d-%d.rdb", os.Getpid(), c.id))
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+	defer f.Close()
+
+	if err := writeReplRDB(f, dbs, streamDB); err != nil {
+		return err
+	}
+	size, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return c.WriteFrom([]byte(fmt.Sprintf("$%d\r\n", size)), f)
+}
+
+func (ch *CommandHandler) removeReplica(c *Client) {
+	ch.replMu.Lock()
+	defer ch.replMu.Unlock()
+	r, ok := ch.replicas[c.id]
+	if !ok {
+		return
+	}
+	delete(ch.replicas, c.id)
+	close(r.wake)
+	if len(ch.replicas) == 0 {
+		ch.noReplicasAt = time.Now()
+	}
+}
+
+// psyncArgs are the replication ID and offset a replica asks its master to
+// continue from, "?" and -1 when it has never been synchronized
+func (ch *CommandHandler) psyncArgs() (string, int) {
+	ch.replMu.Lock()
+	defer ch.replMu.Unlock()
+	info := &ch.replConf.replication
+	if info.master_replid == "" {
+		return "?", -1
+	}
+	return info.master_replid, info.master_repl_offset + 1
+}
+
+// replOffset returns the replication offset of the server
+func (ch *CommandHandler) replOffset() int {
+	ch.replMu.Lock()
+	defer ch.replMu.Unlock()
+	return ch.replConf.replication.master_repl_offset
+}
+
+// rdbReplInfo returns the replication state saved with a dump, nil when the
+// server has no replication history yet. Caller must hold ch.writeMu.
+func (ch *CommandHandler) rdbReplInfo() *rdbReplInfo {
+	ch.replMu.Lock()
+	defer ch.replMu.Unlock()
+	info := &ch.replConf.replication
+	if info.master_replid == "" {
+		return nil
+	}
+	return &rdbReplInfo{replid: info.master_replid, offset: info.master_repl_offset, streamDB: ch.replDB}
+}
+
+// restoreReplInfo takes the replication ID and offset saved with the dump
+// loaded at startup. A replica then asks its master to continue the stream
+// after the offset instead of sending a full snapshot, and a master lets its
+// former replicas continue.
+func (ch *CommandHandler) restoreReplInfo(aux map[string]string) {
+	replid := aux["repl-id"]
+	offset, err := strconv.Atoi(aux["repl-offset"])
+	if err != nil || len(replid) != len(noReplID) {
+		return
+	}
+	streamDB, err := strconv.Atoi(aux["repl-stream-db"])
+	if err != nil {
+		streamDB = -1
+	}
+	ch.replMu.Lock()
+	defer ch.replMu.Unlock()
+	info := &ch.replConf.replication
+	info.master_replid = replid
+	info.master_repl_offset = offset
+	info.offset = offset
+	if info.role == "master" {
+		ch.createBacklog()
+		ch.noReplicasAt = time.Now()
+	} else {
+		ch.replDB = streamDB
+	}
+}
+
+// masterFullResync takes the replication ID and offset of the master for the
+// snapshot about to be loaded, the former history is lost
+func (ch *CommandHandler) masterFullResync(replid string, offset int) {
+	ch.replMu.Lock()
+	defer ch.replMu.Unlock()
+	info := &ch.replConf.replication
+	info.master_replid = replid
+	info.master_replid2 = noReplID
+	info.second_repl_offset = -1
+	info.master_repl_offset = offset
+	info.offset = offset
+	ch.backlog = newReplBacklog(ch.replConf.backlogSize, offset)
+	// the dataset of the replicas is no longer the one of this server
+	ch.disconnectReplicas()
+	if ch.aof != nil {
+		ch.aof.resetReplOffset(offset)
+	}
+}
+
+// masterContinue follows the replication ID of the master after a partial
+// resync, it differs when the master was promoted from a replica meanwhile
+func (ch *CommandHandler) masterContinue(replid string) {
+	ch.replMu.Lock()
+	defer ch.replMu.Unlock()
+	if replid != "" && replid != ch.replConf.replication.master_replid {
+		ch.shiftReplicationID(replid)
+		ch.disconnectReplicas()
+	}
+	ch.createBacklog()
+}
+
+// feedFromMaster records the stream applied by a replica, so it can continue
+// from its offset after a reconnection or serve partial resyncs, and passes
+// it on unchanged to its own replicas. db is the database selected in the
+// stream after it.
+func (ch *CommandHandler) feedFromMaster(db int, stream []byte) {
+	ch.replMu.Lock()
+	defer ch.replMu.Unlock()
+	ch.feedStream(stream)
+	ch.replDB = db
+	ch.replConf.replication.offset += len(stream)
+	ch.replConf.replication.master_last_io = time.Now()
+	if ch.aof != nil {
+		ch.aof.setReplOffset(ch.replConf.replication.offset)
+	}
+}
+
+// streamDB is the database selected in the stream of the master, a new
+// connection to the master starts from it
+func (ch *CommandHandler) streamDB() int {
+	ch.replMu.Lock()
+	defer ch.replMu.Unlock()
+	return max(ch.replDB, 0)
+}
+
+// replicaof implements REPLICAOF host port and REPLICAOF NO ONE
+func (ch *CommandHandler) replicaof(v Value) []byte {
+	var repl Value
+	if ch.cluster != nil {
+		return repl.Error("ERR REPLICAOF not allowed in cluster mode.")
+	}
+	host, port := v.array[1].bulk, v.array[2].bulk
+	masterHost, masterPort, isReplica := ch.masterAddr()
+	if strings.EqualFold(host, "no") && strings.EqualFold(port, "one") {
+		if isReplica {
+			ch.setMaster("", "")
+		}
+		return repl.OK()
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return repl.Error("ERR Invalid master port")
+	}
+	if isReplica && masterHost == host && masterPort == port {
+		repl.vType = "str"
+		repl.str = "OK Already connected to specified master"
+		return repl.Unmarshal()
+	}
+	ch.setMaster(host, port)
+	return repl.OK()
+}
+
+// isMaster reports whether the server is a master. The role is changed by
+// promote and demote holding writeMu and replMu, code holding neither reads
+// it here.
+func (ch *CommandHandler) isMaster() bool {
+	ch.replMu.Lock()
+	defer ch.replMu.Unlock()
+	return ch.replConf.replication.role == "master"
+}
+
+// masterAddr returns the address of the master of a replica, ok is false on
+// a master
+func (ch *CommandHandler) masterAddr() (host, port string, ok bool) {
+	ch.replMu.Lock()
+	defer ch.replMu.Unlock()
+	info := &ch.replConf.replication
+	return info.master_host, info.master_port, info.role == "slave"
+}
+
+// promote turns a replica into a master. The stream of the former master
+// goes on under a new replication ID, its ID stays valid up to the current
+// offset so the other replicas of the former master can continue from here.
+func (ch *CommandHandler) promote() {
+	ch.writeMu.Lock()
+	defer ch.writeMu.Unlock()
+	ch.replMu.Lock()
+	defer ch.replMu.Unlock()
+	info := &ch.replConf.replication
+	if info.master_replid == "" {
+		info.master_replid = randomHex(20)
+	} else {
+		ch.shiftReplicationID(randomHex(20))
+	}
+	info.role = "master"
+	info.master_host, info.master_port = "", ""
+	info.master_link_state = ""
+	info.master_link_down_since = time.Time{}
+	ch.replDB = -1
+	ch.createBacklog()
+	// the replicas of the former master have repl-backlog-ttl to continue
+	ch.noReplicasAt = time.Now()
+	ch.disconnectReplicas()
+}
+
+// demote turns the server into a replica of host:port. A former master asks
+// the new one to continue its own stream, which succeeds when the new master
+// was its replica.
+func (ch *CommandHandler) demote(host, port string) {
+	ch.writeMu.Lock()
+	defer ch.writeMu.Unlock()
+	ch.replMu.Lock()
+	defer ch.replMu.Unlock()
+	info := &ch.replConf.replication
+	if info.role == "master" {
+		info.offset = info.master_repl_offset
+	}
+	info.role = "slave"
+	info.master_host, info.master_port = host, port
+	info.master_link_state = replStateConnect
+	info.master_link_down_since = time.Time{}
+}
+
+// setMasterLink records the state of the link to the master shown by INFO
+// and ROLE
+func (ch *CommandHandler) setMasterLink(state string) {
+	ch.replMu.Lock()
+	defer ch.replMu.Unlock()
+	info := &ch.replConf.replication
+	if state == replStateConnected {
+		info.master_last_io = time.Now()
+	} else if info.master_link_state == replStateConnected {
+		info.master_link_down_since = time.Now()
+	}
+	info.master_link_state = state
+}
+
+// eofMarkReader reads snapshot sent in the EOF format up to the mark. Nothing
+// past the mark is consumed, the replication stream follows it.
+type eofMarkReader struct {
+	r    *bufio.Reader
+	mark []byte
+	done bool
+}
+
+func (e *eofMarkReader) Read(p []byte) (int, error) {
+	if e.done {
+		return 0, io.EOF
+	}
+	// at least the size of the mark is needed to tell whether it is the mark
+	if _, err := e.r.Peek(len(e.mark)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	window, _ := e.r.Peek(e.r.Buffered())
+	if bytes.HasPrefix(window, e.mark) {
+		e.r.Discard(len(e.mark))
+		e.done = true
+		return 0, io.EOF
+	}
+	// bytes that can't be the start of the mark are returned
+	n := len(window) - len(e.mark) + 1
+	if i := bytes.Index(window, e.mark); i >= 0 && i < n {
+		n = i
+	}
+	n = copy(p, window[:n])
+	e.r.Discard(n)
+	return n, nil
+}
+
+// replicaAck records the offsets processed and synced to the AOF by the
+// replica, fack is -1 when the replica has no AOF
+func (ch *CommandHandler) replicaAck(c *Client, offset, fack int) {
+	ch.replMu.Lock()
+	defer ch.replMu.Unlock()
+	if r, ok := ch.replicas[c.id]; ok {
+		r.ackOffset = offset
+		r.fackOffset = fack
+		r.ackTime = time.Now()
+		ch.notifyAcked()
+	}
+}
+
+// replicaInfo describes the replicas for INFO in the order they connected.
+// Caller must hold ch.replMu.
+func (ch *CommandHandler) replicaInfo() []string {
+	var lines []string
+	for _, r := range ch.sortedReplicas() {
+		ip, _, _ := net.SplitHostPort(r.client.addr)
+		lines = append(lines, fmt.Sprintf("ip=%s,port=%d,state=%s,offset=%d,lag=%d", ip, r.client.replListeningPort,
+			replicaStateNames[r.state], r.ackOffset, int(time.Since(r.ackTime)/time.Second)))
+	}
+	return lines
+}
+
+// sortedReplicas returns the replicas in the order they connected. Caller
+// must hold ch.replMu.
+func (ch *CommandHandler) sortedReplicas() []*replica {
+	ids := make([]int64, 0, len(ch.replicas))
+	for id := range ch.replicas {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	replicas := make([]*replica, len(ids))
+	for i, id := range ids {
+		replicas[i] = ch.replicas[id]
+	}
+	return replicas
+}
+
+// role replies with the role of the server. A master lists the address and
+// acknowledged offset of its replicas, a replica gives its master, the state
+// of the link and the offset it processed, -1 until it is connected.
+func (ch *CommandHandler) role() []byte {
+	ch.replMu.Lock()
+	defer ch.replMu.Unlock()
+	info := &ch.replConf.replication
+
+	repl := Value{vType: "array"}
+	if info.role == "master" {
+		replicas := Value{vType: "array", array: []Value{}}
+		for _, r := range ch.sortedReplicas() {
+			ip, _, _ := net.SplitHostPort(r.client.addr)
+			replicas.array = append(replicas.array, bulkArray([]string{
+				ip, strconv.Itoa(r.client.replListeningPort), strconv.Itoa(r.ackOffset),
+			}))
+		}
+		repl.array = []Value{
+			{vType: "bulk", bulk: "master"},
+			{vType: "num", num: info.master_repl_offset},
+			replicas,
+		}
+		return repl.Unmarshal()
+	}
+
+	port, _ := strconv.Atoi(info.master_port)
+	offset := -1
+	if info.master_link_state == replStateConnected {
+		offset = info.offset
+	}
+	repl.array = []Value{
+		{vType: "bulk", bulk: "slave"},
+		{vType: "bulk", bulk: info.master_host},
+		{vType: "num", num: port},
+		{vType: "bulk", bulk: info.master_link_state},
+		{vType: "num", num: offset},
+	}
+	return repl.Unmarshal()
+}
+
+// goodReplicas counts online replicas that acknowledged the stream within
+// min-replicas-max-lag
+func (ch *CommandHandler) goodReplicas() int {
+	ch.replMu.Lock()
+	defer ch.replMu.Unlock()
+	n := 0
+	for _, r := range ch.replicas {
+		if r.state == replicaOnline && time.Since(r.ackTime) <= ch.replConf.minReplicasMaxLag {
+			n++
+		}
+	}
+	return n
+}
+
+// ackCommand is the REPLCONF ACK a replica sends its master, with FACK when
+// the offset synced to the AOF is known
+func (ch *CommandHandler) ackCommand() []byte {
+	ch.replMu.Lock()
+	args := []string{"REPLCONF", "ACK", strconv.Itoa(ch.replConf.replication.offset)}
+	ch.replMu.Unlock()
+	if ch.aof != nil {
+		if fsynced := ch.aof.FsyncedOffset(); fsynced >= 0 {
+			args = append(args, "FACK", strconv.Itoa(fsynced))
+		}
+	}
+	cmd := bulkArray(args)
+	return cmd.Unmarshal()
+}
+
+// notifyAcked wakes up the clients blocked in WAIT and WAITAOF. Caller must
+// hold ch.replMu.
+func (ch *CommandHandler) notifyAcked() {
+	close(ch.acked)
+	ch.acked = make(chan struct{})
+}
+
+// ackedReplicas counts online replicas that processed the stream up to
+// offset, or synced it to their AOF with fsynced. Caller must hold ch.replMu.
+func (ch *CommandHandler) ackedReplicas(offset int, fsynced bool) int {
+	n := 0
+	for _, r := range ch.replicas {
+		ack := r.ackOffset
+		if fsynced {
+			ack = r.fackOffset
+		}
+		if r.state == replicaOnline && ack >= offset {
+			n++
+		}
+	}
+	return n
+}
+
+// parseWaitTimeout parses the timeout of WAIT and WAITAOF in milliseconds,
+// 0 blocks forever
+func parseWaitTimeout(arg string) (time.Duration, error) {
+	timeout, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return 0, errors.New("ERR timeout is not an integer or out of range")
+	}
+	if timeout < 0 {
+		return 0, errors.New("ERR timeout is negative")
+	}
+	return time.Duration(timeout) * time.Millisecond, nil
+}
+
+// blockForAcks returns once done, called with ch.replMu held, reports true,
+// checking it again after every acknowledgement of a replica. It returns
+// early, with done still false, when the timeout expires, a timeout of 0
+// never does. Replicas are asked for an acknowledgement once with REPLCONF
+// GETACK sent in the replication stream, after the writes waited for.
+func (ch *CommandHandler) blockForAcks(timeout time.Duration, done func() bool) {
+	var deadline <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	ch.stats.blocked.Add(1)
+	defer ch.stats.blocked.Add(-1)
+	getAckSent := false
+	for {
+		ch.replMu.Lock()
+		if done() {
+			ch.replMu.Unlock()
+			return
+		}
+		if !getAckSent {
+			getAck := bulkArray([]string{"REPLCONF", "GETACK", "*"})
+			ch.feedStream(getAck.Unmarshal())
+			getAckSent = true
+		}
+		acked := ch.acked
+		ch.replMu.Unlock()
+
+		select {
+		case <-acked:
+		case <-deadline:
+			return
+		}
+	}
+}
+
+// wait blocks until numreplicas replicas acknowledged the last write of the
+// client or the timeout expires, then replies with the number of replicas
+// that did
+func (ch *CommandHandler) wait(c *Client, v Value) []byte {
+	var repl Value
+	if !ch.isMaster() {
+		return repl.Error("ERR WAIT cannot be used with replica instances")
+	}
+	numReplicas, err := strconv.Atoi(v.array[1].bulk)
+	if err != nil {
+		return repl.Error("ERR value is not an integer or out of range")
+	}
+	timeout, err := parseWaitTimeout(v.array[2].bulk)
+	if err != nil {
+		return repl.Error(err.Error())
+	}
+
+	ch.blockForAcks(timeout, func() bool {
+		return ch.ackedReplicas(c.woff, false) >= numReplicas
+	})
+	ch.replMu.Lock()
+	repl.vType = "num"
+	repl.num = ch.ackedReplicas(c.woff, false)
+	ch.replMu.Unlock()
+	return repl.Unmarshal()
+}
+
+// waitaof blocks until the last write of the client is synced to the AOF
+// locally, when numlocal is 1, and by numreplicas replicas, or the timeout
+// expires. The reply counts the local server and the replicas that did.
+func (ch *CommandHandler) waitaof(c *Client, v Value) []byte {
+	var repl Value
+	if !ch.isMaster() {
+		return repl.Error("ERR WAITAOF cannot be used with replica instances")
+	}
+	numLocal, err := strconv.Atoi(v.array[1].bulk)
+	if err != nil {
+		return repl.Error("ERR value is not an integer or out of range")
+	}
+	numReplicas, err := strconv.Atoi(v.array[2].bulk)
+	if err != nil {
+		return repl.Error("ERR value is not an integer or out of range")
+	}
+	timeout, err := parseWaitTimeout(v.array[3].bulk)
+	if err != nil {
+		return repl.Error(err.Error())
+	}
+	if numLocal > 0 && ch.aof == nil {
+		return repl.Error("ERR WAITAOF cannot be used when numlocal is set but appendonly is disabled.")
+	}
+
+	local, replicas := 0, 0
+	count := func() {
+		local = 0
+		if ch.aof != nil && ch.aof.FsyncedOffset() >= c.woff {
+			local = 1
+		}
+		replicas = ch.ackedReplicas(c.woff, true)
+	}
+	ch.blockForAcks(timeout, func() bool {
+		count()
+		return local >= numLocal && replicas >= numReplicas
+	})
+	ch.replMu.Lock()
+	count()
+	ch.replMu.Unlock()
+	repl.vType = "array"
+	repl.array = []Value{{vType: "num", num: local}, {vType: "num", num: replicas}}
+	return repl.Unmarshal()
+}
+
+// syncFromMaster loads the snapshot sent by the master according to
+// repl-diskless-load. The old dataset is kept until the snapshot is parsed,
+// a failed transfer leaves it untouched.
+func (ch *CommandHandler) syncFromMaster(r io.Reader) error {
+	mode := ch.replConf.disklessLoad
+	if mode == replLoadSwapDB || mode == replLoadOnEmptyDB && ch.datasetEmpty() {
+		fmt.Println("MASTER <-> REPLICA sync: Loading DB in memory from the socket")
+		return ch.loadFromMaster(r)
+	}
+
+	if err := ch.rdbconn.Receive(r); err != nil {
+		return err
+	}
+	f, err := os.Open(filepath.Join(ch.rdbconn.dir, ch.rdbconn.dbfilename))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fmt.Println("MASTER <-> REPLICA sync: Loading DB in memory from the dump file")
+	return ch.loadFromMaster(f)
+}
+
+func (ch *CommandHandler) datasetEmpty() bool {
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+	for _, keys := range ch.data {
+		if keys.Len() > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// loadFromMaster replaces the dataset with the RDB snapshot sent by the master
+func (ch *CommandHandler) loadFromMaster(r io.Reader) error {
+	dbs := make(map[int]map[string]StoredValue)
+	aux, err := readRDB(r, func(db int, key string, v StoredValue) {
+		if dbs[db] == nil {
+			dbs[db] = make(map[string]StoredValue)
+		}
+		dbs[db][key] = v
+	})
+	if err != nil {
+		return err
+	}
+
+	ch.writeMu.Lock()
+	ch.mu.Lock()
+	for i := range ch.data {
+		ch.data[i] = newDict[StoredValue]()
+	}
+	ch.setKeys(dbs)
+	ch.mu.Unlock()
+	ch.replMu.Lock()
+	ch.replDB = 0
+	if db, err := strconv.Atoi(aux["repl-stream-db"]); err == nil {
+		ch.replDB = db
+	}
+	ch.replMu.Unlock()
+	ch.writeMu.Unlock()
+	ch.dirty.Add(1)
+	ch.invalidateAll()
+	fmt.Println("MASTER <-> REPLICA sync: Finished with success")
+
+	// the AOF must start over from the new dataset
+	if ch.aof != nil {
+		if err := ch.startAOFRewrite(); err != nil {
+			fmt.Println("replication.go/loadFromMaster(): error rewriting the AOF", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A replica promoted with REPLICAOF NO ONE continues the stream of its former
+// master for the other replicas of that master
+func TestPartialResyncAfterPromotion(t *testing.T) {
+	ch := newTestCommandHandler(t)
+	ch.replConf.backlogSize = 1024 * 1024
+	ch.replConf.backlogTTL = time.Hour
+	oldID := strings.Repeat("a", 40)
+	first, second := bulkArray([]string{"SET", "a", "1"}), bulkArray([]string{"SET", "b", "2"})
+
+	// the stream received from the former master
+	ch.writeMu.Lock()
+	ch.replMu.Lock()
+	info := &ch.replConf.replication
+	info.role = "slave"
+	info.master_replid = oldID
+	ch.createBacklog()
+	ch.feedStream(first.Unmarshal())
+	ch.feedStream(second.Unmarshal())
+	ch.replMu.Unlock()
+	ch.writeMu.Unlock()
+
+	ch.promote()
+	if !ch.isMaster() {
+		t.Fatal("not a master after promote")
+	}
+	ch.replMu.Lock()
+	ch.freeBacklog()
+	freed := ch.backlog == nil
+	ch.replMu.Unlock()
+	if freed {
+		t.Fatal("backlog freed right after promote")
+	}
+	newID, oldEnd := info.master_replid, len(first.Unmarshal())+len(second.Unmarshal())
+	if newID == oldID || info.master_replid2 != oldID || info.second_repl_offset != oldEnd+1 {
+		t.Fatalf("replid %s, replid2 %s up to %d after promote, want a new ID and %s up to %d",
+			newID, info.master_replid2, info.second_repl_offset, oldID, oldEnd+1)
+	}
+
+	writer := NewClient(bufio.NewReader(strings.NewReader("")), bufio.NewWriter(io.Discard))
+	ch.call(writer, bulkArray([]string{"SET", "c", "3"}))
+	sel, set := bulkArray([]string{"SELECT", "0"}), bulkArray([]string{"SET", "c", "3"})
+
+	// a replica that missed the second command of the former master
+	replica, conn := newPipeClient(t, ch)
+	replica.replCapaPSync2 = true
+	offset := strconv.Itoa(len(first.Unmarshal()) + 1)
+	if !ch.partialResync(replica, oldID, offset) {
+		t.Fatalf("partial resync refused for %s at %s", oldID, offset)
+	}
+	want := "+CONTINUE " + newID + "\r\n" + string(second.Unmarshal()) + string(sel.Unmarshal()) + string(set.Unmarshal())
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	other := NewClient(bufio.NewReader(strings.NewReader("")), bufio.NewWriter(io.Discard))
+	for _, tt := range []struct {
+		replid string
+		offset int
+	}{
+		// past the point where the stream of the former master ended
+		{oldID, oldEnd + 2},
+		{strings.Repeat("b", 40), 1},
+	} {
+		if ch.partialResync(other, tt.replid, strconv.Itoa(tt.offset)) {
+			t.Errorf("partial resync accepted for %s at %d", tt.replid, tt.offset)
+		}
+	}
+}
+
+func TestMinReplicasToWrite(t *testing.T) {
+	ch := newTestCommandHandler(t)
+	ch.replConf.minReplicas = 1
+	ch.replConf.minReplicasMaxLag = 10 * time.Second
+	c := NewClient(bufio.NewReader(strings.NewReader("")), bufio.NewWriter(io.Discard))
+	addReplica := func(state int, ackTime time.Time) {
+		r := newReplica(NewClient(bufio.NewReader(strings.NewReader("")), bufio.NewWriter(io.Discard)), state)
+		r.ackTime = ackTime
+		ch.replMu.Lock()
+		ch.replicas[r.client.id] = r
+		ch.replMu.Unlock()
+	}
+	noReplicas := "-NOREPLICAS Not enough good replicas to write.\r\n"
+	tests := []struct {
+		name string
+		add  func()
+		want string
+	}{
+		{"no replica", func() {}, noReplicas},
+		{"replica still syncing", func() { addReplica(replicaWaitSnapshot, time.Now()) }, noReplicas},
+		{"replica lagging", func() { addReplica(replicaOnline, time.Now().Add(-time.Minute)) }, noReplicas},
+		{"good replica", func() { addReplica(replicaOnline, time.Now()) }, "+OK\r\n"},
+	}
+	for _, tt := range tests {
+		tt.add()
+		if got := string(ch.call(c, bulkArray([]string{"SET", "k", "v"}))); got != tt.want {
+			t.Errorf("%s: SET = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	ch.replConf.minReplicas = 2
+	if got := string(ch.call(c, bulkArray([]string{"SET", "k", "v"}))); got != noReplicas {
+		t.Errorf("SET with 1 of 2 good replicas = %q, want %q", got, noReplicas)
+	}
+	// reads are always allowed
+	if got := string(ch.call(c, bulkArray([]string{"GET", "k"}))); got != "$1\r\nv\r\n" {
+		t.Errorf("GET = %q", got)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// failed background save is not retried by save points sooner than this
+const bgsaveRetryDelay = 5 * time.Second
+
+type saveParam struct {
+	seconds int
+	changes int
+}
+
+// parseSaveParams parses "<seconds> <changes> ..." pairs of the save option
+func parseSaveParams(s string) ([]saveParam, error) {
+	fields := strings.Fields(s)
+	if len(fields)%2 != 0 {
+		return nil, fmt.Errorf("invalid save parameters %q", s)
+	}
+	var params []saveParam
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err1 := strconv.Atoi(fields[i])
+		changes, err2 := strconv.Atoi(fields[i+1])
+		if err1 != nil || err2 != nil || seconds < 0 || changes < 0 {
+			return nil, fmt.Errorf("invalid save parameters %q", s)
+		}
+		params = append(params, saveParam{seconds: seconds, changes: changes})
+	}
+	return params, nil
+}
+
+func formatSaveParams(params []saveParam) string {
+	var fields []string
+	for _, p := range params {
+		fields = append(fields, strconv.Itoa(p.seconds), strconv.Itoa(p.changes))
+	}
+	return strings.Join(fields, " ")
+}
+
+type bgsaveState struct {
+	mu         sync.Mutex
+	inProgress bool
+	scheduled  bool // BGSAVE SCHEDULE called while another save was running
+	lastSave   time.Time
+	lastTry    time.Time
+	lastErr    error
+}
+
+// takeSnapshot returns a point in time copy of all databases and the dirty
+// counter it corresponds to. Only the tables are copied, collections stay shared
+// with the live keyspace until the first write copies them (see lookupWrite).
+func (ch *CommandHandler) takeSnapshot() ([]*dict[StoredValue], int64) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+
+	ch.snapshotGen++
+	ch.snapshots++
+	dbs := make([]*dict[StoredValue], len(ch.data))
+	for i, d := range ch.data {
+		dbs[i] = d.clone()
+	}
+	return dbs, ch.dirty.Load()
+}
+
+func (ch *CommandHandler) releaseSnapshot() {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.snapshots--
+}
+
+// rdbSave writes the dump file from a fresh snapshot. The snapshot is taken
+// between writes, so the replication offset saved with it matches its data.
+func (ch *CommandHandler) rdbSave() error {
+	ch.writeMu.Lock()
+	dbs, dirty := ch.takeSnapshot()
+	ri := ch.rdbReplInfo()
+	ch.writeMu.Unlock()
+	err := ch.rdbconn.Save(dbs, ri)
+	ch.releaseSnapshot()
+
+	ch.bgsave.mu.Lock()
+	defer ch.bgsave.mu.Unlock()
+	ch.bgsave.lastTry = time.Now()
+	ch.bgsave.lastErr = err
+	if err != nil {
+		fmt.Println("save.go/rdbSave(): error saving rdb file", err)
+		return err
+	}
+	ch.dirty.Add(-dirty)
+	ch.bgsave.lastSave = time.Now()
+	return nil
+}
+
+// startBgsave runs rdbSave in background, false means another save is running
+func (ch *CommandHandler) startBgsave() bool {
+	ch.bgsave.mu.Lock()
+	defer ch.bgsave.mu.Unlock()
+
+	if ch.bgsave.inProgress {
+		return false
+	}
+	ch.bgsave.inProgress = true
+	go func() {
+		for {
+			ch.rdbSave()
+
+			ch.bgsave.mu.Lock()
+			if !ch.bgsave.scheduled {
+				ch.bgsave.inProgress = false
+				ch.bgsave.mu.Unlock()
+				return
+			}
+			ch.bgsave.scheduled = false
+			ch.bgsave.mu.Unlock()
+		}
+	}()
+	return true
+}
+
+func (ch *CommandHandler) save(v Value) []byte {
+	var repl Value
+	if len(v.array) != 1 {
+		return wrongArgsError("save")
+	}
+	ch.bgsave.mu.Lock()
+	if ch.bgsave.inProgress {
+		ch.bgsave.mu.Unlock()
+		return repl.Error("ERR Background save already in progress")
+	}
+	ch.bgsave.inProgress = true
+	ch.bgsave.mu.Unlock()
+
+	err := ch.rdbSave()
+
+	ch.bgsave.mu.Lock()
+	ch.bgsave.inProgress = false
+	ch.bgsave.mu.Unlock()
+	if err != nil {
+		return repl.Error("ERR " + err.Error())
+	}
+	return repl.OK()
+}
+
+func (ch *CommandHandler) bgsaveCmd(v Value) []byte {
+	var repl Value
+	schedule := false
+	if len(v.array) > 2 {
+		return wrongArgsError("bgsave")
+	}
+	if len(v.array) == 2 {
+		if strings.ToLower(v.array[1].bulk) != "schedule" {
+			return repl.Error("ERR syntax error")
+		}
+		schedule = true
+	}
+	if ch.startBgsave() {
+		repl.vType = "str"
+		repl.str = "Background saving started"
+		return repl.Unmarshal()
+	}
+	if !schedule {
+		return repl.Error("ERR Background save already in progress")
+	}
+	ch.bgsave.mu.Lock()
+	ch.bgsave.scheduled = true
+	ch.bgsave.mu.Unlock()
+	repl.vType = "str"
+	repl.str = "Background saving scheduled"
+	return repl.Unmarshal()
+}
+
+func (ch *CommandHandler) lastsave() []byte {
+	ch.bgsave.mu.Lock()
+	defer ch.bgsave.mu.Unlock()
+
+	repl := Value{vType: "num", num: int(ch.bgsave.lastSave.Unix())}
+	return repl.Unmarshal()
+}
+
+// persistenceInfo returns the lines of the persistence section of INFO
+func (ch *CommandHandler) persistenceInfo() []string {
+	ch.bgsave.mu.Lock()
+	lines := []string{
+		"loading:0",
+		fmt.Sprintf("rdb_changes_since_last_save:%d", ch.dirty.Load()),
+		fmt.Sprintf("rdb_bgsave_in_progress:%d", boolToInt(ch.bgsave.inProgress)),
+		fmt.Sprintf("rdb_last_save_time:%d", ch.bgsave.lastSave.Unix()),
+		fmt.Sprintf("rdb_last_bgsave_status:%s", statusString(ch.bgsave.lastErr)),
+	}
+	ch.bgsave.mu.Unlock()
+
+	var aofSize, aofBaseSize int64
+	var aofErr, rewriteErr error
+	rewriting := false
+	if ch.aof != nil {
+		aofErr = ch.aof.WriteError()
+		ch.aof.mu.Lock()
+		aofSize = ch.aof.baseSize + ch.aof.incrSize
+		aofBaseSize = ch.aof.rewriteBaseSize
+		rewriting = ch.aof.rewriting
+		rewriteErr = ch.aof.lastRewriteErr
+		ch.aof.mu.Unlock()
+	}
+	return append(lines,
+		fmt.Sprintf("aof_enabled:%d", boolToInt(ch.aof != nil)),
+		fmt.Sprintf("aof_rewrite_in_progress:%d", boolToInt(rewriting)),
+		fmt.Sprintf("aof_last_bgrewrite_status:%s", statusString(rewriteErr)),
+		fmt.Sprintf("aof_last_write_status:%s", statusString(aofErr)),
+		fmt.Sprintf("aof_current_size:%d", aofSize),
+		fmt.Sprintf("aof_base_size:%d", aofBaseSize),
+	)
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func statusString(err error) string {
+	if err != nil {
+		return "err"
+	}
+	return "ok"
+}
+
+// checkSavePoints starts background save when any save point is reached
+func (ch *CommandHandler) checkSavePoints() {
+	dirty := ch.dirty.Load()
+	ch.bgsave.mu.Lock()
+	sinceSave := time.Since(ch.bgsave.lastSave)
+	retryAllowed := ch.bgsave.lastErr == nil || time.Since(ch.bgsave.lastTry) > bgsaveRetryDelay
+	ch.bgsave.mu.Unlock()
+
+	for _, p := range ch.rdbconn.save {
+		if dirty >= int64(p.changes) && sinceSave > time.Duration(p.seconds)*time.Second && retryAllowed {
+			fmt.Printf("%d changes in %d seconds. Saving...\n", p.changes, p.seconds)
+			ch.startBgsave()
+			return
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSaveAndLoad(t *testing.T) {
+	rdb := &RDBconfig{dir: t.TempDir(), dbfilename: "dump.rdb", load: true}
+	open := func() *CommandHandler {
+		t.Helper()
+		repl := &ReplicationConfig{}
+		repl.replication.role = "master"
+		ch, err := NewCommandHandler(&ServerConfig{databases: 16}, rdb, &AOFconfig{}, repl, &ClusterConfig{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(ch.stopCron)
+		return ch
+	}
+
+	ch := open()
+	c := NewClient(bufio.NewReader(strings.NewReader("")), bufio.NewWriter(io.Discard))
+	for _, args := range [][]string{
+		{"SET", "str", "hello"},
+		{"SET", "num", "12345"},
+		{"SET", "ttl", "v", "PX", "100000"},
+		{"RPUSH", "list", "a", "b", "c"},
+		{"HSET", "hash", "f1", "v1", "f2", "v2"},
+		{"SADD", "set", "x", "y", "z"},
+		{"ZADD", "zset", "1", "one", "2.5", "two"},
+		{"XADD", "stream", "1-1", "f", "v"},
+		{"SELECT", "5"},
+		{"SET", "str", "in db 5"},
+	} {
+		if reply := ch.call(c, bulkArray(args)); reply[0] == '-' {
+			t.Fatalf("%q: %s", args, reply)
+		}
+	}
+	if reply := string(ch.call(c, bulkArray([]string{"SAVE"}))); reply != "+OK\r\n" {
+		t.Fatalf("SAVE: %s", reply)
+	}
+	if n := ch.dirty.Load(); n != 0 {
+		t.Errorf("%d changes left after SAVE, want 0", n)
+	}
+
+	loaded := open()
+	size := func(ch *CommandHandler, db int) int {
+		ch.mu.RLock()
+		defer ch.mu.RUnlock()
+		return ch.data[db].Len()
+	}
+	for db := range ch.data {
+		if got, want := size(loaded, db), size(ch, db); got != want {
+			t.Errorf("db %d has %d keys after loading, want %d", db, got, want)
+		}
+		for cursor := uint64(0); ; {
+			ch.mu.RLock()
+			cursor = ch.data[db].Scan(cursor, func(key string, want StoredValue) {
+				got, ok := loaded.getValue(db, key)
+				if !ok {
+					t.Errorf("key %s of db %d not loaded", key, db)
+					return
+				}
+				if !got.expires.Equal(want.expires.Truncate(time.Millisecond)) {
+					t.Errorf("key %s expires at %v, want %v", key, got.expires, want.expires)
+				}
+				got.expires, want.expires = time.Time{}, time.Time{}
+				if g, w := valueJSON(t, got), valueJSON(t, want); g != w {
+					t.Errorf("key %s of db %d = %s, want %s", key, db, g, w)
+				}
+			})
+			ch.mu.RUnlock()
+			if cursor == 0 {
+				break
+			}
+		}
+	}
+}
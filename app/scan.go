@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type scanOptions struct {
+	match    string
+	count    int
+	vType    string
+	novalues bool
+}
+
+func parseScanCursor(arg string) (uint64, error) {
+	cursor, err := strconv.ParseUint(arg, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("ERR invalid cursor")
+	}
+	return cursor, nil
+}
+
+// parseScanOptions parses MATCH, COUNT, and TYPE for SCAN or NOVALUES for HSCAN
+func parseScanOptions(command string, args []Value) (scanOptions, error) {
+	opts := scanOptions{count: 10}
+	for i := 0; i < len(args); i++ {
+		arg := strings.ToLower(args[i].bulk)
+		switch {
+		case arg == "match" && i+1 < len(args):
+			i++
+			opts.match = args[i].bulk
+		case arg == "count" && i+1 < len(args):
+			i++
+			count, err := strconv.Atoi(args[i].bulk)
+			if err != nil {
+				return opts, fmt.Errorf("ERR value is not an integer or out of range")
+			}
+			if count < 1 {
+				return opts, fmt.Errorf("ERR syntax error")
+			}
+			opts.count = count
+		case arg == "type" && i+1 < len(args) && command == "scan":
+			i++
+			opts.vType = strings.ToLower(args[i].bulk)
+		case arg == "novalues" && command == "hscan":
+			opts.novalues = true
+		default:
+			return opts, fmt.Errorf("ERR syntax error")
+		}
+	}
+	return opts, nil
+}
+
+// scanDict calls fn for entries of d starting at cursor until about count entries
+// were visited and returns the cursor to continue from. Like Redis it gives up
+// after visiting 10*count empty buckets so a sparse table does not block the server.
+func scanDict[V any](d *dict[V], cursor uint64, count int, fn func(key string, val V)) uint64 {
+	visited := 0
+	maxIterations := count * 10
+	for {
+		cursor = d.Scan(cursor, func(key string, val V) {
+			visited++
+			fn(key, val)
+		})
+		maxIterations--
+		if cursor == 0 || maxIterations == 0 || visited >= count {
+			return cursor
+		}
+	}
+}
+
+func (opts scanOptions) matches(s string) bool {
+	return opts.match == "" || opts.match == "*" || stringMatch(opts.match, s, false)
+}
+
+func scanReply(cursor uint64, items []Value) []byte {
+	repl := Value{vType: "array"}
+	repl.array = append(repl.array,
+		Value{vType: "bulk", bulk: strconv.FormatUint(cursor, 10)},
+		Value{vType: "array", array: items},
+	)
+	return repl.Unmarshal()
+}
+
+func (ch *CommandHandler) scan(c *Client, v Value) []byte {
+	var repl Value
+	if len(v.array) < 2 {
+		return wrongArgsError("scan")
+	}
+	cursor, err := parseScanCursor(v.array[1].bulk)
+	if err != nil {
+		return repl.Error(err.Error())
+	}
+	opts, err := parseScanOptions("scan", v.array[2:])
+	if err != nil {
+		return repl.Error(err.Error())
+	}
+
+	var keys []Value
+	ch.mu.RLock()
+	cursor = scanDict(ch.data[c.db], cursor, opts.count, func(key string, val StoredValue) {
+		if val.isExpired() || !opts.matches(key) {
+			return
+		}
+		if opts.vType != "" && opts.vType != val.vType {
+			return
+		}
+		keys = append(keys, Value{vType: "bulk", bulk: key})
+	})
+	ch.mu.RUnlock()
+	return scanReply(cursor, keys)
+}
+
+// scanCollection parses arguments shared by HSCAN, SSCAN and ZSCAN and looks up
+// the collection. Caller must hold ch.mu.
+func (ch *CommandHandler) scanCollection(c *Client, v Value, vType string) (StoredValue, bool, uint64, scanOptions, error) {
+	command := strings.ToLower(v.array[0].bulk)
+	var opts scanOptions
+	if len(v.array) < 3 {
+		return StoredValue{}, false, 0, opts, fmt.Errorf("ERR wrong number of arguments for '%s' command", command)
+	}
+	cursor, err := parseScanCursor(v.array[2].bulk)
+	if err != nil {
+		return StoredValue{}, false, 0, opts, err
+	}
+	opts, err = parseScanOptions(command, v.array[3:])
+	if err != nil {
+		return StoredValue{}, false, 0, opts, err
+	}
+	val, ok, err := ch.lookupTyped(c.db, v.array[1].bulk, vType)
+	return val, ok, cursor, opts, err
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func (s *Sentinel) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	client := NewClient(bufio.NewReader(conn), bufio.NewWriter(conn))
+	client.conn = conn
+	client.addr = conn.RemoteAddr().String()
+	s.clients.Add(1)
+	defer s.clients.Add(-1)
+	defer client.stopPush()
+	defer s.pubsub.RemoveClient(client)
+	for {
+		parser := NewParser(client.rw.Reader)
+		v, err := parser.Parse()
+		if err != nil {
+			return
+		}
+		client.Write(s.handleCommand(client, v))
+	}
+}
+
+// handleCommand runs the commands of a sentinel: PING, INFO, ROLE, SENTINEL
+// and the pub/sub commands to follow its events
+func (s *Sentinel) handleCommand(c *Client, v Value) []byte {
+	var repl Value
+	command := commandName(v)
+	if command == "" {
+		return repl.Error("ERR Protocol error: expected a command")
+	}
+	if s.pubsub.inSubscribedContext(c, command) {
+		return repl.Error(fmt.Sprintf("ERR Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT / RESET are allowed in this context", command))
+	}
+	switch command {
+	case "ping":
+		if s.pubsub.SubscriptionsCount(c) > 0 && c.Protocol() == 2 {
+			return pubsubMessage(c, "pong", Value{vType: "bulk", bulk: ""})
+		}
+		repl.vType, repl.str = "str", "PONG"
+		return repl.Unmarshal()
+	case "info":
+		return s.info(v)
+	case "role":
+		return s.role()
+	case "sentinel":
+		if len(v.array) < 2 {
+			return wrongArgsError("sentinel")
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.sentinelCommand(v)
+	case "subscribe":
+		return s.pubsub.subscribe(c, v)
+	case "unsubscribe":
+		return s.pubsub.unsubscribe(c, v)
+	case "psubscribe":
+		return s.pubsub.psubscribe(c, v)
+	case "punsubscribe":
+		return s.pubsub.punsubscribe(c, v)
+	}
+	var args []string
+	for _, arg := range v.array[1:] {
+		args = append(args, "'"+arg.bulk+"'")
+	}
+	return repl.Error(fmt.Sprintf("ERR unknown command '%s', with args beginning with: %s", v.array[0].bulk, strings.Join(args, " ")))
+}
+
+// sentinelCommand implements the SENTINEL subcommands. Caller must hold s.mu.
+func (s *Sentinel) sentinelCommand(v Value) []byte {
+	var repl Value
+	args := v.array[2:]
+	sub := strings.ToLower(v.array[1].bulk)
+	arity := map[string]int{
+		"masters": 0, "master": 1, "replicas": 1, "slaves": 1, "sentinels": 1,
+		"get-master-addr-by-name": 1, "is-master-down-by-addr": 4, "failover": 1,
+		"ckquorum": 1, "monitor": 4, "remove": 1, "myid": 0,
+	}
+	n, ok := arity[sub]
+	if !ok {
+		return repl.Error(fmt.Sprintf("ERR unknown subcommand '%s'. Try SENTINEL HELP.", v.array[1].bulk))
+	}
+	if len(args) != n {
+		return repl.Error(fmt.Sprintf("ERR wrong number of arguments for 'sentinel|%s' command", sub))
+	}
+
+	var m *sentinelMaster
+	switch sub {
+	case "master", "replicas", "slaves", "sentinels", "failover", "ckquorum", "remove":
+		if m, ok = s.masters[args[0].bulk]; !ok {
+			return repl.Error("ERR No such master with that name")
+		}
+	}
+
+	repl.vType = "array"
+	switch sub {
+	case "masters":
+		repl.array = []Value{}
+		for _, name := range sortedKeys(s.masters) {
+			repl.array = append(repl.array, s.masterFields(s.masters[name]))
+		}
+	case "master":
+		repl = s.masterFields(m)
+	case "replicas", "slaves":
+		repl.array = []Value{}
+		for _, r := range sortedInstances(m.replicas) {
+			repl.array = append(repl.array, s.instanceFields(r))
+		}
+	case "sentinels":
+		repl.array = []Value{}
+		for _, si := range sortedInstances(m.sentinels) {
+			repl.array = append(repl.array, s.instanceFields(si))
+		}
+	case "get-master-addr-by-name":
+		m, ok := s.masters[args[0].bulk]
+		if !ok {
+			return []byte("*-1\r\n")
+		}
+		host, port := m.currentMasterAddr()
+		repl = bulkArray([]string{host, port})
+	case "is-master-down-by-addr":
+		return s.isMasterDownByAddr(args[0].bulk, args[1].bulk, args[2].bulk, args[3].bulk)
+	case "failover":
+		if m.failoverState != failoverNone {
+			return repl.Error("INPROG Failover already in progress")
+		}
+		if s.selectReplica(m) == nil {
+			return repl.Error("NOGOODSLAVE No suitable replica to promote")
+		}
+		s.startFailover(m)
+		m.forceFailover = true
+		return repl.OK()
+	case "ckquorum":
+		return s.ckquorum(m)
+	case "monitor":
+		quorum, err := strconv.Atoi(args[3].bulk)
+		if err != nil {
+			return repl.Error("ERR Invalid quorum")
+		}
+		if err := s.monitor(args[0].bulk, args[1].bulk, args[2].bulk, quorum); err != nil {
+			return repl.Error(err.Error())
+		}
+		return repl.OK()
+	case "remove":
+		s.removeInstance(m.sentinelInstance)
+		for _, inst := range m.replicas {
+			s.removeInstance(inst)
+		}
+		for _, inst := range m.sentinels {
+			s.removeInstance(inst)
+		}
+		delete(s.masters, m.name)
+		s.event("-monitor", m, m.sentinelInstance, "")
+		return repl.OK()
+	case "myid":
+		repl = Value{vType: "bulk", bulk: s.myID}
+	}
+	return repl.Unmarshal()
+}
+
+// isMasterDownByAddr tells another sentinel whether the master at host:port
+// is subjectively down here. When runID is not * it asks for the vote of
+// this sentinel for the failover leader of epoch.
+func (s *Sentinel) isMasterDownByAddr(host, port, epochArg, runID string) []byte {
+	var repl Value
+	epoch, err := strconv.Atoi(epochArg)
+	if err != nil {
+		return repl.Error("ERR value is not an integer or out of range")
+	}
+	var m *sentinelMaster
+	for _, candidate := range s.masters {
+		if candidate.host == host && candidate.port == port {
+			m = candidate
+		}
+	}
+	down := m != nil && m.sdown
+	leader, leaderEpoch := "*", 0
+	if m != nil && runID != "*" {
+		leader, leaderEpoch = s.voteLeader(m, epoch, runID)
+	}
+	repl.vType = "array"
+	repl.array = []Value{
+		{vType: "num", num: boolToInt(down)},
+		{vType: "bulk", bulk: leader},
+		{vType: "num", num: leaderEpoch},
+	}
+	return repl.Unmarshal()
+}
+
+// ckquorum checks that enough sentinels are up to reach the quorum and to
+// authorize a failover
+func (s *Sentinel) ckquorum(m *sentinelMaster) []byte {
+	var repl Value
+	usable := 1
+	for _, si := range m.sentinels {
+		if !si.sdown {
+			usable++
+		}
+	}
+	voters := len(m.sentinels) + 1
+	var problems []string
+	if usable < m.quorum {
+		problems = append(problems, fmt.Sprintf("%d usable Sentinels. Not enough available Sentinels to reach the specified quorum for this master", usable))
+	}
+	if usable < voters/2+1 {
+		problems = append(problems, fmt.Sprintf("%d usable Sentinels. Not enough available Sentinels to reach the majority and authorize a failover", usable))
+	}
+	if len(problems) > 0 {
+		return repl.Error("NOQUORUM " + strings.Join(problems, ". "))
+	}
+	repl.vType = "str"
+	repl.str = fmt.Sprintf("OK %d usable Sentinels. Quorum and failover authorization can be reached", usable)
+	return repl.Unmarshal()
+}
+
+// flags describes the state of inst as in SENTINEL replies
+func (s *Sentinel) flags(inst *sentinelInstance) string {
+	flags := []string{instKindNames[inst.kind]}
+	if inst.sdown {
+		flags = append(flags, "s_down")
+	}
+	if inst.link == nil {
+		flags = append(flags, "disconnected")
+	}
+	if inst.kind == instSentinel && inst.masterDown {
+		flags = append(flags, "master_down")
+	}
+	for _, m := range s.masters {
+		if m.sentinelInstance == inst {
+			if m.odown {
+				flags = append(flags, "o_down")
+			}
+			if m.failoverState != failoverNone {
+				flags = append(flags, "failover_in_progress")
+			}
+			if m.forceFailover {
+				flags = append(flags, "force_failover")
+			}
+		}
+		if m.promoted == inst {
+			flags = append(flags, "promoted")
+		}
+		switch {
+		case inst.kind != instReplica || m.replicas[inst.name] != inst:
+		case inst.reconf == reconfSent:
+			flags = append(flags, "reconf_sent")
+		case inst.reconf == reconfInProg:
+			flags = append(flags, "reconf_inprog")
+		case inst.reconf == reconfDone:
+			flags = append(flags, "reconf_done")
+		}
+	}
+	return strings.Join(flags, ",")
+}
+
+// instanceFields lists the state of inst as field value pairs
+func (s *Sentinel) instanceFields(inst *sentinelInstance) Value {
+	ms := func(t time.Time) string {
+		if t.IsZero() {
+			return "0"
+		}
+		return strconv.FormatInt(time.Since(t).Milliseconds(), 10)
+	}
+	pending := 0
+	if inst.link != nil {
+		pending = len(inst.link.pending)
+	}
+	fields := []string{
+		"name", inst.name,
+		"ip", inst.host,
+		"port", inst.port,
+		"runid", inst.runID,
+		"flags", s.flags(inst),
+		"link-pending-commands", strconv.Itoa(pending),
+		"link-refcount", "1",
+		"last-ping-sent", ms(inst.pingPending),
+		"last-ok-ping-reply", ms(inst.lastAvail),
+		"last-ping-reply", ms(inst.lastPong),
+	}
+	if inst.sdown {
+		fields = append(fields, "s-down-time", ms(inst.sdownSince))
+	}
+	if inst.kind != instSentinel {
+		fields = append(fields,
+			"info-refresh", ms(inst.infoRefresh),
+			"role-reported", inst.role,
+			"role-reported-time", ms(inst.roleReported),
+		)
+	}
+	if inst.kind == instReplica {
+		linkStatus := "err"
+		if inst.masterLinkUp {
+			linkStatus = "ok"
+		}
+		fields = append(fields,
+			"master-link-down-time", strconv.FormatInt(inst.masterLinkDownSince.Milliseconds(), 10),
+			"master-link-status", linkStatus,
+			"master-host", inst.masterHost,
+			"master-port", inst.masterPort,
+			"slave-priority", strconv.Itoa(inst.priority),
+			"slave-repl-offset", strconv.Itoa(inst.replOffset),
+		)
+	}
+	if inst.kind == instSentinel {
+		leader := inst.leader
+		if leader == "" {
+			leader = "?"
+		}
+		fields = append(fields,
+			"last-hello-message", ms(inst.lastHello),
+			"voted-leader", leader,
+			"voted-leader-epoch", strconv.Itoa(inst.leaderEpoch),
+		)
+	}
+	return bulkArray(fields)
+}
+
+// masterFields lists the state of the master as field value pairs
+func (s *Sentinel) masterFields(m *sentinelMaster) Value {
+	v := s.instanceFields(m.sentinelInstance)
+	extra := []string{
+		"config-epoch", strconv.Itoa(m.configEpoch),
+		"num-slaves", strconv.Itoa(len(m.replicas)),
+		"num-other-sentinels", strconv.Itoa(len(m.sentinels)),
+		"quorum", strconv.Itoa(m.quorum),
+		"down-after-milliseconds", strconv.FormatInt(m.downAfter.Milliseconds(), 10),
+		"failover-timeout", strconv.FormatInt(m.failoverTimeout.Milliseconds(), 10),
+		"parallel-syncs", strconv.Itoa(m.parallelSyncs),
+	}
+	if m.odown {
+		extra = append(extra, "o-down-time", strconv.FormatInt(time.Since(m.odownSince).Milliseconds(), 10))
+	}
+	if m.failoverState != failoverNone {
+		extra = append(extra,
+			"failover-state", failoverStateNames[m.failoverState],
+			"failover-epoch", strconv.Itoa(m.failoverEpoch),
+		)
+	}
+	v.array = append(v.array, bulkArray(extra).array...)
+	return v
+}
+
+// info implements INFO of a sentinel, with the server, clients and sentinel
+// sections
+func (s *Sentinel) info(v Value) []byte {
+	selected := make(map[string]bool)
+	for _, arg := range v.array[1:] {
+		selected[strings.ToLower(arg.bulk)] = true
+	}
+	all := len(v.array) == 1 || selected["all"] || selected["everything"] || selected["default"]
+
+	var sections []string
+	add := func(name, title string, lines []string) {
+		if all || selected[name] {
+			sections = append(sections, "# "+title+"\r\n"+strings.Join(lines, "\r\n")+"\r\n")
+		}
+	}
+	uptime := time.Since(s.startTime)
+	add("server", "Server", []string{
+		"redis_version:" + redisVersion,
+		"redis_mode:sentinel",
+		fmt.Sprintf("os:%s %s", runtime.GOOS, runtime.GOARCH),
+		fmt.Sprintf("process_id:%d", os.Getpid()),
+		"run_id:" + s.myID,
+		"tcp_port:" + s.conf.port,
+		fmt.Sprintf("uptime_in_seconds:%d", int(uptime/time.Second)),
+		fmt.Sprintf("uptime_in_days:%d", int(uptime/(24*time.Hour))),
+	})
+	add("clients", "Clients", []string{
+		fmt.Sprintf("connected_clients:%d", s.clients.Load()),
+	})
+
+	s.mu.Lock()
+	lines := []string{
+		fmt.Sprintf("sentinel_masters:%d", len(s.masters)),
+		"sentinel_tilt:0",
+		"sentinel_running_scripts:0",
+		"sentinel_scripts_queue_length:0",
+		"sentinel_simulate_failure_flags:0",
+	}
+	for i, name := range sortedKeys(s.masters) {
+		m := s.masters[name]
+		status := "ok"
+		if m.odown {
+			status = "odown"
+		} else if m.sdown {
+			status = "sdown"
+		}
+		host, port := m.currentMasterAddr()
+		lines = append(lines, fmt.Sprintf("master%d:name=%s,status=%s,address=%s,slaves=%d,sentinels=%d",
+			i, name, status, net.JoinHostPort(host, port), len(m.replicas), len(m.sentinels)+1))
+	}
+	s.mu.Unlock()
+	add("sentinel", "Sentinel", lines)
+
+	repl := Value{vType: "bulk", bulk: strings.Join(sections, "\r\n")}
+	return repl.Unmarshal()
+}
+
+// role replies with the names of the monitored masters
+func (s *Sentinel) role() []byte {
+	s.mu.Lock()
+	names := sortedKeys(s.masters)
+	s.mu.Unlock()
+	repl := Value{vType: "array", array: []Value{
+		{vType: "bulk", bulk: "sentinel"},
+		{vType: "array", array: bulkArray(names).array},
+	}}
+	return repl.Unmarshal()
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// instanceLink is a connection of the sentinel to a monitored server or to
+// another sentinel. Commands are pipelined, the reader goroutine hands every
+// reply to the callback of its command with Sentinel.mu held.
+type instanceLink struct {
+	conn     net.Conn
+	w        *bufio.Writer
+	pending  []func(Value) // callbacks of the commands waiting for a reply
+	lastRead time.Time
+}
+
+// send writes a command, cb gets its reply unless it is nil. A failed write
+// closes the connection, the reader goroutine drops the link. Caller must
+// hold Sentinel.mu.
+func (l *instanceLink) send(cb func(Value), args ...string) {
+	cmd := bulkArray(args)
+	l.conn.SetWriteDeadline(time.Now().Add(sentinelWriteTimeout))
+	_, err := l.w.Write(cmd.Unmarshal())
+	if err == nil {
+		err = l.w.Flush()
+	}
+	if err != nil {
+		l.conn.Close()
+		return
+	}
+	l.pending = append(l.pending, cb)
+}
+
+// connectLinks reconnects the missing links of inst in the background.
+// Masters and replicas have a second link subscribed to the hello channel.
+func (s *Sentinel) connectLinks(inst *sentinelInstance) {
+	if inst.link == nil && !inst.linkConnecting {
+		inst.linkConnecting = true
+		go s.connect(inst, false)
+	}
+	if inst.kind != instSentinel && inst.pubsub == nil && !inst.pubsubConnecting {
+		inst.pubsubConnecting = true
+		go s.connect(inst, true)
+	}
+}
+
+func (s *Sentinel) connect(inst *sentinelInstance, pubsub bool) {
+	conn, err := dialInstance(inst.host, inst.port, sentinelConnectTimeout)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if pubsub {
+		inst.pubsubConnecting = false
+	} else {
+		inst.linkConnecting = false
+	}
+	if err != nil {
+		return
+	}
+	if inst.removed {
+		conn.Close()
+		return
+	}
+	l := &instanceLink{conn: conn, w: bufio.NewWriter(conn), lastRead: time.Now()}
+	if pubsub {
+		inst.pubsub = l
+		l.send(nil, "SUBSCRIBE", sentinelHelloChannel)
+	} else {
+		inst.link = l
+	}
+	go s.readLink(inst, l, pubsub)
+}
+
+// readLink reads the replies of the link until its connection breaks. The
+// pub/sub link delivers hello messages.
+func (s *Sentinel) readLink(inst *sentinelInstance, l *instanceLink, pubsub bool) {
+	rd := bufio.NewReader(l.conn)
+	for {
+		v, err := NewParser(rd).Parse()
+
+		s.mu.Lock()
+		if err != nil {
+			l.conn.Close()
+			if inst.link == l {
+				inst.link = nil
+			}
+			if inst.pubsub == l {
+				inst.pubsub = nil
+			}
+			s.mu.Unlock()
+			return
+		}
+		l.lastRead = time.Now()
+		if pubsub {
+			if v.vType == "array" && len(v.array) == 3 && v.array[0].bulk == "message" {
+				s.processHello(v.array[2].bulk)
+			}
+		} else if len(l.pending) > 0 {
+			cb := l.pending[0]
+			l.pending = l.pending[1:]
+			if cb != nil && !inst.removed {
+				cb(v)
+			}
+		}
+		s.mu.Unlock()
+	}
+}
+
+// sendPeriodicCommands pings inst, refreshes its INFO and announces this
+// sentinel through it
+func (s *Sentinel) sendPeriodicCommands(m *sentinelMaster, inst *sentinelInstance) {
+	if inst.link == nil {
+		return
+	}
+	now := time.Now()
+	infoPeriod := sentinelInfoPeriod
+	if inst.kind == instReplica && (m.odown || m.failoverState != failoverNone) {
+		infoPeriod = time.Second
+	}
+	pingPeriod := min(m.downAfter, sentinelPingPeriod)
+
+	if inst.kind != instSentinel && now.Sub(inst.infoSent) > infoPeriod {
+		inst.infoSent = now
+		inst.link.send(func(v Value) {
+			if v.vType == "bulk" {
+				s.processInfo(m, inst, v.bulk)
+			}
+		}, "INFO")
+	}
+	if now.Sub(inst.lastPong) > pingPeriod && now.Sub(inst.lastPingSent) > pingPeriod/2 {
+		s.sendPing(inst)
+	}
+	if inst.kind != instSentinel && now.Sub(inst.lastHelloSent) > sentinelHelloPeriod {
+		s.sendHello(m, inst)
+	}
+}
+
+// sendPing pings inst, a server loading its dataset or refusing commands
+// for lack of a master is still up
+func (s *Sentinel) sendPing(inst *sentinelInstance) {
+	now := time.Now()
+	inst.lastPingSent = now
+	if inst.pingPending.IsZero() {
+		inst.pingPending = now
+	}
+	inst.link.send(func(v Value) {
+		inst.lastPong = time.Now()
+		if (v.vType == "str" && v.str == "PONG") ||
+			(v.vType == "error" && (strings.HasPrefix(v.str, "LOADING") || strings.HasPrefix(v.str, "MASTERDOWN"))) {
+			inst.lastAvail = inst.lastPong
+			inst.pingPending = time.Time{}
+		}
+	}, "PING")
+}
+
+// sendHello publishes the address and run id of this sentinel and its
+// configuration of the master on the hello channel of inst
+func (s *Sentinel) sendHello(m *sentinelMaster, inst *sentinelInstance) {
+	ip, _, _ := net.SplitHostPort(inst.link.conn.LocalAddr().String())
+	masterHost, masterPort := m.currentMasterAddr()
+	payload := fmt.Sprintf("%s,%s,%s,%d,%s,%s,%s,%d",
+		ip, s.conf.port, s.myID, s.currentEpoch, m.name, masterHost, masterPort, m.configEpoch)
+	inst.lastHelloSent = time.Now()
+	inst.link.send(nil, "PUBLISH", sentinelHelloChannel, payload)
+}
+
+// processHello learns about a sentinel from its hello message, and about a
+// newer configuration of the master it announces
+func (s *Sentinel) processHello(payload string) {
+	f := strings.Split(payload, ",")
+	if len(f) != 8 {
+		return
+	}
+	ip, port, runID, name, masterHost, masterPort := f[0], f[1], f[2], f[4], f[5], f[6]
+	epoch, err1 := strconv.Atoi(f[3])
+	configEpoch, err2 := strconv.Atoi(f[7])
+	if err1 != nil || err2 != nil || runID == s.myID {
+		return
+	}
+	m, ok := s.masters[name]
+	if !ok {
+		return
+	}
+
+	si, ok := m.sentinels[runID]
+	if ok && (si.host != ip || si.port != port) {
+		s.removeInstance(si)
+		delete(m.sentinels, runID)
+		ok = false
+	}
+	if !ok {
+		// a sentinel restarted at the same address has a new run id
+		for id, other := range m.sentinels {
+			if other.host == ip && other.port == port {
+				s.removeInstance(other)
+				delete(m.sentinels, id)
+			}
+		}
+		si = newSentinelInstance(instSentinel, net.JoinHostPort(ip, port), ip, port)
+		si.runID = runID
+		m.sentinels[runID] = si
+		s.event("+sentinel", m, si, "")
+	}
+	si.lastHello = time.Now()
+
+	if epoch > s.currentEpoch {
+		s.currentEpoch = epoch
+		s.event("+new-epoch", m, nil, strconv.Itoa(epoch))
+	}
+	if configEpoch > m.configEpoch {
+		m.configEpoch = configEpoch
+		if masterHost != m.host || masterPort != m.port {
+			s.event("+config-update-from", m, si, "")
+			s.switchMaster(m, masterHost, masterPort)
+		}
+	}
+}
+
+// processInfo records the state reported by INFO of a master or replica,
+// discovers the replicas of the master and follows the progress of a
+// failover. Replicas that lost track of the master are pointed back to it.
+func (s *Sentinel) processInfo(m *sentinelMaster, inst *sentinelInstance, info string) {
+	role := ""
+	masterHost, masterPort := "", ""
+	inst.masterLinkDownSince = 0
+	for _, line := range strings.Split(info, "\r\n") {
+		key, val, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "run_id":
+			if inst.runID != "" && inst.runID != val {
+				s.event("+reboot", m, inst, "")
+			}
+			inst.runID = val
+		case "role":
+			role = val
+		case "master_host":
+			masterHost = val
+		case "master_port":
+			masterPort = val
+		case "master_link_status":
+			inst.masterLinkUp = val == "up"
+		case "master_link_down_since_seconds":
+			if n, err := strconv.Atoi(val); err == nil && n > 0 {
+				inst.masterLinkDownSince = time.Duration(n) * time.Second
+			}
+		case "slave_priority", "replica_priority":
+			if n, err := strconv.Atoi(val); err == nil {
+				inst.priority = n
+			}
+		case "slave_repl_offset":
+			if n, err := strconv.Atoi(val); err == nil {
+				inst.replOffset = n
+			}
+		default:
+			// slaveN:ip=...,port=...,state=...
+			if inst == m.sentinelInstance && strings.HasPrefix(key, "slave") {
+				fields := make(map[string]string)
+				for _, f := range strings.Split(val, ",") {
+					k, v, _ := strings.Cut(f, "=")
+					fields[k] = v
+				}
+				if fields["ip"] != "" && fields["port"] != "" {
+					s.addReplica(m, fields["ip"], fields["port"])
+				}
+			}
+		}
+	}
+	now := time.Now()
+	inst.infoRefresh = now
+	if role != inst.role {
+		inst.role, inst.roleReported = role, now
+	}
+	if masterHost != inst.masterHost || masterPort != inst.masterPort {
+		inst.masterHost, inst.masterPort, inst.masterAddrChanged = masterHost, masterPort, now
+	}
+	if inst.kind != instReplica {
+		return
+	}
+
+	if role == "master" {
+		if inst == m.promoted && m.failoverState == failoverWaitPromotion {
+			s.failoverPromoted(m)
+			return
+		}
+		// a replica turned into a master, probably a former master that
+		// restarted. It is given some time to learn a newer configuration
+		// from the other sentinels first.
+		wait := 4 * sentinelHelloPeriod
+		if inst != m.promoted && m.sane() && inst.noDownFor(wait) && now.Sub(inst.roleReported) > wait {
+			inst.link.send(nil, "REPLICAOF", m.host, m.port)
+			s.event("+convert-to-slave", m, inst, "")
+		}
+		return
+	}
+
+	if m.failoverState == failoverReconfReplicas && m.promoted != nil && inst != m.promoted {
+		if inst.reconf == reconfSent && masterHost == m.promoted.host && masterPort == m.promoted.port {
+			inst.reconf = reconfInProg
+			s.event("+slave-reconf-inprog", m, inst, "")
+		}
+		if inst.reconf == reconfInProg && inst.masterLinkUp {
+			inst.reconf = reconfDone
+			s.event("+slave-reconf-done", m, inst, "")
+		}
+		return
+	}
+
+	// a replica following another master
+	if role == "slave" && (masterHost != m.host || masterPort != m.port) {
+		wait := m.failoverTimeout
+		if m.sane() && inst.noDownFor(wait) && now.Sub(inst.masterAddrChanged) > wait {
+			inst.link.send(nil, "REPLICAOF", m.host, m.port)
+			s.event("+fix-slave-config", m, inst, "")
+		}
+	}
+}
@@ -0,0 +1,722 @@
+package main
+
+import (
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sentinelDefaultPort is the port of a sentinel started without --port
+const sentinelDefaultPort = "26379"
+
+// channel of the monitored servers where sentinels announce themselves
+const sentinelHelloChannel = "__sentinel__:hello"
+
+const (
+	sentinelTimerPeriod     = 100 * time.Millisecond
+	sentinelPingPeriod      = time.Second      // instances are pinged this often, or every down-after if shorter
+	sentinelInfoPeriod      = 10 * time.Second // INFO refresh, every second for replicas of a failing master
+	sentinelHelloPeriod     = 2 * time.Second
+	sentinelAskPeriod       = time.Second // other sentinels are asked this often whether a master is down
+	sentinelConnectTimeout  = time.Second
+	sentinelWriteTimeout    = time.Second
+	sentinelMaxDesync       = time.Second // random delay spreading the failover attempts of sentinels
+	sentinelElectionTimeout = 10 * time.Second
+)
+
+// kinds of instances, named as in events and SENTINEL replies
+const (
+	instMaster = iota
+	instReplica
+	instSentinel
+)
+
+var instKindNames = []string{
+	instMaster:   "master",
+	instReplica:  "slave",
+	instSentinel: "sentinel",
+}
+
+// failover states, a failover goes through them in order
+const (
+	failoverNone = iota
+	failoverWaitStart
+	failoverSelectReplica
+	failoverSendReplicaofNoOne
+	failoverWaitPromotion
+	failoverReconfReplicas
+	failoverUpdateConfig
+)
+
+var failoverStateNames = []string{
+	failoverNone:               "none",
+	failoverWaitStart:          "wait_start",
+	failoverSelectReplica:      "select_slave",
+	failoverSendReplicaofNoOne: "send_slaveof_noone",
+	failoverWaitPromotion:      "wait_promotion",
+	failoverReconfReplicas:     "reconf_slaves",
+	failoverUpdateConfig:       "update_config",
+}
+
+// progress of a replica pointed to the promoted one during a failover
+const (
+	reconfNone   = iota
+	reconfSent   // REPLICAOF sent
+	reconfInProg // the replica follows the promoted replica
+	reconfDone   // the replica is synchronized with it
+)
+
+// SentinelConfig holds the options of a sentinel and the defaults of the
+// masters it monitors
+type SentinelConfig struct {
+	host, port      string
+	downAfter       time.Duration // an instance not replying for this long is subjectively down
+	failoverTimeout time.Duration
+	parallelSyncs   int // replicas pointed to the promoted replica at once
+}
+
+// Sentinel monitors masters and their replicas, and fails a master over to
+// one of its replicas when enough sentinels agree that it is down
+type Sentinel struct {
+	conf      *SentinelConfig
+	myID      string
+	startTime time.Time
+	pubsub    *PubSub // events published to the clients of the sentinel
+	clients   atomic.Int64
+
+	mu           sync.Mutex // guards the state below, the instances and their links
+	currentEpoch int
+	masters      map[string]*sentinelMaster
+}
+
+// sentinelInstance is a server monitored by the sentinel or another
+// sentinel. Its address never changes, a moved server is a new instance.
+type sentinelInstance struct {
+	kind       int
+	name       string // master name, ip:port for the others
+	host, port string
+	runID      string
+	removed    bool // dropped from the configuration, its links are closed
+
+	link, pubsub                     *instanceLink // nil while disconnected
+	linkConnecting, pubsubConnecting bool
+
+	lastAvail    time.Time // last valid reply to a ping
+	lastPong     time.Time // last reply to a ping
+	lastPingSent time.Time
+	pingPending  time.Time // when the oldest unanswered ping was sent, zero if none
+	sdown        bool
+	sdownSince   time.Time
+	sdownChanged time.Time // last change of sdown, zero if it never was down
+
+	// state reported by INFO of masters and replicas
+	infoSent            time.Time
+	infoRefresh         time.Time
+	role                string
+	roleReported        time.Time
+	masterHost          string
+	masterPort          string
+	masterAddrChanged   time.Time
+	masterLinkUp        bool
+	masterLinkDownSince time.Duration
+	priority            int
+	replOffset          int
+	lastHelloSent       time.Time
+	reconf              int // reconf* during a failover
+	reconfSentAt        time.Time
+
+	// state of other sentinels
+	lastHello         time.Time
+	masterDown        bool // the sentinel considers the master down
+	masterDownReplied time.Time
+	leader            string // vote of the sentinel for the failover leader
+	leaderEpoch       int
+}
+
+// sentinelMaster is a monitored master with its replicas and the other
+// sentinels monitoring it
+type sentinelMaster struct {
+	*sentinelInstance
+	quorum          int // sentinels agreeing the master is down before a failover
+	downAfter       time.Duration
+	failoverTimeout time.Duration
+	parallelSyncs   int
+	configEpoch     int                          // epoch of the failover that produced the current address
+	replicas        map[string]*sentinelInstance // by ip:port
+	sentinels       map[string]*sentinelInstance // by run id
+
+	odown      bool
+	odownSince time.Time
+
+	leader      string // vote of this sentinel for the failover leader
+	leaderEpoch int
+
+	failoverState        int
+	failoverEpoch        int
+	failoverStart        time.Time // a failover is not retried within 2*failoverTimeout of it
+	failoverStateChanged time.Time
+	forceFailover        bool // started by SENTINEL FAILOVER, no agreement needed
+	promoted             *sentinelInstance
+}
+
+func newSentinelInstance(kind int, name, host, port string) *sentinelInstance {
+	return &sentinelInstance{kind: kind, name: name, host: host, port: port, lastAvail: time.Now(), priority: 100}
+}
+
+func NewSentinel(conf *SentinelConfig) *Sentinel {
+	return &Sentinel{
+		conf:      conf,
+		myID:      randomHex(20),
+		startTime: time.Now(),
+		pubsub:    NewPubSub(),
+		masters:   make(map[string]*sentinelMaster),
+	}
+}
+
+// monitor starts monitoring master name at host:port. Caller must hold s.mu.
+func (s *Sentinel) monitor(name, host, port string, quorum int) error {
+	if _, ok := s.masters[name]; ok {
+		return fmt.Errorf("ERR Duplicated master name")
+	}
+	if quorum <= 0 {
+		return fmt.Errorf("ERR Quorum must be 1 or greater.")
+	}
+	if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+		return fmt.Errorf("ERR Invalid port number")
+	}
+	m := &sentinelMaster{
+		sentinelInstance: newSentinelInstance(instMaster, name, host, port),
+		quorum:           quorum,
+		downAfter:        s.conf.downAfter,
+		failoverTimeout:  s.conf.failoverTimeout,
+		parallelSyncs:    s.conf.parallelSyncs,
+		replicas:         make(map[string]*sentinelInstance),
+		sentinels:        make(map[string]*sentinelInstance),
+	}
+	s.masters[name] = m
+	s.event("+monitor", m, m.sentinelInstance, fmt.Sprintf("quorum %d", quorum))
+	return nil
+}
+
+// serve accepts the clients of the sentinel and runs its timer
+func (s *Sentinel) serve() {
+	l := listenPort(s.conf.host, s.conf.port)
+	defer l.Close()
+	fmt.Println("Sentinel ID is", s.myID)
+	go s.timer()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			fmt.Println("sentinel.go/Accept(): error accepting connection: ", err.Error())
+			return
+		}
+		go s.handleConn(conn)
+	}
+}
+
+func (s *Sentinel) timer() {
+	ticker := time.NewTicker(sentinelTimerPeriod)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.mu.Lock()
+		for _, m := range s.masters {
+			s.handleMaster(m)
+		}
+		s.mu.Unlock()
+	}
+}
+
+// handleMaster monitors the master, its replicas and the other sentinels,
+// and drives the failover of the master
+func (s *Sentinel) handleMaster(m *sentinelMaster) {
+	s.handleInstance(m, m.sentinelInstance)
+	s.checkObjectivelyDown(m)
+	if s.startFailoverIfNeeded(m) {
+		s.askMasterState(m, true)
+	}
+	s.failoverStateMachine(m)
+	s.askMasterState(m, false)
+
+	for _, r := range m.replicas {
+		s.handleInstance(m, r)
+	}
+	for _, si := range m.sentinels {
+		s.handleInstance(m, si)
+	}
+	if m.failoverState == failoverUpdateConfig {
+		s.switchMaster(m, m.promoted.host, m.promoted.port)
+	}
+}
+
+func (s *Sentinel) handleInstance(m *sentinelMaster, inst *sentinelInstance) {
+	s.connectLinks(inst)
+	s.sendPeriodicCommands(m, inst)
+	s.checkSubjectivelyDown(m, inst)
+}
+
+// event logs an event and publishes it to the clients subscribed to the
+// channel named after it, like +sdown. The message describes inst followed
+// by extra, or is extra alone when inst is nil.
+func (s *Sentinel) event(typ string, m *sentinelMaster, inst *sentinelInstance, extra string) {
+	msg := extra
+	if inst != nil {
+		msg = fmt.Sprintf("%s %s %s %s", instKindNames[inst.kind], inst.name, inst.host, inst.port)
+		if inst.kind != instMaster {
+			msg += fmt.Sprintf(" @ %s %s %s", m.name, m.host, m.port)
+		}
+		if extra != "" {
+			msg += " " + extra
+		}
+	}
+	fmt.Println(typ, msg)
+	s.pubsub.Publish(typ, Value{vType: "bulk", bulk: msg})
+}
+
+// checkSubjectivelyDown flags inst down when it didn't answer a ping for
+// down-after, or, for a master, when it keeps reporting itself a replica
+func (s *Sentinel) checkSubjectivelyDown(m *sentinelMaster, inst *sentinelInstance) {
+	now := time.Now()
+	var elapsed time.Duration
+	if !inst.pingPending.IsZero() {
+		elapsed = now.Sub(inst.pingPending)
+	} else if inst.link == nil {
+		elapsed = now.Sub(inst.lastAvail)
+	}
+
+	// a link waiting long for a pong may be stuck, a new connection tells a
+	// busy server from a broken one
+	if l := inst.link; l != nil && !inst.pingPending.IsZero() &&
+		now.Sub(inst.pingPending) > m.downAfter/2 && now.Sub(inst.lastPong) > m.downAfter/2 {
+		l.conn.Close()
+	}
+	// the sentinel receives its own hello messages at least
+	if l := inst.pubsub; l != nil && now.Sub(l.lastRead) > 3*sentinelHelloPeriod {
+		l.conn.Close()
+	}
+
+	down := elapsed > m.downAfter ||
+		(inst.kind == instMaster && inst.role == "slave" && now.Sub(inst.roleReported) > m.downAfter+2*sentinelInfoPeriod)
+	if down && !inst.sdown {
+		inst.sdown, inst.sdownSince, inst.sdownChanged = true, now, now
+		s.event("+sdown", m, inst, "")
+	} else if !down && inst.sdown {
+		inst.sdown, inst.sdownChanged = false, now
+		s.event("-sdown", m, inst, "")
+	}
+}
+
+// noDownFor reports whether inst has been up for at least d
+func (inst *sentinelInstance) noDownFor(d time.Duration) bool {
+	return !inst.sdown && (inst.sdownChanged.IsZero() || time.Since(inst.sdownChanged) >= d)
+}
+
+// checkObjectivelyDown flags the master down when quorum sentinels, this one
+// included, consider it down
+func (s *Sentinel) checkObjectivelyDown(m *sentinelMaster) {
+	votes := 0
+	if m.sdown {
+		votes = 1
+		for _, si := range m.sentinels {
+			if si.masterDown {
+				votes++
+			}
+		}
+	}
+	odown := votes >= m.quorum
+	if odown && !m.odown {
+		m.odown, m.odownSince = true, time.Now()
+		s.event("+odown", m, m.sentinelInstance, fmt.Sprintf("#quorum %d/%d", votes, m.quorum))
+	} else if !odown && m.odown {
+		m.odown = false
+		s.event("-odown", m, m.sentinelInstance, "")
+	}
+}
+
+// askMasterState asks the other sentinels whether they consider the master
+// down, every sentinelAskPeriod or right away when forced. Once a failover
+// started the request also asks for their vote.
+func (s *Sentinel) askMasterState(m *sentinelMaster, force bool) {
+	for _, si := range m.sentinels {
+		if time.Since(si.masterDownReplied) > 5*sentinelAskPeriod {
+			si.masterDown = false
+			si.leader = ""
+		}
+		if !m.sdown || si.link == nil {
+			continue
+		}
+		if !force && time.Since(si.masterDownReplied) < sentinelAskPeriod {
+			continue
+		}
+		runID := "*"
+		if m.failoverState > failoverNone {
+			runID = s.myID
+		}
+		si.link.send(func(v Value) {
+			if v.vType != "array" || len(v.array) != 3 {
+				return
+			}
+			si.masterDownReplied = time.Now()
+			si.masterDown = v.array[0].num == 1
+			if leader := v.array[1].bulk; leader != "*" {
+				si.leader, si.leaderEpoch = leader, v.array[2].num
+			}
+		}, "SENTINEL", "is-master-down-by-addr", m.host, m.port, strconv.Itoa(s.currentEpoch), runID)
+	}
+}
+
+// voteLeader gives the vote of this sentinel for the leader of the failover
+// of epoch to runID, unless it already voted in that epoch. It returns the
+// leader voted for and the epoch of the vote.
+func (s *Sentinel) voteLeader(m *sentinelMaster, epoch int, runID string) (string, int) {
+	if epoch > s.currentEpoch {
+		s.currentEpoch = epoch
+		s.event("+new-epoch", m, nil, strconv.Itoa(epoch))
+	}
+	if m.leaderEpoch < epoch && s.currentEpoch <= epoch {
+		m.leader, m.leaderEpoch = runID, s.currentEpoch
+		s.event("+vote-for-leader", m, nil, fmt.Sprintf("%s %d", runID, m.leaderEpoch))
+		// let the voted sentinel fail the master over before trying
+		if runID != s.myID {
+			m.failoverStart = time.Now().Add(rand.N(sentinelMaxDesync))
+		}
+	}
+	return m.leader, m.leaderEpoch
+}
+
+// getLeader returns the sentinel elected to run the failover of epoch, the
+// one voted by a majority of the sentinels and at least quorum of them, or
+// "" when there is none yet. This sentinel votes for the leading candidate,
+// or for itself.
+func (s *Sentinel) getLeader(m *sentinelMaster, epoch int) string {
+	votes := make(map[string]int)
+	for _, si := range m.sentinels {
+		if si.leader != "" && si.leaderEpoch == s.currentEpoch {
+			votes[si.leader]++
+		}
+	}
+	winner, _ := mostVoted(votes)
+	if winner == "" {
+		winner = s.myID
+	}
+	if vote, voteEpoch := s.voteLeader(m, epoch, winner); voteEpoch == epoch {
+		votes[vote]++
+	}
+	winner, count := mostVoted(votes)
+	voters := len(m.sentinels) + 1
+	if count < voters/2+1 || count < m.quorum {
+		return ""
+	}
+	return winner
+}
+
+// mostVoted returns the candidate with the most votes, ties go to the lowest
+// run id so every sentinel picks the same one
+func mostVoted(votes map[string]int) (string, int) {
+	winner, most := "", 0
+	for candidate, n := range votes {
+		if n > most || (n == most && candidate < winner) {
+			winner, most = candidate, n
+		}
+	}
+	return winner, most
+}
+
+// startFailoverIfNeeded starts the failover of an objectively down master,
+// unless one was attempted within 2*failover-timeout
+func (s *Sentinel) startFailoverIfNeeded(m *sentinelMaster) bool {
+	if !m.odown || m.failoverState != failoverNone {
+		return false
+	}
+	if time.Since(m.failoverStart) < 2*m.failoverTimeout {
+		return false
+	}
+	s.startFailover(m)
+	return true
+}
+
+func (s *Sentinel) startFailover(m *sentinelMaster) {
+	s.currentEpoch++
+	m.failoverEpoch = s.currentEpoch
+	m.failoverState = failoverWaitStart
+	m.failoverStart = time.Now().Add(rand.N(sentinelMaxDesync))
+	m.failoverStateChanged = time.Now()
+	s.event("+new-epoch", m, nil, strconv.Itoa(s.currentEpoch))
+	s.event("+try-failover", m, m.sentinelInstance, "")
+}
+
+func (s *Sentinel) setFailoverState(m *sentinelMaster, state int, inst *sentinelInstance) {
+	m.failoverState = state
+	m.failoverStateChanged = time.Now()
+	s.event("+failover-state-"+strings.ReplaceAll(failoverStateNames[state], "_", "-"), m, inst, "")
+}
+
+func (s *Sentinel) abortFailover(m *sentinelMaster) {
+	m.failoverState = failoverNone
+	m.failoverStateChanged = time.Now()
+	m.forceFailover = false
+	m.promoted = nil
+	for _, r := range m.replicas {
+		r.reconf = reconfNone
+	}
+}
+
+func (s *Sentinel) failoverStateMachine(m *sentinelMaster) {
+	switch m.failoverState {
+	case failoverWaitStart:
+		s.failoverWaitStart(m)
+	case failoverSelectReplica:
+		s.failoverSelectReplica(m)
+	case failoverSendReplicaofNoOne:
+		s.failoverSendReplicaofNoOne(m)
+	case failoverWaitPromotion:
+		// the promotion is noticed by processInfo
+		if time.Since(m.failoverStateChanged) > m.failoverTimeout {
+			s.event("-failover-abort-slave-timeout", m, m.sentinelInstance, "")
+			s.abortFailover(m)
+		}
+	case failoverReconfReplicas:
+		s.failoverReconfReplicas(m)
+	}
+}
+
+// failoverWaitStart proceeds once this sentinel is elected leader of the
+// failover, and gives up when the election takes too long
+func (s *Sentinel) failoverWaitStart(m *sentinelMaster) {
+	leader := s.getLeader(m, m.failoverEpoch)
+	if leader != s.myID && !m.forceFailover {
+		if time.Since(m.failoverStateChanged) > min(sentinelElectionTimeout, m.failoverTimeout) {
+			s.event("-failover-abort-not-elected", m, m.sentinelInstance, "")
+			s.abortFailover(m)
+		}
+		return
+	}
+	s.event("+elected-leader", m, m.sentinelInstance, "")
+	s.setFailoverState(m, failoverSelectReplica, m.sentinelInstance)
+}
+
+func (s *Sentinel) failoverSelectReplica(m *sentinelMaster) {
+	r := s.selectReplica(m)
+	if r == nil {
+		s.event("-failover-abort-no-good-slave", m, m.sentinelInstance, "")
+		s.abortFailover(m)
+		return
+	}
+	s.event("+selected-slave", m, r, "")
+	m.promoted = r
+	s.setFailoverState(m, failoverSendReplicaofNoOne, r)
+}
+
+func (s *Sentinel) failoverSendReplicaofNoOne(m *sentinelMaster) {
+	if m.promoted.link == nil {
+		if time.Since(m.failoverStateChanged) > m.failoverTimeout {
+			s.event("-failover-abort-slave-timeout", m, m.sentinelInstance, "")
+			s.abortFailover(m)
+		}
+		return
+	}
+	m.promoted.link.send(nil, "REPLICAOF", "NO", "ONE")
+	s.setFailoverState(m, failoverWaitPromotion, m.promoted)
+}
+
+// selectReplica picks the replica to promote among those that are up, were
+// recently refreshed and lost their master not too long before it went
+// down: the lowest priority, then the most data, then the lowest run id
+func (s *Sentinel) selectReplica(m *sentinelMaster) *sentinelInstance {
+	maxLinkDown := 10 * m.downAfter
+	if m.sdown {
+		maxLinkDown += time.Since(m.sdownSince)
+	}
+	infoValidity := 3 * sentinelInfoPeriod
+	if m.sdown {
+		infoValidity = 5 * sentinelPingPeriod
+	}
+	var candidates []*sentinelInstance
+	for _, r := range m.replicas {
+		if r.sdown || r.link == nil || r.priority == 0 ||
+			time.Since(r.lastAvail) > 5*sentinelPingPeriod ||
+			time.Since(r.infoRefresh) > infoValidity ||
+			r.masterLinkDownSince > maxLinkDown {
+			continue
+		}
+		candidates = append(candidates, r)
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	slices.SortFunc(candidates, func(a, b *sentinelInstance) int {
+		if a.priority != b.priority {
+			return a.priority - b.priority
+		}
+		if a.replOffset != b.replOffset {
+			return b.replOffset - a.replOffset
+		}
+		// replicas that didn't report a run id come last
+		if (a.runID == "") != (b.runID == "") {
+			return boolToInt(a.runID == "") - boolToInt(b.runID == "")
+		}
+		return strings.Compare(a.runID, b.runID)
+	})
+	return candidates[0]
+}
+
+// failoverPromoted moves on once the selected replica reports it is a master,
+// the new configuration is announced to the other sentinels right away
+func (s *Sentinel) failoverPromoted(m *sentinelMaster) {
+	m.configEpoch = m.failoverEpoch
+	s.event("+promoted-slave", m, m.promoted, "")
+	s.setFailoverState(m, failoverReconfReplicas, m.sentinelInstance)
+	m.lastHelloSent = time.Time{}
+	for _, r := range m.replicas {
+		r.lastHelloSent = time.Time{}
+	}
+}
+
+// failoverReconfReplicas points the replicas to the promoted one,
+// parallel-syncs at a time, until all of them follow it or the failover
+// times out
+func (s *Sentinel) failoverReconfReplicas(m *sentinelMaster) {
+	inProgress := 0
+	for _, r := range m.replicas {
+		if r.reconf == reconfSent || r.reconf == reconfInProg {
+			inProgress++
+		}
+	}
+	for _, r := range sortedInstances(m.replicas) {
+		if inProgress >= m.parallelSyncs {
+			break
+		}
+		if r == m.promoted || r.reconf == reconfDone {
+			continue
+		}
+		// a replica not moving forward is considered reconfigured anyway
+		if r.reconf == reconfSent && time.Since(r.reconfSentAt) > m.failoverTimeout {
+			s.event("-slave-reconf-sent-timeout", m, r, "")
+			r.reconf = reconfDone
+			inProgress--
+			continue
+		}
+		if r.reconf != reconfNone || r.link == nil {
+			continue
+		}
+		r.link.send(nil, "REPLICAOF", m.promoted.host, m.promoted.port)
+		r.reconf, r.reconfSentAt = reconfSent, time.Now()
+		s.event("+slave-reconf-sent", m, r, "")
+		inProgress++
+	}
+
+	timeout := time.Since(m.failoverStateChanged) > m.failoverTimeout
+	pending := 0
+	for _, r := range m.replicas {
+		if r != m.promoted && r.reconf != reconfDone && !r.sdown {
+			pending++
+		}
+	}
+	if pending > 0 && !timeout {
+		return
+	}
+	if timeout {
+		s.event("+failover-end-for-timeout", m, m.sentinelInstance, "")
+		// the replicas left get the new master anyway, they may sync later
+		for _, r := range m.replicas {
+			if r != m.promoted && r.reconf == reconfNone && r.link != nil {
+				r.link.send(nil, "REPLICAOF", m.promoted.host, m.promoted.port)
+				s.event("+slave-reconf-sent-be", m, r, "")
+			}
+		}
+	}
+	s.event("+failover-end", m, m.sentinelInstance, "")
+	m.failoverState = failoverUpdateConfig
+	m.failoverStateChanged = time.Now()
+}
+
+// switchMaster moves the master to host:port. The former master and the
+// other replicas become its replicas, they are pointed to it once they
+// report a different configuration.
+func (s *Sentinel) switchMaster(m *sentinelMaster, host, port string) {
+	s.event("+switch-master", m, nil, fmt.Sprintf("%s %s %s %s %s", m.name, m.host, m.port, host, port))
+	var addrs [][2]string
+	for _, r := range sortedInstances(m.replicas) {
+		if r.host != host || r.port != port {
+			addrs = append(addrs, [2]string{r.host, r.port})
+		}
+		s.removeInstance(r)
+	}
+	if m.host != host || m.port != port {
+		addrs = append(addrs, [2]string{m.host, m.port})
+	}
+	s.removeInstance(m.sentinelInstance)
+
+	m.sentinelInstance = newSentinelInstance(instMaster, m.name, host, port)
+	m.replicas = make(map[string]*sentinelInstance)
+	m.odown = false
+	m.failoverState = failoverNone
+	m.failoverStart = time.Time{}
+	m.failoverStateChanged = time.Now()
+	m.forceFailover = false
+	m.promoted = nil
+	for _, si := range m.sentinels {
+		si.masterDown = false
+		si.leader = ""
+	}
+	for _, addr := range addrs {
+		s.addReplica(m, addr[0], addr[1])
+	}
+}
+
+// addReplica returns the replica at host:port, added when it is new
+func (s *Sentinel) addReplica(m *sentinelMaster, host, port string) *sentinelInstance {
+	addr := net.JoinHostPort(host, port)
+	if r, ok := m.replicas[addr]; ok {
+		return r
+	}
+	r := newSentinelInstance(instReplica, addr, host, port)
+	m.replicas[addr] = r
+	s.event("+slave", m, r, "")
+	return r
+}
+
+// removeInstance closes the links of an instance dropped from the
+// configuration
+func (s *Sentinel) removeInstance(inst *sentinelInstance) {
+	inst.removed = true
+	if inst.link != nil {
+		inst.link.conn.Close()
+	}
+	if inst.pubsub != nil {
+		inst.pubsub.conn.Close()
+	}
+}
+
+// currentMasterAddr is the address announced for the master, the promoted
+// replica once a failover reached the reconfiguration of the replicas
+func (m *sentinelMaster) currentMasterAddr() (string, string) {
+	if m.promoted != nil && m.failoverState >= failoverReconfReplicas {
+		return m.promoted.host, m.promoted.port
+	}
+	return m.host, m.port
+}
+
+// sane reports whether the master is up and confirmed to be a master, the
+// sentinel only fixes the configuration of its replicas then
+func (m *sentinelMaster) sane() bool {
+	return m.failoverState == failoverNone && m.role == "master" && !m.sdown && !m.odown &&
+		time.Since(m.infoRefresh) < 2*sentinelInfoPeriod
+}
+
+// sortedInstances returns the instances ordered by name
+func sortedInstances(instances map[string]*sentinelInstance) []*sentinelInstance {
+	sorted := make([]*sentinelInstance, 0, len(instances))
+	for _, inst := range instances {
+		sorted = append(sorted, inst)
+	}
+	slices.SortFunc(sorted, func(a, b *sentinelInstance) int {
+		return strings.Compare(a.name, b.name)
+	})
+	return sorted
+}
@@ -4,31 +4,169 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
 func main() {
-	fmt.Println("Logs from your program will appear here!")
-
+	conf := new(ServerConfig)
 	rdbConf := new(RDBconfig)
+	aofConf := new(AOFconfig)
 	replConf := new(ReplicationConfig)
+	clusterConf := new(ClusterConfig)
 
-	dir := flag.String("dir", "", "directory for rdb file")
-	dbfilename := flag.String("dbfilename", "", "rdb file name")
+	dir := flag.String("dir", ".", "directory for rdb file")
+	dbfilename := flag.String("dbfilename", "dump.rdb", "rdb file name")
+	save := flag.String("save", "3600 1 300 100 60 10000", "save points as '<seconds> <changes> ...', empty to disable, the default only applies with dir or dbfilename")
 	host := flag.String("host", "0.0.0.0", "server host addr")
 	port := flag.String("port", "6379", "server port")
 	replicaof := flag.String("replicaof", "", "command to signal that current server stated as a replica")
+	databases := flag.Int("databases", 16, "number of databases")
+	appendonly := flag.String("appendonly", "no", "log every write command to the append only file, yes or no")
+	appendfilename := flag.String("appendfilename", "appendonly.aof", "append only file name")
+	appenddirname := flag.String("appenddirname", "appendonlydir", "directory of the append only files, inside dir")
+	appendfsync := flag.String("appendfsync", aofFsyncEverySec, "fsync policy of the append only file: always, everysec or no")
+	aofLoadTruncated := flag.String("aof-load-truncated", "yes", "load the append only file cut short at the end, yes or no")
+	aofUseRDBPreamble := flag.String("aof-use-rdb-preamble", "yes", "write the base file of the rewritten append only file in RDB format, yes or no")
+	autoAOFRewritePercentage := flag.Int("auto-aof-rewrite-percentage", 100, "rewrite the append only file when it grows by this percentage, 0 disables it")
+	autoAOFRewriteMinSize := flag.String("auto-aof-rewrite-min-size", "64mb", "minimum size of the append only file to rewrite automatically")
+	checkRDBfile := flag.String("check-rdb", "", "check the rdb file, print its statistics and exit")
+	rdbToJSONfile := flag.String("rdb-to-json", "", "print keys of the rdb file as JSON lines and exit")
+	jsonToRDBfile := flag.String("json-to-rdb", "", "convert JSON lines written by --rdb-to-json to an rdb file printed to stdout and exit")
+	replDisklessSync := flag.String("repl-diskless-sync", "yes", "send the snapshot to replicas over the socket without saving it to disk, yes or no")
+	replDisklessSyncDelay := flag.Int("repl-diskless-sync-delay", 5, "seconds to wait for more replicas before a diskless transfer")
+	replDisklessLoad := flag.String("repl-diskless-load", replLoadDisabled, "load the snapshot from the master without saving it to disk: disabled, on-empty-db or swapdb")
+	replBacklogSize := flag.String("repl-backlog-size", "1mb", "size of the replication backlog used for partial resyncs")
+	replBacklogTTL := flag.Int("repl-backlog-ttl", 3600, "seconds after the last replica disconnects to free the backlog, 0 never")
+	replPingReplicaPeriod := flag.Int("repl-ping-replica-period", 10, "seconds between pings of the master to its replicas")
+	replTimeout := flag.Int("repl-timeout", 60, "seconds without data after which the link between master and replica is dropped")
+	minReplicasToWrite := flag.Int("min-replicas-to-write", 0, "refuse writes with fewer good replicas connected, 0 disables it")
+	minReplicasMaxLag := flag.Int("min-replicas-max-lag", 10, "seconds since the last acknowledgement for a replica to be good")
+	replicaReadOnly := flag.String("replica-read-only", "yes", "a replica refuses write commands from its clients, yes or no")
+	rdbToRESPfile := flag.String("rdb-to-resp", "", "print commands recreating keys of the rdb file and exit")
+	sentinelMode := flag.Bool("sentinel", false, "run as a sentinel monitoring masters and failing them over")
+	sentinelMonitor := flag.String("sentinel-monitor", "", "master monitored by the sentinel as '<name> <ip> <port> <quorum>'")
+	sentinelDownAfter := flag.Int("sentinel-down-after-milliseconds", 30000, "milliseconds without a valid reply after which the sentinel considers an instance down")
+	sentinelFailoverTimeout := flag.Int("sentinel-failover-timeout", 180000, "milliseconds a failover may take, retried after twice as long")
+	sentinelParallelSyncs := flag.Int("sentinel-parallel-syncs", 1, "replicas pointed to the new master at once after a failover")
+	clusterEnabled := flag.String("cluster-enabled", "no", "run as a node of a cluster serving a part of the hash slots, yes or no")
+	clusterConfigFile := flag.String("cluster-config-file", "nodes.conf", "file in dir where the node keeps the cluster configuration")
+	clusterNodeTimeout := flag.Int("cluster-node-timeout", 15000, "milliseconds without a reply after which a node is considered failing")
+	clusterPort := flag.Int("cluster-port", 0, "port of the cluster bus, 0 for the port plus 10000")
 
 	flag.Parse()
 
+	if *checkRDBfile != "" {
+		if err := checkRDB(*checkRDBfile, os.Stdout); err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if *rdbToJSONfile != "" {
+		os.Exit(runRDBConversion(rdbToJSON, *rdbToJSONfile))
+	}
+	if *jsonToRDBfile != "" {
+		os.Exit(runRDBConversion(jsonToRDB, *jsonToRDBfile))
+	}
+	if *rdbToRESPfile != "" {
+		os.Exit(runRDBConversion(rdbToRESP, *rdbToRESPfile))
+	}
+
+	fmt.Println("Logs from your program will appear here!")
+
+	if *sentinelMode {
+		sentinelConf := &SentinelConfig{
+			host:            *host,
+			port:            *port,
+			downAfter:       time.Duration(*sentinelDownAfter) * time.Millisecond,
+			failoverTimeout: time.Duration(*sentinelFailoverTimeout) * time.Millisecond,
+			parallelSyncs:   max(*sentinelParallelSyncs, 1),
+		}
+		if !flagSet("port") {
+			sentinelConf.port = sentinelDefaultPort
+		}
+		s := NewSentinel(sentinelConf)
+		if *sentinelMonitor != "" {
+			f := strings.Fields(*sentinelMonitor)
+			quorum := 0
+			if len(f) == 4 {
+				quorum, _ = strconv.Atoi(f[3])
+			}
+			if len(f) != 4 || quorum <= 0 {
+				fmt.Println("server.go: sentinel-monitor must be '<name> <ip> <port> <quorum>'")
+				os.Exit(1)
+			}
+			if err := s.monitor(f[0], f[1], f[2], quorum); err != nil {
+				fmt.Println("server.go: sentinel-monitor:", err)
+				os.Exit(1)
+			}
+		}
+		s.serve()
+		os.Exit(1)
+	}
+
+	conf.databases = *databases
+	if conf.databases < 1 {
+		fmt.Println("server.go: databases must be at least 1")
+		os.Exit(1)
+	}
 	rdbConf.dir = *dir
 	rdbConf.dbfilename = *dbfilename
+	// the RDB file is only loaded and saved automatically when its location
+	// is given, a bare start keeps the dataset in memory
+	rdbConf.load = flagSet("dir") || flagSet("dbfilename")
+	saveParams, err := parseSaveParams(*save)
+	if err != nil {
+		fmt.Println("server.go:", err)
+		os.Exit(1)
+	}
+	if rdbConf.load || flagSet("save") {
+		rdbConf.save = saveParams
+	}
+	aofConf.enabled = *appendonly == "yes"
+	aofConf.filename = *appendfilename
+	aofConf.fsync = *appendfsync
+	aofConf.loadTruncated = *aofLoadTruncated == "yes"
+	aofConf.dirname = *appenddirname
+	aofConf.useRDBPreamble = *aofUseRDBPreamble == "yes"
+	aofConf.rewritePercentage = *autoAOFRewritePercentage
+	if aofConf.rewriteMinSize, err = parseMemorySize(*autoAOFRewriteMinSize); err != nil {
+		fmt.Println("server.go: auto-aof-rewrite-min-size:", err)
+		os.Exit(1)
+	}
+	if aofConf.fsync != aofFsyncAlways && aofConf.fsync != aofFsyncEverySec && aofConf.fsync != aofFsyncNo {
+		fmt.Println("server.go: appendfsync must be always, everysec or no")
+		os.Exit(1)
+	}
 	replConf.host = *host
+	replConf.disklessSync = *replDisklessSync == "yes"
+	replConf.disklessSyncDelay = time.Duration(*replDisklessSyncDelay) * time.Second
+	replConf.disklessLoad = *replDisklessLoad
+	if replConf.disklessLoad != replLoadDisabled && replConf.disklessLoad != replLoadOnEmptyDB && replConf.disklessLoad != replLoadSwapDB {
+		fmt.Println("server.go: repl-diskless-load must be disabled, on-empty-db or swapdb")
+		os.Exit(1)
+	}
+	backlogSize, err := parseMemorySize(*replBacklogSize)
+	if err != nil {
+		fmt.Println("server.go: repl-backlog-size:", err)
+		os.Exit(1)
+	}
+	replConf.backlogSize = max(int(backlogSize), minBacklogSize)
+	replConf.backlogTTL = time.Duration(*replBacklogTTL) * time.Second
+	replConf.readOnly = *replicaReadOnly == "yes"
+	replConf.pingPeriod = time.Duration(*replPingReplicaPeriod) * time.Second
+	replConf.timeout = time.Duration(*replTimeout) * time.Second
+	replConf.minReplicas = *minReplicasToWrite
+	replConf.minReplicasMaxLag = time.Duration(*minReplicasMaxLag) * time.Second
+	replConf.replication.master_replid2 = noReplID
+	replConf.replication.second_repl_offset = -1
 	replConf.port = *port
 	if *replicaof == "" {
 		replConf.replication.role = "master"
-		//TODO make random alphanumeric string of 40 characters
-		replConf.replication.master_replid = "8371b4fb1155b71f4a04d3e1bc3e18c4a990aeeb"
+		replConf.replication.master_replid = randomHex(20)
 		replConf.replication.master_repl_offset = 0
 
 	} else {
@@ -38,24 +176,61 @@ func main() {
 		replConf.replication.master_port = addr[1]
 	}
 
-	r := NewRedis(rdbConf, replConf)
+	clusterConf.enabled = *clusterEnabled == "yes"
+	clusterConf.configFile = *clusterConfigFile
+	clusterConf.nodeTimeout = time.Duration(*clusterNodeTimeout) * time.Millisecond
+	clusterConf.port = strconv.Itoa(*clusterPort)
+	if clusterConf.enabled && *clusterPort == 0 {
+		p, err := strconv.Atoi(*port)
+		if err != nil || p+10000 > 65535 {
+			fmt.Println("server.go: cluster-port must be given for port", *port)
+			os.Exit(1)
+		}
+		clusterConf.port = strconv.Itoa(p + 10000)
+	}
+	if clusterConf.enabled && *replicaof != "" {
+		fmt.Println("server.go: replicaof is not allowed in cluster mode")
+		os.Exit(1)
+	}
+
+	r, err := NewRedis(conf, rdbConf, aofConf, replConf, clusterConf)
+	if err != nil {
+		fmt.Println("server.go:", err)
+		os.Exit(1)
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-sig
+		r.Shutdown()
+		os.Exit(0)
+	}()
 	l := r.ListenPort()
 	defer l.Close()
+	if cl := r.commandHandler.cluster; cl != nil {
+		go cl.serve(listenPort(*host, cl.conf.port))
+	}
 
+	if r.replConf.replication.role == "slave" {
+		r.setMaster(r.replConf.replication.master_host, r.replConf.replication.master_port)
+	}
 	for {
-		if r.replConf.replication.role == "slave" {
-			masterConn, rd, err := r.Handshake()
-			if err != nil {
-				fmt.Println("server.go/Handshake(): error from Handshake func", err.Error())
-				//TODO try to os.Exit on err
-			}
-			go r.handleConn(masterConn, rd)
-		}
 		conn, err := l.Accept()
 		if err != nil {
 			fmt.Println("server.go/Accept(): error accepting connection: ", err.Error())
 			os.Exit(1)
 		}
-		go r.handleConn(conn, nil)
+		go r.handleConn(conn)
 	}
 }
+
+// flagSet reports whether the flag was given on the command line
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
@@ -0,0 +1,205 @@
+package main
+
+import "strconv"
+
+func (ch *CommandHandler) sadd(c *Client, v Value) []byte {
+	var repl Value
+	if len(v.array) < 3 {
+		return wrongArgsError("sadd")
+	}
+	key := v.array[1].bulk
+
+	ch.mu.Lock()
+	set, err := ch.lookupOrCreate(c.db, key, "set")
+	if err != nil {
+		ch.mu.Unlock()
+		return repl.Error(err.Error())
+	}
+	added := 0
+	for _, member := range v.array[2:] {
+		if set.set.Set(member.bulk, struct{}{}) {
+			added++
+		}
+	}
+	ch.mu.Unlock()
+
+	ch.signalModifiedKey(c, key)
+	repl.vType = "num"
+	repl.num = added
+	return repl.Unmarshal()
+}
+
+func (ch *CommandHandler) srem(c *Client, v Value) []byte {
+	var repl Value
+	if len(v.array) < 3 {
+		return wrongArgsError("srem")
+	}
+	key := v.array[1].bulk
+
+	ch.mu.Lock()
+	set, ok, err := ch.lookupWrite(c.db, key, "set")
+	if err != nil {
+		ch.mu.Unlock()
+		return repl.Error(err.Error())
+	}
+	removed := 0
+	if ok {
+		for _, member := range v.array[2:] {
+			if set.set.Delete(member.bulk) {
+				removed++
+			}
+		}
+		ch.deleteIfEmpty(c.db, key, set)
+	}
+	ch.mu.Unlock()
+
+	if removed > 0 {
+		ch.signalModifiedKey(c, key)
+	}
+	repl.vType = "num"
+	repl.num = removed
+	return repl.Unmarshal()
+}
+
+// spop removes random members of the set. They are propagated as SREM of the
+// members picked, replicas would pick others.
+func (ch *CommandHandler) spop(c *Client, v Value) []byte {
+	var repl Value
+	if len(v.array) > 3 {
+		return repl.Error("ERR syntax error")
+	}
+	key := v.array[1].bulk
+	count := 1
+	if len(v.array) == 3 {
+		n, err := strconv.Atoi(v.array[2].bulk)
+		if err != nil || n < 0 {
+			return repl.Error("ERR value is out of range, must be positive")
+		}
+		count = n
+	}
+
+	ch.mu.Lock()
+	set, ok, err := ch.lookupWrite(c.db, key, "set")
+	if err != nil {
+		ch.mu.Unlock()
+		return repl.Error(err.Error())
+	}
+	var popped []string
+	if ok {
+		for len(popped) < count {
+			member, found := set.set.RandomKey()
+			if !found {
+				break
+			}
+			set.set.Delete(member)
+			popped = append(popped, member)
+		}
+		ch.deleteIfEmpty(c.db, key, set)
+	}
+	ch.mu.Unlock()
+
+	if len(popped) > 0 {
+		ch.signalModifiedKey(c, key)
+		c.rewriteCommand(bulkArray(append([]string{"SREM", key}, popped...)))
+	} else {
+		c.rewriteCommand()
+	}
+	if len(v.array) == 2 {
+		if len(popped) == 0 {
+			repl.vType = "null"
+			return repl.Unmarshal()
+		}
+		repl.vType = "bulk"
+		repl.bulk = popped[0]
+		return repl.Unmarshal()
+	}
+	repl = bulkArray(popped)
+	return repl.Unmarshal()
+}
+
+func (ch *CommandHandler) sismember(c *Client, v Value) []byte {
+	var repl Value
+	if len(v.array) != 3 {
+		return wrongArgsError("sismember")
+	}
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+
+	ch.tracking.Read(c.id, v.array[1].bulk)
+	set, ok, err := ch.lookupTyped(c.db, v.array[1].bulk, "set")
+	if err != nil {
+		return repl.Error(err.Error())
+	}
+	repl.vType = "num"
+	if ok {
+		if _, exists := set.set.Get(v.array[2].bulk); exists {
+			repl.num = 1
+		}
+	}
+	return repl.Unmarshal()
+}
+
+func (ch *CommandHandler) scard(c *Client, v Value) []byte {
+	var repl Value
+	if len(v.array) != 2 {
+		return wrongArgsError("scard")
+	}
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+
+	ch.tracking.Read(c.id, v.array[1].bulk)
+	set, ok, err := ch.lookupTyped(c.db, v.array[1].bulk, "set")
+	if err != nil {
+		return repl.Error(err.Error())
+	}
+	repl.vType = "num"
+	if ok {
+		repl.num = set.set.Len()
+	}
+	return repl.Unmarshal()
+}
+
+func (ch *CommandHandler) smembers(c *Client, v Value) []byte {
+	var repl Value
+	if len(v.array) != 2 {
+		return wrongArgsError("smembers")
+	}
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+
+	ch.tracking.Read(c.id, v.array[1].bulk)
+	set, ok, err := ch.lookupTyped(c.db, v.array[1].bulk, "set")
+	if err != nil {
+		return repl.Error(err.Error())
+	}
+	repl.vType = "array"
+	if ok {
+		set.set.Range(func(member string, _ struct{}) bool {
+			repl.array = append(repl.array, Value{vType: "bulk", bulk: member})
+			return true
+		})
+	}
+	return repl.Unmarshal()
+}
+
+func (ch *CommandHandler) sscan(c *Client, v Value) []byte {
+	var repl Value
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+
+	set, ok, cursor, opts, err := ch.scanCollection(c, v, "set")
+	if err != nil {
+		return repl.Error(err.Error())
+	}
+	ch.tracking.Read(c.id, v.array[1].bulk)
+	if !ok {
+		return scanReply(0, nil)
+	}
+	var items []Value
+	cursor = scanDict(set.set, cursor, opts.count, func(member string, _ struct{}) {
+		if opts.matches(member) {
+			items = append(items, Value{vType: "bulk", bulk: member})
+		}
+	})
+	return scanReply(cursor, items)
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errInvalidStreamID = errors.New("ERR Invalid stream ID specified as stream command argument")
+
+type streamID struct {
+	ms  uint64
+	seq uint64
+}
+
+func (id streamID) String() string {
+	return fmt.Sprintf("%d-%d", id.ms, id.seq)
+}
+
+func (id streamID) less(o streamID) bool {
+	return id.ms < o.ms || (id.ms == o.ms && id.seq < o.seq)
+}
+
+// parseStreamID parses "<ms>-<seq>" or "<ms>", in which case seq is missingSeq
+func parseStreamID(s string, missingSeq uint64) (streamID, error) {
+	msPart, seqPart, hasSeq := strings.Cut(s, "-")
+	ms, err := strconv.ParseUint(msPart, 10, 64)
+	if err != nil {
+		return streamID{}, errInvalidStreamID
+	}
+	if !hasSeq {
+		return streamID{ms: ms, seq: missingSeq}, nil
+	}
+	seq, err := strconv.ParseUint(seqPart, 10, 64)
+	if err != nil {
+		return streamID{}, errInvalidStreamID
+	}
+	return streamID{ms: ms, seq: seq}, nil
+}
+
+type streamEntry struct {
+	id     streamID
+	fields []string // field value pairs
+}
+
+// streamPending is an entry delivered to a consumer of a group but not acknowledged yet
+type streamPending struct {
+	id            streamID
+	consumer      string
+	deliveryTime  int64 // unix time in milliseconds
+	deliveryCount uint64
+}
+
+type streamConsumer struct {
+	name       string
+	seenTime   int64 // unix time in milliseconds
+	activeTime int64
+	pending    []streamID
+}
+
+type streamGroup struct {
+	name        string
+	lastID      streamID
+	entriesRead int64 // -1 when not known
+	pending     []streamPending
+	consumers   []streamConsumer
+}
+
+// stream keeps entries ordered by ID. Consumer groups are only kept so they
+// survive a load and save of the dump.
+type stream struct {
+	entries      []streamEntry
+	lastID       streamID
+	maxDeletedID streamID
+	entriesAdded uint64 // all entries ever added, including deleted ones
+	groups       []*streamGroup
+}
+
+func newStream() *stream {
+	return &stream{}
+}
+
+func (s *stream) clone() *stream {
+	c := *s
+	c.entries = append([]streamEntry(nil), s.entries...)
+	c.groups = make([]*streamGroup, len(s.groups))
+	for i, g := range s.groups {
+		cg := *g
+		cg.pending = append([]streamPending(nil), g.pending...)
+		cg.consumers = make([]streamConsumer, len(g.consumers))
+		for j, consumer := range g.consumers {
+			consumer.pending = append([]streamID(nil), consumer.pending...)
+			cg.consumers[j] = consumer
+		}
+		c.groups[i] = &cg
+	}
+	return &c
+}
+
+func (s *stream) Len() int {
+	return len(s.entries)
+}
+
+// firstID returns ID of the first entry, zero ID if the stream is empty
+func (s *stream) firstID() streamID {
+	if len(s.entries) == 0 {
+		return streamID{}
+	}
+	return s.entries[0].id
+}
+
+// nextStreamID returns ID for a new entry after top, ms of the explicit ID or the current time
+func nextStreamID(top streamID, ms uint64, explicitMs bool) (streamID, error) {
+	if !explicitMs {
+		ms = max(uint64(time.Now().UnixMilli()), top.ms)
+	}
+	if ms < top.ms {
+		return streamID{}, fmt.Errorf("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+	}
+	if ms > top.ms {
+		return streamID{ms: ms}, nil
+	}
+	if top.seq == math.MaxUint64 {
+		return streamID{}, fmt.Errorf("ERR The stream has exhausted the last possible ID, unable to add more items")
+	}
+	return streamID{ms: ms, seq: top.seq + 1}, nil
+}
+
+// Add appends entry, its ID must be greater than the last one
+func (s *stream) Add(id streamID, fields []string) {
+	s.entries = append(s.entries, streamEntry{id: id, fields: fields})
+	s.lastID = id
+	s.entriesAdded++
+}
+
+// Range returns up to count entries with IDs between start and end inclusive, count 0 means all
+func (s *stream) Range(start, end streamID, count int) []streamEntry {
+	i := sort.Search(len(s.entries), func(i int) bool {
+		return !s.entries[i].id.less(start)
+	})
+	var entries []streamEntry
+	for ; i < len(s.entries) && !end.less(s.entries[i].id); i++ {
+		if count > 0 && len(entries) == count {
+			break
+		}
+		entries = append(entries, s.entries[i])
+	}
+	return entries
+}
+
+func (ch *CommandHandler) xadd(c *Client, v Value) []byte {
+	var repl Value
+	if len(v.array) < 5 {
+		return wrongArgsError("xadd")
+	}
+	key := v.array[1].bulk
+	args := v.array[2:]
+	noMkStream := strings.ToLower(args[0].bulk) == "nomkstream"
+	if noMkStream {
+		args = args[1:]
+	}
+	if len(args) < 3 || len(args)%2 != 1 {
+		return wrongArgsError("xadd")
+	}
+
+	idArg := args[0].bulk
+	var explicit streamID
+	explicitMs, explicitSeq := false, false
+	if idArg != "*" {
+		msPart, seqPart, _ := strings.Cut(idArg, "-")
+		var err error
+		if seqPart == "*" {
+			explicit, err = parseStreamID(msPart, 0)
+		} else {
+			explicit, err = parseStreamID(idArg, 0)
+			explicitSeq = true
+		}
+		if err != nil {
+			return repl.Error(err.Error())
+		}
+		explicitMs = true
+		if explicitSeq && explicit == (streamID{}) {
+			return repl.Error("ERR The ID specified in XADD must be greater than 0-0")
+		}
+	}
+	fields := make([]string, 0, len(args)-1)
+	for _, arg := range args[1:] {
+		fields = append(fields, arg.bulk)
+	}
+
+	ch.mu.Lock()
+	s, ok, err := ch.lookupWrite(c.db, key, "stream")
+	if err != nil {
+		ch.mu.Unlock()
+		return repl.Error(err.Error())
+	}
+	if !ok && noMkStream {
+		ch.mu.Unlock()
+		repl.vType = "null"
+		return repl.Unmarshal()
+	}
+	// the ID is checked before creating the key, empty streams are not deleted
+	top := streamID{}
+	if ok {
+		top = s.stream.lastID
+	}
+	id := explicit
+	if explicitSeq {
+		if !top.less(id) {
+			err = fmt.Errorf("ERR The ID specified in XADD is equal or smaller than the target stream top item")
+		}
+	} else {
+		id, err = nextStreamID(top, explicit.ms, explicitMs)
+	}
+	if err != nil {
+		ch.mu.Unlock()
+		return repl.Error(err.Error())
+	}
+	if !ok {
+		s, _ = ch.lookupOrCreate(c.db, key, "stream")
+	}
+	s.stream.Add(id, fields)
+	ch.mu.Unlock()
+
+	ch.signalModifiedKey(c, key)
+	// replicas must add the entry with the ID generated here
+	if !explicitSeq {
+		argv := append([]Value(nil), v.array...)
+		argv[len(v.array)-len(args)] = Value{vType: "bulk", bulk: id.String()}
+		c.rewriteCommand(Value{vType: "array", array: argv})
+	}
+	repl.vType = "bulk"
+	repl.bulk = id.String()
+	return repl.Unmarshal()
+}
+
+func (ch *CommandHandler) xlen(c *Client, v Value) []byte {
+	var repl Value
+	if len(v.array) != 2 {
+		return wrongArgsError("xlen")
+	}
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+
+	ch.tracking.Read(c.id, v.array[1].bulk)
+	s, ok, err := ch.lookupTyped(c.db, v.array[1].bulk, "stream")
+	if err != nil {
+		return repl.Error(err.Error())
+	}
+	repl.vType = "num"
+	if ok {
+		repl.num = s.stream.Len()
+	}
+	return repl.Unmarshal()
+}
+
+func (ch *CommandHandler) xrange(c *Client, v Value) []byte {
+	var repl Value
+	if len(v.array) != 4 && len(v.array) != 6 {
+		return wrongArgsError("xrange")
+	}
+	start := streamID{}
+	if arg := v.array[2].bulk; arg != "-" {
+		id, err := parseStreamID(arg, 0)
+		if err != nil {
+			return repl.Error(err.Error())
+		}
+		start = id
+	}
+	end := streamID{ms: math.MaxUint64, seq: math.MaxUint64}
+	if arg := v.array[3].bulk; arg != "+" {
+		id, err := parseStreamID(arg, math.MaxUint64)
+		if err != nil {
+			return repl.Error(err.Error())
+		}
+		end = id
+	}
+	count := 0
+	if len(v.array) == 6 {
+		if strings.ToLower(v.array[4].bulk) != "count" {
+			return repl.Error("ERR syntax error")
+		}
+		n, err := strconv.Atoi(v.array[5].bulk)
+		if err != nil {
+			return repl.Error("ERR value is not an integer or out of range")
+		}
+		if n <= 0 {
+			repl.vType = "array"
+			return repl.Unmarshal()
+		}
+		count = n
+	}
+
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+
+	ch.tracking.Read(c.id, v.array[1].bulk)
+	s, ok, err := ch.lookupTyped(c.db, v.array[1].bulk, "stream")
+	if err != nil {
+		return repl.Error(err.Error())
+	}
+	repl.vType = "array"
+	if ok {
+		for _, e := range s.stream.Range(start, end, count) {
+			fields := Value{vType: "array"}
+			for _, f := range e.fields {
+				fields.array = append(fields.array, Value{vType: "bulk", bulk: f})
+			}
+			repl.array = append(repl.array, Value{vType: "array", array: []Value{
+				{vType: "bulk", bulk: e.id.String()},
+				fields,
+			}})
+		}
+	}
+	return repl.Unmarshal()
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// clients with RESP2 connection receive invalidation messages through this channel
+const invalidateChannel = "__redis__:invalidate"
+
+type trackingOptions struct {
+	redirect int64
+	bcast    bool
+	optin    bool
+	optout   bool
+	noloop   bool
+	prefixes []string
+	caching  string // "yes" or "no" set by CLIENT CACHING, applies only to the next command
+}
+
+// Tracking implements server assisted client side caching. In default mode it
+// remembers the keys read by every client, in BCAST mode it remembers prefixes
+// clients are interested in, and it reports who must be notified on key change.
+type Tracking struct {
+	mu       sync.Mutex
+	clients  map[int64]*trackingOptions
+	keys     map[string]map[int64]bool
+	prefixes map[string]map[int64]bool
+}
+
+// invalidation target, the message goes to redirect client if it is set
+type trackingTarget struct {
+	client   int64
+	redirect int64
+}
+
+func NewTracking() *Tracking {
+	return &Tracking{
+		clients:  make(map[int64]*trackingOptions),
+		keys:     make(map[string]map[int64]bool),
+		prefixes: make(map[string]map[int64]bool),
+	}
+}
+
+func (t *Tracking) Enable(id int64, opts trackingOptions) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	current, ok := t.clients[id]
+	if !ok {
+		current = &trackingOptions{bcast: opts.bcast}
+	}
+	if ok && current.bcast != opts.bcast {
+		return fmt.Errorf("ERR You can't switch BCAST mode on/off before disabling tracking for this client, and then re-enabling it with a different mode.")
+	}
+	all := append(append([]string(nil), current.prefixes...), opts.prefixes...)
+	for _, p := range opts.prefixes {
+		for _, existing := range all {
+			if p != existing && (strings.HasPrefix(p, existing) || strings.HasPrefix(existing, p)) {
+				return fmt.Errorf("ERR Prefix '%s' overlaps with an existing prefix '%s'. Prefixes for a single client must not overlap.", p, existing)
+			}
+		}
+	}
+	if opts.bcast && len(opts.prefixes) == 0 && len(current.prefixes) == 0 {
+		// BCAST without prefixes means every key
+		opts.prefixes = []string{""}
+	}
+	for _, p := range opts.prefixes {
+		if t.prefixes[p] == nil {
+			t.prefixes[p] = make(map[int64]bool)
+		}
+		if !t.prefixes[p][id] {
+			t.prefixes[p][id] = true
+			current.prefixes = append(current.prefixes, p)
+		}
+	}
+	current.redirect = opts.redirect
+	current.optin = opts.optin
+	current.optout = opts.optout
+	current.noloop = opts.noloop
+	current.caching = ""
+	t.clients[id] = current
+	return nil
+}
+
+// Disable turns tracking off, keys remembered for the client are dropped
+// lazily on the next invalidation
+func (t *Tracking) Disable(id int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	opts, ok := t.clients[id]
+	if !ok {
+		return
+	}
+	for _, p := range opts.prefixes {
+		delete(t.prefixes[p], id)
+		if len(t.prefixes[p]) == 0 {
+			delete(t.prefixes, p)
+		}
+	}
+	delete(t.clients, id)
+}
+
+// Clients returns the number of clients with tracking enabled
+func (t *Tracking) Clients() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.clients)
+}
+
+// Options returns a copy of client tracking options, ok is false if tracking is off
+func (t *Tracking) Options(id int64) (opts trackingOptions, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	current, ok := t.clients[id]
+	if !ok {
+		return opts, false
+	}
+	opts = *current
+	opts.prefixes = append([]string(nil), current.prefixes...)
+	return opts, true
+}
+
+func (t *Tracking) SetCaching(id int64, caching string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	opts, ok := t.clients[id]
+	if !ok || (!opts.optin && !opts.optout) {
+		return fmt.Errorf("ERR CLIENT CACHING can be called only when the client is in tracking mode with OPTIN or OPTOUT mode enabled")
+	}
+	if caching == "yes" && !opts.optin {
+		return fmt.Errorf("ERR CLIENT CACHING YES is only valid when tracking is enabled in OPTIN mode.")
+	}
+	if caching == "no" && !opts.optout {
+		return fmt.Errorf("ERR CLIENT CACHING NO is only valid when tracking is enabled in OPTOUT mode.")
+	}
+	opts.caching = caching
+	return nil
+}
+
+// ResetCaching forgets CLIENT CACHING once the command following it is executed
+func (t *Tracking) ResetCaching(id int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if opts, ok := t.clients[id]; ok {
+		opts.caching = ""
+	}
+}
+
+// Read remembers key read by the client tracking in default mode
+func (t *Tracking) Read(id int64, key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	opts, ok := t.clients[id]
+	if !ok || opts.bcast {
+		return
+	}
+	if opts.optin && opts.caching != "yes" {
+		return
+	}
+	if opts.optout && opts.caching == "no" {
+		return
+	}
+	if t.keys[key] == nil {
+		t.keys[key] = make(map[int64]bool)
+	}
+	t.keys[key][id] = true
+}
+
+// Invalidated returns clients that must be notified about modified key. The key
+// is forgotten for clients in default mode, they are notified only once.
+func (t *Tracking) Invalidated(key string, writer int64) []trackingTarget {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var targets []trackingTarget
+	notify := func(id int64) {
+		opts, ok := t.clients[id]
+		if !ok || (opts.noloop && id == writer) {
+			return
+		}
+		targets = append(targets, trackingTarget{client: id, redirect: opts.redirect})
+	}
+
+	for id := range t.keys[key] {
+		if opts, ok := t.clients[id]; ok && !opts.bcast {
+			notify(id)
+		}
+	}
+	delete(t.keys, key)
+
+	for p, ids := range t.prefixes {
+		if !strings.HasPrefix(key, p) {
+			continue
+		}
+		for id := range ids {
+			notify(id)
+		}
+	}
+	return targets
+}
+
+// Flushed returns every tracking client, all their cached keys must be discarded
+func (t *Tracking) Flushed() []trackingTarget {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var targets []trackingTarget
+	for id, opts := range t.clients {
+		targets = append(targets, trackingTarget{client: id, redirect: opts.redirect})
+	}
+	clear(t.keys)
+	return targets
+}
+
+// invalidateKey notifies clients tracking the key that it was modified by writer
+func (ch *CommandHandler) invalidateKey(writer *Client, key string) {
+	// keys expired by the server have no writer
+	var writerID int64
+	if writer != nil {
+		writerID = writer.id
+	}
+	keys := Value{vType: "array", array: []Value{{vType: "bulk", bulk: key}}}
+	for _, target := range ch.tracking.Invalidated(key, writerID) {
+		ch.sendInvalidation(target, keys)
+	}
+}
+
+// invalidateAll notifies every tracking client that the keyspace was flushed
+func (ch *CommandHandler) invalidateAll() {
+	for _, target := range ch.tracking.Flushed() {
+		ch.sendInvalidation(target, Value{vType: "null"})
+	}
+}
+
+func (ch *CommandHandler) sendInvalidation(target trackingTarget, keys Value) {
+	id := target.client
+	if target.redirect != 0 {
+		id = target.redirect
+	}
+	c := ch.getClient(id)
+	if c == nil {
+		// redirect client is gone, tell the tracking client its cache is not reliable anymore
+		if orig := ch.getClient(target.client); orig != nil && orig.Protocol() == 3 {
+			msg := Value{vType: "push", array: []Value{{vType: "bulk", bulk: "tracking-redir-broken"}, {vType: "num", num: int(id)}}}
+			orig.Push(msg.Unmarshal())
+		}
+		return
+	}
+	if c.Protocol() == 3 {
+		msg := Value{vType: "push", array: []Value{{vType: "bulk", bulk: "invalidate"}, keys}}
+		c.Push(msg.Unmarshal())
+		return
+	}
+	if ch.pubsub.IsSubscribed(c, invalidateChannel) {
+		c.Push(pubsubMessage(c, "message", Value{vType: "bulk", bulk: invalidateChannel}, keys))
+	}
+}
+
+func (ch *CommandHandler) clientTracking(c *Client, v Value) []byte {
+	var repl Value
+	if len(v.array) < 3 {
+		return repl.Error("ERR wrong number of arguments for 'client|tracking' command")
+	}
+	switch strings.ToLower(v.array[2].bulk) {
+	case "on":
+	case "off":
+		ch.tracking.Disable(c.id)
+		return repl.OK()
+	default:
+		return repl.Error("ERR syntax error")
+	}
+
+	var opts trackingOptions
+	args := v.array[3:]
+	for i := 0; i < len(args); i++ {
+		switch strings.ToLower(args[i].bulk) {
+		case "redirect":
+			if i+1 >= len(args) {
+				return repl.Error("ERR syntax error")
+			}
+			i++
+			id, err := strconv.ParseInt(args[i].bulk, 10, 64)
+			if err != nil {
+				return repl.Error("ERR value is not an integer or out of range")
+			}
+			if id == c.id {
+				return repl.Error("ERR You can't redirect tracking messages to the same client.")
+			}
+			if ch.getClient(id) == nil {
+				return repl.Error("ERR The client ID you want redirect to does not exist")
+			}
+			opts.redirect = id
+		case "prefix":
+			if i+1 >= len(args) {
+				return repl.Error("ERR syntax error")
+			}
+			i++
+			opts.prefixes = append(opts.prefixes, args[i].bulk)
+		case "bcast":
+			opts.bcast = true
+		case "optin":
+			opts.optin = true
+		case "optout":
+			opts.optout = true
+		case "noloop":
+			opts.noloop = true
+		default:
+			return repl.Error("ERR syntax error")
+		}
+	}
+
+	if len(opts.prefixes) > 0 && !opts.bcast {
+		return repl.Error("ERR PREFIX option requires BCAST mode to be enabled")
+	}
+	if opts.optin && opts.optout {
+		return repl.Error("ERR You can't use both OPTIN and OPTOUT")
+	}
+	if opts.bcast && (opts.optin || opts.optout) {
+		return repl.Error("ERR OPTIN and OPTOUT are not compatible with BCAST")
+	}
+	if err := ch.tracking.Enable(c.id, opts); err != nil {
+		return repl.Error(err.Error())
+	}
+	return repl.OK()
+}
+
+func (ch *CommandHandler) clientCaching(c *Client, v Value) []byte {
+	var repl Value
+	if len(v.array) != 3 {
+		return repl.Error("ERR wrong number of arguments for 'client|caching' command")
+	}
+	caching := strings.ToLower(v.array[2].bulk)
+	if caching != "yes" && caching != "no" {
+		return repl.Error("ERR syntax error")
+	}
+	if err := ch.tracking.SetCaching(c.id, caching); err != nil {
+		return repl.Error(err.Error())
+	}
+	return repl.OK()
+}
+
+func (ch *CommandHandler) clientGetredir(c *Client) []byte {
+	repl := Value{vType: "num", num: -1}
+	if opts, ok := ch.tracking.Options(c.id); ok {
+		repl.num = int(opts.redirect)
+	}
+	return repl.Unmarshal()
+}
+
+func (ch *CommandHandler) clientTrackingInfo(c *Client) []byte {
+	flags := Value{vType: "array"}
+	redirect := Value{vType: "num", num: -1}
+	prefixes := Value{vType: "array"}
+
+	opts, ok := ch.tracking.Options(c.id)
+	if !ok {
+		flags.array = append(flags.array, Value{vType: "bulk", bulk: "off"})
+	} else {
+		flags.array = append(flags.array, Value{vType: "bulk", bulk: "on"})
+		flagSet := []struct {
+			name string
+			set  bool
+		}{
+			{"bcast", opts.bcast},
+			{"optin", opts.optin},
+			{"optout", opts.optout},
+			{"caching-yes", opts.caching == "yes"},
+			{"caching-no", opts.caching == "no"},
+			{"noloop", opts.noloop},
+			{"broken_redirect", opts.redirect != 0 && ch.getClient(opts.redirect) == nil},
+		}
+		for _, f := range flagSet {
+			if f.set {
+				flags.array = append(flags.array, Value{vType: "bulk", bulk: f.name})
+			}
+		}
+		redirect.num = int(opts.redirect)
+		for _, p := range opts.prefixes {
+			prefixes.array = append(prefixes.array, Value{vType: "bulk", bulk: p})
+		}
+	}
+
+	repl := Value{vType: "array"}
+	if c.Protocol() == 3 {
+		repl.vType = "map"
+	}
+	repl.array = append(repl.array,
+		Value{vType: "bulk", bulk: "flags"}, flags,
+		Value{vType: "bulk", bulk: "redirect"}, redirect,
+		Value{vType: "bulk", bulk: "prefixes"}, prefixes,
+	)
+	return repl.Unmarshal()
+}
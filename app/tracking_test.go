@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newPipeClient returns a client registered with ch and the other end of its
+// connection, where the messages pushed to the client are read
+func newPipeClient(t *testing.T, ch *CommandHandler) (*Client, net.Conn) {
+	t.Helper()
+	server, conn := net.Pipe()
+	c := NewClient(bufio.NewReader(server), bufio.NewWriter(server))
+	c.conn = server
+	ch.addClient(c)
+	t.Cleanup(func() {
+		ch.removeClient(c)
+		server.Close()
+		conn.Close()
+	})
+	return c, conn
+}
+
+// expectPush reads the next message pushed to the client at the other end of
+// conn and compares it with want
+func expectPush(t *testing.T, conn net.Conn, want Value) {
+	t.Helper()
+	wantBytes := want.Unmarshal()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, len(wantBytes))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("reading push %q: %v", wantBytes, err)
+	}
+	if string(got) != string(wantBytes) {
+		t.Fatalf("got push %q, want %q", got, wantBytes)
+	}
+}
+
+func invalidatePush(keys Value) Value {
+	return Value{vType: "push", array: []Value{{vType: "bulk", bulk: "invalidate"}, keys}}
+}
+
+func TestTrackingInvalidation(t *testing.T) {
+	ch := newTestCommandHandler(t)
+	tracker, conn := newPipeClient(t, ch)
+	writer := NewClient(bufio.NewReader(strings.NewReader("")), bufio.NewWriter(io.Discard))
+	run := func(c *Client, args ...string) {
+		t.Helper()
+		if reply := ch.call(c, bulkArray(args)); len(reply) > 0 && reply[0] == '-' {
+			t.Fatalf("%q: %s", args, reply)
+		}
+	}
+
+	tracker.SetProtocol(3)
+	run(tracker, "CLIENT", "TRACKING", "on")
+	run(writer, "SET", "read", "1")
+	run(tracker, "GET", "read")
+
+	// only the key read by the tracking client is reported, once
+	run(writer, "SET", "unread", "1")
+	run(writer, "SET", "read", "2")
+	expectPush(t, conn, invalidatePush(bulkArray([]string{"read"})))
+	run(writer, "SET", "read", "3")
+
+	run(writer, "FLUSHALL")
+	expectPush(t, conn, invalidatePush(Value{vType: "null"}))
+}
+
+// A client that stops reading its pushed messages must not hold up writes
+func TestTrackingClientNotReading(t *testing.T) {
+	ch := newTestCommandHandler(t)
+	tracker, _ := newPipeClient(t, ch)
+	writer := NewClient(bufio.NewReader(strings.NewReader("")), bufio.NewWriter(io.Discard))
+	tracker.SetProtocol(3)
+	ch.call(tracker, bulkArray([]string{"CLIENT", "TRACKING", "on", "BCAST"}))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 100 {
+			ch.call(writer, bulkArray([]string{"SET", "k", "v"}))
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writes blocked by a tracking client that doesn't read")
+	}
+}
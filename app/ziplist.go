@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+)
+
+// Encodings older Redis versions used for small collections. They are only
+// decoded when loading, everything is saved back using listpacks or plain types.
+
+const ziplistHeaderSize = 10
+
+// ziplistEntries decodes all elements of a ziplist, integers are returned in
+// their decimal form
+func ziplistEntries(zl []byte) ([]string, error) {
+	if len(zl) < ziplistHeaderSize+1 {
+		return nil, fmt.Errorf("ziplist is too short")
+	}
+	if total := binary.LittleEndian.Uint32(zl); int(total) != len(zl) {
+		return nil, fmt.Errorf("ziplist size %d does not match header %d", len(zl), total)
+	}
+	var entries []string
+	p := ziplistHeaderSize
+	for {
+		if p >= len(zl) {
+			return nil, fmt.Errorf("ziplist is not terminated")
+		}
+		if zl[p] == 0xFF {
+			return entries, nil
+		}
+		// skip length of the previous entry
+		if zl[p] == 0xFE {
+			p += 5
+		} else {
+			p++
+		}
+		entry, size, err := ziplistEntry(zl[min(p, len(zl)):])
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+		p += size
+	}
+}
+
+// ziplistEntry decodes entry starting with its encoding byte and returns it
+// with the number of bytes it takes
+func ziplistEntry(p []byte) (string, int, error) {
+	need := func(n int) error {
+		if len(p) < n {
+			return fmt.Errorf("ziplist entry is truncated")
+		}
+		return nil
+	}
+	if err := need(1); err != nil {
+		return "", 0, err
+	}
+	b := p[0]
+	var header, n int
+	switch b >> 6 {
+	case 0:
+		header, n = 1, int(b&0x3F)
+	case 1:
+		if err := need(2); err != nil {
+			return "", 0, err
+		}
+		header, n = 2, int(b&0x3F)<<8|int(p[1])
+	case 2:
+		if err := need(5); err != nil {
+			return "", 0, err
+		}
+		header, n = 5, int(binary.BigEndian.Uint32(p[1:]))
+	}
+	if b>>6 != 3 {
+		if err := need(header + n); err != nil {
+			return "", 0, err
+		}
+		return string(p[header : header+n]), header + n, nil
+	}
+
+	var v int64
+	var size int
+	switch {
+	case b == 0xC0:
+		size = 3
+		if err := need(size); err != nil {
+			return "", 0, err
+		}
+		v = int64(int16(binary.LittleEndian.Uint16(p[1:])))
+	case b == 0xD0:
+		size = 5
+		if err := need(size); err != nil {
+			return "", 0, err
+		}
+		v = int64(int32(binary.LittleEndian.Uint32(p[1:])))
+	case b == 0xE0:
+		size = 9
+		if err := need(size); err != nil {
+			return "", 0, err
+		}
+		v = int64(binary.LittleEndian.Uint64(p[1:]))
+	case b == 0xF0:
+		size = 4
+		if err := need(size); err != nil {
+			return "", 0, err
+		}
+		v = int64(int32(uint32(p[1])<<8|uint32(p[2])<<16|uint32(p[3])<<24) >> 8)
+	case b == 0xFE:
+		size = 2
+		if err := need(size); err != nil {
+			return "", 0, err
+		}
+		v = int64(int8(p[1]))
+	case b >= 0xF1 && b <= 0xFD: // 4 bit immediate between 0 and 12
+		size = 1
+		v = int64(b&0x0F) - 1
+	default:
+		return "", 0, fmt.Errorf("invalid ziplist entry encoding 0x%02x", b)
+	}
+	return strconv.FormatInt(v, 10), size, nil
+}
+
+// intsetEntries decodes sorted array of 16, 32 or 64 bit integers
+func intsetEntries(is []byte) ([]string, error) {
+	if len(is) < 8 {
+		return nil, fmt.Errorf("intset is too short")
+	}
+	width := int(binary.LittleEndian.Uint32(is))
+	count := int(binary.LittleEndian.Uint32(is[4:]))
+	if width != 2 && width != 4 && width != 8 {
+		return nil, fmt.Errorf("invalid intset encoding %d", width)
+	}
+	if len(is) != 8+width*count {
+		return nil, fmt.Errorf("intset size %d does not match %d elements", len(is), count)
+	}
+	entries := make([]string, 0, count)
+	for i := 0; i < count; i++ {
+		p := is[8+i*width:]
+		var v int64
+		switch width {
+		case 2:
+			v = int64(int16(binary.LittleEndian.Uint16(p)))
+		case 4:
+			v = int64(int32(binary.LittleEndian.Uint32(p)))
+		case 8:
+			v = int64(binary.LittleEndian.Uint64(p))
+		}
+		entries = append(entries, strconv.FormatInt(v, 10))
+	}
+	return entries, nil
+}
+
+// zipmapEntries decodes field value pairs of a zipmap, the hash encoding of Redis 2.4 and older
+func zipmapEntries(zm []byte) ([]string, error) {
+	var entries []string
+	p := 1 // skip the element count, it is not reliable above 253
+	readLen := func() (int, error) {
+		if p >= len(zm) {
+			return 0, fmt.Errorf("zipmap is truncated")
+		}
+		b := zm[p]
+		switch {
+		case b < 254:
+			p++
+			return int(b), nil
+		case b == 254 && p+5 <= len(zm):
+			n := int(binary.LittleEndian.Uint32(zm[p+1:]))
+			p += 5
+			return n, nil
+		}
+		return 0, fmt.Errorf("invalid zipmap length")
+	}
+	for {
+		if p >= len(zm) {
+			return nil, fmt.Errorf("zipmap is not terminated")
+		}
+		if zm[p] == 0xFF {
+			if len(entries)%2 != 0 {
+				return nil, fmt.Errorf("zipmap has a field without value")
+			}
+			return entries, nil
+		}
+		n, err := readLen()
+		if err != nil {
+			return nil, err
+		}
+		free := 0
+		if len(entries)%2 == 1 {
+			// values are followed by a count of unused bytes after them
+			if p >= len(zm) {
+				return nil, fmt.Errorf("zipmap is truncated")
+			}
+			free = int(zm[p])
+			p++
+		}
+		if p+n+free > len(zm) {
+			return nil, fmt.Errorf("zipmap is truncated")
+		}
+		entries = append(entries, string(zm[p:p+n]))
+		p += n + free
+	}
+}
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type zsetEntry struct {
+	member string
+	score  float64
+}
+
+// sortedSet keeps members in a dict for lookups and scans, and in a slice
+// ordered by score then member for range queries
+type sortedSet struct {
+	scores *dict[float64]
+	sorted []zsetEntry
+}
+
+func newSortedSet() *sortedSet {
+	return &sortedSet{
+		scores: newDict[float64](),
+	}
+}
+
+func (z *sortedSet) clone() *sortedSet {
+	return &sortedSet{
+		scores: z.scores.clone(),
+		sorted: append([]zsetEntry(nil), z.sorted...),
+	}
+}
+
+func (z *sortedSet) Len() int {
+	return z.scores.Len()
+}
+
+func (z *sortedSet) Score(member string) (float64, bool) {
+	return z.scores.Get(member)
+}
+
+// position returns index of entry in sorted slice or where it should be inserted
+func (z *sortedSet) position(member string, score float64) int {
+	return sort.Search(len(z.sorted), func(i int) bool {
+		e := z.sorted[i]
+		return e.score > score || (e.score == score && e.member >= member)
+	})
+}
+
+// Add sets score of the member and returns true if the member is new
+func (z *sortedSet) Add(member string, score float64) bool {
+	old, exists := z.scores.Get(member)
+	if exists {
+		if old == score {
+			return false
+		}
+		z.removeSorted(member, old)
+	}
+	z.scores.Set(member, score)
+	i := z.position(member, score)
+	z.sorted = append(z.sorted, zsetEntry{})
+	copy(z.sorted[i+1:], z.sorted[i:])
+	z.sorted[i] = zsetEntry{member: member, score: score}
+	return !exists
+}
+
+func (z *sortedSet) Remove(member string) bool {
+	score, exists := z.scores.Get(member)
+	if !exists {
+		return false
+	}
+	z.scores.Delete(member)
+	z.removeSorted(member, score)
+	return true
+}
+
+func (z *sortedSet) removeSorted(member string, score float64) {
+	i := z.position(member, score)
+	z.sorted = append(z.sorted[:i], z.sorted[i+1:]...)
+}
+
+// Range returns entries between start and stop ranks inclusive, negative ranks count from the end
+func (z *sortedSet) Range(start, stop int) []zsetEntry {
+	length := len(z.sorted)
+	if start < 0 {
+		start += length
+	}
+	if stop < 0 {
+		stop += length
+	}
+	start = max(start, 0)
+	stop = min(stop, length-1)
+	if start > stop || start >= length {
+		return nil
+	}
+	return z.sorted[start : stop+1]
+}
+
+func parseScore(arg string) (float64, error) {
+	score, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(score) {
+		return 0, fmt.Errorf("ERR value is not a valid float")
+	}
+	return score, nil
+}
+
+// formatScore formats score the way Redis replies with it
+func formatScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	}
+	if abs := math.Abs(score); abs != 0 && (abs < 1e-5 || abs >= 1e21) {
+		return strconv.FormatFloat(score, 'g', -1, 64)
+	}
+	return strconv.FormatFloat(score, 'f', -1, 64)
+}
+
+type zaddOptions struct {
+	nx, xx, gt, lt, ch bool
+}
+
+func (ch *CommandHandler) zadd(c *Client, v Value) []byte {
+	var repl Value
+	if len(v.array) < 4 {
+		return wrongArgsError("zadd")
+	}
+	key := v.array[1].bulk
+
+	var opts zaddOptions
+	flags := map[string]*bool{"nx": &opts.nx, "xx": &opts.xx, "gt": &opts.gt, "lt": &opts.lt, "ch": &opts.ch}
+	i := 2
+	for ; i < len(v.array); i++ {
+		flag, ok := flags[strings.ToLower(v.array[i].bulk)]
+		if !ok {
+			break
+		}
+		*flag = true
+	}
+	args := v.array[i:]
+	if len(args) == 0 || len(args)%2 != 0 {
+		return repl.Error("ERR syntax error")
+	}
+	if opts.nx && opts.xx {
+		return repl.Error("ERR XX and NX options at the same time are not compatible")
+	}
+	if (opts.gt && opts.lt) || (opts.nx && (opts.gt || opts.lt)) {
+		return repl.Error("ERR GT, LT, and/or NX options at the same time are not compatible")
+	}
+	entries := make([]zsetEntry, 0, len(args)/2)
+	for j := 0; j < len(args); j += 2 {
+		score, err := parseScore(args[j].bulk)
+		if err != nil {
+			return repl.Error(err.Error())
+		}
+		entries = append(entries, zsetEntry{member: args[j+1].bulk, score: score})
+	}
+
+	ch.mu.Lock()
+	zset, ok, err := ch.lookupWrite(c.db, key, "zset")
+	if err != nil {
+		ch.mu.Unlock()
+		return repl.Error(err.Error())
+	}
+	if !ok && opts.xx {
+		ch.mu.Unlock()
+		repl.vType = "num"
+		return repl.Unmarshal()
+	}
+	if !ok {
+		zset, _ = ch.lookupOrCreate(c.db, key, "zset")
+	}
+	added, changed := 0, 0
+	for _, e := range entries {
+		old, exists := zset.zset.Score(e.member)
+		if (exists && opts.nx) || (!exists && opts.xx) {
+			continue
+		}
+		if exists && ((opts.gt && e.score <= old) || (opts.lt && e.score >= old)) {
+			continue
+		}
+		if zset.zset.Add(e.member, e.score) {
+			added++
+		} else if old != e.score {
+			changed++
+		}
+	}
+	ch.deleteIfEmpty(c.db, key, zset)
+	ch.mu.Unlock()
+
+	if added+changed > 0 {
+		ch.signalModifiedKey(c, key)
+	}
+	repl.vType = "num"
+	repl.num = added
+	if opts.ch {
+		repl.num += changed
+	}
+	return repl.Unmarshal()
+}
+
+func (ch *CommandHandler) zrem(c *Client, v Value) []byte {
+	var repl Value
+	if len(v.array) < 3 {
+		return wrongArgsError("zrem")
+	}
+	key := v.array[1].bulk
+
+	ch.mu.Lock()
+	zset, ok, err := ch.lookupWrite(c.db, key, "zset")
+	if err != nil {
+		ch.mu.Unlock()
+		return repl.Error(err.Error())
+	}
+	removed := 0
+	if ok {
+		for _, member := range v.array[2:] {
+			if zset.zset.Remove(member.bulk) {
+				removed++
+			}
+		}
+		ch.deleteIfEmpty(c.db, key, zset)
+	}
+	ch.mu.Unlock()
+
+	if removed > 0 {
+		ch.signalModifiedKey(c, key)
+	}
+	repl.vType = "num"
+	repl.num = removed
+	return repl.Unmarshal()
+}
+
+func (ch *CommandHandler) zscore(c *Client, v Value) []byte {
+	var repl Value
+	if len(v.array) != 3 {
+		return wrongArgsError("zscore")
+	}
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+
+	ch.tracking.Read(c.id, v.array[1].bulk)
+	zset, ok, err := ch.lookupTyped(c.db, v.array[1].bulk, "zset")
+	if err != nil {
+		return repl.Error(err.Error())
+	}
+	repl.vType = "null"
+	if ok {
+		if score, exists := zset.zset.Score(v.array[2].bulk); exists {
+			repl.vType = "bulk"
+			repl.bulk = formatScore(score)
+		}
+	}
+	return repl.Unmarshal()
+}
+
+func (ch *CommandHandler) zcard(c *Client, v Value) []byte {
+	var repl Value
+	if len(v.array) != 2 {
+		return wrongArgsError("zcard")
+	}
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+
+	ch.tracking.Read(c.id, v.array[1].bulk)
+	zset, ok, err := ch.lookupTyped(c.db, v.array[1].bulk, "zset")
+	if err != nil {
+		return repl.Error(err.Error())
+	}
+	repl.vType = "num"
+	if ok {
+		repl.num = zset.zset.Len()
+	}
+	return repl.Unmarshal()
+}
+
+func (ch *CommandHandler) zrange(c *Client, v Value) []byte {
+	var repl Value
+	if len(v.array) != 4 && len(v.array) != 5 {
+		return wrongArgsError("zrange")
+	}
+	withScores := len(v.array) == 5
+	if withScores && strings.ToLower(v.array[4].bulk) != "withscores" {
+		return repl.Error("ERR syntax error")
+	}
+	start, err1 := strconv.Atoi(v.array[2].bulk)
+	stop, err2 := strconv.Atoi(v.array[3].bulk)
+	if err1 != nil || err2 != nil {
+		return repl.Error("ERR value is not an integer or out of range")
+	}
+
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+
+	ch.tracking.Read(c.id, v.array[1].bulk)
+	zset, ok, err := ch.lookupTyped(c.db, v.array[1].bulk, "zset")
+	if err != nil {
+		return repl.Error(err.Error())
+	}
+	repl.vType = "array"
+	if ok {
+		for _, e := range zset.zset.Range(start, stop) {
+			repl.array = append(repl.array, Value{vType: "bulk", bulk: e.member})
+			if withScores {
+				repl.array = append(repl.array, Value{vType: "bulk", bulk: formatScore(e.score)})
+			}
+		}
+	}
+	return repl.Unmarshal()
+}
+
+func (ch *CommandHandler) zscan(c *Client, v Value) []byte {
+	var repl Value
+	ch.mu.RLock()
+	defer ch.mu.RUnlock()
+
+	zset, ok, cursor, opts, err := ch.scanCollection(c, v, "zset")
+	if err != nil {
+		return repl.Error(err.Error())
+	}
+	ch.tracking.Read(c.id, v.array[1].bulk)
+	if !ok {
+		return scanReply(0, nil)
+	}
+	var items []Value
+	cursor = scanDict(zset.zset.scores, cursor, opts.count, func(member string, score float64) {
+		if opts.matches(member) {
+			items = append(items, Value{vType: "bulk", bulk: member}, Value{vType: "bulk", bulk: formatScore(score)})
+		}
+	})
+	return scanReply(cursor, items)
+}